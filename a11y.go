@@ -0,0 +1,59 @@
+// Accessible listing page structure and keyboard navigation
+
+package midserve
+
+import (
+	"fmt"
+	"io"
+)
+
+// listingBaseCSS hides the skip link until it is focused and makes focus
+// visible in every theme.
+const listingBaseCSS = `.skip { position: absolute; left: -10000px; }
+.skip:focus { position: static; }
+a:focus, button:focus, select:focus { outline: 2px solid currentColor; outline-offset: 1px; }
+h1 { font-size: 1.2em; }
+`
+
+// listingKeysScript lets the arrow keys move the focus between the
+// entries of a listing, Home and End jump to the first and last, and
+// keeps the focus in the list when the live listing removes the entry
+// holding it. The entry focused last is forgotten once the focus moved
+// elsewhere; removal, unlike that, leaves the focus on the body.
+const listingKeysScript = `<script>(function(){
+var pre=document.querySelector("pre");
+function links(){return Array.prototype.slice.call(pre.getElementsByTagName("a"))}
+pre.addEventListener("keydown",function(e){var as=links(),i=as.indexOf(document.activeElement),j;
+if(i<0||e.altKey||e.ctrlKey||e.metaKey)return;
+switch(e.key){case "ArrowDown":j=i+1;break;case "ArrowUp":j=i-1;break;
+case "Home":j=0;break;case "End":j=as.length-1;break;default:return}
+if(j>=0&&j<as.length){as[j].focus();e.preventDefault()}});
+var focused=null;
+pre.addEventListener("focusin",function(e){focused=e.target});
+pre.addEventListener("focusout",function(e){var t=e.target;
+setTimeout(function(){if(focused===t&&document.activeElement!==t)focused=null},0)});
+new MutationObserver(function(ms){if(!focused||document.activeElement!==document.body)return;
+ms.forEach(function(m){for(var i=0;i<m.removedNodes.length;i++)if(m.removedNodes[i]===focused){
+focused=null;var n=m.nextSibling;while(n&&n.nodeName!=="A")n=n.nextSibling;
+if(!n){var as=links();n=as[as.length-1]}(n||document.getElementById("files")).focus();return}})}).observe(pre,{childList:true});
+})();</script>
+`
+
+// writeListingHead starts the listing page of dir: a document in lang
+// with a title, the canonical URL, whatever query it was requested
+// with, the listing style, a skip link and the heading of the main
+// region holding the entries.
+func (fh *fileHandler) writeListingHead(w io.Writer, dir, canonical, lang string, msgs messages) {
+	title := htmlReplacer.Replace(fmt.Sprintf(msgs.t("Index of %s"), dir))
+	fmt.Fprintf(w, "<!doctype html>\n<html lang=\"%s\">\n<head>\n<meta charset=\"utf-8\">\n<meta name=\"viewport\" content=\"width=device-width\">\n<title>%s</title>\n<link rel=\"canonical\" href=\"%s\">\n",
+		lang, title, htmlReplacer.Replace(canonical))
+	fh.writeListingStyle(w)
+	fmt.Fprintf(w, "</head>\n<body>\n<a class=\"skip\" href=\"#files\">%s</a>\n<main id=\"files\" tabindex=\"-1\" aria-labelledby=\"title\">\n<h1 id=\"title\">%s</h1>\n",
+		htmlReplacer.Replace(msgs.t("Skip to files")), title)
+}
+
+// writeListingFoot ends a page started by writeListingHead.
+func writeListingFoot(w io.Writer) {
+	io.WriteString(w, listingKeysScript)
+	io.WriteString(w, "</main>\n</body>\n</html>\n")
+}
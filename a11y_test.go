@@ -0,0 +1,90 @@
+package midserve
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+var (
+	idRe     = regexp.MustCompile(`\sid="([^"]*)"`)
+	skipRe   = regexp.MustCompile(`<a class="skip" href="#([^"]*)"`)
+	selectRe = regexp.MustCompile(`<select\b`)
+	buttonRe = regexp.MustCompile(`<button\b[^>]*>([^<]*)</button>`)
+	scriptRe = regexp.MustCompile(`(?s)<script>(.*?)</script>`)
+)
+
+// checkA11y checks the structure of a listing page that assistive
+// technology relies on, and that its scripts parse if node is at hand.
+func checkA11y(t *testing.T, page string) {
+	t.Helper()
+	for _, want := range []string{`<html lang="en">`, "<title>Index of /</title>", `<main id="files"`, `<h1 id="title">`} {
+		if strings.Count(page, want) != 1 {
+			t.Errorf("page has not exactly one %s", want)
+		}
+	}
+	ids := map[string]bool{}
+	for _, m := range idRe.FindAllStringSubmatch(page, -1) {
+		if ids[m[1]] {
+			t.Errorf("id %q is not unique", m[1])
+		}
+		ids[m[1]] = true
+	}
+	if m := skipRe.FindStringSubmatch(page); m == nil || !ids[m[1]] {
+		t.Errorf("skip link missing or without target")
+	}
+	if n, labelled := len(selectRe.FindAllString(page, -1)), strings.Count(page, "<label>"); n > labelled {
+		t.Errorf("%d selects, only %d labels", n, labelled)
+	}
+	for _, m := range buttonRe.FindAllStringSubmatch(page, -1) {
+		if strings.TrimSpace(m[1]) == "" && !strings.Contains(m[0], "aria-label") {
+			t.Errorf("button without a name: %s", m[0])
+		}
+	}
+	node, err := exec.LookPath("node")
+	if err != nil {
+		return
+	}
+	for i, m := range scriptRe.FindAllStringSubmatch(page, -1) {
+		file := filepath.Join(t.TempDir(), "script.js")
+		if err := os.WriteFile(file, []byte(m[1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command(node, "--check", file).CombinedOutput(); err != nil {
+			t.Errorf("script %d: %v\n%s", i, err, out)
+		}
+	}
+}
+
+func TestListingA11y(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		set  func(*Options)
+	}{
+		{"plain", nil},
+		{"all", func(o *Options) {
+			o.API = true
+			o.Write = true
+			o.CopyLinks = true
+			o.Changes = true
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestServer(t, Dir(dir), tc.set)
+			res := midservetest.Get(t, h, "/", "Accept-Language", "en").Status(http.StatusOK)
+			checkA11y(t, res.ResponseRecorder.Body.String())
+		})
+	}
+}
@@ -0,0 +1,198 @@
+// Transfer accounting and caps per client
+
+package midserve
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// usageBuckets is the number of parts the accounting window is
+	// divided into; usage leaves the window one part at a time.
+	usageBuckets = 24
+	// usageMaxClients bounds the number of clients tracked. Clients
+	// idle for a whole window are forgotten first.
+	usageMaxClients = 100000
+)
+
+var errTransferCap = errors.New("transfer cap reached")
+
+// usageMeter counts the bytes sent to each client over a rolling window.
+// Clients are identified by usageClient.
+type usageMeter struct {
+	window time.Duration
+	bucket time.Duration
+	cap    int64 // per client and window, 0 for none
+
+	mu        sync.Mutex
+	clients   map[string]*clientUsage
+	lastPrune time.Time
+}
+
+type clientUsage struct {
+	sent  [usageBuckets]int64
+	epoch [usageBuckets]int64 // bucket number sent[i] counts for
+	total int64               // since the client was first seen
+	last  time.Time
+}
+
+func newUsageMeter(window time.Duration, cap int64) *usageMeter {
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	return &usageMeter{
+		window:  window,
+		bucket:  window / usageBuckets,
+		cap:     cap,
+		clients: make(map[string]*clientUsage),
+	}
+}
+
+// inWindow returns the bytes u was sent during the window ending now.
+func (m *usageMeter) inWindow(u *clientUsage, now time.Time) int64 {
+	cur := now.UnixNano() / int64(m.bucket)
+	var n int64
+	for i := range u.sent {
+		if cur-u.epoch[i] < usageBuckets {
+			n += u.sent[i]
+		}
+	}
+	return n
+}
+
+// add counts n bytes sent to client.
+func (m *usageMeter) add(client string, n int64) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.clients[client]
+	if !ok {
+		if len(m.clients) >= usageMaxClients {
+			m.prune(now)
+		}
+		if len(m.clients) >= usageMaxClients {
+			return
+		}
+		u = &clientUsage{}
+		m.clients[client] = u
+	}
+	cur := now.UnixNano() / int64(m.bucket)
+	i := cur % usageBuckets
+	if u.epoch[i] != cur {
+		u.epoch[i], u.sent[i] = cur, 0
+	}
+	u.sent[i] += n
+	u.total += n
+	u.last = now
+	if now.Sub(m.lastPrune) > m.bucket {
+		m.prune(now)
+	}
+}
+
+// prune forgets clients idle for a whole window. It must be called
+// with mu held.
+func (m *usageMeter) prune(now time.Time) {
+	m.lastPrune = now
+	for c, u := range m.clients {
+		if now.Sub(u.last) > m.window {
+			delete(m.clients, c)
+		}
+	}
+}
+
+// over reports whether client used up its cap and, if so, after how
+// long the oldest usage leaves the window.
+func (m *usageMeter) over(client string) (bool, time.Duration) {
+	if m.cap <= 0 {
+		return false, 0
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.clients[client]
+	if !ok || m.inWindow(u, now) < m.cap {
+		return false, 0
+	}
+	cur := now.UnixNano() / int64(m.bucket)
+	oldest := cur
+	for i := range u.sent {
+		if cur-u.epoch[i] < usageBuckets && u.sent[i] > 0 && u.epoch[i] < oldest {
+			oldest = u.epoch[i]
+		}
+	}
+	leaves := time.Unix(0, (oldest+usageBuckets)*int64(m.bucket))
+	return true, leaves.Sub(now)
+}
+
+// usageReport is what /_admin/usage reports about one client.
+type usageReport struct {
+	Client string    `json:"client"`
+	Window int64     `json:"window_bytes"`
+	Total  int64     `json:"total_bytes"`
+	Last   time.Time `json:"last"`
+}
+
+func (m *usageMeter) report() []usageReport {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reports := make([]usageReport, 0, len(m.clients))
+	for c, u := range m.clients {
+		reports = append(reports, usageReport{c, m.inWindow(u, now), u.total, u.last.UTC()})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Window != reports[j].Window {
+			return reports[i].Window > reports[j].Window
+		}
+		return reports[i].Client < reports[j].Client
+	})
+	return reports
+}
+
+// clientAddr returns the IP address of the client of r.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// usageClient returns the client r is accounted to: its principal if it
+// has one, so that a token's usage is capped from wherever it is used,
+// and its IP address otherwise.
+func usageClient(r *http.Request) string {
+	if name := principalName(r); name != "" {
+		return "principal:" + name
+	}
+	return clientAddr(r)
+}
+
+// checkTransferCap replies 429 and returns false if the client of r used
+// up its transfer cap.
+func (fh *fileHandler) checkTransferCap(w http.ResponseWriter, r *http.Request, name string) bool {
+	over, retry := fh.usage.over(usageClient(r))
+	if !over {
+		return true
+	}
+	fh.overloaded(w, r, name, http.StatusTooManyRequests, errTransferCap.Error(), int(retry/time.Second)+1, errTransferCap)
+	return false
+}
+
+// serveUsage implements GET /_admin/usage, the bytes sent to each client
+// during the accounting window and in total.
+func (fh *fileHandler) serveUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, struct {
+		Window  string        `json:"window"`
+		Cap     int64         `json:"cap_bytes,omitempty"`
+		Clients []usageReport `json:"clients"`
+	}{fh.usage.window.String(), fh.usage.cap, fh.usage.report()})
+}
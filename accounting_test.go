@@ -0,0 +1,97 @@
+package midserve
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestTransferCapPrincipal(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.txt", "0123456789").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) {
+		o.TransferCap = 10
+		o.Principals = []Principal{{Name: "alice", Token: "a", Grants: []Grant{{"/", RoleRead}}}}
+	})
+
+	get := func(addr string) *midservetest.Response {
+		req := midservetest.NewRequest("GET", "/a.txt", "Authorization", "Bearer a")
+		req.RemoteAddr = addr
+		return midservetest.Do(t, h, req)
+	}
+	get("192.0.2.1:1234").Status(http.StatusOK)
+	// The cap follows the token, not the address.
+	get("192.0.2.2:1234").Status(http.StatusTooManyRequests)
+
+	midservetest.Get(t, h, "/a.txt").Status(http.StatusOK)
+}
+
+func TestTransferCapSSI(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.shtml", "0123456789").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) {
+		o.TransferCap = 10
+		o.SSIExts = []string{".shtml"}
+	})
+
+	midservetest.Get(t, h, "/a.shtml").Status(http.StatusOK).Body("0123456789")
+	midservetest.Get(t, h, "/a.shtml").Status(http.StatusTooManyRequests)
+}
+
+func TestTransferCapViewers(t *testing.T) {
+	for _, target := range []string{"/a.md", "/a.log?view=log", "/a.json?view=pretty"} {
+		root := midservetest.NewFS().
+			File("a.md", "# a").
+			File("a.log", "a").
+			File("a.json", `{"a": 1}`).
+			HTTP()
+		h := newTestServer(t, root, func(o *Options) {
+			o.TransferCap = 100
+			o.RenderMarkdown = true
+			o.LogViewer = true
+			o.PrettyViewer = true
+		})
+
+		midservetest.Get(t, h, target).Status(http.StatusOK)
+		midservetest.Get(t, h, target).Status(http.StatusTooManyRequests)
+	}
+}
+
+func TestTransferCapFollowLog(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.log", strings.Repeat("line\n", 100)).
+		HTTP()
+	srv := httptest.NewServer(newTestServer(t, root, func(o *Options) {
+		o.TransferCap = 100
+		o.LogViewer = true
+	}))
+	defer srv.Close()
+
+	// Ends once the cap is used up rather than following on.
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(srv.URL + "/a.log?view=log&follow=1&offset=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("read %d bytes: %v", len(b), err)
+	}
+
+	res, err = client.Get(srv.URL + "/a.log?view=log&follow=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status %d after the cap, want 429", res.StatusCode)
+	}
+}
@@ -0,0 +1,64 @@
+// Administrative endpoints under /_admin/
+
+package midserve
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// adminPrefix is the URL path prefix of the administrative endpoints,
+// which require the admin token as a bearer token.
+const adminPrefix = "/_admin/"
+
+// adminEndpoint is an administrative endpoint and the method it takes,
+// GET for those only reporting, POST for those changing state.
+type adminEndpoint struct {
+	method string
+	serve  func(fh *fileHandler, w http.ResponseWriter, r *http.Request)
+}
+
+// adminEndpoints maps endpoint names, the path after adminPrefix, to
+// their handlers.
+var adminEndpoints = map[string]adminEndpoint{
+	"cdn-tags":  {"GET", (*fileHandler).serveCDNTags},
+	"errors":    {"GET", (*fileHandler).serveErrors},
+	"honeypots": {"GET", (*fileHandler).serveHoneypots},
+	"hot":       {"GET", (*fileHandler).serveHot},
+	"integrity": {"GET", (*fileHandler).serveIntegrity},
+	"journal":   {"GET", (*fileHandler).serveJournal},
+	"load":      {"GET", (*fileHandler).serveLoad},
+	"transfers": {"GET", (*fileHandler).serveTransfers},
+	"purge":     {"POST", (*fileHandler).servePurge},
+	"unban":     {"POST", (*fileHandler).serveUnban},
+	"usage":     {"GET", (*fileHandler).serveUsage},
+	"watcher":   {"GET", (*fileHandler).serveWatcher},
+}
+
+// serveAdmin dispatches a request below adminPrefix after checking its
+// token.
+func (fh *fileHandler) serveAdmin(w http.ResponseWriter, r *http.Request, name string) {
+	endpoint, ok := adminEndpoints[strings.TrimPrefix(name, adminPrefix)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// checkMethod refuses others already; endpoints changing state
+	// must not run for a GET whatever the options.
+	if r.Method != endpoint.method && (endpoint.method != "GET" || r.Method != "HEAD") {
+		w.Header().Set("Allow", fh.allow(name))
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		fh.publish(r, EventDenied, name, http.StatusMethodNotAllowed, -1, nil)
+		return
+	}
+	token := bearerToken(r)
+	admin := fh.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(fh.adminToken)) == 1
+	if !admin && (principal(r) == nil || !fh.permitted(r, "/", RoleAdmin)) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="midserve admin"`)
+		apiError(w, errUnauthorized, http.StatusUnauthorized)
+		fh.publish(r, EventDenied, name, http.StatusUnauthorized, -1, nil)
+		return
+	}
+	endpoint.serve(fh, w, r)
+}
@@ -0,0 +1,55 @@
+package midserve
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestAdminTransfers(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.txt", "a").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) {
+		o.API = true
+		o.AdminToken = "secret"
+	})
+
+	// Transfers tell who downloads what, for administrators only.
+	midservetest.Get(t, h, "/_api/transfers").
+		Status(http.StatusNotFound)
+	midservetest.Get(t, h, "/_admin/transfers").
+		Status(http.StatusUnauthorized)
+	midservetest.Get(t, h, "/_admin/transfers", "Authorization", "Bearer secret").
+		Status(http.StatusOK).
+		Body("[]\n")
+}
+
+func TestAdminMethods(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.txt", "a").
+		HTTP()
+	for _, tc := range []struct {
+		name string
+		set  func(*Options)
+		auth string
+	}{
+		{"token", func(o *Options) { o.AdminToken = "secret" }, "Bearer secret"},
+		{"principal", func(o *Options) {
+			o.Principals = []Principal{{Name: "root", Token: "r", Grants: []Grant{{"/", RoleAdmin}}}}
+		}, "Bearer r"},
+	} {
+		h := newTestServer(t, root, tc.set)
+		// Purging changes state, so GET must not.
+		midservetest.Get(t, h, "/_admin/purge?path=/a.txt", "Authorization", tc.auth).
+			Status(http.StatusMethodNotAllowed).
+			Header("Allow", writeMethods)
+		midservetest.Do(t, h, midservetest.NewRequest("OPTIONS", "/_admin/purge")).
+			Header("Allow", writeMethods)
+		midservetest.Do(t, h, midservetest.NewRequest("POST", "/_admin/usage", "Authorization", tc.auth)).
+			Status(http.StatusMethodNotAllowed)
+		midservetest.Get(t, h, "/_admin/usage", "Authorization", tc.auth).
+			Status(http.StatusOK)
+	}
+}
@@ -0,0 +1,158 @@
+// JSON and tool endpoints under /_api/
+
+package midserve
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// apiPrefix is the URL path prefix of the API endpoints. A directory of
+// the same name in the root is shadowed while the API is enabled.
+const apiPrefix = "/_api/"
+
+// apiVersion is the version of the responses of the API, sent in the
+// X-Midserve-API-Version header. It changes when they change in ways
+// clients may break on; fields are added without a new version.
+const apiVersion = 1
+
+// apiEndpoints maps endpoint names, the path after apiPrefix, to their
+// handlers.
+var apiEndpoints = map[string]func(fh *fileHandler, w http.ResponseWriter, r *http.Request){
+	"blocks":   (*fileHandler).serveBlocks,
+	"delete":   (*fileHandler).serveDelete,
+	"diff":     (*fileHandler).serveDiff,
+	"dupes":    (*fileHandler).serveDupes,
+	"list":     (*fileHandler).serveList,
+	"manifest": (*fileHandler).serveManifest,
+	"move":     (*fileHandler).serveMove,
+	"resolve":  (*fileHandler).serveResolve,
+	"search":   (*fileHandler).serveSearch,
+	"segments": (*fileHandler).serveSegments,
+	"shorten":  (*fileHandler).serveShorten,
+	"stat":     (*fileHandler).serveStat,
+	"upload":   (*fileHandler).serveUpload,
+	"workers":  (*fileHandler).serveWorkers,
+
+	"openapi.json":    (*fileHandler).serveOpenAPI,
+	"upload-progress": (*fileHandler).serveUploadProgress,
+}
+
+// serveAPI dispatches a request below apiPrefix.
+func (fh *fileHandler) serveAPI(w http.ResponseWriter, r *http.Request, name string) {
+	ep := strings.TrimPrefix(name, apiPrefix)
+	endpoint, ok := apiEndpoints[ep]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// Clients built against another version fail rather than misread
+	// responses.
+	if v := r.Header.Get("X-Midserve-API-Version"); v != "" && v != strconv.Itoa(apiVersion) {
+		apiError(w, fmt.Errorf("API version %s is not supported, only %d", v, apiVersion), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("X-Midserve-API-Version", strconv.Itoa(apiVersion))
+	// Endpoints changing files check the role for each path. Upload
+	// IDs are secret to the uploader.
+	if !apiWriteEndpoints[ep] && ep != "upload-progress" {
+		for _, p := range apiReadPaths(r) {
+			if !fh.checkSignature(w, r, p) || !fh.checkPermitted(w, r, p, RoleRead) {
+				return
+			}
+		}
+	}
+	endpoint(fh, w, r)
+}
+
+// errNotRegular is returned by openRegular for directories and special
+// files.
+var errNotRegular = errors.New("not a regular file")
+
+// openRegular opens the regular file name, given as an API parameter,
+// applying the same exclusions as requests for it.
+func (fh *fileHandler) openRegular(r *http.Request, name string) (http.File, fs.FileInfo, error) {
+	name = path.Clean("/" + name)
+	if fh.denied(name) {
+		fh.publish(r, EventDenied, name, http.StatusNotFound, -1, nil)
+		return nil, nil, fs.ErrNotExist
+	}
+	if err := fh.closedWindow(name); err != nil {
+		_, code := toHTTPError(err)
+		fh.publish(r, EventDenied, name, code, -1, nil)
+		return nil, nil, err
+	}
+	f, err := openContext(r.Context(), fh.root, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !d.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, errNotRegular
+	}
+	return f, d, nil
+}
+
+// apiError replies to an API request with a JSON error object. Errors
+// from the file system are mapped with toHTTPError and not revealed.
+func apiError(w http.ResponseWriter, err error, code int) {
+	msg := err.Error()
+	if code == 0 {
+		msg, code = toHTTPError(err)
+		if errors.Is(err, errNotRegular) {
+			msg, code = err.Error(), http.StatusBadRequest
+		}
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// writeJSON replies with v encoded as JSON. Replies to GET and HEAD
+// requests get an ETag, that of the encoding unless the handler set
+// one, so that clients polling for changes get 304 Not Modified while
+// there are none.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		apiError(w, err, http.StatusInternalServerError)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	if r.Method == "GET" || r.Method == "HEAD" {
+		if h.Get("Etag") == "" {
+			sum := sha256.Sum256(buf.Bytes())
+			h.Set("Etag", `W/"`+hex.EncodeToString(sum[:12])+`"`)
+		}
+		if checkIfNoneMatch(w, r) == condFalse {
+			writeNotModified(w)
+			return
+		}
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write(buf.Bytes())
+}
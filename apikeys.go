@@ -0,0 +1,151 @@
+// API keys kept hashed in a state file
+
+package midserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// apiKeyPrefix starts API keys, so that they are easy to recognize in
+// leaked configurations and logs.
+const apiKeyPrefix = "msk_"
+
+// apiKeyRecheck is how often the state file is checked for changes.
+const apiKeyRecheck = time.Second
+
+// apiKeyRecord is an API key as stored in the state file. Only the hash
+// of the key is stored; the key itself is shown once, when created.
+type apiKeyRecord struct {
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Hash    string        `json:"hash"` // hex SHA-256 of the key
+	Scopes  []GrantConfig `json:"scopes"`
+	Created time.Time     `json:"created"`
+	Expires *time.Time    `json:"expires,omitempty"`
+}
+
+// expired reports whether the key has expired at now.
+func (k *apiKeyRecord) expired(now time.Time) bool {
+	return k.Expires != nil && !now.Before(*k.Expires)
+}
+
+// apiKeyState is the content of the state file.
+type apiKeyState struct {
+	Keys []apiKeyRecord `json:"keys"`
+}
+
+// readAPIKeys reads the state file, which need not exist yet.
+func readAPIKeys(file string) (*apiKeyState, error) {
+	st := &apiKeyState{}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return st, nil
+}
+
+// writeAPIKeys replaces the state file with st.
+func writeAPIKeys(file string, st *apiKeyState) error {
+	return (&tempFiles{}).write(file, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	})
+}
+
+// apiKey is a loaded API key.
+type apiKey struct {
+	principal *Principal
+	expires   *time.Time
+}
+
+// apiKeys finds the principals of API keys in the state file, reading
+// it again when it changes, so that keys created and revoked with
+// "midserve token" take effect without a restart.
+type apiKeys struct {
+	file string
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	size    int64
+	byHash  map[[sha256.Size]byte]apiKey
+}
+
+func newAPIKeys(file string) *apiKeys {
+	return &apiKeys{file: file}
+}
+
+// reload reads the state file if it changed since it was last read.
+// If it can't be read, the keys read before stay in effect. It must be
+// called with mu held.
+func (ak *apiKeys) reload() {
+	now := time.Now()
+	if now.Sub(ak.checked) < apiKeyRecheck {
+		return
+	}
+	ak.checked = now
+	fi, err := os.Stat(ak.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		ak.byHash, ak.modTime, ak.size = nil, time.Time{}, 0
+		return
+	}
+	if err != nil {
+		log.Printf("api keys: %v", err)
+		return
+	}
+	if ak.byHash != nil && fi.ModTime().Equal(ak.modTime) && fi.Size() == ak.size {
+		return
+	}
+	st, err := readAPIKeys(ak.file)
+	if err != nil {
+		log.Printf("api keys: %v", err)
+		return
+	}
+	m := make(map[[sha256.Size]byte]apiKey, len(st.Keys))
+	for _, k := range st.Keys {
+		b, err := hex.DecodeString(k.Hash)
+		if err != nil || len(b) != sha256.Size {
+			log.Printf("api keys: %s: key %s: invalid hash", ak.file, k.ID)
+			continue
+		}
+		var h [sha256.Size]byte
+		copy(h[:], b)
+		gs, err := grants(k.Scopes)
+		if err != nil {
+			log.Printf("api keys: %s: key %s: %v", ak.file, k.ID, err)
+			continue
+		}
+		m[h] = apiKey{principal: &Principal{Name: k.Name, Grants: gs}, expires: k.Expires}
+	}
+	ak.byHash, ak.modTime, ak.size = m, fi.ModTime(), fi.Size()
+}
+
+// lookup returns the principal of the unexpired key with the hash h,
+// nil if there is none.
+func (ak *apiKeys) lookup(h [sha256.Size]byte) *Principal {
+	ak.mu.Lock()
+	defer ak.mu.Unlock()
+	ak.reload()
+	k, ok := ak.byHash[h]
+	if !ok || (k.expires != nil && !time.Now().Before(*k.expires)) {
+		return nil
+	}
+	return k.principal
+}
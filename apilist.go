@@ -0,0 +1,101 @@
+// JSON directory listings
+
+package midserve
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"time"
+)
+
+var errNotDir = errors.New("not a directory")
+
+// jsonListing is what /_api/list reports about a directory.
+type jsonListing struct {
+	Version  int                `json:"version"`
+	Path     string             `json:"path"`
+	Entries  []jsonListingEntry `json:"entries"`
+	NextPage int                `json:"next_page,omitempty"`
+}
+
+// jsonListingEntry is an entry of a jsonListing. Unserved entries are
+// listed but can't be downloaded.
+type jsonListingEntry struct {
+	Name     string     `json:"name"`
+	IsDir    bool       `json:"dir,omitempty"`
+	Size     int64      `json:"size,omitempty"`
+	ModTime  *time.Time `json:"mtime,omitempty"`
+	Unserved bool       `json:"unserved,omitempty"`
+}
+
+// serveList implements /_api/list?path=&page=, the entries of a
+// directory its listing shows, in the same order and pages.
+func (fh *fileHandler) serveList(w http.ResponseWriter, r *http.Request) {
+	dir := path.Clean("/" + r.URL.Query().Get("path"))
+	if fh.denied(dir + "/") {
+		fh.publish(r, EventDenied, dir, http.StatusNotFound, -1, nil)
+		apiError(w, fs.ErrNotExist, 0)
+		return
+	}
+	if err := fh.closedWindow(dir); err != nil {
+		_, code := toHTTPError(err)
+		fh.publish(r, EventDenied, dir, code, -1, nil)
+		apiError(w, err, 0)
+		return
+	}
+	f, err := openContext(r.Context(), fh.root, dir)
+	if err != nil {
+		apiError(w, err, 0)
+		return
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		apiError(w, err, 0)
+		return
+	}
+	if !d.IsDir() {
+		apiError(w, errNotDir, http.StatusBadRequest)
+		return
+	}
+	dirs, err := fh.readDirSorted(r.Context(), f)
+	if r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		apiError(w, err, 0)
+		return
+	}
+
+	l := jsonListing{Version: apiVersion, Path: dir, Entries: []jsonListingEntry{}}
+	if dir != "/" {
+		l.Path += "/"
+	}
+	page, skip := fh.listingPage(r)
+	for i, n := 0, dirs.len(); i < n; i++ {
+		listed, served := fh.listingEntry(r, dir, dirs.name(i), dirs.isDir(i))
+		if !listed {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if fh.maxEntries > 0 && len(l.Entries) == fh.maxEntries {
+			l.NextPage = page + 1
+			break
+		}
+		e := jsonListingEntry{Name: dirs.name(i), IsDir: dirs.isDir(i), Unserved: !served}
+		if fi, err := dirs.info(i); err == nil {
+			mtime := fi.ModTime().UTC()
+			e.ModTime = &mtime
+			if fi.Mode().IsRegular() {
+				e.Size = fi.Size()
+			}
+		}
+		l.Entries = append(l.Entries, e)
+	}
+	writeJSON(w, r, l)
+}
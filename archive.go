@@ -0,0 +1,219 @@
+// Zip downloads of directories
+
+package midserve
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveModes lists the -archives values:
+//
+//	stream  zip files as they are sent, without Content-Length
+//	spool   zip them into the cache first, then serve the archive like
+//	        a file, with a length and range requests for resuming
+var archiveModes = map[string]bool{"stream": true, "spool": true}
+
+// errArchiveTooLarge is returned for directories beyond the archive
+// limits.
+var errArchiveTooLarge = errors.New("directory too large to archive")
+
+// archiveEntry is a file going into an archive.
+type archiveEntry struct {
+	name string // relative to the archived directory
+	fi   fs.FileInfo
+}
+
+// archiveEntries returns the files below dir that go into its archive,
+// those a listing would show to the client of r, or errArchiveTooLarge
+// if they exceed the limits.
+func (fh *fileHandler) archiveEntries(r *http.Request, dir string) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	var size int64
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	err := walkFS(r.Context(), fh.root, dir, fh.excludes, func(name string, fi fs.FileInfo) error {
+		if fh.closedWindow(name) != nil || fh.unlistedEntry(name, fi.IsDir()) {
+			return skipEntry(fi)
+		}
+		if !fh.permitted(r, name, RoleRead) {
+			// A grant below may still allow what is inside.
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if _, err := fh.metadataStripper(name); err != nil {
+			// Refused when served, so not archived either.
+			return nil
+		}
+		entries = append(entries, archiveEntry{strings.TrimPrefix(name, prefix), fi})
+		size += fi.Size()
+		if fh.archiveMaxFiles > 0 && len(entries) > fh.archiveMaxFiles ||
+			fh.archiveMaxBytes > 0 && size > fh.archiveMaxBytes {
+			return errArchiveTooLarge
+		}
+		return nil
+	})
+	// The walk goes by name within each directory; ordering by the whole
+	// path keeps archives the same however it is done, and in the order
+	// of listings.
+	sort.Slice(entries, func(i, j int) bool { return pathLess(fh.less, entries[i].name, entries[j].name) })
+	return entries, err
+}
+
+// serveArchive serves the directory name as a zip file.
+func (fh *fileHandler) serveArchive(w http.ResponseWriter, r *http.Request, name string, d fs.FileInfo) {
+	if fh.usage.cap > 0 && !fh.checkTransferCap(w, r, name) {
+		return
+	}
+	entries, err := fh.archiveEntries(r, name)
+	if r.Context().Err() != nil {
+		return
+	}
+	if errors.Is(err, errArchiveTooLarge) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		fh.publish(r, EventDenied, name, http.StatusForbidden, -1, err)
+		return
+	}
+	if err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+
+	base := path.Base(name)
+	if base == "/" {
+		base = "root"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fh.contentDisposition("attachment", base+".zip"))
+
+	if fh.archives == "spool" {
+		fh.serveSpooledArchive(w, r, name, d, entries)
+		return
+	}
+	// Neither the length nor the content is known up front.
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+	sw := &statusWriter{ResponseWriter: w}
+	sw.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		if err := fh.writeArchive(r.Context(), sw, name, entries); err != nil && r.Context().Err() == nil {
+			// The status is sent, only a truncated archive tells.
+			logf(r, "http: error archiving %s: %v", name, err)
+		}
+	}
+	fh.publishSent(r, name, sw, -1)
+}
+
+// serveSpooledArchive serves the archive of name from the cache, where
+// it is kept by the state of the files it contains.
+func (fh *fileHandler) serveSpooledArchive(w http.ResponseWriter, r *http.Request, name string, d fs.FileInfo, entries []archiveEntry) {
+	h := sha256.New()
+	fmt.Fprintf(h, "archive\x00%s\x00%t\x00%t\x00", name, fh.archiveNormal, fh.stripEXIF)
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", e.name, e.fi.Size(), e.fi.ModTime().UnixNano())
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+	cached := filepath.Join(fh.cacheDir, "archives", key+".zip")
+	fh.dropPurged(name, cached)
+
+	cf, err := os.Open(cached)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fh.produce(r.Context(), cached, func(w io.Writer) error {
+			return fh.writeArchive(r.Context(), w, name, entries)
+		})
+		if err == nil {
+			cf, err = os.Open(cached)
+		}
+	}
+	if err != nil {
+		if r.Context().Err() == nil {
+			logf(r, "http: error archiving %s: %v", name, err)
+		}
+		fh.error(w, r, name, err)
+		return
+	}
+	defer cf.Close()
+	// The key and the newest time change with any file, unlike the
+	// directory's time.
+	w.Header().Set("ETag", `"`+key[:32]+`"`)
+	latest := archiveInfo{d, d.ModTime()}
+	for _, e := range entries {
+		if e.fi.ModTime().After(latest.modTime) {
+			latest.modTime = e.fi.ModTime()
+		}
+	}
+	fh.serveCached(w, r, name, latest, cf)
+}
+
+// archiveInfo is the info of an archived directory with the time of
+// its newest file.
+type archiveInfo struct {
+	fs.FileInfo
+	modTime time.Time
+}
+
+func (ai archiveInfo) ModTime() time.Time { return ai.modTime }
+
+// archiveEpoch is the time of all files in normalized archives, the
+// earliest a zip file can record.
+var archiveEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// writeArchive writes the zip archive of the entries below dir to w,
+// streaming each file. Sizes beyond 4 GiB get zip64 records. Images go
+// without their metadata with -strip-exif, as when served, unless they
+// match a -no-transform pattern. The archive only depends on the
+// entries, in their order, and their contents; normalized, not even on
+// their times and modes.
+func (fh *fileHandler) writeArchive(ctx context.Context, w io.Writer, dir string, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		hdr, err := zip.FileInfoHeader(e.fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = e.name
+		// Stored entries with data descriptors trip up some readers.
+		hdr.Method = zip.Deflate
+		hdr.Modified = e.fi.ModTime().UTC().Truncate(time.Second)
+		if fh.archiveNormal {
+			hdr.Modified = archiveEpoch
+			mode := fs.FileMode(0644)
+			if e.fi.Mode()&0111 != 0 {
+				mode = 0755
+			}
+			hdr.SetMode(mode)
+		}
+		name := path.Join(dir, e.name)
+		f, err := openContext(ctx, fh.root, name)
+		if err != nil {
+			return err
+		}
+		fw, err := zw.CreateHeader(hdr)
+		// archiveEntries leaves out images whose metadata can't be
+		// stripped.
+		if strip, _ := fh.metadataStripper(name); err == nil && strip != nil {
+			err = strip(fw, f)
+		} else if err == nil {
+			_, err = io.Copy(fw, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,59 @@
+package midserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestArchiveStripsMetadata(t *testing.T) {
+	// A JPEG with an APP1 (EXIF) segment.
+	jpeg := "\xff\xd8\xff\xe1\x00\x06Exif\xff\xd9"
+	root := midservetest.NewFS().
+		File("d/p.jpg", jpeg).
+		File("d/signed/q.jpg", jpeg).
+		File("d/c.heic", "heic").
+		File("d/signed/c.heic", "heic").
+		HTTP()
+	for _, mode := range []string{"stream", "spool"} {
+		h := newTestServer(t, root, func(o *Options) {
+			o.Archives = mode
+			o.StripEXIF = true
+			o.NoTransforms = []*regexp.Regexp{regexp.MustCompile(`^d/signed/`)}
+		})
+		res := midservetest.Get(t, h, "/d/?archive=zip").Status(http.StatusOK)
+		body := res.ResponseRecorder.Body.Bytes()
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{
+			"p.jpg":        "\xff\xd8\xff\xd9",
+			"signed/q.jpg": jpeg,
+			// Metadata isn't stripped from HEIC, so it is left out.
+			"signed/c.heic": "heic",
+		}
+		for _, zf := range zr.File {
+			rc, err := zf.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != want[zf.Name] {
+				t.Errorf("%s: %s = %q, want %q", mode, zf.Name, b, want[zf.Name])
+			}
+		}
+		if len(zr.File) != len(want) {
+			t.Errorf("%s: %d files, want %d", mode, len(zr.File), len(want))
+		}
+	}
+}
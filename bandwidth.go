@@ -0,0 +1,158 @@
+// Scheduled bandwidth limits
+
+package midserve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bandwidthChunk bounds the bytes written at once under a bandwidth
+// limit, so that concurrent responses take turns.
+const bandwidthChunk = 32 << 10
+
+// A BandwidthRule sets the bandwidth of all responses together to Rate
+// bytes per second, 0 for no limit, during the daily window from From
+// to To after local midnight, which may span midnight, on the Days of
+// the week set, every day if none is.
+type BandwidthRule struct {
+	Days     [7]bool // indexed by time.Weekday
+	From, To time.Duration
+	Rate     int64
+}
+
+// applies reports whether the rule is in force at t.
+func (br *BandwidthRule) applies(t time.Time) bool {
+	if !inDaily(t, br.From, br.To) {
+		return false
+	}
+	// A window spanning midnight belongs to the day it starts on.
+	day := t.Weekday()
+	if br.From > br.To && sinceMidnight(t) < br.To {
+		day = (day + 6) % 7
+	}
+	return br.Days == [7]bool{} || br.Days[day]
+}
+
+// bandwidthDays maps the day names of a schedule to weekdays.
+var bandwidthDays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseDays parses days of the week such as "mon-fri" or "sat,sun".
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		part = strings.TrimSpace(part)
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = part[:i], part[i+1:]
+		}
+		d, ok1 := bandwidthDays[from]
+		end, ok2 := bandwidthDays[to]
+		if !ok1 || !ok2 {
+			return days, fmt.Errorf("%q is not a day such as mon or a range such as mon-fri", part)
+		}
+		for {
+			days[d] = true
+			if d == end {
+				break
+			}
+			d = (d + 1) % 7
+		}
+	}
+	return days, nil
+}
+
+// bandwidth paces the responses of the server to the rate of the first
+// rule of its schedule in force, or its default rate.
+type bandwidth struct {
+	rate     int64
+	schedule []BandwidthRule
+
+	mu   sync.Mutex
+	next time.Time // when the bytes reserved so far are sent
+}
+
+// current returns the rate at t.
+func (b *bandwidth) current(t time.Time) int64 {
+	for i := range b.schedule {
+		if b.schedule[i].applies(t) {
+			return b.schedule[i].Rate
+		}
+	}
+	return b.rate
+}
+
+// reserve reserves n bytes after those reserved before by any response
+// and returns how long to wait before sending them.
+func (b *bandwidth) reserve(n int) time.Duration {
+	now := time.Now()
+	rate := b.current(now)
+	if rate <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	wait := b.next.Sub(now)
+	b.next = b.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	return wait
+}
+
+// bandwidthWriter writes to a ResponseWriter under a bandwidth limit.
+type bandwidthWriter struct {
+	http.ResponseWriter
+	b   *bandwidth
+	ctx context.Context
+}
+
+func (w *bandwidthWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > bandwidthChunk {
+			chunk = chunk[:bandwidthChunk]
+		}
+		if wait := w.b.reserve(len(chunk)); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-w.ctx.Done():
+				t.Stop()
+				return written, w.ctx.Err()
+			}
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// ReadFrom copies through Write, giving up sendfile for pacing.
+func (w *bandwidthWriter) ReadFrom(src io.Reader) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{w}, src, make([]byte, bandwidthChunk))
+}
+
+func (w *bandwidthWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *bandwidthWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,115 @@
+// Startup banner
+
+package midserve
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// writeBanner writes a summary of what the server exposes: where it
+// listens, what it serves, and which features are on.
+func (c *Config) writeBanner(w io.Writer) {
+	line := func(key, format string, args ...interface{}) {
+		fmt.Fprintf(w, "  %-10s %s\n", key+":", fmt.Sprintf(format, args...))
+	}
+	fmt.Fprintf(w, "midserve %s\n", buildVersion())
+
+	scheme := "http"
+	if c.TLS() {
+		scheme = "https"
+	}
+	addr, err := normalizeListen(c.Listen)
+	if err != nil {
+		addr = c.Listen
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil && (host == "" || host == "0.0.0.0" || host == "::") {
+		// Only wildcard addresses accept more than one IP version.
+		ipv := "IPv4 and IPv6"
+		switch {
+		case host == "0.0.0.0" || c.IPVersion == "4":
+			ipv = "IPv4 only"
+		case c.IPVersion == "6":
+			ipv = "IPv6 only"
+		}
+		line("listen", "%s://%s/ (%s, %s)", scheme, net.JoinHostPort("localhost", port), addr, ipv)
+	} else if err == nil {
+		line("listen", "%s://%s/", scheme, addr)
+	} else {
+		line("listen", "%s", c.Listen)
+	}
+	if c.RedirectHTTP != "" {
+		line("redirect", "http %s to https", c.RedirectHTTP)
+	}
+	if c.CanonicalHost != "" {
+		line("host", "%s", c.CanonicalHost)
+	}
+	root, err := filepath.Abs(c.Root)
+	if err != nil {
+		root = c.Root
+	}
+	line("root", "%s", root)
+	if len(c.Excludes) > 0 {
+		line("excludes", "%s", strings.Join(c.Excludes, "  "))
+	} else {
+		line("excludes", "none")
+	}
+	if len(c.Principals) > 0 || c.APIKeys != "" {
+		auth := fmt.Sprintf("bearer tokens, %d principals", len(c.Principals))
+		if c.APIKeys != "" {
+			auth += ", API keys from " + c.APIKeys
+		}
+		line("auth", "%s", auth)
+	} else {
+		line("auth", "none")
+	}
+	if c.TLS() {
+		line("tls", "%s", c.TLSCert)
+	} else {
+		line("tls", "off")
+	}
+	if features := c.features(); len(features) > 0 {
+		line("features", "%s", strings.Join(features, ", "))
+	}
+	var rules []string
+	for _, r := range []struct {
+		n    int
+		what string
+	}{
+		{len(c.Transforms), "transforms"},
+		{len(c.AccessWindows), "access windows"},
+		{len(c.ConcurrencyLimits), "concurrency limits"},
+		{len(c.Retention), "retention rules"},
+		{len(c.UploadPolicies), "upload policies"},
+		{len(c.BandwidthSchedule), "bandwidth rules"},
+		{len(c.Honeypots), "honeypots"},
+		{len(c.GeoAllow) + len(c.GeoDeny), "country rules"},
+	} {
+		if r.n > 0 {
+			rules = append(rules, fmt.Sprintf("%d %s", r.n, r.what))
+		}
+	}
+	if len(rules) > 0 {
+		line("rules", "%s", strings.Join(rules, ", "))
+	}
+}
+
+// features returns the JSON names of the boolean settings that are on,
+// so that new toggles show up without changing the banner.
+func (c *Config) features() []string {
+	var names []string
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Type.Kind() != reflect.Bool || !v.Field(i).Bool() || f.Name == "Quiet" {
+			continue
+		}
+		names = append(names, strings.Split(f.Tag.Get("json"), ",")[0])
+	}
+	return names
+}
@@ -0,0 +1,150 @@
+// Block checksums for delta sync
+
+package midserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	minBlockSize = 2 << 10
+	maxBlockSize = 1 << 20
+)
+
+// blockSize returns the block size for a file of the given size: its
+// square root, as rsync does, within minBlockSize and maxBlockSize.
+func blockSize(size int64) int64 {
+	n := int64(math.Sqrt(float64(size))) &^ 1023
+	if n < minBlockSize {
+		return minBlockSize
+	}
+	if n > maxBlockSize {
+		return maxBlockSize
+	}
+	return n
+}
+
+// weakChecksum is the rsync rolling checksum of p: with a the sum of the
+// bytes and b the sum of the running sums a, both modulo 2^16, it is
+// a | b<<16. A client can update it in constant time while sliding a
+// window over its own copy of the file:
+//
+//	a = a - out + in
+//	b = b - n*out + a
+func weakChecksum(p []byte) uint32 {
+	var a, b uint32
+	for i, c := range p {
+		a += uint32(c)
+		b += uint32(len(p)-i) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+// blockList is the reply of /_api/blocks.
+type blockList struct {
+	Path      string  `json:"path"`
+	Size      int64   `json:"size"`
+	SHA256    string  `json:"sha256"`
+	BlockSize int64   `json:"block_size"`
+	Blocks    []block `json:"blocks"`
+}
+
+// block is the checksums of the block at index*BlockSize. The last block
+// may be shorter. Strong is the first 16 bytes of its SHA-256.
+type block struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// serveBlocks implements /_api/blocks?path=&block_size=, returning the
+// checksums of the blocks of a file. A client rolls the weak checksum
+// over its own copy, confirms matches with the strong one, and fetches
+// the blocks it lacks with a multi-range request to the file.
+func (fh *fileHandler) serveBlocks(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("path")
+	if name == "" {
+		apiError(w, errors.New("parameter path is required"), http.StatusBadRequest)
+		return
+	}
+	f, d, err := fh.openRegular(r, name)
+	if err != nil {
+		apiError(w, err, 0)
+		return
+	}
+	defer f.Close()
+	name = path.Clean("/" + name)
+
+	// Other block sizes than the default are powers of two, so that
+	// the lists cached per size stay few.
+	bs := blockSize(d.Size())
+	if s := r.URL.Query().Get("block_size"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n != bs && (n < 512 || n > maxBlockSize || n&(n-1) != 0) {
+			apiError(w, fmt.Errorf("block_size must be %d or a power of two between 512 and %d", bs, maxBlockSize), http.StatusBadRequest)
+			return
+		}
+		bs = n
+	}
+
+	key := sha256.Sum256([]byte(fmt.Sprintf("blocks\x00%s\x00%d\x00%d\x00%d", name, d.ModTime().UnixNano(), d.Size(), bs)))
+	cached := filepath.Join(fh.cacheDir, "blocks", hex.EncodeToString(key[:]))
+	fh.dropPurged(name, cached)
+	cf, err := os.Open(cached)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fh.produce(r.Context(), cached, func(w io.Writer) error {
+			list, err := computeBlocks(f, bs)
+			if err != nil {
+				return err
+			}
+			list.Path, list.Size = name, d.Size()
+			fh.checksums.put(name, d.Size(), d.ModTime(), list.SHA256)
+			return json.NewEncoder(w).Encode(list)
+		})
+		if err == nil {
+			cf, err = os.Open(cached)
+		}
+	}
+	if err != nil {
+		logf(r, "http: error computing blocks of %s: %v", name, err)
+		apiError(w, err, 0)
+		return
+	}
+	defer cf.Close()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fh.serveCached(w, r, name, d, cf)
+}
+
+func computeBlocks(r io.Reader, bs int64) (*blockList, error) {
+	list := &blockList{BlockSize: bs, Blocks: []block{}}
+	whole := sha256.New()
+	buf := make([]byte, bs)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			p := buf[:n]
+			whole.Write(p)
+			strong := sha256.Sum256(p)
+			list.Blocks = append(list.Blocks, block{weakChecksum(p), hex.EncodeToString(strong[:16])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	list.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return list, nil
+}
@@ -0,0 +1,33 @@
+package midserve
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestBlockSizeParam(t *testing.T) {
+	content := strings.Repeat("x", 10000)
+	root := midservetest.NewFS().File("f", content).HTTP()
+	h := newTestServer(t, root, func(o *Options) { o.API = true })
+	for _, tc := range []struct {
+		size string
+		code int
+	}{
+		{"", http.StatusOK},
+		{fmt.Sprint(blockSize(int64(len(content)))), http.StatusOK},
+		{"512", http.StatusOK},
+		{"4096", http.StatusOK},
+		{"1048576", http.StatusOK},
+		{"256", http.StatusBadRequest},
+		{"1000", http.StatusBadRequest},
+		{"4097", http.StatusBadRequest},
+		{"2097152", http.StatusBadRequest},
+		{"x", http.StatusBadRequest},
+	} {
+		midservetest.Get(t, h, "/_api/blocks?path=/f&block_size="+tc.size).Status(tc.code)
+	}
+}
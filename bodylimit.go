@@ -0,0 +1,77 @@
+// Request body size and rate limits
+
+package midserve
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// defaultMaxBody is the largest request body accepted by default.
+	defaultMaxBody = 1 << 20
+	// bodyRateGrace is how long a body may be sent slower than the
+	// minimum rate before the rate is enforced.
+	bodyRateGrace = 10 * time.Second
+)
+
+// errSlowBody is returned when a request body arrives slower than the
+// minimum rate.
+var errSlowBody = errors.New("request body too slow")
+
+// limitBody returns the body of r bounded by the maximum size and, if
+// set, the minimum rate.
+func (fh *fileHandler) limitBody(w http.ResponseWriter, r *http.Request) io.Reader {
+	max := fh.maxBody
+	if max <= 0 {
+		max = defaultMaxBody
+	}
+	body := http.MaxBytesReader(w, r.Body, max)
+	if fh.minBodyRate <= 0 {
+		return body
+	}
+	return &rateReader{r: body, rc: http.NewResponseController(w), min: fh.minBodyRate, start: time.Now()}
+}
+
+// rateReader fails reads once the average rate since start fell below
+// min bytes per second, after a grace period. A read deadline stops
+// reads from a client that sends nothing at all.
+type rateReader struct {
+	r     io.Reader
+	rc    *http.ResponseController
+	min   int64
+	start time.Time
+	n     int64
+}
+
+func (rr *rateReader) Read(p []byte) (int, error) {
+	// The time allowed for everything read so far and all of p.
+	allowed := bodyRateGrace + time.Duration(float64(rr.n+int64(len(p)))/float64(rr.min)*float64(time.Second))
+	deadline := rr.start.Add(allowed)
+	if !time.Now().Before(deadline) {
+		return 0, errSlowBody
+	}
+	rr.rc.SetReadDeadline(deadline)
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = errSlowBody
+	}
+	return n, err
+}
+
+// bodyError returns the status code of an error reading a request body
+// through limitBody.
+func bodyError(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errSlowBody):
+		return http.StatusRequestTimeout
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,35 @@
+// On-disk cache of derived files
+
+package midserve
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// defaultCacheDir returns the directory derived files such as resized
+// images are cached in when no -cache-dir is given.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "midserve")
+}
+
+// serveCached serves the cache file cf derived from the file name with
+// info d. Conditional requests are evaluated against d's modification
+// time, the content type is derived from name unless already set.
+func (fh *fileHandler) serveCached(w http.ResponseWriter, r *http.Request, name string, d fs.FileInfo, cf *os.File) {
+	ci, err := cf.Stat()
+	if err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	sizeFunc := func() (int64, error) { return ci.Size(), nil }
+	serveContent(sw, r, name, d.ModTime(), sizeFunc, cf)
+	fh.publishSent(r, name, sw, ci.Size())
+}
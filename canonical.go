@@ -0,0 +1,117 @@
+// Canonical request paths
+
+package midserve
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+var errBadPath = errors.New("bad path")
+
+// pathParams are the query parameters holding paths, checked like the
+// path of the request itself.
+var pathParams = []string{"path", "a", "b"}
+
+// windowsPaths enables the checks for what Windows reads differently.
+var windowsPaths = runtime.GOOS == "windows"
+
+// windowsDevices are the names Windows opens as devices in any
+// directory, with any extension.
+var windowsDevices = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// canonicalPath returns the cleaned form of p, a path decoded from a
+// request, or an error wrapping errBadPath if p is one that file
+// systems, proxies or the rules applied to paths may read differently:
+//
+//   - bytes that aren't UTF-8, such as overlong encodings of '.' or '/'
+//     (%c0%ae), and control characters such as NUL
+//   - percent signs followed by hex digits, left by encoding twice
+//     (%252e%252e decodes to %2e%2e)
+//   - ".." segments, and segments of dots and spaces only
+//   - on Windows, backslashes, colons of alternate data streams,
+//     segments ending in a dot or space, which Windows drops, and
+//     device names such as NUL or COM1
+//
+// All other paths are cleaned as usual, so that every check and file
+// system access after sees the same name.
+func canonicalPath(p string) (string, error) {
+	bad := func(format string, args ...interface{}) (string, error) {
+		return "", fmt.Errorf("%w: %s", errBadPath, fmt.Sprintf(format, args...))
+	}
+	if !utf8.ValidString(p) {
+		return bad("invalid UTF-8")
+	}
+	for i, c := range p {
+		switch {
+		case c < ' ' || c == 0x7f:
+			return bad("control character %U", c)
+		case c == '%' && i+2 < len(p) && isHex(p[i+1]) && isHex(p[i+2]):
+			return bad("percent-encoded twice")
+		case windowsPaths && (c == '\\' || c == ':'):
+			return bad("%q in path", c)
+		}
+	}
+	for _, seg := range strings.Split(p, "/") {
+		switch {
+		case seg == "" || seg == ".":
+			continue
+		case seg == "..":
+			return bad("parent directory segment")
+		case strings.Trim(seg, ". ") == "":
+			return bad("segment of dots")
+		}
+		if windowsPaths {
+			if strings.HasSuffix(seg, ".") || strings.HasSuffix(seg, " ") {
+				return bad("segment ending in a dot or space")
+			}
+			base := seg
+			if i := strings.IndexByte(base, '.'); i >= 0 {
+				base = base[:i]
+			}
+			if windowsDevices[strings.ToUpper(strings.TrimRight(base, " "))] {
+				return bad("device name")
+			}
+		}
+	}
+	return path.Clean("/" + p), nil
+}
+
+// checkPath returns the canonical form of upath, the path of r, or
+// replies with 400 Bad Request if it has none. Requests to the reserved
+// paths must have canonical path parameters too.
+func (fh *fileHandler) checkPath(w http.ResponseWriter, r *http.Request, upath string) (string, bool) {
+	name, err := canonicalPath(upath)
+	if err == nil && strings.HasPrefix(name, "/_") {
+		q := r.URL.Query()
+	params:
+		for _, k := range pathParams {
+			for _, v := range q[k] {
+				if _, err = canonicalPath(v); err != nil {
+					break params
+				}
+			}
+		}
+	}
+	if err == nil {
+		return name, true
+	}
+	logf(r, "http: rejected %s: %v", r.URL.EscapedPath(), err)
+	sw := &statusWriter{ResponseWriter: w}
+	fh.errorHandler.ServeError(sw, r, err)
+	fh.publish(r, EventDenied, path.Clean(upath), sw.status, -1, err)
+	return "", false
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
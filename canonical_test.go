@@ -0,0 +1,116 @@
+package midserve
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestCanonicalPath(t *testing.T) {
+	defer func(w bool) { windowsPaths = w }(windowsPaths)
+	for _, tt := range []struct {
+		path    string
+		windows bool
+		want    string // "" if the path is refused
+	}{
+		{path: "/a/b.txt", want: "/a/b.txt"},
+		{path: "a//b/", want: "/a/b"},
+		{path: "/a/./b", want: "/a/b"},
+		{path: "/", want: "/"},
+		{path: "/a/.b/c..d", want: "/a/.b/c..d"},
+		{path: "/100%", want: "/100%"},
+		{path: "/a%zz", want: "/a%zz"},
+
+		// Encoded twice.
+		{path: "/%2e%2e/etc/passwd"},
+		{path: "/a/%252e%252e/b"},
+		{path: "/a%2F..%2Fb"},
+
+		// Overlong UTF-8 and other bytes that aren't UTF-8.
+		{path: "/\xc0\xae\xc0\xae/etc/passwd"},
+		{path: "/a\xc0\xafb"},
+		{path: "/\xff"},
+
+		// Control characters.
+		{path: "/a\x00b"},
+		{path: "/a\nb"},
+		{path: "/a\x7fb"},
+
+		// Dot segments.
+		{path: "/a/../b"},
+		{path: "../a"},
+		{path: "/a/.."},
+		{path: "/..."},
+		{path: "/a/. /b"},
+		{path: "/a/ ../b"},
+
+		// Allowed elsewhere, refused on Windows.
+		{path: `/a\b`, want: `/a\b`},
+		{path: `/a\b`, windows: true},
+		{path: `/..\b`, windows: true},
+		{path: "/a:b", want: "/a:b"},
+		{path: "/a.txt:stream", windows: true},
+		{path: "/a.", want: "/a."},
+		{path: "/a.", windows: true},
+		{path: "/a ", windows: true},
+		{path: "/a./b", windows: true},
+		{path: "/NUL", want: "/NUL"},
+		{path: "/NUL", windows: true},
+		{path: "/d/nul.txt", windows: true},
+		{path: "/COM1.log", windows: true},
+		{path: "/con ", windows: true},
+		{path: "/con .txt", windows: true},
+		{path: "/conin$", windows: true},
+		{path: "/lpt9.tar.gz", windows: true},
+		{path: "/console.txt", windows: true, want: "/console.txt"},
+		{path: "/COM10", windows: true, want: "/COM10"},
+		{path: "/a b/c.d", windows: true, want: "/a b/c.d"},
+	} {
+		windowsPaths = tt.windows
+		got, err := canonicalPath(tt.path)
+		switch {
+		case tt.want == "" && !errors.Is(err, errBadPath):
+			t.Errorf("canonicalPath(%q), windows %v = %q, %v; want errBadPath", tt.path, tt.windows, got, err)
+		case tt.want != "" && (err != nil || got != tt.want):
+			t.Errorf("canonicalPath(%q), windows %v = %q, %v; want %q", tt.path, tt.windows, got, err, tt.want)
+		}
+	}
+}
+
+func TestManageCanonicalPaths(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"root/a.txt": "a", "outside.txt": "o"})
+	h := newTestServer(t, Dir(filepath.Join(dir, "root")), func(o *Options) {
+		o.API = true
+		o.Write = true
+	})
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	errs := manage(t, h, "/_api/delete", `{"paths": ["../outside.txt", "a.txt/../a.txt", "a\u0000.txt"]}`)
+	for _, name := range []string{"../outside.txt", "a.txt/../a.txt", "a\x00.txt"} {
+		if errs[name] == "" {
+			t.Errorf("delete of %q not refused", name)
+		}
+	}
+	errs = manage(t, h, "/_api/move", `{"moves": [{"from": "a.txt", "to": "../moved.txt"}, {"from": "%2e%2e/outside.txt", "to": "b.txt"}]}`)
+	for _, name := range []string{"../moved.txt", "b.txt"} {
+		if errs[name] == "" {
+			t.Errorf("move to %q not refused", name)
+		}
+	}
+	if !exists("root/a.txt") || !exists("outside.txt") || exists("moved.txt") || exists("root/b.txt") {
+		t.Fatal("refused requests changed files")
+	}
+
+	if errs := manage(t, h, "/_api/move", `{"moves": [{"from": "a.txt", "to": "b.txt"}]}`); errs["/b.txt"] != "" {
+		t.Fatalf("move: %s", errs["/b.txt"])
+	}
+	midservetest.Get(t, h, "/b.txt").Status(http.StatusOK).Body("a")
+}
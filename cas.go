@@ -0,0 +1,200 @@
+// Content-addressed URLs
+
+package midserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// casPrefix is the URL path prefix of content-addressed files, served as
+// /_cas/<sha256>[/<name>]. The optional name only determines the content
+// type and is not verified.
+const casPrefix = "/_cas/"
+
+var casPathRe = regexp.MustCompile(`^/_cas/([0-9a-f]{64})(?:/([^/]+))?$`)
+
+// Bounds of the content-addressed store. Files larger than
+// casMaxFileSize aren't stored; beyond casMaxEntries or casMaxBytes, the
+// oldest snapshots are dropped.
+const (
+	casMaxFileSize = 1 << 30
+	casMaxEntries  = 10000
+	casMaxBytes    = 10 << 30
+)
+
+var errCASTooLarge = errors.New("file too large to snapshot")
+
+// casFile returns the name of the content with the given hex encoded
+// SHA-256 in the store.
+func (fh *fileHandler) casFile(sum string) string {
+	return filepath.Join(fh.cacheDir, "cas", sum[:2], sum)
+}
+
+// casStore snapshots the content of the regular file name into the
+// content-addressed store and returns its SHA-256. Later changes to the
+// file don't affect the stored content, so its URL stays valid until
+// the snapshot is dropped to keep the store within its bounds. Images
+// are stored without metadata if it is stripped when serving them.
+func (fh *fileHandler) casStore(r *http.Request, name string) (sum string, size int64, err error) {
+	f, d, err := fh.openRegular(r, name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	if d.Size() > casMaxFileSize {
+		return "", 0, errCASTooLarge
+	}
+	var src io.Reader = f
+	strip, err := fh.metadataStripper(name)
+	if err != nil {
+		return "", 0, err
+	}
+	if strip != nil {
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(strip(pw, f)) }()
+		defer pr.Close()
+		src = pr
+	} else if sum, ok := fh.checksums.get(path.Clean("/"+name), d.Size(), d.ModTime()); ok {
+		if _, err := os.Stat(fh.casFile(sum)); err == nil {
+			return sum, d.Size(), nil
+		}
+	}
+
+	tmp, err := fh.temps.create(filepath.Join(fh.cacheDir, "cas"))
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, h), src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+	if strip == nil {
+		fh.checksums.put(path.Clean("/"+name), d.Size(), d.ModTime(), sum)
+	}
+
+	dst := fh.casFile(sum)
+	if _, err := os.Stat(dst); err == nil {
+		return sum, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", 0, err
+	}
+	os.Chmod(tmp.Name(), 0444)
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", 0, err
+	}
+	fh.casPrune(dst)
+	return sum, size, nil
+}
+
+// casPrune drops the oldest snapshots beyond casMaxEntries or
+// casMaxBytes, but not keep, the one just stored.
+func (fh *fileHandler) casPrune(keep string) {
+	fh.casMu.Lock()
+	defer fh.casMu.Unlock()
+	type snapshot struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var all []snapshot
+	var total int64
+	filepath.WalkDir(filepath.Join(fh.cacheDir, "cas"), func(name string, e fs.DirEntry, err error) error {
+		if err != nil || !e.Type().IsRegular() || filepath.Dir(filepath.Dir(name)) != filepath.Join(fh.cacheDir, "cas") {
+			return nil
+		}
+		if fi, err := e.Info(); err == nil {
+			all = append(all, snapshot{name, fi.Size(), fi.ModTime()})
+			total += fi.Size()
+		}
+		return nil
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].modTime.Before(all[j].modTime) })
+	for n := len(all); n > 0 && (n > casMaxEntries || total > casMaxBytes); n-- {
+		s := all[len(all)-n]
+		if s.name == keep {
+			continue
+		}
+		if err := os.Remove(s.name); err == nil {
+			total -= s.size
+		}
+	}
+}
+
+// serveCAS serves a request below casPrefix.
+func (fh *fileHandler) serveCAS(w http.ResponseWriter, r *http.Request, name string) {
+	m := casPathRe.FindStringSubmatch(name)
+	if m == nil {
+		fh.error(w, r, name, fs.ErrNotExist)
+		return
+	}
+	sum, filename := m[1], m[2]
+	f, err := os.Open(fh.casFile(sum))
+	if err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+
+	// The content can never change.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Etag", `"`+sum+`"`)
+	sw := &statusWriter{ResponseWriter: w}
+	serveContent(sw, r, filename, d.ModTime(), func() (int64, error) { return d.Size(), nil }, f)
+	fh.publishSent(r, name, sw, d.Size())
+}
+
+// serveResolve implements POST /_api/resolve?path=, which stores the
+// current content of path and returns its content-addressed URL. As it
+// takes space, it requires the upload role below path.
+func (fh *fileHandler) serveResolve(w http.ResponseWriter, r *http.Request) {
+	if !fh.cas {
+		apiError(w, fs.ErrNotExist, 0)
+		return
+	}
+	name := r.URL.Query().Get("path")
+	if name == "" {
+		apiError(w, errors.New("parameter path is required"), http.StatusBadRequest)
+		return
+	}
+	if !fh.checkPermitted(w, r, path.Clean("/"+name), RoleUpload) {
+		return
+	}
+	sum, size, err := fh.casStore(r, name)
+	if errors.Is(err, errCASTooLarge) {
+		apiError(w, err, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		apiError(w, err, 0)
+		return
+	}
+	writeJSON(w, r, struct {
+		Path   string `json:"path"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+		URL    string `json:"url"`
+	}{path.Clean("/" + name), size, sum, casPrefix + sum + "/" + path.Base(name)})
+}
@@ -0,0 +1,45 @@
+package midserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestResolve(t *testing.T) {
+	// A JPEG with an APP1 (EXIF) segment.
+	jpeg := "\xff\xd8\xff\xe1\x00\x06Exif\xff\xd9"
+	root := midservetest.NewFS().
+		File("a.txt", "hello").
+		File("p.jpg", jpeg).
+		File("c.heic", "heic").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) {
+		o.API = true
+		o.CAS = true
+		o.StripEXIF = true
+	})
+
+	midservetest.Get(t, h, "/_api/resolve?path=/a.txt").
+		Status(http.StatusMethodNotAllowed).
+		Header("Allow", "POST, OPTIONS")
+
+	for _, tc := range []struct{ path, body string }{
+		{"/a.txt", "hello"},
+		{"/p.jpg", "\xff\xd8\xff\xd9"},
+	} {
+		res := midservetest.Do(t, h, midservetest.NewRequest("POST", "/_api/resolve?path="+tc.path)).
+			Status(http.StatusOK)
+		var v struct{ URL string }
+		if err := json.Unmarshal(res.ResponseRecorder.Body.Bytes(), &v); err != nil {
+			t.Fatal(err)
+		}
+		midservetest.Get(t, h, v.URL).
+			Status(http.StatusOK).
+			Body(tc.body)
+	}
+	midservetest.Do(t, h, midservetest.NewRequest("POST", "/_api/resolve?path=/c.heic")).
+		Status(http.StatusForbidden)
+}
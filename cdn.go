@@ -0,0 +1,108 @@
+// Headers for CDN caches in front of midserve
+
+package midserve
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A CDNRule sets the surrogate cache policy and cache tags of the paths
+// matching Pattern, which is matched like an exclusion. The first
+// matching rule sets SurrogateControl, the tags of all matching rules
+// are combined.
+type CDNRule struct {
+	Pattern          *regexp.Regexp
+	SurrogateControl string
+	Tags             []string
+}
+
+// cdnHeaders holds the header names a CDN reads its cache policy and
+// tags from, and how it separates tags.
+type cdnHeaders struct {
+	control, tags, sep string
+}
+
+// cdnVendors maps the -cdn values to their headers.
+var cdnVendors = map[string]cdnHeaders{
+	"generic":    {"Surrogate-Control", "Cache-Tag", ","},
+	"fastly":     {"Surrogate-Control", "Surrogate-Key", " "},
+	"cloudflare": {"Cloudflare-CDN-Cache-Control", "Cache-Tag", ","},
+	"akamai":     {"Edge-Control", "Edge-Cache-Tag", ","},
+}
+
+// checkCDN reports an error if vendor, a -cdn value, is unknown.
+func checkCDN(vendor string) error {
+	if _, ok := cdnVendors[vendor]; vendor != "" && !ok {
+		return fmt.Errorf("cdn: %q is not generic, fastly, cloudflare or akamai", vendor)
+	}
+	return nil
+}
+
+// cdnTags returns the cache tags of name: those of the matching rules,
+// and one for every directory it is in, "dir:/" up to its parent, so
+// that purging a directory's tag purges everything below it.
+func (fh *fileHandler) cdnTags(name string, isDir bool) (tags []string, control string) {
+	entry := name
+	if isDir && entry != "/" {
+		entry += "/"
+	}
+	for _, cr := range fh.cdnRules {
+		if !exclude(entry, []*regexp.Regexp{cr.Pattern}) {
+			continue
+		}
+		if control == "" {
+			control = cr.SurrogateControl
+		}
+		tags = append(tags, cr.Tags...)
+	}
+	dir := path.Dir(strings.TrimSuffix(entry, "/"))
+	if isDir {
+		dir = name
+	}
+	for {
+		// Tags are separated by commas or spaces.
+		tags = append(tags, "dir:"+strings.Replace((&url.URL{Path: dir}).EscapedPath(), ",", "%2C", -1))
+		if dir == "/" {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	return tags, control
+}
+
+// setCDNHeaders adds the surrogate cache policy and tags of name to the
+// response.
+func (fh *fileHandler) setCDNHeaders(w http.ResponseWriter, name string, isDir bool) {
+	h := cdnVendors[fh.cdn]
+	tags, control := fh.cdnTags(name, isDir)
+	if control != "" {
+		w.Header().Set(h.control, control)
+	}
+	w.Header().Set(h.tags, strings.Join(tags, h.sep))
+}
+
+// serveCDNTags implements GET /_admin/cdn-tags?path=, the cache tags to
+// purge at the CDN after path changed.
+func (fh *fileHandler) serveCDNTags(w http.ResponseWriter, r *http.Request) {
+	if fh.cdn == "" {
+		apiError(w, errors.New("cdn mode is off"), http.StatusNotFound)
+		return
+	}
+	name := path.Clean("/" + r.URL.Query().Get("path"))
+	isDir := strings.HasSuffix(r.URL.Query().Get("path"), "/")
+	if d, err := fh.isDir(r, name); err == nil {
+		isDir = d
+	}
+	tags, control := fh.cdnTags(name, isDir)
+	writeJSON(w, r, struct {
+		Path             string   `json:"path"`
+		Tags             []string `json:"tags"`
+		SurrogateControl string   `json:"surrogate_control,omitempty"`
+	}{name, tags, control})
+}
@@ -0,0 +1,130 @@
+// Change notification stream
+
+package midserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// changesPath is the event stream of changes below a directory.
+const changesPath = "/_events"
+
+// changesKeepAlive is how often an idle change stream sends a comment,
+// so that proxies don't close it.
+const changesKeepAlive = 30 * time.Second
+
+// serveChanges streams the changes below the directory given by the
+// path parameter as server-sent events named after their ChangeOp, with
+// a JSON object describing the file as data. A resync event means that
+// changes were lost and the directory must be read again.
+func (fh *fileHandler) serveChanges(w http.ResponseWriter, r *http.Request) {
+	dir := path.Clean("/" + r.URL.Query().Get("path"))
+	if fh.denied(dir) {
+		sw := &statusWriter{ResponseWriter: w}
+		fh.errorHandler.ServeError(sw, r, fs.ErrNotExist)
+		fh.publish(r, EventDenied, dir, sw.status, -1, nil)
+		return
+	}
+	if err := fh.closedWindow(dir); err != nil {
+		sw := &statusWriter{ResponseWriter: w}
+		fh.errorHandler.ServeError(sw, r, err)
+		fh.publish(r, EventDenied, dir, sw.status, -1, nil)
+		return
+	}
+	f, err := openContext(r.Context(), fh.root, dir)
+	if err != nil {
+		fh.error(w, r, dir, err)
+		return
+	}
+	d, err := f.Stat()
+	f.Close()
+	if err != nil {
+		fh.error(w, r, dir, err)
+		return
+	}
+	if !d.IsDir() {
+		http.Error(w, "not a directory", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	changes, cancel := fh.watcher.subscribe()
+	defer cancel()
+	keepAlive := time.NewTicker(changesKeepAlive)
+	defer keepAlive.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case batch := <-changes:
+			for _, c := range batch {
+				if c.Op == ChangeResync {
+					fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+					continue
+				}
+				if !strings.HasPrefix(c.Path, prefix) || fh.closedWindow(c.Path) != nil || fh.unlistedEntry(c.Path, c.IsDir) || !fh.permitted(r, c.Path, RoleRead) {
+					continue
+				}
+				data, _ := json.Marshal(struct {
+					Path  string `json:"path"`
+					IsDir bool   `json:"dir"`
+					Size  int64  `json:"size"`
+				}{c.Path, c.IsDir, c.Size})
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", c.Op, data)
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// liveListingScript keeps a directory listing up to date from the
+// change stream: entries are added and removed in place, along with any
+// copy buttons and checkboxes, and the size of a file shows in its tooltip once it is
+// known. Should changes have been lost, the page reloads.
+const liveListingScript = `<script>(function(){
+var dir="%s",unit="%s",pre=document.querySelector("pre");
+function child(e){var d=JSON.parse(e.data),n=d.path.slice(dir.length);
+if(!n||n.indexOf("/")>=0)return null;d.name=d.dir?n+"/":n;return d}
+function find(name){var as=pre.getElementsByTagName("a");
+for(var i=0;i<as.length;i++)if(as[i].textContent===name)return as[i];return null}
+function title(a,d){if(!d.dir)a.title=d.size+" "+unit}
+var es=new EventSource("` + changesPath + `?path="+encodeURIComponent(dir));
+es.addEventListener("created",function(e){var d=child(e);if(!d||find(d.name))return;
+var a=document.createElement("a");a.href=encodeURIComponent(d.name.replace(/\/$/,""))+(d.dir?"/":"");
+a.textContent=d.name;title(a,d);var as=pre.getElementsByTagName("a"),next=null;
+for(var i=0;i<as.length;i++)if(as[i].textContent>d.name){next=as[i];break}
+pre.insertBefore(a,next);pre.insertBefore(document.createTextNode("\n"),next);
+if(window.copyLinks)copyLinks(a);if(window.bulkSelect)bulkSelect(a)});
+es.addEventListener("resync",function(){location.reload()});
+es.addEventListener("modified",function(e){var d=child(e),a=d&&find(d.name);if(a)title(a,d)});
+es.addEventListener("removed",function(e){var d=child(e),a=d&&find(d.name);
+if(a){while(a.nextSibling&&a.nextSibling.nodeType===1)pre.removeChild(a.nextSibling);
+if(a.nextSibling)pre.removeChild(a.nextSibling);pre.removeChild(a)}});
+})();</script>
+`
+
+// writeLiveListing writes the script refreshing the listing of dir.
+func writeLiveListing(w io.Writer, dir string, msgs messages) {
+	fmt.Fprintf(w, liveListingScript, template.JSEscapeString(strings.TrimSuffix(dir, "/")+"/"),
+		template.JSEscapeString(msgs.t("bytes")))
+}
@@ -0,0 +1,79 @@
+// Checksums of served files
+
+package midserve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// checksumCache remembers the SHA-256 of files by name, valid as long as
+// their size and modification time don't change.
+type checksumCache struct {
+	mu   sync.Mutex
+	sums map[string]checksumEntry
+}
+
+type checksumEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+func newChecksumCache() *checksumCache {
+	return &checksumCache{sums: make(map[string]checksumEntry)}
+}
+
+// get returns the cached checksum of name, if still valid for a file of
+// the given size and modification time.
+func (c *checksumCache) get(name string, size int64, modTime time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.sums[name]
+	if !ok || e.size != size || !e.modTime.Equal(modTime) {
+		return "", false
+	}
+	return e.sum, true
+}
+
+func (c *checksumCache) put(name string, size int64, modTime time.Time, sum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sums[name] = checksumEntry{size, modTime, sum}
+}
+
+// fileSHA256 returns the hex encoded SHA-256 of the file name with info
+// d, reading it only if the cached checksum is missing or stale.
+func (fh *fileHandler) fileSHA256(ctx context.Context, name string, d fs.FileInfo) (string, error) {
+	if sum, ok := fh.checksums.get(name, d.Size(), d.ModTime()); ok {
+		return sum, nil
+	}
+	shared := fh.sharedCache && fh.index != nil
+	if shared {
+		// Another process sharing the index may have computed it.
+		fh.index.catchUp(fh.checksums)
+		if sum, ok := fh.checksums.get(name, d.Size(), d.ModTime()); ok {
+			return sum, nil
+		}
+	}
+	f, err := openContext(ctx, fh.root, name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	fh.checksums.put(name, d.Size(), d.ModTime(), sum)
+	if shared {
+		fh.index.shareChecksum(indexEntry{Path: name, Size: d.Size(), ModTime: d.ModTime(), SHA256: sum})
+	}
+	return sum, nil
+}
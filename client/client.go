@@ -0,0 +1,419 @@
+// Package client is a client of the midserve API, for Go programs that
+// list, download, upload and manage files on a midserve server.
+//
+// A typical program creates a Client for the server and calls its
+// methods:
+//
+//	c := client.New("https://files.example.com", os.Getenv("MIDSERVE_TOKEN"))
+//	entries, err := c.ListDir(ctx, "/builds")
+//	...
+//	err = c.Download(ctx, "/builds/app.tar.gz", "app.tar.gz")
+//
+// The server must run with -api, and with -write for uploading and
+// managing files.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIVersion is the version of the API the client is built against.
+// Servers speaking another one refuse its requests.
+const APIVersion = 1
+
+// A Client talks to one server. Its methods may be called concurrently.
+type Client struct {
+	// BaseURL is the URL of the server, such as
+	// "https://files.example.com", without a trailing slash.
+	BaseURL string
+	// Token, if set, is sent as a bearer token: that of a principal or an
+	// API key.
+	Token string
+	// HTTPClient makes the requests; nil means http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// New returns a client of the server at baseURL authenticating with
+// token, which may be empty.
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token}
+}
+
+// An Error is an error reported by the server.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("midserve: %d %s", e.StatusCode, e.Message)
+}
+
+// Entry is an entry of a directory.
+type Entry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"dir,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mtime"`
+	// Unserved entries are listed, but can't be downloaded.
+	Unserved bool `json:"unserved,omitempty"`
+}
+
+// FileInfo describes a file or directory. Err is set instead for paths
+// that can't be served, such as missing ones.
+type FileInfo struct {
+	Path        string    `json:"path"`
+	Err         string    `json:"error,omitempty"`
+	IsDir       bool      `json:"dir,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	ModTime     time.Time `json:"mtime"`
+	Mode        string    `json:"mode,omitempty"`
+	ETag        string    `json:"etag,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+}
+
+// SearchOptions narrow and order a search.
+type SearchOptions struct {
+	Path  string // directory to search below; the root if empty
+	Sort  string // name, size, mtime or downloads; name if empty
+	Desc  bool
+	Limit int // 0 for the server's default
+}
+
+// SearchResult is a path found by Search.
+type SearchResult struct {
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"dir,omitempty"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Downloads int64     `json:"downloads"`
+}
+
+// Result is the outcome of an operation on one path. Failures of single
+// paths don't fail the request; they are reported in Err.
+type Result struct {
+	Path string `json:"path"`
+	From string `json:"from,omitempty"`
+	Err  string `json:"error,omitempty"`
+}
+
+// Move is a path to move and where to.
+type Move struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// request returns a request for the path p with the query q.
+func (c *Client) request(ctx context.Context, method, p string, q url.Values, body io.Reader) (*http.Request, error) {
+	u := c.BaseURL + (&url.URL{Path: p}).EscapedPath()
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+// do sends req, returning the response if its status is ok and an
+// *Error otherwise.
+func (c *Client) do(req *http.Request, ok ...int) (*http.Response, error) {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	e := &Error{StatusCode: resp.StatusCode}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(b, &body) == nil && body.Error != "" {
+		e.Message = body.Error
+	} else {
+		e.Message = strings.TrimSpace(string(b))
+	}
+	return nil, e
+}
+
+// api calls the endpoint ep, decoding the JSON response into v.
+func (c *Client) api(ctx context.Context, method, ep string, q url.Values, in, v interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := c.request(ctx, method, "/_api/"+ep, q, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Midserve-API-Version", strconv.Itoa(APIVersion))
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// ListDir returns the entries of the directory dir, as its listing
+// shows them, fetching every page.
+func (c *Client) ListDir(ctx context.Context, dir string) ([]Entry, error) {
+	var entries []Entry
+	for page := 1; page > 0; {
+		var l struct {
+			Entries  []Entry `json:"entries"`
+			NextPage int     `json:"next_page"`
+		}
+		q := url.Values{"path": {dir}, "page": {strconv.Itoa(page)}}
+		if err := c.api(ctx, "GET", "list", q, nil, &l); err != nil {
+			return nil, err
+		}
+		entries = append(entries, l.Entries...)
+		page = l.NextPage
+	}
+	return entries, nil
+}
+
+// Stat describes the paths, in the same order.
+func (c *Client) Stat(ctx context.Context, paths ...string) ([]FileInfo, error) {
+	var fis []FileInfo
+	err := c.api(ctx, "GET", "stat", url.Values{"path": paths}, nil, &fis)
+	return fis, err
+}
+
+// Search returns the indexed paths whose name contains q, ignoring case,
+// up to the limit, and how many match in all. The server must run with
+// -index.
+func (c *Client) Search(ctx context.Context, q string, opts SearchOptions) (results []SearchResult, total int, err error) {
+	v := url.Values{"q": {q}}
+	if opts.Path != "" {
+		v.Set("path", opts.Path)
+	}
+	if opts.Sort != "" {
+		v.Set("sort", opts.Sort)
+	}
+	if opts.Desc {
+		v.Set("desc", "1")
+	}
+	if opts.Limit > 0 {
+		v.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	var resp struct {
+		Total   int            `json:"total"`
+		Results []SearchResult `json:"results"`
+	}
+	err = c.api(ctx, "GET", "search", v, nil, &resp)
+	return resp.Results, resp.Total, err
+}
+
+// Delete deletes the files and, with their contents, the directories.
+func (c *Client) Delete(ctx context.Context, paths ...string) ([]Result, error) {
+	var results []Result
+	err := c.api(ctx, "POST", "delete", nil, struct {
+		Paths []string `json:"paths"`
+	}{paths}, &results)
+	return results, err
+}
+
+// MoveFiles moves or renames files and directories. Destinations must
+// not exist.
+func (c *Client) MoveFiles(ctx context.Context, moves ...Move) ([]Result, error) {
+	var results []Result
+	err := c.api(ctx, "POST", "move", nil, struct {
+		Moves []Move `json:"moves"`
+	}{moves}, &results)
+	return results, err
+}
+
+// Upload uploads the content of r as the new file name in the directory
+// dir, streaming it in a multipart request. Existing files are never
+// replaced. The server has no resumable upload protocol such as tus, so
+// an interrupted upload must be started over.
+func (c *Client) Upload(ctx context.Context, dir, name string, r io.Reader) (Result, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		fw, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(fw, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	req, err := c.request(ctx, "POST", "/_api/upload", url.Values{"path": {dir}}, pr)
+	if err != nil {
+		return Result{}, err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	req.Header.Set("X-Upload-ID", hex.EncodeToString(id))
+	req.Header.Set("X-Midserve-API-Version", strconv.Itoa(APIVersion))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	var results []Result
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return Result{}, err
+	}
+	if len(results) != 1 {
+		return Result{}, errors.New("midserve: unexpected upload response")
+	}
+	return results[0], nil
+}
+
+// Open returns the content of the file name from offset on.
+func (c *Client) Open(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	req, err := c.request(ctx, "GET", name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := c.do(req, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, errors.New("midserve: server ignored the range")
+	}
+	return resp.Body, nil
+}
+
+// Download saves the file name as dst. It writes to dst+".part" first,
+// which it resumes from when called again after an interruption, as
+// long as the file didn't change since. The server's strong ETag, kept
+// in dst+".part.etag", tells; without one, the file's time does.
+func (c *Client) Download(ctx context.Context, name, dst string) error {
+	part := dst + ".part"
+	etagFile := part + ".etag"
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := c.request(ctx, "GET", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	offset := fi.Size()
+	if offset > 0 {
+		// The part file has the time of the file it is part of, which
+		// must still be the same, but times only go by the second.
+		validator := fi.ModTime().UTC().Format(http.TimeFormat)
+		if b, err := os.ReadFile(etagFile); err == nil && strongETag(string(b)) {
+			validator = string(b)
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := c.do(req, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		var e *Error
+		if errors.As(err, &e) && e.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// Complete already, or the file shrank: start over.
+			f.Truncate(0)
+			f.Close()
+			os.Remove(part)
+			os.Remove(etagFile)
+			return c.Download(ctx, name, dst)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		offset = 0
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if etag := resp.Header.Get("ETag"); strongETag(etag) {
+			if err := os.WriteFile(etagFile, []byte(etag), 0644); err != nil {
+				return err
+			}
+		} else {
+			os.Remove(etagFile)
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	// Set before and after writing, as writing changes it, so that an
+	// interrupted download can be resumed.
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	setTime := func() {
+		if !modTime.IsZero() {
+			os.Chtimes(part, modTime, modTime)
+		}
+	}
+	setTime()
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	setTime()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(part, dst); err != nil {
+		return err
+	}
+	os.Remove(etagFile)
+	return nil
+}
+
+// strongETag reports whether etag is a strong entity tag, the only kind
+// If-Range may have.
+func strongETag(etag string) bool {
+	return len(etag) >= 2 && etag[0] == '"' && etag[len(etag)-1] == '"'
+}
@@ -0,0 +1,66 @@
+package midserve
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hellodword/midserve/client"
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestClientDownloadResume(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	root := midservetest.NewFS().File("f", content).HTTP()
+	srv := httptest.NewServer(newTestServer(t, root, func(o *Options) {
+		o.API = true
+		o.ETag = "strong"
+	}))
+	defer srv.Close()
+	c := client.New(srv.URL, "")
+	dst := filepath.Join(t.TempDir(), "f")
+
+	if err := c.Download(context.Background(), "/f", dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst + ".part.etag"); !os.IsNotExist(err) {
+		t.Fatalf("etag file left behind: %v", err)
+	}
+
+	// An interrupted download whose part file lost its time, as copies
+	// do: the ETag still tells it is part of the same file. Its content
+	// is marked to tell it was resumed rather than started over.
+	res := midservetest.Get(t, srv.Config.Handler, "/f")
+	etag := res.ResponseRecorder.Header().Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("ETag %q is not strong", etag)
+	}
+	if err := os.WriteFile(dst+".part", []byte("XXXXX"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst+".part.etag", []byte(etag), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	os.Chtimes(dst+".part", now, now)
+	if err := c.Download(context.Background(), "/f", dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(dst); err != nil || string(b) != "XXXXX"+content[5:] {
+		t.Fatalf("resumed download = %.20q..., %v", b, err)
+	}
+
+	// A changed file is downloaded again.
+	os.WriteFile(dst+".part", []byte("XXXXX"), 0644)
+	os.WriteFile(dst+".part.etag", []byte(`"other"`), 0644)
+	if err := c.Download(context.Background(), "/f", dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(dst); err != nil || string(b) != content {
+		t.Fatalf("download = %.20q..., %v", b, err)
+	}
+}
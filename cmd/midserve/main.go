@@ -0,0 +1,11 @@
+// Command midserve serves files and directories over HTTP/s.
+//
+// Run "midserve help" for its commands. The file server itself is the
+// package github.com/hellodword/midserve, for use in other programs.
+package main
+
+import "github.com/hellodword/midserve"
+
+func main() {
+	midserve.Main()
+}
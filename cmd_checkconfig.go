@@ -0,0 +1,28 @@
+package midserve
+
+import (
+	"encoding/json"
+	"os"
+)
+
+var checkConfigCommand = &command{
+	name:  "check-config",
+	short: "validate the configuration and print it, without serving",
+	run:   runCheckConfig,
+}
+
+func runCheckConfig(c *command, args []string) error {
+	flags := c.flagSet()
+	cfg, err := parseConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	// Print the effective configuration in the format of -config.
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cfg)
+}
@@ -0,0 +1,71 @@
+package midserve
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var dupesCommand = &command{
+	name:  "dupes",
+	usage: "dir ...",
+	short: "report files with the same content, walking directories",
+	run:   runDupes,
+}
+
+func runDupes(c *command, args []string) error {
+	flags := c.flagSet()
+	minSize := flags.Int64("min-size", 1, "ignore files smaller than this many bytes")
+	asJSON := flags.Bool("json", false, "print the report as JSON, as /_api/dupes does")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no directories given")
+	}
+
+	rep := newDupeReport("")
+	for _, root := range flags.Args() {
+		err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if fi.Size() >= *minSize {
+				rep.add(filepath.ToSlash(name), fi)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err := rep.group(func(name string, _ fs.FileInfo) (string, error) {
+		return hashFile(filepath.FromSlash(name), sha256.New())
+	})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rep)
+	}
+	for _, g := range rep.Groups {
+		fmt.Printf("%d copies of %d bytes, %d wasted, sha256 %s\n", len(g.Paths), g.Size, g.Wasted, g.SHA256)
+		for _, p := range g.Paths {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	fmt.Printf("%d bytes wasted in %d groups of the %d files compared\n", rep.Wasted, len(rep.Groups), rep.Files)
+	return nil
+}
@@ -0,0 +1,89 @@
+package midserve
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var genCertCommand = &command{
+	name:  "gen-cert",
+	short: "generate a self-signed certificate for -tls-cert and -tls-key",
+	run:   runGenCert,
+}
+
+func runGenCert(c *command, args []string) error {
+	flags := c.flagSet()
+	hosts := flags.String("host", "localhost,127.0.0.1,::1", "comma-separated host names and IP addresses to certify")
+	validFor := flags.Duration("valid-for", 365*24*time.Hour, "validity period")
+	certFile := flags.String("cert", "cert.pem", "certificate output file")
+	keyFile := flags.String("key", "key.pem", "private key output file")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	notBefore := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"midserve"}},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(*validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range strings.Split(*hosts, ",") {
+		h = strings.TrimSpace(h)
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(*certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	if err := writePEM(*keyFile, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s and %s\n", *certFile, *keyFile)
+	return nil
+}
+
+func writePEM(name, typ string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
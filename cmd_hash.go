@@ -0,0 +1,83 @@
+package midserve
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var hashCommand = &command{
+	name:  "hash",
+	usage: "file|dir ...",
+	short: "print checksums of files, walking directories",
+	run:   runHash,
+}
+
+// hashAlgorithms maps the names accepted by -algo to constructors.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func runHash(c *command, args []string) error {
+	flags := c.flagSet()
+	algo := flags.String("algo", "sha256", "hash algorithm: md5, sha1, sha256 or sha512")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	newHash, ok := hashAlgorithms[*algo]
+	if !ok {
+		return fmt.Errorf("unknown algorithm %q", *algo)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no files given")
+	}
+
+	for _, root := range flags.Args() {
+		err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			sum, err := hashFile(name, newHash())
+			if err != nil {
+				return err
+			}
+			// Same format as sha256sum and friends, for -c.
+			fmt.Printf("%s  %s\n", sum, filepath.ToSlash(name))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashFile returns the hex encoded digest of the content of name.
+func hashFile(name string, h hash.Hash) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(f, h)
+}
+
+func hashReader(r io.Reader, h hash.Hash) (string, error) {
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,168 @@
+package midserve
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var precompressCommand = &command{
+	name:  "precompress",
+	usage: "dir",
+	short: "write gzip (.gz) sidecars and a SHA256SUMS manifest for a tree",
+	run:   runPrecompress,
+}
+
+// incompressibleExts lists extensions of formats that are already
+// compressed, for which a sidecar would only waste space.
+var incompressibleExts = map[string]bool{
+	".gz": true, ".br": true, ".zst": true, ".xz": true, ".bz2": true,
+	".zip": true, ".7z": true, ".rar": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".mkv": true, ".webm": true, ".ogg": true,
+	".woff": true, ".woff2": true,
+}
+
+// manifestName is the checksum manifest written by precompress, in the
+// format of sha256sum.
+const manifestName = "SHA256SUMS"
+
+func runPrecompress(c *command, args []string) error {
+	flags := c.flagSet()
+	minSize := flags.Int64("min-size", 1024, "don't compress files smaller than this many bytes")
+	level := flags.Int("level", gzip.BestCompression, "gzip compression level; only gzip sidecars are written, make .br ones with \"brotli -k\"")
+	cfg, err := parseConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected exactly one directory")
+	}
+	root := flags.Arg(0)
+	opts, err := cfg.Options()
+	if err != nil {
+		return err
+	}
+
+	var sums []string
+	err = filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if exclude(rel+"/", opts.Excludes) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || exclude(rel, opts.Excludes) || isSidecar(rel, regularIn(root)) || rel == manifestName {
+			return nil
+		}
+
+		sum, err := hashFile(name, sha256.New())
+		if err != nil {
+			return err
+		}
+		sums = append(sums, fmt.Sprintf("%s  %s\n", sum, rel))
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Size() < *minSize || incompressibleExts[strings.ToLower(filepath.Ext(name))] {
+			return nil
+		}
+		return writeGzipSidecar(name, fi, *level)
+	})
+	if err != nil {
+		return err
+	}
+
+	// WalkDir visits files in lexical order, so the manifest is
+	// deterministic.
+	return os.WriteFile(filepath.Join(root, manifestName), []byte(strings.Join(sums, "")), 0644)
+}
+
+// sidecarExts are the extensions of precompressed variants, those
+// written by precompress and Brotli ones written by other tools.
+var sidecarExts = []string{".gz", ".br"}
+
+// isSidecar reports whether name is a precompressed variant of another
+// file, whose name exists reports whether it is a regular file. A
+// tarball "x.tar.gz" alone is a file of its own.
+func isSidecar(name string, exists func(name string) bool) bool {
+	for _, ext := range sidecarExts {
+		if base := strings.TrimSuffix(name, ext); base != name && base != "" && !strings.HasSuffix(base, "/") && exists(base) {
+			return true
+		}
+	}
+	return false
+}
+
+// regularIn returns a function reporting whether a '/'-separated name
+// relative to root is a regular file.
+func regularIn(root string) func(name string) bool {
+	return func(name string) bool {
+		fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(name)))
+		return err == nil && fi.Mode().IsRegular()
+	}
+}
+
+// writeGzipSidecar writes name.gz unless it is already up to date. The
+// sidecar gets the modification time of name, so that it is considered
+// stale as soon as name changes.
+func writeGzipSidecar(name string, fi fs.FileInfo, level int) error {
+	gzName := name + ".gz"
+	if gi, err := os.Stat(gzName); err == nil && gi.ModTime().Equal(fi.ModTime()) {
+		return nil
+	}
+
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Write to a temporary file first so that a server never sees a
+	// partial sidecar.
+	tmp, err := (&tempFiles{}).create(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	zw, err := gzip.NewWriterLevel(tmp, level)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := io.Copy(zw, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), gzName)
+}
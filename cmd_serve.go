@@ -0,0 +1,128 @@
+package midserve
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var serveCommand = &command{
+	name:  "serve",
+	short: "serve files over HTTP/s (default)",
+	run:   runServe,
+}
+
+// shutdownTimeout is how long requests in flight get to complete on
+// shutdown. Windows kills a console process about 5s after it is closed.
+const shutdownTimeout = 4 * time.Second
+
+func runServe(c *command, args []string) error {
+	flags := c.flagSet()
+	cfg, err := parseConfig(flags, args)
+	if err != nil {
+		return err
+	}
+
+	// On Windows, closing the console window, logging off and shutting
+	// down are delivered as SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serve(ctx, cfg)
+}
+
+// serve runs the servers configured by cfg until one fails or ctx is
+// done, then shuts them down gracefully.
+func serve(ctx context.Context, cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	h, err := cfg.Handler()
+	if err != nil {
+		return err
+	}
+	banner, err := setupLogging(cfg.LogFormat)
+	if err != nil {
+		return err
+	}
+	if !cfg.Quiet {
+		cfg.writeBanner(banner)
+	}
+
+	var servers []*http.Server
+	var listeners []net.Listener
+	errc := make(chan error, 2)
+	start := func(srv *http.Server, useTLS bool) error {
+		l, err := inheritedListener(srv.Addr)
+		if l == nil && err == nil {
+			l, err = cfg.listen(srv.Addr)
+		}
+		if err != nil {
+			return err
+		}
+		servers = append(servers, srv)
+		listeners = append(listeners, l)
+		go func() { errc <- cfg.serveListener(srv, l, useTLS) }()
+		return nil
+	}
+	if cfg.TLS() && cfg.RedirectHTTP != "" {
+		addr, err := normalizeListen(cfg.Listen)
+		if err != nil {
+			return err
+		}
+		_, port, _ := net.SplitHostPort(addr)
+		err = start(cfg.newServer(cfg.RedirectHTTP, HTTPSRedirect(cfg.CanonicalHost, port)), false)
+		if err != nil {
+			return err
+		}
+	}
+	if err := start(cfg.newServer(cfg.Listen, h), cfg.TLS()); err != nil {
+		for _, srv := range servers {
+			srv.Close()
+		}
+		return err
+	}
+
+	upgradeReady()
+
+	// On SIGUSR2, a new process takes over the listeners, and this one
+	// lets transfers in flight finish for up to the drain timeout.
+	upgrades := make(chan os.Signal, 1)
+	notifyUpgrade(upgrades)
+	defer signal.Stop(upgrades)
+	timeout := shutdownTimeout
+wait:
+	for {
+		select {
+		case err = <-errc:
+			break wait
+		case <-ctx.Done():
+			break wait
+		case <-upgrades:
+			addrs := make([]string, len(servers))
+			for i, srv := range servers {
+				addrs[i] = srv.Addr
+			}
+			if uerr := upgrade(addrs, listeners); uerr != nil {
+				log.Printf("%v", uerr)
+				continue
+			}
+			log.Printf("upgrade: the new process serves, draining for up to %v", time.Duration(cfg.DrainTimeout))
+			timeout = time.Duration(cfg.DrainTimeout)
+			break wait
+		}
+	}
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(sctx)
+	}
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return err
+}
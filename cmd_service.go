@@ -0,0 +1,46 @@
+package midserve
+
+import (
+	"fmt"
+)
+
+var serviceCommand = &command{
+	name:  "service",
+	usage: "install|uninstall|run [serve flags]",
+	short: "manage midserve as a Windows service",
+	run:   runService,
+}
+
+// serviceName is the name of the Windows service unless -name is given.
+const serviceName = "midserve"
+
+func runService(c *command, args []string) error {
+	flags := c.flagSet()
+	name := flags.String("name", serviceName, "service name")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("missing action")
+	}
+	action, serveArgs := flags.Arg(0), flags.Args()[1:]
+	switch action {
+	case "install":
+		// The service starts in the system directory, so relative
+		// paths would not mean what they mean here.
+		cfg, err := parseConfig(serveCommand.flagSet(), serveArgs)
+		if err != nil {
+			return err
+		}
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+		return installService(*name, serveArgs)
+	case "uninstall":
+		return uninstallService(*name)
+	case "run":
+		return runAsService(*name, serveArgs)
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
@@ -0,0 +1,381 @@
+package midserve
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shareCommand = &command{
+	name:  "share",
+	usage: "file|dir",
+	short: "share a file or directory under a secret URL until downloaded or expired",
+	run:   runShare,
+}
+
+func runShare(c *command, args []string) error {
+	flags := c.flagSet()
+	listen := flags.String("listen", ":0", "address to listen on; port 0 picks a free one")
+	host := flags.String("host", "", "host name or address in the URL; defaults to the listen address or else the first non-loopback IPv4 address")
+	downloads := flags.Int("downloads", 0, "exit after this many complete downloads; 0 for no limit")
+	ttl := flags.Duration("ttl", time.Hour, "exit after this long; 0 for no limit")
+	qr := flags.Bool("qr", true, "show the URL as a QR code as well")
+	name := flags.String("name", "", "file name of data shared from stdin, given as -, or a named pipe; defaults to stdin or the pipe's name")
+	spool := flags.Bool("spool", false, "read stdin or a named pipe into a temporary file first, so it can be downloaded several times and resumed, rather than streaming it to the first client")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected one file or directory, or - for stdin")
+	}
+	if *downloads < 0 {
+		return errors.New("downloads: must not be negative")
+	}
+
+	// On Windows, closing the console window, logging off and shutting
+	// down are delivered as SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Data from stdin or a named pipe is streamed, unless spooled.
+	var in *os.File
+	var abs string
+	var fi os.FileInfo
+	var err error
+	if flags.Arg(0) == "-" {
+		in, abs = os.Stdin, "stdin"
+	} else {
+		if abs, err = filepath.Abs(flags.Arg(0)); err != nil {
+			return err
+		}
+		if fi, err = os.Stat(abs); err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeNamedPipe != 0 {
+			if in, err = os.Open(abs); err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+	}
+	if in != nil {
+		if *name == "" {
+			*name = filepath.Base(abs)
+		}
+		if *name != filepath.Base(*name) || strings.ContainsAny(*name, `/\`) || *name == "." || *name == ".." {
+			return fmt.Errorf("name: %q is not a file name", *name)
+		}
+	}
+	if in != nil && *spool {
+		dir, err := os.MkdirTemp("", "midserve-share-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		abs = filepath.Join(dir, *name)
+		fmt.Fprintf(os.Stderr, "spooling %s\n", *name)
+		if fi, err = spoolShare(ctx, abs, in); err != nil {
+			return err
+		}
+		in = nil
+	}
+
+	cfg := DefaultConfig()
+	l, err := cfg.listen(*listen)
+	if err != nil {
+		return err
+	}
+	sh := &shareHandler{token: randomHex(16)}
+	root, err := shareURL(l.Addr(), *host, sh.token)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	var events <-chan Event
+	var streamed chan streamResult
+	switch {
+	case in != nil:
+		sh.file = "/" + *name
+		st := &streamHandler{r: in, name: *name, done: make(chan streamResult, 1)}
+		sh.h, streamed = st, st.done
+	default:
+		cfg.Root = abs
+		if fi.IsDir() {
+			cfg.Archives = "stream"
+		} else {
+			// Only the file is served, whatever its name.
+			cfg.Root = filepath.Dir(abs)
+			cfg.Excludes = nil
+			sh.file = "/" + filepath.Base(abs)
+		}
+		opts, err := cfg.Options()
+		if err != nil {
+			l.Close()
+			return err
+		}
+		opts.BaseURL = root
+		opts.Events = NewEventBus()
+		var unsubscribe func()
+		events, unsubscribe = opts.Events.Subscribe(64)
+		defer unsubscribe()
+		sh.h = http.StripPrefix("/"+sh.token, NewFileServer(Dir(cfg.Root), opts))
+	}
+	srv := cfg.newServer(*listen, sh)
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(l) }()
+
+	u := root + (&url.URL{Path: sh.file}).EscapedPath()
+	if sh.file == "" {
+		u += "/"
+	}
+	if *qr {
+		if q, err := newQRCode([]byte(u)); err == nil {
+			fmt.Print(q)
+		}
+	}
+	fmt.Println(u)
+	limits := "until interrupted"
+	switch {
+	case in != nil && *ttl > 0:
+		limits = fmt.Sprintf("to the first client within %v", *ttl)
+	case in != nil:
+		limits = "to the first client"
+	case *downloads > 0 && *ttl > 0:
+		limits = fmt.Sprintf("for %d download(s) or %v", *downloads, *ttl)
+	case *downloads > 0:
+		limits = fmt.Sprintf("for %d download(s)", *downloads)
+	case *ttl > 0:
+		limits = fmt.Sprintf("for %v", *ttl)
+	}
+	fmt.Fprintf(os.Stderr, "sharing %s %s\n", abs, limits)
+
+	var expired <-chan time.Time
+	if *ttl > 0 {
+		t := time.NewTimer(*ttl)
+		defer t.Stop()
+		expired = t.C
+	}
+	n := 0
+wait:
+	for {
+		select {
+		case ev := <-events:
+			if !completeDownload(ev) {
+				continue
+			}
+			n++
+			log.Printf("share: %s downloaded %s, %d bytes", ev.RemoteAddr, ev.Path, ev.Sent)
+			if *downloads > 0 && n >= *downloads {
+				log.Printf("share: %d download(s), done", n)
+				break wait
+			}
+		case res := <-streamed:
+			if res.err != nil {
+				srv.Close()
+				return fmt.Errorf("streaming to %s after %d bytes: %v", res.addr, res.n, res.err)
+			}
+			log.Printf("share: %s downloaded %s, %d bytes", res.addr, sh.file, res.n)
+			break wait
+		case <-expired:
+			log.Printf("share: expired after %v", *ttl)
+			break wait
+		case <-ctx.Done():
+			srv.Close()
+			return nil
+		case err := <-errc:
+			return err
+		}
+	}
+
+	// New requests are turned away; those in flight may finish unless
+	// interrupted.
+	atomic.StoreInt32(&sh.closed, 1)
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+	}
+	return nil
+}
+
+// spoolShare copies r into the new file name, returning its info, or
+// gives up when ctx is done.
+func spoolShare(ctx context.Context, name string, r io.Reader) (os.FileInfo, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(f, r)
+		errc <- err
+	}()
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.Stat()
+}
+
+// shareHandler serves the files of a share below a secret path, and
+// nothing once closed.
+type shareHandler struct {
+	token  string
+	file   string // the only path served when sharing a file
+	h      http.Handler
+	closed int32 // atomic
+}
+
+func (sh *shareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	tok, rest := p, ""
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		tok, rest = p[:i], p[i:]
+	}
+	if subtle.ConstantTimeCompare([]byte(tok), []byte(sh.token)) != 1 || sh.file != "" && rest != sh.file {
+		http.NotFound(w, r)
+		return
+	}
+	if atomic.LoadInt32(&sh.closed) != 0 {
+		http.Error(w, "this share has ended", http.StatusGone)
+		return
+	}
+	if rest == "" {
+		localRedirect(w, r, sh.token+"/")
+		return
+	}
+	sh.h.ServeHTTP(w, r)
+}
+
+// streamHandler sends the data read from r, such as stdin, as the file
+// name to the first client requesting it, which it can't resume.
+type streamHandler struct {
+	r     io.Reader
+	name  string
+	taken int32 // atomic
+	done  chan streamResult
+}
+
+// streamResult is the outcome of streaming to a client at addr.
+type streamResult struct {
+	addr string
+	n    int64
+	err  error
+}
+
+func (st *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctype := mime.TypeByExtension(path.Ext(st.name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", st.name, false))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == "HEAD" {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&st.taken, 0, 1) {
+		http.Error(w, "already downloaded by another client", http.StatusGone)
+		return
+	}
+
+	// Without a length, the response is chunked. Each read is sent at
+	// once, as the data may trickle in.
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32<<10)
+	var n int64
+	for {
+		k, rerr := st.r.Read(buf)
+		if k > 0 {
+			if _, err := w.Write(buf[:k]); err != nil {
+				st.done <- streamResult{r.RemoteAddr, n, err}
+				return
+			}
+			n += int64(k)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			st.done <- streamResult{r.RemoteAddr, n, nil}
+			return
+		}
+		if rerr != nil {
+			st.done <- streamResult{r.RemoteAddr, n, rerr}
+			// Cut the response short, so the client can tell it is
+			// incomplete.
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// completeDownload reports whether ev is a file or archive sent in
+// full, rather than a listing, a range or an aborted transfer.
+func completeDownload(ev Event) bool {
+	return ev.Kind == EventServed && ev.Method == "GET" && ev.Status == http.StatusOK &&
+		ev.Sent >= 0 && (ev.Size < 0 || ev.Sent == ev.Size)
+}
+
+// shareURL returns the URL of the root of a share listening on addr,
+// without a trailing slash, with the host if given.
+func shareURL(addr net.Addr, host, token string) (string, error) {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("listen: not a TCP address: %v", addr)
+	}
+	if host == "" && !ta.IP.IsUnspecified() {
+		host = ta.IP.String()
+	}
+	if host == "" {
+		host = outboundHost()
+	}
+	u := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(host, fmt.Sprint(ta.Port)),
+		Path:   "/" + token,
+	}
+	return u.String(), nil
+}
+
+// outboundHost returns the first non-loopback IPv4 address of the
+// machine, which others on its network can likely reach, or else its
+// host name.
+func outboundHost() string {
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil && ipn.IP.IsGlobalUnicast() {
+			return ipn.IP.String()
+		}
+	}
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "localhost"
+}
@@ -0,0 +1,53 @@
+package midserve
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var signCommand = &command{
+	name:  "sign",
+	usage: "path|url ...",
+	short: "print URLs signed for -signed-urls, valid for -ttl",
+	run:   runSign,
+}
+
+func runSign(c *command, args []string) error {
+	flags := c.flagSet()
+	scheme := flags.String("scheme", "hmac", "signed URL scheme: hmac, cloudflare or akamai")
+	key := flags.String("key", os.Getenv("MIDSERVE_SIGN_KEY"), "key to sign with, as for -sign-key; defaults to $MIDSERVE_SIGN_KEY")
+	ttl := flags.Duration("ttl", 24*time.Hour, "how long the signed URLs are valid")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	k, err := checkSignedURLs(*scheme, *key)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no paths given")
+	}
+
+	expires := time.Now().Add(*ttl)
+	for _, arg := range flags.Args() {
+		u, err := url.Parse(arg)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(u.Path, "/") {
+			u.Path = "/" + u.Path
+		}
+		q := signedURLSchemes[*scheme].sign(u.EscapedPath(), k, expires)
+		if u.RawQuery != "" {
+			q = u.RawQuery + "&" + q
+		}
+		u.RawQuery = q
+		fmt.Println(u)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package midserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var tokenCommand = &command{
+	name:  "token",
+	usage: "create|revoke|list [id|name ...]",
+	short: "manage the API keys of an -api-keys state file",
+	run:   runToken,
+}
+
+func runToken(c *command, args []string) error {
+	flags := c.flagSet()
+	file := flags.String("file", os.Getenv("MIDSERVE_API_KEYS"), "state file, as for -api-keys; defaults to $MIDSERVE_API_KEYS")
+	name := flags.String("name", "", "create: name of the key, reported as its principal")
+	var scopes []string
+	flags.Var(&stringsFlag{v: &scopes}, "scope", "create: grant ROLE below PREFIX, as PREFIX:ROLE such as /builds:upload; repeatable")
+	ttl := flags.Duration("ttl", 0, "create: how long the key is valid; 0 for no expiry")
+	rotate := flags.Bool("rotate", false, "create: revoke the keys of the same name, taking over their scopes unless -scope is given")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("missing action")
+	}
+	// Flags may also follow the action.
+	action := flags.Arg(0)
+	if err := parseFlags(flags, flags.Args()[1:]); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("no state file: requires -file or $MIDSERVE_API_KEYS")
+	}
+	st, err := readAPIKeys(*file)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "create":
+		if flags.NArg() > 0 {
+			return errors.New("create: unexpected arguments")
+		}
+		return createAPIKey(*file, st, *name, scopes, *ttl, *rotate)
+	case "revoke":
+		if flags.NArg() == 0 {
+			return errors.New("revoke: no keys given")
+		}
+		return revokeAPIKeys(*file, st, flags.Args())
+	case "list":
+		listAPIKeys(st)
+		return nil
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// parseScope parses a scope given as PREFIX:ROLE.
+func parseScope(s string) (GrantConfig, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return GrantConfig{}, fmt.Errorf("scope %q: not PREFIX:ROLE", s)
+	}
+	if _, err := parseRole(s[i+1:]); err != nil {
+		return GrantConfig{}, fmt.Errorf("scope %q: %v", s, err)
+	}
+	return GrantConfig{Prefix: path.Clean("/" + s[:i]), Role: s[i+1:]}, nil
+}
+
+func createAPIKey(file string, st *apiKeyState, name string, scopes []string, ttl time.Duration, rotate bool) error {
+	if name == "" {
+		return errors.New("create: requires -name")
+	}
+	var gcs []GrantConfig
+	for _, s := range scopes {
+		gc, err := parseScope(s)
+		if err != nil {
+			return err
+		}
+		gcs = append(gcs, gc)
+	}
+	var kept []apiKeyRecord
+	var revoked []string
+	for _, k := range st.Keys {
+		if k.Name != name {
+			kept = append(kept, k)
+			continue
+		}
+		if !rotate {
+			return fmt.Errorf("create: a key named %s exists; revoke it or use -rotate", name)
+		}
+		if len(scopes) == 0 && gcs == nil {
+			gcs = k.Scopes
+		}
+		revoked = append(revoked, k.ID)
+	}
+	if len(gcs) == 0 {
+		return errors.New("create: requires -scope")
+	}
+
+	key := apiKeyPrefix + randomHex(24)
+	sum := sha256.Sum256([]byte(key))
+	now := time.Now().UTC().Truncate(time.Second)
+	k := apiKeyRecord{ID: randomHex(4), Name: name, Hash: hex.EncodeToString(sum[:]), Scopes: gcs, Created: now}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		k.Expires = &expires
+	}
+	st.Keys = append(kept, k)
+	if err := writeAPIKeys(file, st); err != nil {
+		return err
+	}
+	for _, id := range revoked {
+		fmt.Fprintf(os.Stderr, "revoked %s\n", id)
+	}
+	fmt.Fprintf(os.Stderr, "created %s (%s); the key is shown only once:\n", k.ID, name)
+	fmt.Println(key)
+	return nil
+}
+
+// revokeAPIKeys removes the keys with the given IDs or names.
+func revokeAPIKeys(file string, st *apiKeyState, which []string) error {
+	match := make(map[string]bool)
+	for _, w := range which {
+		match[w] = false
+	}
+	var kept []apiKeyRecord
+	var revoked []string
+	for _, k := range st.Keys {
+		_, byID := match[k.ID]
+		_, byName := match[k.Name]
+		if !byID && !byName {
+			kept = append(kept, k)
+			continue
+		}
+		match[k.ID], match[k.Name] = true, true
+		revoked = append(revoked, k.ID)
+	}
+	for _, w := range which {
+		if !match[w] {
+			return fmt.Errorf("revoke: no key %s", w)
+		}
+	}
+	st.Keys = kept
+	if err := writeAPIKeys(file, st); err != nil {
+		return err
+	}
+	for _, id := range revoked {
+		fmt.Fprintf(os.Stderr, "revoked %s\n", id)
+	}
+	return nil
+}
+
+func listAPIKeys(st *apiKeyState) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tCREATED\tEXPIRES")
+	now := time.Now()
+	for _, k := range st.Keys {
+		var scopes []string
+		for _, gc := range k.Scopes {
+			scopes = append(scopes, gc.Prefix+":"+gc.Role)
+		}
+		expires := "never"
+		if k.Expires != nil {
+			expires = k.Expires.Format(time.RFC3339)
+			if k.expired(now) {
+				expires += " (expired)"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, strings.Join(scopes, ","), k.Created.Format(time.RFC3339), expires)
+	}
+	tw.Flush()
+}
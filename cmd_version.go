@@ -0,0 +1,36 @@
+package midserve
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is set at build time with
+// -ldflags "-X github.com/hellodword/midserve.version=v1.2.3".
+var version = ""
+
+var versionCommand = &command{
+	name:  "version",
+	short: "print the version",
+	run: func(c *command, args []string) error {
+		flags := c.flagSet()
+		if err := parseFlags(flags, args); err != nil {
+			return err
+		}
+		fmt.Printf("midserve %s %s %s/%s\n", buildVersion(), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		return nil
+	},
+}
+
+// buildVersion returns version, falling back to the module version
+// recorded by "go install".
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
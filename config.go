@@ -0,0 +1,1119 @@
+// Server configuration
+
+package midserve
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of the serve command.
+//
+// Settings are merged from DefaultConfig, the JSON file given with
+// -config, and the command line flags, later sources taking precedence.
+type Config struct {
+	Listen string `json:"listen"`
+	// IPVersion is 4, 6, or dual, the default.
+	IPVersion string `json:"ip_version,omitempty"`
+	// Connection tuning, zero values keep the defaults of net/http.
+	// A negative TCPKeepAlive disables keep-alive probes.
+	TCPKeepAlive      Duration `json:"tcp_keepalive,omitempty"`
+	ReusePort         bool     `json:"reuse_port,omitempty"`
+	Backlog           int      `json:"backlog,omitempty"`
+	ReadHeaderTimeout Duration `json:"read_header_timeout,omitempty"`
+	IdleTimeout       Duration `json:"idle_timeout,omitempty"`
+	// DrainTimeout is how long a process replaced on SIGUSR2 lets
+	// transfers in flight finish.
+	DrainTimeout Duration `json:"drain_timeout,omitempty"`
+	Root         string   `json:"root"`
+	Excludes     []string `json:"excludes"`
+	NoTransform  []string `json:"no_transform,omitempty"`
+	ErrorPages   string   `json:"error_pages,omitempty"`
+	// Errors is "terse", the default, or "descriptive" to include the
+	// cause in error responses. Descriptive can't be used with
+	// ErrorPages.
+	Errors string `json:"errors,omitempty"`
+	// Headers are set on every response, "Name:" alone removes one.
+	Headers []string `json:"headers,omitempty"`
+	// MaxTransfer aborts requests taking longer, zero means no limit.
+	MaxTransfer Duration `json:"max_transfer,omitempty"`
+	// FSTimeout fails file system operations taking longer with 504.
+	FSTimeout Duration `json:"fs_timeout,omitempty"`
+	// ReadBuffer and DropPageCache are in bytes, see Options.
+	ReadBuffer    int   `json:"read_buffer,omitempty"`
+	DropPageCache int64 `json:"drop_page_cache,omitempty"`
+	Workers       int   `json:"workers,omitempty"`
+	// Sort is the order of listings: lexical, natural or locale.
+	Sort string `json:"sort,omitempty"`
+	// Lang fixes the language of listings instead of following
+	// Accept-Language.
+	Lang string `json:"lang,omitempty"`
+	// Theme is light, dark or auto; CustomCSS is a file with CSS added
+	// to listings.
+	Theme     string `json:"theme,omitempty"`
+	CustomCSS string `json:"custom_css,omitempty"`
+	// CopyLinks adds copy buttons for URLs and curl/wget commands to
+	// listings; BaseURL is the URL they use for the root.
+	CopyLinks bool   `json:"copy_links,omitempty"`
+	BaseURL   string `json:"base_url,omitempty"`
+	// Write enables uploading, deleting and moving files through the
+	// API and the listings. It requires API.
+	Write bool `json:"write,omitempty"`
+	// ShortLinks is the file short links are stored in.
+	ShortLinks string `json:"short_links,omitempty"`
+	// MaxBodySize and MinBodyRate limit the request bodies of write
+	// endpoints.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	MinBodyRate int64 `json:"min_body_rate,omitempty"`
+	// MaxUploadSize limits the request bodies of uploads.
+	MaxUploadSize int64 `json:"max_upload_size,omitempty"`
+	// UploadPolicies can only be set in the configuration file.
+	UploadPolicies []UploadPolicyConfig `json:"upload_policies,omitempty"`
+	// MethodOverride honors X-HTTP-Method-Override on POST requests.
+	MethodOverride bool `json:"method_override,omitempty"`
+	// ETag is the entity tag policy: weak, strong or none.
+	ETag string `json:"etag,omitempty"`
+	// AdminToken enables /_admin/ for requests bearing it.
+	AdminToken string `json:"admin_token,omitempty"`
+	// ListingCache and ListingMaxStale control the caching of
+	// directory listings.
+	ListingCache    Duration `json:"listing_cache,omitempty"`
+	ListingMaxStale Duration `json:"listing_max_stale,omitempty"`
+	// ListingMaxEntries is the number of entries per listing page.
+	ListingMaxEntries int `json:"listing_max_entries,omitempty"`
+	// TransferCap limits the bytes sent to a client per TransferWindow.
+	TransferCap    int64    `json:"transfer_cap,omitempty"`
+	TransferWindow Duration `json:"transfer_window,omitempty"`
+	// FallbackProxy is the URL of an application server getting the
+	// requests no file matches.
+	FallbackProxy string `json:"fallback_proxy,omitempty"`
+	// CDN selects the headers for a CDN in front; CDNRules can only be
+	// set in the configuration file.
+	CDN      string          `json:"cdn,omitempty"`
+	CDNRules []CDNRuleConfig `json:"cdn_rules,omitempty"`
+	// SignedURLs is the scheme requests below SignedPrefixes, or all
+	// requests, must be signed with using SignKey.
+	SignedURLs     string   `json:"signed_urls,omitempty"`
+	SignKey        string   `json:"sign_key,omitempty"`
+	SignedPrefixes []string `json:"signed_prefixes,omitempty"`
+	// MinisignKey is the secret key file of signatures of files.
+	MinisignKey string `json:"minisign_key,omitempty"`
+	// Honeypots are decoy paths answered with HoneypotStatus whose
+	// clients are banned for HoneypotBan.
+	Honeypots      []string `json:"honeypots,omitempty"`
+	HoneypotStatus int      `json:"honeypot_status,omitempty"`
+	HoneypotBan    Duration `json:"honeypot_ban,omitempty"`
+	// GeoIP lists MaxMind DB files; GeoAllow and GeoDeny are country
+	// codes, "-" for unknown ones.
+	GeoIP    []string `json:"geoip,omitempty"`
+	GeoAllow []string `json:"geo_allow,omitempty"`
+	GeoDeny  []string `json:"geo_deny,omitempty"`
+	// Precompressed serves .br and .gz sidecars, as written by brotli
+	// and precompress.
+	Precompressed bool `json:"precompressed,omitempty"`
+	// AdaptiveCache keeps the files requested most in memory, up to
+	// HotCacheSize bytes.
+	AdaptiveCache bool  `json:"adaptive_cache"`
+	HotCacheSize  int64 `json:"hot_cache_size,omitempty"`
+	// RenderMarkdown serves .md files as HTML using MarkdownTemplate,
+	// a html/template file, or the built-in layout.
+	RenderMarkdown   bool   `json:"render_markdown,omitempty"`
+	MarkdownTemplate string `json:"markdown_template,omitempty"`
+	// SSIExts enables server-side includes for these extensions.
+	SSIExts []string `json:"ssi_exts,omitempty"`
+	// CacheDir holds derived files such as resized images.
+	CacheDir string `json:"cache_dir"`
+	// ImageCache is the former way to enable ResizeImages, with the
+	// cache directory in place of CacheDir.
+	ImageCache string `json:"image_cache,omitempty"`
+	TempDir    string `json:"tmp_dir,omitempty"`
+	// SharedCache coordinates the cache and the index with other
+	// processes using them.
+	SharedCache bool `json:"shared_cache,omitempty"`
+	// Archives enables zip downloads of directories, stream or spool.
+	Archives        string `json:"archives,omitempty"`
+	ArchiveMaxFiles int    `json:"archive_max_files,omitempty"`
+	ArchiveMaxBytes int64  `json:"archive_max_bytes,omitempty"`
+	// ArchiveNormalize fixes the times and modes of archived files.
+	ArchiveNormalize bool `json:"archive_normalize,omitempty"`
+	// Transliterate spells download file names in ASCII for old clients.
+	Transliterate bool `json:"transliterate,omitempty"`
+	// CrawlerLimit flags clients requesting more listing variants a
+	// minute; CrawlerBlock refuses them.
+	CrawlerLimit int  `json:"crawler_limit,omitempty"`
+	CrawlerBlock bool `json:"crawler_block,omitempty"`
+	// MaxInFlight sheds the requests of the classes in Shed, in order,
+	// as this many are in flight; zero sheds none.
+	MaxInFlight  int      `json:"max_in_flight,omitempty"`
+	Shed         []string `json:"shed,omitempty"`
+	ResizeImages bool     `json:"resize_images,omitempty"`
+	StripEXIF    bool     `json:"strip_exif,omitempty"`
+	HLS          bool     `json:"hls,omitempty"`
+	FFmpeg       string   `json:"ffmpeg,omitempty"`
+	LogViewer    bool     `json:"log_viewer,omitempty"`
+	PrettyViewer bool     `json:"pretty_viewer,omitempty"`
+	API          bool     `json:"api,omitempty"`
+	CAS          bool     `json:"cas,omitempty"`
+	Dev          bool     `json:"dev,omitempty"`
+	Changes      bool     `json:"changes,omitempty"`
+	DebugEcho    bool     `json:"debug_echo,omitempty"`
+	Tail         bool     `json:"tail,omitempty"`
+	// TailRate is the lines a second -tail sends each client; 0 for no
+	// limit.
+	TailRate int `json:"tail_rate,omitempty"`
+	// WatchInterval is how often the root is scanned for changes in
+	// -dev and -changes modes.
+	WatchInterval Duration `json:"watch_interval,omitempty"`
+	Growing       bool     `json:"growing,omitempty"`
+	Metafiles     bool     `json:"metafiles,omitempty"`
+	// Sitemap is the public base URL of the site, enabling /sitemap.xml.
+	Sitemap        string   `json:"sitemap,omitempty"`
+	SitemapRefresh Duration `json:"sitemap_refresh,omitempty"`
+	// Index is the file of the metadata index behind /_api/search,
+	// rescanned every IndexInterval.
+	Index         string   `json:"index,omitempty"`
+	IndexInterval Duration `json:"index_interval,omitempty"`
+	// PullFrom is the URL of another instance, with -api, to mirror
+	// every PullInterval at up to PullRate bytes per second.
+	PullFrom     string   `json:"pull_from,omitempty"`
+	PullInterval Duration `json:"pull_interval,omitempty"`
+	PullRate     int64    `json:"pull_rate,omitempty"`
+	PullConflict string   `json:"pull_conflict,omitempty"`
+	PullDelete   bool     `json:"pull_delete,omitempty"`
+	// PullDeleteMax is the most files a pull deletes, 0 for no limit.
+	PullDeleteMax int `json:"pull_delete_max,omitempty"`
+	// VerifyInterval enables re-hashing VerifyFraction of the indexed
+	// files that often, posting corrupt ones to VerifyWebhook.
+	VerifyInterval Duration `json:"verify_interval,omitempty"`
+	VerifyFraction float64  `json:"verify_fraction,omitempty"`
+	VerifyWebhook  string   `json:"verify_webhook,omitempty"`
+	// Bandwidth is the bytes per second of all responses together; 0
+	// for no limit. BandwidthSchedule can only be set in the
+	// configuration file.
+	Bandwidth         int64             `json:"bandwidth,omitempty"`
+	BandwidthSchedule []BandwidthConfig `json:"bandwidth_schedule,omitempty"`
+	// Journal is the file changes through the management API are
+	// recorded in.
+	Journal string `json:"journal,omitempty"`
+	// Retention can only be set in the configuration file.
+	Retention         []RetentionConfig `json:"retention,omitempty"`
+	RetentionInterval Duration          `json:"retention_interval,omitempty"`
+	RetentionDryRun   bool              `json:"retention_dry_run,omitempty"`
+	// Transforms can only be set in the configuration file.
+	Transforms []TransformConfig `json:"transforms,omitempty"`
+	// AccessWindows can only be set in the configuration file.
+	AccessWindows []AccessWindowConfig `json:"access_windows,omitempty"`
+	// ConcurrencyLimits can only be set in the configuration file.
+	ConcurrencyLimits []ConcurrencyLimitConfig `json:"concurrency_limits,omitempty"`
+	// Visibility can only be set in the configuration file.
+	Visibility []VisibilityConfig `json:"visibility,omitempty"`
+	// Principals and Anonymous can only be set in the configuration
+	// file. Without Anonymous, requests without a token may read
+	// everything.
+	Principals []PrincipalConfig `json:"principals,omitempty"`
+	Anonymous  []GrantConfig     `json:"anonymous,omitempty"`
+	// Sessions lets browsers sign in with a principal's token for
+	// SessionTTL.
+	Sessions   bool     `json:"sessions,omitempty"`
+	SessionTTL Duration `json:"session_ttl,omitempty"`
+	// APIKeys is the state file of "midserve token".
+	APIKeys string `json:"api_keys,omitempty"`
+
+	TLSCert string `json:"tls_cert,omitempty"`
+	TLSKey  string `json:"tls_key,omitempty"`
+	// RedirectHTTP is the address of a plain HTTP listener redirecting
+	// to HTTPS, only with TLS.
+	RedirectHTTP string `json:"redirect_http,omitempty"`
+	// CanonicalHost redirects requests for other host names to it.
+	CanonicalHost string `json:"canonical_host,omitempty"`
+	// Quiet suppresses the startup banner.
+	Quiet bool `json:"quiet,omitempty"`
+	// LogFormat is text, json, or auto for json unless on a terminal.
+	LogFormat string `json:"log_format,omitempty"`
+}
+
+// AccessWindowConfig configures an AccessWindow. NotBefore and NotAfter
+// are RFC 3339 timestamps, Daily is local time such as "09:00-17:00",
+// and Status defaults to 404.
+type AccessWindowConfig struct {
+	Prefix    string `json:"prefix"`
+	NotBefore string `json:"not_before,omitempty"`
+	NotAfter  string `json:"not_after,omitempty"`
+	Daily     string `json:"daily,omitempty"`
+	Status    int    `json:"status,omitempty"`
+}
+
+// VisibilityConfig configures a VisibilityRule. Mode is "unlisted" to
+// serve but not list, "unserved" to list but not serve, or "hidden".
+type VisibilityConfig struct {
+	Pattern string `json:"pattern"`
+	Mode    string `json:"mode"`
+}
+
+// PrincipalConfig configures a Principal.
+type PrincipalConfig struct {
+	Name   string        `json:"name"`
+	Token  string        `json:"token"`
+	Grants []GrantConfig `json:"grants"`
+}
+
+// GrantConfig configures a Grant. Role is none, read, upload, manage or
+// admin.
+type GrantConfig struct {
+	Prefix string `json:"prefix"`
+	Role   string `json:"role"`
+}
+
+// grants converts gcs to Grants.
+func grants(gcs []GrantConfig) ([]Grant, error) {
+	var gs []Grant
+	for _, gc := range gcs {
+		role, err := parseRole(gc.Role)
+		if err != nil {
+			return nil, fmt.Errorf("grant %s: %v", gc.Prefix, err)
+		}
+		gs = append(gs, Grant{Prefix: path.Clean("/" + gc.Prefix), Role: role})
+	}
+	return gs, nil
+}
+
+// CDNRuleConfig configures a CDNRule.
+type CDNRuleConfig struct {
+	Pattern          string   `json:"pattern"`
+	SurrogateControl string   `json:"surrogate_control,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+}
+
+// BandwidthConfig configures a BandwidthRule. Daily is local time such
+// as "09:00-17:00", Days a list such as "mon-fri" or "sat,sun", every
+// day if empty, and Rate bytes per second, 0 for no limit.
+type BandwidthConfig struct {
+	Daily string `json:"daily"`
+	Days  string `json:"days,omitempty"`
+	Rate  int64  `json:"rate"`
+}
+
+// RetentionConfig configures a RetentionRule. MaxAge is a duration such
+// as "720h" for 30 days, MaxSize a number of bytes.
+type RetentionConfig struct {
+	Prefix  string   `json:"prefix"`
+	MaxAge  Duration `json:"max_age,omitempty"`
+	Keep    int      `json:"keep,omitempty"`
+	MaxSize int64    `json:"max_size,omitempty"`
+}
+
+// UploadPolicyConfig configures an UploadPolicy.
+type UploadPolicyConfig struct {
+	Prefix    string   `json:"prefix"`
+	Exts      []string `json:"exts,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Lowercase bool     `json:"lowercase,omitempty"`
+	Rename    bool     `json:"rename,omitempty"`
+}
+
+// ConcurrencyLimitConfig configures a ConcurrencyLimit.
+type ConcurrencyLimitConfig struct {
+	Prefix string   `json:"prefix"`
+	Max    int      `json:"max"`
+	Wait   Duration `json:"wait,omitempty"`
+}
+
+// TransformConfig configures a CommandTransform, see TransformRule.
+type TransformConfig struct {
+	Name        string   `json:"name"`
+	Match       string   `json:"match"`
+	ContentType string   `json:"content_type"`
+	Command     []string `json:"command"`
+}
+
+// Duration is a time.Duration written as a string such as "1h30m" in
+// the configuration file.
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	*d = Duration(v)
+	return err
+}
+
+// defaultExcludes hides version control and editor metadata.
+var defaultExcludes = []string{
+	`^\.git`,
+	`^\.vscode`,
+	`^\.idea`,
+}
+
+// DefaultConfig returns the configuration used when no flags are given.
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:   ":8000",
+		Root:     ".",
+		CacheDir: defaultCacheDir(),
+
+		MaxBodySize: defaultMaxBody,
+		MinBodyRate: 1 << 10,
+
+		ListingMaxStale:   Duration(time.Minute),
+		ListingMaxEntries: 10000,
+		AdaptiveCache:     true,
+		HotCacheSize:      64 << 20,
+		ArchiveMaxFiles:   100000,
+		TransferWindow:    Duration(24 * time.Hour),
+
+		SitemapRefresh:    Duration(time.Hour),
+		DrainTimeout:      Duration(time.Hour),
+		IndexInterval:     Duration(10 * time.Minute),
+		VerifyFraction:    0.01,
+		PullInterval:      Duration(5 * time.Minute),
+		PullConflict:      "upstream",
+		PullDeleteMax:     100,
+		HoneypotStatus:    http.StatusNotFound,
+		SessionTTL:        Duration(12 * time.Hour),
+		TailRate:          100,
+		RetentionInterval: Duration(time.Hour),
+		Shed:              []string{ShedListings, ShedArchives, ShedAPI},
+		Excludes:          append([]string(nil), defaultExcludes...),
+	}
+}
+
+// LoadConfig reads the JSON configuration file name over c. Unknown
+// fields are an error, to catch typos before deployment.
+func (c *Config) LoadConfig(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// parseConfig parses the serve flags in args over DefaultConfig,
+// loading the configuration file given with -config first.
+func parseConfig(flags *flag.FlagSet, args []string) (*Config, error) {
+	cfg := DefaultConfig()
+	var file string
+	flags.StringVar(&file, "config", "", "JSON configuration file, overridden by environment variables and flags")
+	cfg.RegisterFlags(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return nil, err
+	}
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if !explicit["config"] {
+		file = os.Getenv(envName("config"))
+	}
+
+	// Environment variables override the file and flags override both,
+	// so load it into a fresh config and replay the other two.
+	cfg = DefaultConfig()
+	if file != "" {
+		if err := cfg.LoadConfig(file); err != nil {
+			return nil, err
+		}
+	}
+	replay := flag.NewFlagSet(flags.Name(), flag.ContinueOnError)
+	cfg.RegisterFlags(replay)
+	var err error
+	set := func(name string, values []string) {
+		for _, v := range values {
+			if err == nil {
+				err = replay.Set(name, v)
+			}
+		}
+	}
+	replay.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] {
+			return
+		}
+		values := []string{v}
+		if _, ok := f.Value.(*stringsFlag); ok {
+			values = strings.Split(v, ",")
+		}
+		set(f.Name, values)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), err)
+		}
+	})
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || replay.Lookup(f.Name) == nil {
+			return
+		}
+		values := []string{f.Value.String()}
+		if sf, ok := f.Value.(*stringsFlag); ok {
+			values = *sf.v
+		}
+		set(f.Name, values)
+	})
+	return cfg, err
+}
+
+// envName returns the environment variable setting the flag name, such
+// as MIDSERVE_CACHE_DIR for -cache-dir. Repeatable flags take a comma
+// separated list.
+func envName(name string) string {
+	return "MIDSERVE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// RegisterFlags defines flags on fs that set the fields of c.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address to listen on, e.g. :8000, 127.0.0.1:8000 or [::1]:8000")
+	fs.DurationVar((*time.Duration)(&c.TCPKeepAlive), "tcp-keepalive", time.Duration(c.TCPKeepAlive), "TCP keep-alive period, negative to disable")
+	fs.BoolVar(&c.ReusePort, "reuse-port", c.ReusePort, "set SO_REUSEPORT so that several processes can share the port (Linux)")
+	fs.IntVar(&c.Backlog, "backlog", c.Backlog, "listen backlog, capped by net.core.somaxconn (Linux)")
+	fs.DurationVar((*time.Duration)(&c.ReadHeaderTimeout), "read-header-timeout", time.Duration(c.ReadHeaderTimeout), "time allowed to read request headers")
+	fs.DurationVar((*time.Duration)(&c.IdleTimeout), "idle-timeout", time.Duration(c.IdleTimeout), "time an idle keep-alive connection is kept open")
+	fs.DurationVar((*time.Duration)(&c.DrainTimeout), "drain-timeout", time.Duration(c.DrainTimeout), "on SIGUSR2 a new process takes over the listeners; time the old one lets transfers in flight finish (Unix)")
+	fs.StringVar(&c.IPVersion, "ip-version", c.IPVersion, "IP versions to accept connections over: 4, 6 or dual")
+	fs.StringVar(&c.Root, "root", c.Root, "directory to serve")
+	fs.Var(&stringsFlag{v: &c.Excludes}, "exclude", "regexp of paths to hide, relative to the root; repeatable, replaces the defaults")
+	fs.Var(&stringsFlag{v: &c.NoTransform}, "no-transform", "regexp of paths, relative to the root, always served byte for byte as they are, never rendered, resized, stripped or compressed; repeatable")
+	fs.StringVar(&c.ErrorPages, "error-pages", c.ErrorPages, "directory with custom error pages named after the status code, e.g. 404.html")
+	fs.BoolVar(&c.Precompressed, "precompressed", c.Precompressed, "serve up-to-date .br and .gz sidecars to clients accepting Brotli or gzip; \"midserve precompress\" writes .gz ones, \"brotli -k\" .br ones")
+	fs.BoolVar(&c.AdaptiveCache, "adaptive-cache", c.AdaptiveCache, "keep the files of up to 1 MiB requested most in memory, with gzip variants for clients accepting gzip; -adaptive-cache=false to serve all from disk")
+	fs.Int64Var(&c.HotCacheSize, "hot-cache-size", c.HotCacheSize, "memory in bytes for the files kept by -adaptive-cache")
+	fs.BoolVar(&c.RenderMarkdown, "render-markdown", c.RenderMarkdown, "render markdown files as HTML, ?raw=1 serves the source")
+	fs.StringVar(&c.MarkdownTemplate, "markdown-template", c.MarkdownTemplate, "html/template file used as the layout of rendered markdown")
+	fs.StringVar(&c.Errors, "errors", c.Errors, "error responses: terse, or descriptive to include the cause; not with -error-pages")
+	fs.Var(&stringsFlag{v: &c.Headers}, "header", `header to set on every response, e.g. "Server: midserve", or "Name:" to remove it; repeatable`)
+	fs.DurationVar((*time.Duration)(&c.MaxTransfer), "max-transfer", time.Duration(c.MaxTransfer), "abort requests taking longer than this, e.g. 1h; 0 for no limit")
+	fs.DurationVar((*time.Duration)(&c.FSTimeout), "fs-timeout", time.Duration(c.FSTimeout), "reply 504 when opening a file or reading a directory takes longer than this, as on a stalled network file system; 0 for no limit")
+	fs.IntVar(&c.ReadBuffer, "read-buffer", c.ReadBuffer, "size in bytes of the buffer files are sent with")
+	fs.Int64Var(&c.DropPageCache, "drop-page-cache", c.DropPageCache, "drop files at least this many bytes large from the page cache as they are sent (Linux)")
+	fs.StringVar(&c.Sort, "sort", c.Sort, "order of listings: lexical, natural (file2 before file10) or locale (natural, case-insensitive)")
+	fs.StringVar(&c.Lang, "lang", c.Lang, "language of listings, e.g. de; negotiated from Accept-Language by default")
+	fs.StringVar(&c.Theme, "theme", c.Theme, "style of listings: light, dark or auto")
+	fs.StringVar(&c.CustomCSS, "custom-css", c.CustomCSS, "file with CSS added to listings")
+	fs.BoolVar(&c.CopyLinks, "copy-links", c.CopyLinks, "add buttons copying file URLs and curl/wget commands to listings")
+	fs.StringVar(&c.BaseURL, "base-url", c.BaseURL, "externally visible URL of the root, e.g. https://files.example.com; taken from requests by default")
+	fs.BoolVar(&c.Write, "write", c.Write, "allow uploading, deleting, moving and renaming files through the API, listings, PUT and DELETE; requires -api")
+	fs.StringVar(&c.ShortLinks, "short-links", c.ShortLinks, "serve short links /s/<id>, created with POST /_api/shorten?path=, storing them in this file")
+	fs.Int64Var(&c.MaxBodySize, "max-body-size", c.MaxBodySize, "largest request body in bytes accepted by endpoints that change files")
+	fs.Int64Var(&c.MinBodyRate, "min-body-rate", c.MinBodyRate, "cut off request bodies sent slower than this many bytes per second on average, after 10s; 0 for no limit")
+	fs.Int64Var(&c.MaxUploadSize, "max-upload-size", c.MaxUploadSize, "largest upload request body in bytes; 0 for no limit")
+	fs.BoolVar(&c.MethodOverride, "method-override", c.MethodOverride, "treat POST requests with X-HTTP-Method-Override: PUT or DELETE as using that method")
+	fs.StringVar(&c.ETag, "etag", c.ETag, "entity tags of files: weak (modification time and size), strong (SHA-256 of the content) or none")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "enable the endpoints under /_admin/, such as /_admin/purge, for requests with this bearer token")
+	fs.DurationVar((*time.Duration)(&c.ListingCache), "listing-cache", time.Duration(c.ListingCache), "cache directory listings for this long while the directory is unchanged; 0 to read it on every request")
+	fs.DurationVar((*time.Duration)(&c.ListingMaxStale), "listing-max-stale", time.Duration(c.ListingMaxStale), "serve expired cached listings for up to this much longer while refreshing them in the background")
+	fs.IntVar(&c.ListingMaxEntries, "listing-max-entries", c.ListingMaxEntries, "render listings in pages of this many entries, ?page=2 and on; 0 for no limit")
+	fs.Int64Var(&c.TransferCap, "transfer-cap", c.TransferCap, "bytes each principal, or client IP without one, may download per -transfer-window; 0 for no cap")
+	fs.DurationVar((*time.Duration)(&c.TransferWindow), "transfer-window", time.Duration(c.TransferWindow), "rolling window of -transfer-cap and the usage at /_admin/usage")
+	fs.StringVar(&c.FallbackProxy, "fallback-proxy", c.FallbackProxy, "proxy requests no file matches to this URL, e.g. http://backend:3000")
+	fs.StringVar(&c.CDN, "cdn", c.CDN, "add cache policy and tag headers for a CDN: generic, fastly, cloudflare or akamai")
+	fs.StringVar(&c.SignedURLs, "signed-urls", c.SignedURLs, "require URLs signed with -sign-key, as by \"midserve sign\": hmac, cloudflare or akamai (EdgeAuth tokens)")
+	fs.StringVar(&c.SignKey, "sign-key", c.SignKey, "key of -signed-urls; hex for akamai")
+	fs.StringVar(&c.MinisignKey, "minisign-key", c.MinisignKey, "minisign secret key file, not password-protected (minisign -G -W), to serve detached signatures of files as <file>.minisig and <file>.sig with; the public key is served as "+signingKeyPath)
+	fs.Var(&stringsFlag{v: &c.SignedPrefixes}, "signed-prefix", "require signed URLs only below this path, e.g. /private; repeatable")
+	fs.Var(&stringsFlag{v: &c.Honeypots}, "honeypot", "decoy path, such as /wp-admin or /.env, whose clients are logged and listed at /_admin/honeypots; repeatable")
+	fs.IntVar(&c.HoneypotStatus, "honeypot-status", c.HoneypotStatus, "status of responses to -honeypot paths: 404 or 403")
+	fs.DurationVar((*time.Duration)(&c.HoneypotBan), "honeypot-ban", time.Duration(c.HoneypotBan), "refuse all requests of clients that requested a -honeypot path for this long; 0 to only list them")
+	fs.Var(&stringsFlag{v: &c.GeoIP}, "geoip", "MaxMind DB file, such as GeoLite2-Country.mmdb or GeoLite2-ASN.mmdb, to tag events with the country and ASN of clients; repeatable")
+	fs.Var(&stringsFlag{v: &c.GeoAllow}, "geo-allow", "allow only clients from this country, an ISO code such as DE, or - for unknown ones; repeatable, requires -geoip")
+	fs.Var(&stringsFlag{v: &c.GeoDeny}, "geo-deny", "refuse clients from this country, an ISO code such as DE, or - for unknown ones; repeatable, requires -geoip")
+	fs.BoolVar(&c.Sessions, "sessions", c.Sessions, "let browsers sign in at /_login with the token of a principal or an API key, staying signed in with a cookie")
+	fs.DurationVar((*time.Duration)(&c.SessionTTL), "session-ttl", time.Duration(c.SessionTTL), "how long a browser stays signed in with -sessions")
+	fs.StringVar(&c.APIKeys, "api-keys", c.APIKeys, "accept the API keys of this state file, managed with \"midserve token\", as principals")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "number of background workers computing checksums, gzip variants of hot files and thumbnails of listed images")
+	fs.Var(&stringsFlag{v: &c.SSIExts}, "ssi", "expand server-side includes in files with this extension, e.g. .shtml; repeatable")
+	fs.StringVar(&c.CacheDir, "cache-dir", c.CacheDir, "directory to cache derived files such as resized images in")
+	fs.StringVar(&c.ImageCache, "image-cache", c.ImageCache, "deprecated: same as -resize-images -cache-dir")
+	fs.StringVar(&c.TempDir, "tmp-dir", c.TempDir, "directory to write cache files in before renaming them into -cache-dir, on the same file system; -cache-dir/.midserve-tmp by default")
+	fs.BoolVar(&c.SharedCache, "shared-cache", c.SharedCache, "coordinate with other processes using the same -cache-dir and -index, such as with -reuse-port, so that cache files and checksums one computes serve all")
+	fs.StringVar(&c.Archives, "archives", c.Archives, "serve directories as zip files with ?archive=zip: stream (no length) or spool (cached first, resumable)")
+	fs.IntVar(&c.ArchiveMaxFiles, "archive-max-files", c.ArchiveMaxFiles, "largest number of files in a zip of a directory; 0 for no limit")
+	fs.Int64Var(&c.ArchiveMaxBytes, "archive-max-bytes", c.ArchiveMaxBytes, "largest total size in bytes of the files in a zip of a directory; 0 for no limit")
+	fs.BoolVar(&c.Transliterate, "transliterate", c.Transliterate, "transliterate accented and Cyrillic letters in the ASCII file names of downloads (?download, zips) for old clients, instead of replacing them with _")
+	fs.BoolVar(&c.ArchiveNormalize, "archive-normalize", c.ArchiveNormalize, "give files in zips of directories a fixed time and mode, so that trees with the same names and contents zip to identical archives")
+	fs.IntVar(&c.CrawlerLimit, "crawler-limit", c.CrawlerLimit, "log clients requesting more than this many distinct query variants of listings a minute, such as looping crawlers; 0 to not track them")
+	fs.BoolVar(&c.CrawlerBlock, "crawler-block", c.CrawlerBlock, "reply 429 Too Many Requests to clients over -crawler-limit for the rest of the minute")
+	fs.IntVar(&c.MaxInFlight, "max-in-flight", c.MaxInFlight, "shed requests of the -shed classes as this many requests are in flight, replying 503 Service Unavailable; 0 to shed none")
+	fs.Var(&stringsFlag{v: &c.Shed}, "shed", "class of requests to shed under -max-in-flight, first shed first: "+strings.Join(ShedClasses[:], ", ")+"; repeatable, listings, archives and api by default")
+	fs.BoolVar(&c.ResizeImages, "resize-images", c.ResizeImages, "serve images scaled down to ?w= and ?h= with JPEG quality ?q=")
+	fs.BoolVar(&c.StripEXIF, "strip-exif", c.StripEXIF, "strip EXIF, XMP and IPTC metadata such as GPS locations from served JPEG and PNG images; HEIC and HEIF images, whose metadata isn't stripped, are refused")
+	fs.BoolVar(&c.HLS, "hls", c.HLS, "serve videos as HLS streams under <file>/hls/index.m3u8, packaged by ffmpeg on first access")
+	fs.StringVar(&c.FFmpeg, "ffmpeg", c.FFmpeg, "ffmpeg executable used by -hls")
+	fs.BoolVar(&c.LogViewer, "log-viewer", c.LogViewer, "offer ?view=log on .log and .txt files, following them live with ANSI colors")
+	fs.BoolVar(&c.PrettyViewer, "pretty-viewer", c.PrettyViewer, "offer ?view=pretty on .json and .yaml files, a collapsible highlighted tree")
+	fs.BoolVar(&c.API, "api", c.API, "enable the endpoints under /_api/, such as /_api/diff")
+	fs.BoolVar(&c.CAS, "cas", c.CAS, "serve immutable snapshots under /_cas/<sha256>, created with POST /_api/resolve?path=")
+	fs.StringVar(&c.Sitemap, "sitemap", c.Sitemap, "public base URL of the site, e.g. https://example.com/, enables a generated /sitemap.xml")
+	fs.DurationVar((*time.Duration)(&c.SitemapRefresh), "sitemap-refresh", time.Duration(c.SitemapRefresh), "how often the generated sitemap is refreshed")
+	fs.StringVar(&c.Index, "index", c.Index, "keep an index of the tree with checksums and download counts in this file, searchable at /_api/search; requires -api")
+	fs.DurationVar((*time.Duration)(&c.IndexInterval), "index-interval", time.Duration(c.IndexInterval), "how often -index rescans the tree for changes")
+	fs.DurationVar((*time.Duration)(&c.VerifyInterval), "verify-interval", time.Duration(c.VerifyInterval), "re-hash -verify-fraction of the files with a checksum in -index this often, reporting corrupt ones at /_admin/integrity; 0 to never")
+	fs.Float64Var(&c.VerifyFraction, "verify-fraction", c.VerifyFraction, "share of the indexed files re-hashed per -verify-interval, least recently verified first")
+	fs.StringVar(&c.VerifyWebhook, "verify-webhook", c.VerifyWebhook, "URL to POST a JSON report of each corrupt file found by -verify-interval to")
+	fs.StringVar(&c.PullFrom, "pull-from", c.PullFrom, "mirror the tree of another midserve with -api at this URL into the root, e.g. https://primary.example.com/")
+	fs.DurationVar((*time.Duration)(&c.PullInterval), "pull-interval", time.Duration(c.PullInterval), "how often -pull-from checks for changes")
+	fs.Int64Var(&c.PullRate, "pull-rate", c.PullRate, "bytes per second -pull-from downloads at; 0 for no limit")
+	fs.StringVar(&c.PullConflict, "pull-conflict", c.PullConflict, "which of a local and an upstream file that differ -pull-from keeps: upstream, newer or keep (local)")
+	fs.BoolVar(&c.PullDelete, "pull-delete", c.PullDelete, "delete local files missing upstream with -pull-from, unless -pull-conflict is keep")
+	fs.IntVar(&c.PullDeleteMax, "pull-delete-max", c.PullDeleteMax, "the most files -pull-delete deletes in one pull, refusing to delete any beyond; 0 for no limit")
+	fs.Int64Var(&c.Bandwidth, "bandwidth", c.Bandwidth, "bytes per second of all responses together, outside the bandwidth_schedule of the configuration file; 0 for no limit")
+	fs.StringVar(&c.Journal, "journal", c.Journal, "append uploads, deletions and moves through the API to this file, listed at /_admin/journal")
+	fs.DurationVar((*time.Duration)(&c.RetentionInterval), "retention-interval", time.Duration(c.RetentionInterval), "how often the retention rules of the configuration file delete old files")
+	fs.BoolVar(&c.RetentionDryRun, "retention-dry-run", c.RetentionDryRun, "only log what the retention rules would delete")
+	fs.BoolVar(&c.Dev, "dev", c.Dev, "development mode: reload HTML pages in the browser when files change")
+	fs.BoolVar(&c.Changes, "changes", c.Changes, "stream file changes below a directory at /_events?path=")
+	fs.BoolVar(&c.DebugEcho, "debug-echo", c.DebugEcho, "reflect requests at /_debug/echo: headers, client address, TLS and the route of the path after it; shows any client the headers proxies add")
+	fs.BoolVar(&c.Tail, "tail", c.Tail, "stream the lines appended to a text file at /_tail?path=, for following logs")
+	fs.IntVar(&c.TailRate, "tail-rate", c.TailRate, "lines per second -tail sends each client, dropping the rest; 0 for no limit")
+	fs.DurationVar((*time.Duration)(&c.WatchInterval), "watch-interval", time.Duration(c.WatchInterval), "how often to scan the root for changes with -dev and -changes")
+	fs.BoolVar(&c.Growing, "growing", c.Growing, "serve files still being written: ?follow=1 streams them as they grow, ?wait= holds ranges past the end")
+	fs.BoolVar(&c.Metafiles, "metafiles", c.Metafiles, "serve torrent and Metalink documents of files with ?format=torrent|metalink")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "PEM certificate file, enables HTTPS together with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "PEM private key file for -tls-cert")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log as text, json, or auto: json unless stdout is a terminal")
+	fs.BoolVar(&c.Quiet, "quiet", c.Quiet, "don't print the startup summary")
+	fs.StringVar(&c.RedirectHTTP, "redirect-http", c.RedirectHTTP, "address of a plain HTTP listener redirecting to HTTPS, e.g. :80")
+	fs.StringVar(&c.CanonicalHost, "canonical-host", c.CanonicalHost, "redirect requests for other host names, e.g. www.example.com, to this one")
+}
+
+// TLS reports whether c serves HTTPS.
+func (c *Config) TLS() bool {
+	return c.TLSCert != "" || c.TLSKey != ""
+}
+
+// Options compiles c into handler options.
+func (c *Config) Options() (Options, error) {
+	var opts Options
+	for _, expr := range c.Excludes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return Options{}, fmt.Errorf("exclude: %v", err)
+		}
+		opts.Excludes = append(opts.Excludes, re)
+	}
+	for _, expr := range c.NoTransform {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return Options{}, fmt.Errorf("no transform: %v", err)
+		}
+		opts.NoTransforms = append(opts.NoTransforms, re)
+	}
+	opts.Precompressed = c.Precompressed
+	if c.HotCacheSize < 0 {
+		return Options{}, errors.New("hot cache size: must not be negative")
+	}
+	if c.AdaptiveCache {
+		opts.HotCacheSize = c.HotCacheSize
+	}
+	opts.RenderMarkdown = c.RenderMarkdown
+	opts.CacheDir = c.CacheDir
+	if c.ImageCache != "" {
+		opts.CacheDir = c.ImageCache
+	}
+	if c.Archives != "" && !archiveModes[c.Archives] {
+		return Options{}, fmt.Errorf("archives: %q is neither stream nor spool", c.Archives)
+	}
+	opts.Archives = c.Archives
+	opts.ArchiveMaxFiles = c.ArchiveMaxFiles
+	opts.ArchiveMaxBytes = c.ArchiveMaxBytes
+	opts.ArchiveNormalize = c.ArchiveNormalize
+	opts.Transliterate = c.Transliterate
+	if c.CrawlerBlock && c.CrawlerLimit <= 0 {
+		return Options{}, errors.New("crawler block: requires -crawler-limit")
+	}
+	opts.CrawlerLimit = c.CrawlerLimit
+	opts.CrawlerBlock = c.CrawlerBlock
+	if c.MaxInFlight < 0 {
+		return Options{}, errors.New("max in flight: must not be negative")
+	}
+	opts.MaxInFlight = c.MaxInFlight
+	for _, s := range c.Shed {
+		for _, class := range strings.Split(s, ",") {
+			if !shedClass(class) {
+				return Options{}, fmt.Errorf("shed %q: not one of %s", class, strings.Join(ShedClasses[:], ", "))
+			}
+			opts.Shed = append(opts.Shed, class)
+		}
+	}
+	if c.TempDir != "" {
+		if err := checkTempDir(c.TempDir, opts.CacheDir); err != nil {
+			return Options{}, err
+		}
+		opts.TempDir = c.TempDir
+	}
+	if c.SharedCache && opts.CacheDir == "" {
+		return Options{}, errors.New("shared cache: requires -cache-dir")
+	}
+	opts.SharedCache = c.SharedCache
+	opts.ResizeImages = c.ResizeImages || c.ImageCache != ""
+	opts.StripEXIF = c.StripEXIF
+	opts.HLS = c.HLS
+	opts.LogViewer = c.LogViewer
+	opts.PrettyViewer = c.PrettyViewer
+	opts.API = c.API
+	opts.CAS = c.CAS
+	opts.Dev = c.Dev
+	opts.Changes = c.Changes
+	opts.DebugEcho = c.DebugEcho
+	opts.Tail = c.Tail
+	if c.TailRate < 0 {
+		return Options{}, errors.New("tail rate: must not be negative")
+	}
+	opts.TailRate = c.TailRate
+	opts.Growing = c.Growing
+	opts.Metafiles = c.Metafiles
+	opts.WatchInterval = time.Duration(c.WatchInterval)
+	if c.Index != "" && !c.API {
+		return Options{}, errors.New("index: requires -api")
+	}
+	if c.Index != "" && c.IndexInterval <= 0 {
+		return Options{}, errors.New("index interval: must be positive")
+	}
+	opts.Index = c.Index
+	opts.IndexInterval = time.Duration(c.IndexInterval)
+	if c.PullFrom != "" {
+		u, err := parsePullFrom(c.PullFrom)
+		if err != nil {
+			return Options{}, err
+		}
+		if !pullConflicts[c.PullConflict] {
+			return Options{}, fmt.Errorf("pull conflict: %q is not upstream, newer or keep", c.PullConflict)
+		}
+		if c.PullInterval <= 0 {
+			return Options{}, errors.New("pull interval: must be positive")
+		}
+		if c.PullDeleteMax < 0 {
+			return Options{}, errors.New("pull delete max: must not be negative")
+		}
+		opts.PullFrom = u
+		opts.PullInterval = time.Duration(c.PullInterval)
+		opts.PullRate = c.PullRate
+		opts.PullConflict = c.PullConflict
+		opts.PullDelete = c.PullDelete
+		opts.PullDeleteMax = c.PullDeleteMax
+	}
+	if c.VerifyInterval > 0 {
+		if c.Index == "" {
+			return Options{}, errors.New("verify interval: requires -index")
+		}
+		if c.VerifyFraction <= 0 || c.VerifyFraction > 1 {
+			return Options{}, errors.New("verify fraction: must be above 0 and at most 1")
+		}
+		if c.VerifyWebhook != "" {
+			if u, err := url.Parse(c.VerifyWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return Options{}, fmt.Errorf("verify webhook: %q is not an http or https URL", c.VerifyWebhook)
+			}
+		}
+		opts.VerifyInterval = time.Duration(c.VerifyInterval)
+		opts.VerifyFraction = c.VerifyFraction
+		opts.VerifyWebhook = c.VerifyWebhook
+	}
+	if c.Sitemap != "" {
+		u, err := url.Parse(c.Sitemap)
+		if err != nil || !u.IsAbs() {
+			return Options{}, fmt.Errorf("sitemap: %q is not an absolute URL", c.Sitemap)
+		}
+		if c.SitemapRefresh <= 0 {
+			return Options{}, errors.New("sitemap refresh: must be positive")
+		}
+		opts.SitemapBase = u
+		opts.SitemapRefresh = time.Duration(c.SitemapRefresh)
+	}
+	opts.FFmpeg = c.FFmpeg
+	for _, t := range c.Transforms {
+		if t.Name == "" || len(t.Command) == 0 {
+			return Options{}, errors.New("transform: name and command are required")
+		}
+		opts.Transforms = append(opts.Transforms, TransformRule{
+			Name:        t.Name,
+			Match:       t.Match,
+			ContentType: t.ContentType,
+			Transform:   CommandTransform(t.Command),
+		})
+	}
+	for _, wc := range c.AccessWindows {
+		aw, err := wc.window()
+		if err != nil {
+			return Options{}, fmt.Errorf("access window %s: %v", wc.Prefix, err)
+		}
+		opts.AccessWindows = append(opts.AccessWindows, aw)
+	}
+	for _, vc := range c.Visibility {
+		vr, err := vc.rule()
+		if err != nil {
+			return Options{}, err
+		}
+		opts.Visibility = append(opts.Visibility, vr)
+	}
+	tokens := make(map[string]bool)
+	for _, pc := range c.Principals {
+		if pc.Name == "" || pc.Token == "" {
+			return Options{}, errors.New("principal: name and token are required")
+		}
+		if tokens[pc.Token] || pc.Token == c.AdminToken {
+			return Options{}, fmt.Errorf("principal %s: token in use", pc.Name)
+		}
+		tokens[pc.Token] = true
+		gs, err := grants(pc.Grants)
+		if err != nil {
+			return Options{}, fmt.Errorf("principal %s: %v", pc.Name, err)
+		}
+		opts.Principals = append(opts.Principals, Principal{Name: pc.Name, Token: pc.Token, Grants: gs})
+	}
+	if c.Sessions && len(c.Principals) == 0 && c.APIKeys == "" {
+		return Options{}, errors.New("sessions: requires principals or -api-keys")
+	}
+	opts.APIKeys = c.APIKeys
+	opts.Sessions, opts.SessionTTL = c.Sessions, time.Duration(c.SessionTTL)
+	if c.Anonymous != nil {
+		gs, err := grants(c.Anonymous)
+		if err != nil {
+			return Options{}, fmt.Errorf("anonymous: %v", err)
+		}
+		// Non-nil, so that an empty list still means no access.
+		opts.Anonymous = append([]Grant{}, gs...)
+	} else {
+		opts.Anonymous = []Grant{{Prefix: "/", Role: RoleRead}}
+	}
+	for _, rc := range c.Retention {
+		if rc.MaxAge < 0 || rc.Keep < 0 || rc.MaxSize < 0 {
+			return Options{}, fmt.Errorf("retention %s: limits must not be negative", rc.Prefix)
+		}
+		if rc.MaxAge == 0 && rc.Keep == 0 && rc.MaxSize == 0 {
+			return Options{}, fmt.Errorf("retention %s: max_age, keep or max_size is required", rc.Prefix)
+		}
+		opts.Retention = append(opts.Retention, RetentionRule{
+			Prefix:  path.Clean("/" + rc.Prefix),
+			MaxAge:  time.Duration(rc.MaxAge),
+			Keep:    rc.Keep,
+			MaxSize: rc.MaxSize,
+		})
+	}
+	if len(c.Retention) > 0 && c.RetentionInterval <= 0 {
+		return Options{}, errors.New("retention interval: must be positive")
+	}
+	opts.Journal = c.Journal
+	if c.Bandwidth < 0 {
+		return Options{}, errors.New("bandwidth: must not be negative")
+	}
+	opts.Bandwidth = c.Bandwidth
+	for _, bc := range c.BandwidthSchedule {
+		br := BandwidthRule{Rate: bc.Rate}
+		var err error
+		if br.From, br.To, err = parseDaily(bc.Daily); err != nil {
+			return Options{}, fmt.Errorf("bandwidth schedule: %v", err)
+		}
+		if bc.Days != "" {
+			if br.Days, err = parseDays(bc.Days); err != nil {
+				return Options{}, fmt.Errorf("bandwidth schedule %s: %v", bc.Daily, err)
+			}
+		}
+		if br.Rate < 0 {
+			return Options{}, fmt.Errorf("bandwidth schedule %s: rate must not be negative", bc.Daily)
+		}
+		opts.BandwidthSchedule = append(opts.BandwidthSchedule, br)
+	}
+	opts.RetentionInterval = time.Duration(c.RetentionInterval)
+	opts.RetentionDryRun = c.RetentionDryRun
+	for _, lc := range c.ConcurrencyLimits {
+		if lc.Max <= 0 {
+			return Options{}, fmt.Errorf("concurrency limit %s: max must be positive", lc.Prefix)
+		}
+		opts.ConcurrencyLimits = append(opts.ConcurrencyLimits, ConcurrencyLimit{
+			Prefix: path.Clean("/" + lc.Prefix),
+			Max:    lc.Max,
+			Wait:   time.Duration(lc.Wait),
+		})
+	}
+	for _, ext := range c.SSIExts {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		opts.SSIExts = append(opts.SSIExts, strings.ToLower(ext))
+	}
+	if c.MarkdownTemplate != "" {
+		t, err := template.ParseFiles(c.MarkdownTemplate)
+		if err != nil {
+			return Options{}, fmt.Errorf("markdown template: %v", err)
+		}
+		opts.MarkdownTemplate = t
+	}
+	opts.MaxTransfer = time.Duration(c.MaxTransfer)
+	if c.FSTimeout < 0 {
+		return Options{}, errors.New("fs timeout: must not be negative")
+	}
+	opts.FSTimeout = time.Duration(c.FSTimeout)
+	opts.ReadBuffer = c.ReadBuffer
+	opts.DropPageCache = c.DropPageCache
+	opts.Workers = c.Workers
+	if _, err := nameOrder(c.Sort); err != nil {
+		return Options{}, err
+	}
+	opts.Sort = c.Sort
+	if err := checkLang(c.Lang); err != nil {
+		return Options{}, err
+	}
+	opts.Lang = c.Lang
+	if err := checkTheme(c.Theme); err != nil {
+		return Options{}, err
+	}
+	opts.Theme = c.Theme
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return Options{}, fmt.Errorf("base-url: %q is not an absolute http(s) URL", c.BaseURL)
+		}
+	}
+	opts.CopyLinks = c.CopyLinks
+	opts.BaseURL = c.BaseURL
+	if c.Write && !c.API {
+		return Options{}, errors.New("write: requires -api")
+	}
+	opts.Write = c.Write
+	opts.ShortLinks = c.ShortLinks
+	opts.MaxBodySize = c.MaxBodySize
+	opts.MinBodyRate = c.MinBodyRate
+	opts.MaxUploadSize = c.MaxUploadSize
+	for _, pc := range c.UploadPolicies {
+		p := UploadPolicy{Prefix: path.Clean("/" + pc.Prefix), Lowercase: pc.Lowercase, Rename: pc.Rename}
+		for _, ext := range pc.Exts {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			p.Exts = append(p.Exts, strings.ToLower(ext))
+		}
+		if pc.Pattern != "" {
+			re, err := regexp.Compile(pc.Pattern)
+			if err != nil {
+				return Options{}, fmt.Errorf("upload policy %s: %v", pc.Prefix, err)
+			}
+			p.Pattern = re
+		}
+		opts.UploadPolicies = append(opts.UploadPolicies, p)
+	}
+	opts.MethodOverride = c.MethodOverride
+	if err := checkETagPolicy(c.ETag); err != nil {
+		return Options{}, err
+	}
+	opts.ETag = c.ETag
+	opts.AdminToken = c.AdminToken
+	opts.ListingCache = time.Duration(c.ListingCache)
+	opts.ListingMaxStale = time.Duration(c.ListingMaxStale)
+	opts.ListingMaxEntries = c.ListingMaxEntries
+	opts.TransferCap = c.TransferCap
+	opts.TransferWindow = time.Duration(c.TransferWindow)
+	if err := checkCDN(c.CDN); err != nil {
+		return Options{}, err
+	}
+	opts.CDN = c.CDN
+	for _, rc := range c.CDNRules {
+		re, err := regexp.Compile(rc.Pattern)
+		if err != nil {
+			return Options{}, fmt.Errorf("cdn rule: %v", err)
+		}
+		opts.CDNRules = append(opts.CDNRules, CDNRule{Pattern: re, SurrogateControl: rc.SurrogateControl, Tags: rc.Tags})
+	}
+	key, err := checkSignedURLs(c.SignedURLs, c.SignKey)
+	if err != nil {
+		return Options{}, err
+	}
+	opts.SignedURLs, opts.SignKey = c.SignedURLs, key
+	for _, p := range c.SignedPrefixes {
+		opts.SignedPrefixes = append(opts.SignedPrefixes, path.Clean("/"+p))
+	}
+	if c.MinisignKey != "" {
+		k, err := LoadMinisignKey(c.MinisignKey)
+		if err != nil {
+			return Options{}, fmt.Errorf("minisign key: %v", err)
+		}
+		opts.MinisignKey = k
+	}
+	if c.HoneypotStatus != http.StatusNotFound && c.HoneypotStatus != http.StatusForbidden {
+		return Options{}, fmt.Errorf("honeypot status: %d is neither 404 nor 403", c.HoneypotStatus)
+	}
+	for _, p := range c.Honeypots {
+		opts.Honeypots = append(opts.Honeypots, path.Clean("/"+p))
+	}
+	opts.HoneypotStatus = c.HoneypotStatus
+	opts.HoneypotBan = time.Duration(c.HoneypotBan)
+	if len(c.GeoIP) == 0 && len(c.GeoAllow)+len(c.GeoDeny) > 0 {
+		return Options{}, errors.New("geo allow and deny: require -geoip")
+	}
+	for _, f := range c.GeoIP {
+		db, err := OpenMMDB(f)
+		if err != nil {
+			return Options{}, fmt.Errorf("geoip: %v", err)
+		}
+		opts.GeoIP = append(opts.GeoIP, db)
+	}
+	opts.GeoAllow, opts.GeoDeny = c.GeoAllow, c.GeoDeny
+	if c.FallbackProxy != "" {
+		u, err := parseFallbackProxy(c.FallbackProxy)
+		if err != nil {
+			return Options{}, err
+		}
+		opts.FallbackProxy = u
+	}
+	if c.CustomCSS != "" {
+		css, err := os.ReadFile(c.CustomCSS)
+		if err != nil {
+			return Options{}, err
+		}
+		opts.CustomCSS = string(css)
+	}
+	switch c.Errors {
+	case "", "terse":
+	case "descriptive":
+		opts.ErrorHandler = DescriptiveErrorHandler
+	default:
+		return Options{}, fmt.Errorf("errors: %q is neither terse nor descriptive", c.Errors)
+	}
+	if c.ErrorPages != "" {
+		if c.Errors == "descriptive" {
+			return Options{}, errors.New("errors: descriptive can't be combined with error_pages, which replace the responses")
+		}
+		opts.ErrorHandler = ErrorPages(Dir(c.ErrorPages))
+	}
+	for _, h := range c.Headers {
+		i := strings.Index(h, ":")
+		if i <= 0 {
+			return Options{}, fmt.Errorf("header: %q is not of the form Name: value", h)
+		}
+		if opts.Headers == nil {
+			opts.Headers = make(http.Header)
+		}
+		opts.Headers.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	return opts, nil
+}
+
+// Validate checks c for errors that would otherwise only surface while
+// serving: missing directories and unusable certificates.
+func (c *Config) Validate() error {
+	if _, err := c.Options(); err != nil {
+		return err
+	}
+	if _, err := listenNetwork(c.IPVersion); err != nil {
+		return err
+	}
+	if _, err := normalizeListen(c.Listen); err != nil {
+		return err
+	}
+	if c.RedirectHTTP != "" {
+		if _, err := normalizeListen(c.RedirectHTTP); err != nil {
+			return fmt.Errorf("redirect-http: %v", err)
+		}
+	}
+	if err := checkDir("root", c.Root); err != nil {
+		return err
+	}
+	if c.ErrorPages != "" {
+		if err := checkDir("error pages", c.ErrorPages); err != nil {
+			return err
+		}
+	}
+	if c.TLSCert == "" != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be given together")
+	}
+	if c.RedirectHTTP != "" && !c.TLS() {
+		return errors.New("redirect-http requires tls-cert and tls-key")
+	}
+	if c.TLS() {
+		if _, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey); err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+	}
+	return nil
+}
+
+func checkDir(what, name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: %s is not a directory", what, name)
+	}
+	return nil
+}
+
+// Handler returns the file server described by c.
+func (c *Config) Handler() (http.Handler, error) {
+	opts, err := c.Options()
+	if err != nil {
+		return nil, err
+	}
+	h := NewFileServer(Dir(c.Root), opts)
+	if c.CanonicalHost != "" {
+		h = CanonicalHost(c.CanonicalHost, h)
+	}
+	return h, nil
+}
+
+func (wc AccessWindowConfig) window() (AccessWindow, error) {
+	aw := AccessWindow{Prefix: path.Clean("/" + wc.Prefix), Status: wc.Status}
+	var err error
+	if wc.NotBefore != "" {
+		if aw.NotBefore, err = time.Parse(time.RFC3339, wc.NotBefore); err != nil {
+			return aw, err
+		}
+	}
+	if wc.NotAfter != "" {
+		if aw.NotAfter, err = time.Parse(time.RFC3339, wc.NotAfter); err != nil {
+			return aw, err
+		}
+	}
+	if wc.Daily != "" {
+		aw.Daily = true
+		if aw.From, aw.To, err = parseDaily(wc.Daily); err != nil {
+			return aw, err
+		}
+	}
+	switch aw.Status {
+	case 0:
+		aw.Status = http.StatusNotFound
+	case http.StatusNotFound, http.StatusForbidden:
+	default:
+		return aw, errors.New("status must be 403 or 404")
+	}
+	return aw, nil
+}
+
+// stringsFlag is a repeatable flag. The first use replaces the default
+// value, later uses append to it.
+type stringsFlag struct {
+	v   *[]string
+	set bool
+}
+
+func (s *stringsFlag) String() string {
+	if s == nil || s.v == nil {
+		return ""
+	}
+	return strings.Join(*s.v, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	if !s.set {
+		*s.v = nil
+		s.set = true
+	}
+	*s.v = append(*s.v, v)
+	return nil
+}
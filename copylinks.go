@@ -0,0 +1,62 @@
+// Copy-link and download snippet buttons in listings
+
+package midserve
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// baseURL returns the externally visible URL of the root for r: the
+// configured base URL, or else the one the client used to reach us.
+func (fh *fileHandler) baseURL(r *http.Request) string {
+	if fh.publicURL != "" {
+		return fh.publicURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// copyLinksScript adds buttons after every file in a listing that copy
+// its URL, or a curl or wget command downloading it, to the clipboard.
+// With short links, a further button copies the short link of the file.
+// The live listing calls copyLinks for entries it adds.
+const copyLinksScript = `<script>(function(){
+var dir="%s",base="%s",root="%s",short=%t,labels={link:"%s",short:"%s",copied:"%s"},pre=document.querySelector("pre");
+function csrf(){var m=document.cookie.match(/(?:^|; )` + csrfCookie + `=([^;]*)/);return m?m[1]:""}
+function q(s){return "'"+s.replace(/'/g,"'\\''")+"'"}
+function button(label,text,name){var b=document.createElement("button");b.type="button";b.textContent=label;
+b.setAttribute("aria-label",label+": "+name);
+b.onclick=function(){(typeof text==="function"?text():Promise.resolve(text)).then(function(t){
+return navigator.clipboard.writeText(t)}).then(function(){b.textContent=labels.copied;
+setTimeout(function(){b.textContent=label},1500)})};return b}
+window.copyLinks=function(a){var name=a.textContent;if(name.slice(-1)==="/")return;
+var url=base+a.getAttribute("href"),s=document.createElement("span");
+s.appendChild(document.createTextNode(" "));s.appendChild(button(labels.link,url,name));
+if(short)s.appendChild(button(labels.short,function(){return fetch("` + apiPrefix + `shorten?path="+encodeURIComponent(dir+name),
+{method:"POST",headers:{"X-CSRF-Token":csrf()}})
+.then(function(r){return r.json()}).then(function(d){if(d.error)throw d.error;return root.replace(/\/$/,"")+d.url})},name));
+s.appendChild(button("curl","curl -fL -o "+q(name)+" "+q(url),name));
+s.appendChild(button("wget","wget -O "+q(name)+" "+q(url),name));
+a.parentNode.insertBefore(s,a.nextSibling)};
+if(!navigator.clipboard)return;
+var as=pre.getElementsByTagName("a");for(var i=as.length-1;i>=0;i--)copyLinks(as[i]);
+})();</script>
+`
+
+// writeCopyLinks writes the script adding copy buttons to the listing of
+// dir.
+func (fh *fileHandler) writeCopyLinks(w io.Writer, r *http.Request, dir string, msgs messages) {
+	dir = strings.TrimSuffix(dir, "/") + "/"
+	base := fh.baseURL(r) + (&url.URL{Path: dir}).EscapedPath()
+	fmt.Fprintf(w, copyLinksScript, template.JSEscapeString(dir), template.JSEscapeString(base), template.JSEscapeString(fh.baseURL(r)+"/"),
+		fh.shortLinks != nil && fh.api, template.JSEscapeString(msgs.t("copy link")),
+		template.JSEscapeString(msgs.t("short link")), template.JSEscapeString(msgs.t("copied")))
+}
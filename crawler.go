@@ -0,0 +1,93 @@
+// Protection against crawlers looping through listing URLs
+
+package midserve
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// crawlerWindow is the period over which the listing URLs requested by
+// a client are counted.
+const crawlerWindow = time.Minute
+
+// crawlerGuard notices clients requesting more than limit distinct
+// query variants of listings per crawlerWindow, as crawlers do that
+// follow every page, archive and sort link without end. With block,
+// such clients get 429 Too Many Requests for the rest of the window.
+type crawlerGuard struct {
+	limit int
+	block bool
+
+	mu      sync.Mutex
+	clients map[string]*crawlerClient
+	swept   time.Time
+}
+
+// crawlerClient is the listing URLs one client requested in the
+// current window.
+type crawlerClient struct {
+	start    time.Time
+	variants map[string]bool
+	flagged  bool
+}
+
+func newCrawlerGuard(limit int, block bool) *crawlerGuard {
+	return &crawlerGuard{limit: limit, block: block, clients: make(map[string]*crawlerClient)}
+}
+
+// see records the request r for a listing and reports whether it is
+// one variant too many; flagged is true the first time it is.
+func (cg *crawlerGuard) see(r *http.Request) (over, flagged bool) {
+	if r.URL.RawQuery == "" {
+		// The plain listing is what every visitor asks for.
+		return false, false
+	}
+	now := time.Now()
+	host := clientAddr(r)
+	cg.mu.Lock()
+	defer cg.mu.Unlock()
+	if now.Sub(cg.swept) > crawlerWindow {
+		for k, c := range cg.clients {
+			if now.Sub(c.start) > crawlerWindow {
+				delete(cg.clients, k)
+			}
+		}
+		cg.swept = now
+	}
+	c := cg.clients[host]
+	if c == nil || now.Sub(c.start) > crawlerWindow {
+		c = &crawlerClient{start: now, variants: make(map[string]bool)}
+		cg.clients[host] = c
+	}
+	if len(c.variants) <= cg.limit {
+		// Beyond the limit, only whether it was exceeded matters.
+		c.variants[r.URL.Path+"?"+r.URL.RawQuery] = true
+	}
+	if len(c.variants) <= cg.limit {
+		return false, false
+	}
+	flagged = !c.flagged
+	c.flagged = true
+	return true, flagged
+}
+
+// checkCrawler records the request r for the listing of name, logging
+// clients found looping and, when blocking, replying with 429 Too Many
+// Requests and returning false.
+func (fh *fileHandler) checkCrawler(w http.ResponseWriter, r *http.Request, name string) bool {
+	cg := fh.crawlers
+	if cg == nil {
+		return true
+	}
+	over, flagged := cg.see(r)
+	if flagged {
+		logf(r, "crawler: %s requested over %d listing variants within %v", clientAddr(r), cg.limit, crawlerWindow)
+	}
+	if !over || !cg.block {
+		return true
+	}
+	fh.overloaded(w, r, name, http.StatusTooManyRequests, "too many listing variants", int(crawlerWindow/time.Second), nil)
+	return false
+}
@@ -0,0 +1,114 @@
+// Context-aware file system access
+
+package midserve
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+)
+
+// A ContextFileSystem is a FileSystem whose Open can be bound to a
+// context, typically the context of the request being served.
+//
+// FileSystems that don't implement it are wrapped by contextFS, which
+// checks the context before each operation so that work on behalf of a
+// disconnected client stops at the next Open, Read, Stat or Readdir.
+type ContextFileSystem interface {
+	http.FileSystem
+	OpenContext(ctx context.Context, name string) (http.File, error)
+}
+
+// OpenContext implements ContextFileSystem. The returned File fails
+// with ctx.Err() once ctx is done.
+func (d Dir) OpenContext(ctx context.Context, name string) (http.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := d.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return newContextFile(ctx, f), nil
+}
+
+// openContext opens name from hfs on behalf of ctx.
+func openContext(ctx context.Context, hfs http.FileSystem, name string) (http.File, error) {
+	if cfs, ok := hfs.(ContextFileSystem); ok {
+		return cfs.OpenContext(ctx, name)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := hfs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return newContextFile(ctx, f), nil
+}
+
+// contextFile is an http.File whose operations fail once ctx is done.
+type contextFile struct {
+	http.File
+	ctx context.Context
+}
+
+// contextDirFile is a contextFile whose underlying file supports
+// fs.ReadDirFile, so dirList can keep using the cheaper ReadDir.
+type contextDirFile struct {
+	*contextFile
+	rd fs.ReadDirFile
+}
+
+func newContextFile(ctx context.Context, f http.File) http.File {
+	cf := &contextFile{File: f, ctx: ctx}
+	if rd, ok := f.(fs.ReadDirFile); ok {
+		return &contextDirFile{cf, rd}
+	}
+	return cf
+}
+
+func (f *contextFile) Read(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *contextFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *contextFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if err := f.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.File.Readdir(count)
+}
+
+func (f *contextFile) Stat() (fs.FileInfo, error) {
+	if err := f.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.File.Stat()
+}
+
+// copyN keeps sendfile available for the underlying file, which only
+// sees the context when sending starts.
+func (f *contextFile) copyN(w io.Writer, n int64) (int64, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return copyFileN(w, f.File, n)
+}
+
+func (f *contextDirFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	if err := f.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.rd.ReadDir(count)
+}
@@ -0,0 +1,196 @@
+// Echo of requests, for debugging proxies and rewrites
+
+package midserve
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// debugEchoPath is the URL path of the echo. Below it, the rest of the
+// path is the one to report the route and policies of.
+const debugEchoPath = "/_debug/echo"
+
+// redactedHeaders are the headers whose values the echo leaves out.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// echoTLS is what the echo reports about the TLS connection.
+type echoTLS struct {
+	Version    string `json:"version"`
+	Cipher     string `json:"cipher"`
+	ALPN       string `json:"alpn,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+	Resumed    bool   `json:"resumed"`
+	ClientCert string `json:"client_cert,omitempty"`
+}
+
+// echoPolicy is what the echo reports about how a path is served to
+// the client.
+type echoPolicy struct {
+	Path       string   `json:"path"`
+	Route      string   `json:"route"`
+	Honeypot   bool     `json:"honeypot,omitempty"`
+	GeoAllowed *bool    `json:"geo_allowed,omitempty"`
+	Role       string   `json:"role,omitempty"`
+	Signed     bool     `json:"signed_url_required,omitempty"`
+	Served     bool     `json:"served"`
+	Listed     bool     `json:"listed"`
+	Window     string   `json:"access_window,omitempty"`
+	Limits     []string `json:"concurrency_limits,omitempty"`
+}
+
+// route names the handler ServeHTTP passes a request for name to,
+// following its order.
+func (fh *fileHandler) route(name string) string {
+	switch {
+	case fh.sessions != nil && name == loginPath:
+		return "login"
+	case fh.sessions != nil && name == logoutPath:
+		return "logout"
+	case fh.perms != nil && name == whoamiPath:
+		return "whoami"
+	case fh.debugEcho && underPrefix(name, debugEchoPath):
+		return "debug echo"
+	case fh.api && strings.HasPrefix(name, apiPrefix):
+		return "api " + strings.TrimPrefix(name, apiPrefix)
+	case (fh.adminToken != "" || fh.perms != nil) && strings.HasPrefix(name, adminPrefix):
+		return "admin " + strings.TrimPrefix(name, adminPrefix)
+	case fh.shortLinks != nil && strings.HasPrefix(name, shortLinkPrefix):
+		return "short link"
+	case fh.changes && name == changesPath:
+		return "changes"
+	case fh.tail && name == tailPath:
+		return "tail"
+	case fh.dev && name == devReloadPath:
+		return "dev reload"
+	case fh.sitemap != nil && name == sitemapPath:
+		return "sitemap"
+	case fh.cas && strings.HasPrefix(name, casPrefix):
+		return "cas"
+	case fh.hls != nil && hlsPathRe.MatchString(name):
+		return "hls"
+	}
+	return "file"
+}
+
+// policy returns how name is served to the client of r.
+func (fh *fileHandler) policy(r *http.Request, name string) echoPolicy {
+	p := echoPolicy{Path: name, Route: fh.route(name)}
+	if fh.honeypots != nil {
+		p.Honeypot = fh.honeypots.match(name)
+	}
+	if fh.geoip != nil {
+		allowed := fh.geoip.allowed(geoOf(r).Country)
+		p.GeoAllowed = &allowed
+	}
+	if fh.perms != nil {
+		p.Role = fh.perms.role(principal(r), name).String()
+	}
+	p.Signed = fh.signed(name)
+	p.Served, p.Listed = !fh.denied(name), fh.listed(name)
+	if fh.closedWindow(name) != nil {
+		p.Window = "closed"
+	}
+	for _, l := range fh.limiters {
+		if underPrefix(name, l.Prefix) {
+			p.Limits = append(p.Limits, fmt.Sprintf("%s: %d", l.Prefix, l.Max))
+		}
+	}
+	return p
+}
+
+// serveDebugEcho implements /_debug/echo, reflecting the request as it
+// reached the server: its headers and their size, the client address,
+// the TLS connection, and the route and policies of the path following
+// /_debug/echo, the root if there is none.
+func (fh *fileHandler) serveDebugEcho(w http.ResponseWriter, r *http.Request, name string) {
+	w.Header().Set("Cache-Control", "no-store")
+	var body int64
+	if r.Method == "POST" {
+		n, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, defaultMaxBody))
+		if err != nil {
+			apiError(w, err, http.StatusRequestEntityTooLarge)
+			return
+		}
+		body = n
+	}
+
+	headers := make(map[string][]string, len(r.Header))
+	headerBytes := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	for k, vs := range r.Header {
+		headers[k] = vs
+		for _, v := range vs {
+			headerBytes += len(k) + len(v) + 4
+		}
+	}
+	if r.Host != "" {
+		headerBytes += len("Host") + len(r.Host) + 4
+	}
+	for _, k := range redactedHeaders {
+		if vs, ok := headers[k]; ok {
+			red := make([]string, len(vs))
+			for i, v := range vs {
+				red[i] = fmt.Sprintf("[redacted, %d bytes]", len(v))
+			}
+			headers[k] = red
+		}
+	}
+
+	echo := struct {
+		Method        string              `json:"method"`
+		URI           string              `json:"uri"`
+		Host          string              `json:"host"`
+		Proto         string              `json:"proto"`
+		Headers       map[string][]string `json:"headers"`
+		HeaderBytes   int                 `json:"header_bytes"`
+		ContentLength int64               `json:"content_length"`
+		BodyBytes     int64               `json:"body_bytes"`
+		RemoteAddr    string              `json:"remote_addr"`
+		Client        string              `json:"client"`
+		Country       string              `json:"country,omitempty"`
+		ASN           uint32              `json:"asn,omitempty"`
+		TLS           *echoTLS            `json:"tls,omitempty"`
+		RequestID     string              `json:"request_id,omitempty"`
+		Principal     string              `json:"principal,omitempty"`
+		Time          time.Time           `json:"time"`
+		Policy        echoPolicy          `json:"policy"`
+	}{
+		Method:        r.Method,
+		URI:           r.RequestURI,
+		Host:          r.Host,
+		Proto:         r.Proto,
+		Headers:       headers,
+		HeaderBytes:   headerBytes,
+		ContentLength: r.ContentLength,
+		BodyBytes:     body,
+		RemoteAddr:    r.RemoteAddr,
+		Client:        clientAddr(r),
+		Country:       geoOf(r).Country,
+		ASN:           geoOf(r).ASN,
+		RequestID:     requestID(r),
+		Principal:     principalName(r),
+		Time:          time.Now().UTC(),
+	}
+	if cs := r.TLS; cs != nil {
+		echo.TLS = &echoTLS{
+			Version:    tls.VersionName(cs.Version),
+			Cipher:     tls.CipherSuiteName(cs.CipherSuite),
+			ALPN:       cs.NegotiatedProtocol,
+			ServerName: cs.ServerName,
+			Resumed:    cs.DidResume,
+		}
+		if len(cs.PeerCertificates) > 0 {
+			echo.TLS.ClientCert = cs.PeerCertificates[0].Subject.String()
+		}
+	}
+	target := strings.TrimPrefix(name, debugEchoPath)
+	if target == "" {
+		target = "/"
+	}
+	echo.Policy = fh.policy(r, target)
+	writeJSON(w, r, echo)
+}
@@ -0,0 +1,75 @@
+// Development mode with live reload
+
+package midserve
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// devReloadPath is the event stream telling pages to reload.
+const devReloadPath = "/_dev/reload"
+
+// devReloadScript is injected into HTML pages in development mode.
+const devReloadScript = `<script>(function(){var es=new EventSource("` + devReloadPath + `");` +
+	`es.addEventListener("reload",function(){location.reload()});})();</script>`
+
+func isHTML(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".html" || ext == ".htm"
+}
+
+// serveDevReload streams a reload event whenever something in the tree
+// changes, until the client goes away.
+func (fh *fileHandler) serveDevReload(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	changes, cancel := fh.watcher.subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case batch := <-changes:
+			fmt.Fprintf(w, "event: reload\ndata: %s\n\n", jsonString(batch[0].Path))
+			flusher.Flush()
+		}
+	}
+}
+
+// serveDevHTML serves the HTML page f with the live reload script
+// injected before </body>, or appended if there is none.
+func (fh *fileHandler) serveDevHTML(w http.ResponseWriter, r *http.Request, name string, f io.Reader, d fs.FileInfo) {
+	page, err := io.ReadAll(f)
+	if err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	if i := bytes.LastIndex(bytes.ToLower(page), []byte("</body>")); i >= 0 {
+		page = append(page[:i:i], append([]byte(devReloadScript), page[i:]...)...)
+	} else {
+		page = append(page, devReloadScript...)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(page)
+	}
+	fh.publish(r, EventServed, name, http.StatusOK, d.Size(), nil)
+}
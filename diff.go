@@ -0,0 +1,414 @@
+// Diff view between two files
+
+package midserve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// diffMaxSize bounds the size of each file compared.
+	diffMaxSize = 1 << 20
+	// diffMaxEdits bounds the work of the diff algorithm, which is
+	// proportional to the number of lines times that of differences.
+	diffMaxEdits = 2000
+	// diffContext is the number of unchanged lines around changes.
+	diffContext = 3
+)
+
+// A diffError explains why two files can't be compared.
+type diffError string
+
+func (e diffError) Error() string { return string(e) }
+
+const errTooDifferent = diffError("files differ too much to compare")
+
+// diffOp is a line of a diff.
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	a, b int  // line numbers, 1-based, 0 if absent on that side
+	text string
+}
+
+// diffLines returns the shortest edit script turning a into b, computed
+// with the linear space variant of Myers' algorithm.
+func diffLines(a, b []string) ([]diffOp, error) {
+	max := (len(a)+len(b)+1)/2 + 1
+	df := &differ{a: a, b: b, vf: make([]int, 2*max+1), vb: make([]int, 2*max+1), off: max}
+	if err := df.compare(0, len(a), 0, len(b)); err != nil {
+		return nil, err
+	}
+	// Put the deletions of each change before its additions, as the
+	// split view pairs them up in that order.
+	ops := df.ops
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(ops) && ops[j].kind != ' ' {
+			j++
+		}
+		sort.SliceStable(ops[i:j], func(x, y int) bool { return ops[i+x].kind == '-' && ops[i+y].kind == '+' })
+		i = j
+	}
+	return ops, nil
+}
+
+// differ holds the state of diffLines. vf and vb are the furthest
+// reaching paths forward and backward by diagonal, offset by off; they
+// are reused by the subproblems, which are smaller.
+type differ struct {
+	a, b   []string
+	vf, vb []int
+	off    int
+	ops    []diffOp
+}
+
+// compare appends the edit script turning a[a0:a1] into b[b0:b1].
+func (df *differ) compare(a0, a1, b0, b1 int) error {
+	for a0 < a1 && b0 < b1 && df.a[a0] == df.b[b0] {
+		df.ops = append(df.ops, diffOp{' ', a0 + 1, b0 + 1, df.a[a0]})
+		a0++
+		b0++
+	}
+	suffix := 0
+	for a1-suffix > a0 && b1-suffix > b0 && df.a[a1-suffix-1] == df.b[b1-suffix-1] {
+		suffix++
+	}
+	a1, b1 = a1-suffix, b1-suffix
+	switch {
+	case a0 == a1:
+		for y := b0; y < b1; y++ {
+			df.ops = append(df.ops, diffOp{'+', 0, y + 1, df.b[y]})
+		}
+	case b0 == b1:
+		for x := a0; x < a1; x++ {
+			df.ops = append(df.ops, diffOp{'-', x + 1, 0, df.a[x]})
+		}
+	default:
+		// Both sides are left with differing first and last lines, so
+		// that at least two edits are needed and the split is inside.
+		x, y, err := df.middleSnake(a0, a1, b0, b1)
+		if err != nil {
+			return err
+		}
+		if err := df.compare(a0, x, b0, y); err != nil {
+			return err
+		}
+		if err := df.compare(x, a1, y, b1); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < suffix; i++ {
+		df.ops = append(df.ops, diffOp{' ', a1 + i + 1, b1 + i + 1, df.a[a1+i]})
+	}
+	return nil
+}
+
+// middleSnake returns a point on a shortest edit path turning a[a0:a1]
+// into b[b0:b1], found by searching from both ends until they meet, or
+// errTooDifferent if that takes more than diffMaxEdits edits.
+func (df *differ) middleSnake(a0, a1, b0, b1 int) (int, int, error) {
+	n, m := a1-a0, b1-b0
+	delta := n - m
+	odd := delta%2 != 0
+	vf, vb, off := df.vf, df.vb, df.off
+	vf[off+1], vb[off+1] = 0, 0
+	for d := 0; d <= (n+m+1)/2; d++ {
+		if 2*d > diffMaxEdits {
+			break
+		}
+		// Forward, on diagonals k = x - y.
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && vf[off+k-1] < vf[off+k+1] {
+				x = vf[off+k+1]
+			} else {
+				x = vf[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && df.a[a0+x] == df.b[b0+y] {
+				x++
+				y++
+			}
+			vf[off+k] = x
+			// The backward path on the same diagonal, at d-1.
+			if c := delta - k; odd && c >= -(d-1) && c <= d-1 && x+vb[off+c] >= n {
+				return a0 + x, b0 + y, nil
+			}
+		}
+		// Backward, counting from the ends, on diagonals c = u - v.
+		for c := -d; c <= d; c += 2 {
+			var u int
+			if c == -d || c != d && vb[off+c-1] < vb[off+c+1] {
+				u = vb[off+c+1]
+			} else {
+				u = vb[off+c-1] + 1
+			}
+			v := u - c
+			for u < n && v < m && df.a[a1-u-1] == df.b[b1-v-1] {
+				u++
+				v++
+			}
+			vb[off+c] = u
+			if k := delta - c; !odd && k >= -d && k <= d && u+vf[off+k] >= n {
+				return a1 - u, b1 - v, nil
+			}
+		}
+	}
+	return 0, 0, errTooDifferent
+}
+
+// diffHunks groups ops into hunks of changes with diffContext lines of
+// context.
+func diffHunks(ops []diffOp) [][]diffOp {
+	var hunks [][]diffOp
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			// Extend over unchanged lines only if another change
+			// follows closely.
+			j := end
+			for j < len(ops) && ops[j].kind == ' ' && j-end < 2*diffContext {
+				j++
+			}
+			if j < len(ops) && ops[j].kind != ' ' {
+				end = j
+				continue
+			}
+			break
+		}
+		stop := end + diffContext
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+		hunks = append(hunks, ops[start:stop])
+		i = stop
+	}
+	return hunks
+}
+
+// hunkHeader returns the "@@ -a,n +b,m @@" line of a hunk.
+func hunkHeader(h []diffOp) string {
+	var aStart, bStart, aLen, bLen int
+	for _, op := range h {
+		if op.a > 0 {
+			if aStart == 0 {
+				aStart = op.a
+			}
+			aLen++
+		}
+		if op.b > 0 {
+			if bStart == 0 {
+				bStart = op.b
+			}
+			bLen++
+		}
+	}
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aLen, bStart, bLen)
+}
+
+// readDiffSide reads a text file for diffing.
+func (fh *fileHandler) readDiffSide(r *http.Request, name string) ([]string, error) {
+	f, d, err := fh.openRegular(r, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if d.Size() > diffMaxSize {
+		return nil, diffError(name + " is too large to compare")
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+		return nil, diffError(name + " is not a text file")
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// serveDiff implements /_api/diff?a=&b=[&view=unified|split|raw].
+func (fh *fileHandler) serveDiff(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	a, b, view := q.Get("a"), q.Get("b"), q.Get("view")
+	if a == "" || b == "" {
+		apiError(w, errors.New("parameters a and b are required"), http.StatusBadRequest)
+		return
+	}
+	aLines, err := fh.readDiffSide(r, a)
+	if err == nil {
+		var bLines []string
+		bLines, err = fh.readDiffSide(r, b)
+		if err == nil {
+			var ops []diffOp
+			ops, err = diffLines(aLines, bLines)
+			if err == nil {
+				fh.writeDiff(w, r, a, b, view, diffHunks(ops))
+				return
+			}
+		}
+	}
+	code := 0
+	var de diffError
+	if errors.As(err, &de) {
+		code = http.StatusUnprocessableEntity
+	}
+	apiError(w, err, code)
+}
+
+func (fh *fileHandler) writeDiff(w http.ResponseWriter, r *http.Request, a, b, view string, hunks [][]diffOp) {
+	if view == "raw" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "--- %s\n+++ %s\n", a, b)
+		for _, h := range hunks {
+			fmt.Fprintln(w, hunkHeader(h))
+			for _, op := range h {
+				fmt.Fprintf(w, "%c%s\n", op.kind, op.text)
+			}
+		}
+		return
+	}
+
+	var body strings.Builder
+	esc := template.HTMLEscapeString
+	if len(hunks) == 0 {
+		body.WriteString("<p>The files are identical.</p>")
+	}
+	for _, h := range hunks {
+		body.WriteString(`<table><tr class="hunk"><td colspan="4">` + esc(hunkHeader(h)) + "</td></tr>\n")
+		if view == "split" {
+			writeSplitHunk(&body, h)
+		} else {
+			for _, op := range h {
+				class := map[byte]string{' ': "", '-': "del", '+': "add"}[op.kind]
+				fmt.Fprintf(&body, `<tr class="%s"><td class="num">%s</td><td class="num">%s</td><td>%c%s</td></tr>`+"\n",
+					class, lineNum(op.a), lineNum(op.b), op.kind, esc(op.text))
+			}
+		}
+		body.WriteString("</table>\n")
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	diffTemplate.Execute(w, struct {
+		A, B, View string
+		Body       template.HTML
+	}{a, b, view, template.HTML(body.String())})
+}
+
+// writeSplitHunk renders a hunk side by side, pairing deleted lines with
+// the added lines following them.
+func writeSplitHunk(b *strings.Builder, h []diffOp) {
+	esc := template.HTMLEscapeString
+	for i := 0; i < len(h); {
+		if h[i].kind == ' ' {
+			fmt.Fprintf(b, `<tr><td class="num">%d</td><td>%s</td><td class="num">%d</td><td>%s</td></tr>`+"\n",
+				h[i].a, esc(h[i].text), h[i].b, esc(h[i].text))
+			i++
+			continue
+		}
+		var dels, adds []diffOp
+		for ; i < len(h) && h[i].kind == '-'; i++ {
+			dels = append(dels, h[i])
+		}
+		for ; i < len(h) && h[i].kind == '+'; i++ {
+			adds = append(adds, h[i])
+		}
+		for j := 0; j < len(dels) || j < len(adds); j++ {
+			b.WriteString("<tr>")
+			if j < len(dels) {
+				fmt.Fprintf(b, `<td class="num">%d</td><td class="del">%s</td>`, dels[j].a, esc(dels[j].text))
+			} else {
+				b.WriteString(`<td class="num"></td><td></td>`)
+			}
+			if j < len(adds) {
+				fmt.Fprintf(b, `<td class="num">%d</td><td class="add">%s</td>`, adds[j].b, esc(adds[j].text))
+			} else {
+				b.WriteString(`<td class="num"></td><td></td>`)
+			}
+			b.WriteString("</tr>\n")
+		}
+	}
+}
+
+func lineNum(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprint(n)
+}
+
+var diffTemplate = template.Must(template.New("diff").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<title>{{.A}} vs {{.B}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1em; font-family: monospace; }
+td { white-space: pre-wrap; word-break: break-all; padding: 0 .4em; vertical-align: top; }
+td.num { color: #999; text-align: right; width: 1%; white-space: nowrap; }
+tr.hunk td { background: #eef; color: #555; }
+.del { background: #ffeef0; } .add { background: #e6ffed; }
+</style>
+</head>
+<body>
+<form>
+<input name="a" value="{{.A}}" size="30"> vs <input name="b" value="{{.B}}" size="30">
+<select name="view">
+<option value="unified"{{if ne .View "split"}} selected{{end}}>unified</option>
+<option value="split"{{if eq .View "split"}} selected{{end}}>side by side</option>
+</select>
+<button>diff</button>
+<a href="?a={{.A}}&amp;b={{.B}}&amp;view=raw">raw</a>
+</form>
+{{.Body}}
+</body>
+</html>
+`))
+
+// writeDiffForm writes a form to the directory listing of dir for
+// comparing two of its files, labelled in the language of msgs.
+func writeDiffForm(w io.Writer, dir string, files []string, msgs messages) {
+	options := func(selected int) string {
+		var b strings.Builder
+		for i, f := range files {
+			sel := ""
+			if i == selected {
+				sel = " selected"
+			}
+			fmt.Fprintf(&b, `<option value="%s"%s>%s</option>`, template.HTMLEscapeString(dir+f), sel, template.HTMLEscapeString(f))
+		}
+		return b.String()
+	}
+	fmt.Fprintf(w, `<form action="%sdiff"><label>%s <select name="a">%s</select></label> <label>%s <select name="b">%s</select></label> <button>%s</button></form>`+"\n",
+		apiPrefix, template.HTMLEscapeString(msgs.t("compare")), options(0),
+		template.HTMLEscapeString(msgs.t("with")), options(1), template.HTMLEscapeString(msgs.t("diff")))
+}
@@ -0,0 +1,85 @@
+package midserve
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// lcsEdits returns the length of the shortest edit script turning a
+// into b, by dynamic programming.
+func lcsEdits(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return len(a) + len(b) - 2*prev[len(b)]
+}
+
+func TestDiffLines(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	lines := func() []string {
+		s := make([]string, rng.Intn(30))
+		for i := range s {
+			s[i] = string(rune('a' + rng.Intn(4)))
+		}
+		return s
+	}
+	for i := 0; i < 2000; i++ {
+		a, b := lines(), lines()
+		ops, err := diffLines(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotA, gotB []string
+		edits := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				if op.a != len(gotA)+1 {
+					t.Fatalf("%q -> %q: line %d of a numbered %d", a, b, len(gotA)+1, op.a)
+				}
+				gotA = append(gotA, op.text)
+			}
+			if op.kind != '-' {
+				if op.b != len(gotB)+1 {
+					t.Fatalf("%q -> %q: line %d of b numbered %d", a, b, len(gotB)+1, op.b)
+				}
+				gotB = append(gotB, op.text)
+			}
+			if op.kind != ' ' {
+				edits++
+			}
+		}
+		if strings.Join(gotA, "\n") != strings.Join(a, "\n") || strings.Join(gotB, "\n") != strings.Join(b, "\n") {
+			t.Fatalf("%q -> %q: script gives %q -> %q", a, b, gotA, gotB)
+		}
+		if want := lcsEdits(a, b); edits != want {
+			t.Fatalf("%q -> %q: %d edits, want %d", a, b, edits, want)
+		}
+	}
+}
+
+func TestDiffTooDifferent(t *testing.T) {
+	a := make([]string, diffMaxEdits)
+	b := make([]string, diffMaxEdits)
+	for i := range a {
+		a[i], b[i] = "a", "b"
+	}
+	if _, err := diffLines(a, b); err != errTooDifferent {
+		t.Errorf("err = %v, want %v", err, errTooDifferent)
+	}
+	if _, err := diffLines(a[:diffMaxEdits/4], b[:diffMaxEdits/4]); err != nil {
+		t.Errorf("err = %v", err)
+	}
+}
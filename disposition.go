@@ -0,0 +1,110 @@
+// Content-Disposition with file names for every client
+
+package midserve
+
+import (
+	"strings"
+	"unicode"
+)
+
+// translitGroups lists Latin letters with diacritics after the ASCII
+// letter they fall back to.
+var translitGroups = []string{
+	"AÀÁÂÃÄÅĀĂĄ", "aàáâãäåāăą", "CÇĆĈĊČ", "cçćĉċč", "DĎĐ", "dďđ",
+	"EÈÉÊËĒĔĖĘĚ", "eèéêëēĕėęě", "GĜĞĠĢ", "gĝğġģ", "HĤĦ", "hĥħ",
+	"IÌÍÎÏĨĪĬĮİ", "iìíîïĩīĭįı", "JĴ", "jĵ", "KĶ", "kķĸ", "LĹĻĽĿŁ", "lĺļľŀł",
+	"NÑŃŅŇŊ", "nñńņňŉŋ", "OÒÓÔÕÖØŌŎŐ", "oòóôõöøōŏő", "RŔŖŘ", "rŕŗř",
+	"SŚŜŞŠ", "sśŝşšſ", "TŢŤŦ", "tţťŧ", "UÙÚÛÜŨŪŬŮŰŲ", "uùúûüũūŭůűų",
+	"WŴ", "wŵ", "YÝŶŸ", "yýÿŷ", "ZŹŻŽ", "zźżž",
+}
+
+// translitCyrillic maps the Russian alphabet, in upper case, to its
+// common Latin transliteration.
+var translitCyrillic = map[rune]string{
+	'А': "A", 'Б': "B", 'В': "V", 'Г': "G", 'Д': "D", 'Е': "E", 'Ё': "Yo",
+	'Ж': "Zh", 'З': "Z", 'И': "I", 'Й': "Y", 'К': "K", 'Л': "L", 'М': "M",
+	'Н': "N", 'О': "O", 'П': "P", 'Р': "R", 'С': "S", 'Т': "T", 'У': "U",
+	'Ф': "F", 'Х': "Kh", 'Ц': "Ts", 'Ч': "Ch", 'Ш': "Sh", 'Щ': "Shch",
+	'Ъ': "", 'Ы': "Y", 'Ь': "", 'Э': "E", 'Ю': "Yu", 'Я': "Ya",
+}
+
+// translitTable maps characters to ASCII replacements.
+var translitTable = func() map[rune]string {
+	m := map[rune]string{
+		'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'ß': "ss", 'Þ': "Th",
+		'þ': "th", 'Ð': "D", 'ð': "d", 'Ĳ': "IJ", 'ĳ': "ij",
+		'‐': "-", '–': "-", '—': "-", '‘': "'", '’': "'", '“': "'", '”': "'",
+		'…': "...", '€': "EUR", '×': "x", '\u00a0': " ",
+	}
+	for _, g := range translitGroups {
+		rs := []rune(g)
+		for _, c := range rs[1:] {
+			m[c] = string(rs[0])
+		}
+	}
+	for c, s := range translitCyrillic {
+		m[c] = s
+		m[unicode.ToLower(c)] = strings.ToLower(s)
+	}
+	return m
+}()
+
+// asciiFileName returns name with what old clients may mangle replaced:
+// characters beyond ASCII, transliterated if translit is set and they
+// can be, quotes, backslashes and percent signs, which some clients
+// decode.
+func asciiFileName(name string, translit bool) string {
+	var b strings.Builder
+	for _, c := range name {
+		switch {
+		case c == '"' || c == '\\' || c == '%' || c < ' ' || c == 0x7f:
+			b.WriteByte('_')
+		case c < 0x80:
+			b.WriteRune(c)
+		default:
+			if t, ok := translitTable[c]; ok && translit {
+				b.WriteString(t)
+			} else {
+				b.WriteByte('_')
+			}
+		}
+	}
+	return b.String()
+}
+
+// contentDisposition returns a Content-Disposition header of type
+// disposition, attachment or inline, for the file name. Names that
+// aren't plain ASCII get an ASCII filename for old clients and the
+// UTF-8 filename* of RFC 6266 that current ones prefer.
+func (fh *fileHandler) contentDisposition(disposition, name string) string {
+	return contentDisposition(disposition, name, fh.transliterate)
+}
+
+// contentDisposition is fileHandler.contentDisposition, transliterating
+// the ASCII filename if translit is set.
+func contentDisposition(disposition, name string, translit bool) string {
+	fallback := asciiFileName(name, translit)
+	v := disposition + `; filename="` + fallback + `"`
+	if fallback != name {
+		v += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+	return v
+}
+
+// encodeRFC5987 percent-encodes s as the value of an extended parameter
+// of RFC 5987.
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+	return b.String()
+}
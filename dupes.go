@@ -0,0 +1,136 @@
+// Duplicate file reports
+
+package midserve
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// dupeReport lists the groups of files with the same content below a
+// directory, found by size first and then by SHA-256, so that only
+// files of a size shared with others are read.
+type dupeReport struct {
+	Path   string      `json:"path"`
+	Files  int         `json:"files"`
+	Groups []dupeGroup `json:"groups"`
+	// Wasted is the bytes all copies but one of each group take.
+	Wasted int64 `json:"wasted"`
+
+	sizes map[int64][]dupeFile
+}
+
+// dupeGroup is a set of files with the same content.
+type dupeGroup struct {
+	Size   int64    `json:"size"`
+	SHA256 string   `json:"sha256"`
+	Paths  []string `json:"paths"`
+	Wasted int64    `json:"wasted"`
+}
+
+type dupeFile struct {
+	name string
+	fi   fs.FileInfo
+}
+
+func newDupeReport(dir string) *dupeReport {
+	return &dupeReport{Path: dir, Groups: []dupeGroup{}, sizes: make(map[int64][]dupeFile)}
+}
+
+// add adds the file name with info fi to those compared.
+func (rep *dupeReport) add(name string, fi fs.FileInfo) {
+	rep.Files++
+	rep.sizes[fi.Size()] = append(rep.sizes[fi.Size()], dupeFile{name, fi})
+}
+
+// group hashes the files of sizes shared by several with sum and
+// groups those with the same content, the most wasteful groups first.
+func (rep *dupeReport) group(sum func(name string, fi fs.FileInfo) (string, error)) error {
+	for size, files := range rep.sizes {
+		if len(files) < 2 {
+			continue
+		}
+		bySum := make(map[string][]string)
+		for _, f := range files {
+			s, err := sum(f.name, f.fi)
+			if err != nil {
+				return err
+			}
+			bySum[s] = append(bySum[s], f.name)
+		}
+		for s, names := range bySum {
+			if len(names) < 2 {
+				continue
+			}
+			sort.Strings(names)
+			wasted := size * int64(len(names)-1)
+			rep.Groups = append(rep.Groups, dupeGroup{Size: size, SHA256: s, Paths: names, Wasted: wasted})
+			rep.Wasted += wasted
+		}
+	}
+	sort.Slice(rep.Groups, func(i, j int) bool {
+		a, b := rep.Groups[i], rep.Groups[j]
+		if a.Wasted != b.Wasted {
+			return a.Wasted > b.Wasted
+		}
+		return a.Paths[0] < b.Paths[0]
+	})
+	return nil
+}
+
+// serveDupes implements /_api/dupes?path=&min_size=, reporting the
+// files below a directory with the same content, ignoring those smaller
+// than min_size bytes, 1 by default to skip empty files. Checksums come
+// from the checksum cache where they can.
+func (fh *fileHandler) serveDupes(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	minSize := int64(1)
+	if s := q.Get("min_size"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			apiError(w, errors.New("min_size must be a number of bytes"), http.StatusBadRequest)
+			return
+		}
+		minSize = n
+	}
+	dir := path.Clean("/" + q.Get("path"))
+	if fh.denied(dir + "/") {
+		fh.publish(r, EventDenied, dir, http.StatusNotFound, -1, nil)
+		apiError(w, fs.ErrNotExist, 0)
+		return
+	}
+	if err := fh.closedWindow(dir); err != nil {
+		_, code := toHTTPError(err)
+		fh.publish(r, EventDenied, dir, code, -1, nil)
+		apiError(w, err, 0)
+		return
+	}
+
+	rep := newDupeReport(dir)
+	err := walkFS(r.Context(), fh.root, dir, fh.excludes, func(name string, fi fs.FileInfo) error {
+		if fh.closedWindow(name) != nil || fh.unlistedEntry(name, fi.IsDir()) {
+			return skipEntry(fi)
+		}
+		if fi.Mode().IsRegular() && fi.Size() >= minSize && fh.permitted(r, name, RoleRead) {
+			rep.add(name, fi)
+		}
+		return nil
+	})
+	if err == nil {
+		err = rep.group(func(name string, fi fs.FileInfo) (string, error) {
+			return fh.fileSHA256(r.Context(), name, fi)
+		})
+	}
+	if r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		apiError(w, err, 0)
+		return
+	}
+	writeJSON(w, r, rep)
+}
@@ -0,0 +1,74 @@
+// Classes of file system errors
+
+package midserve
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// errorClass is the kind of an error reported to clients, which decides
+// its status code.
+type errorClass int
+
+const (
+	classNotExist     errorClass = iota
+	classPermission              // 403
+	classNotDir                  // 404, a file where a directory was expected
+	classNameTooLong             // 404
+	classLoop                    // 508, symbolic links too deep or circular
+	classTooManyFiles            // 503, out of file descriptors
+	classCanceled                // 503, cancelled or timed out
+	classSlowBackend             // 504, the file system didn't respond in time
+	classBadPath                 // 400
+	classOther                   // 500
+	numErrorClasses
+)
+
+var errorClassNames = [numErrorClasses]string{
+	"not_exist", "permission", "not_dir", "name_too_long", "loop",
+	"too_many_files", "canceled", "slow_backend", "bad_path", "other",
+}
+
+// errorCounts counts the errors of each class reported since start.
+var errorCounts [numErrorClasses]uint64 // accessed atomically
+
+// classifyError returns the class of err.
+func classifyError(err error) errorClass {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return classNotExist
+	case errors.Is(err, fs.ErrPermission):
+		return classPermission
+	case errors.Is(err, syscall.ENOTDIR):
+		return classNotDir
+	case errors.Is(err, syscall.ENAMETOOLONG):
+		return classNameTooLong
+	case errors.Is(err, syscall.ELOOP):
+		return classLoop
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE):
+		return classTooManyFiles
+	case errors.Is(err, errSlowFS):
+		return classSlowBackend
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return classCanceled
+	case errors.Is(err, errBadPath):
+		return classBadPath
+	}
+	return classOther
+}
+
+// serveErrors implements /_admin/errors, the number of errors of each
+// class reported to clients since start.
+func (fh *fileHandler) serveErrors(w http.ResponseWriter, r *http.Request) {
+	counts := make(map[string]uint64, numErrorClasses)
+	for c, name := range errorClassNames {
+		counts[name] = atomic.LoadUint64(&errorCounts[c])
+	}
+	writeJSON(w, r, counts)
+}
@@ -0,0 +1,80 @@
+// Error responses
+
+package midserve
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+// An ErrorHandler replies to a request for which opening or reading the
+// requested file failed with err. Programs embedding the file server set
+// their own in Options to reply in their manner.
+//
+// Implementations must take care not to send err.Error() or other
+// details of the file system to the client; ErrorStatus returns what is
+// safe to send.
+type ErrorHandler interface {
+	ServeError(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// The ErrorHandlerFunc type is an adapter to allow the use of ordinary
+// functions as error handlers.
+type ErrorHandlerFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// ServeError calls f(w, r, err).
+func (f ErrorHandlerFunc) ServeError(w http.ResponseWriter, r *http.Request, err error) {
+	f(w, r, err)
+}
+
+// ErrorStatus returns the terse message and the status code of the
+// reply to a request that failed with err, which reveal nothing of the
+// file system.
+func ErrorStatus(err error) (msg string, code int) {
+	return toHTTPError(err)
+}
+
+// DefaultErrorHandler replies with the terse plain text message and
+// status code chosen by ErrorStatus.
+var DefaultErrorHandler ErrorHandler = ErrorHandlerFunc(defaultServeError)
+
+func defaultServeError(w http.ResponseWriter, r *http.Request, err error) {
+	msg, code := toHTTPError(err)
+	http.Error(w, msg, code)
+}
+
+// DescriptiveErrorHandler replies like DefaultErrorHandler followed by
+// the error itself. It reveals details such as file system paths and is
+// meant for internal deployments.
+var DescriptiveErrorHandler ErrorHandler = ErrorHandlerFunc(descriptiveServeError)
+
+func descriptiveServeError(w http.ResponseWriter, r *http.Request, err error) {
+	msg, code := toHTTPError(err)
+	http.Error(w, msg+"\n\n"+err.Error(), code)
+}
+
+// ErrorPages returns an ErrorHandler that replies with the status code
+// chosen by ErrorStatus and, as the body, the file "<code>.html" from
+// pages if it exists. Otherwise it falls back to DefaultErrorHandler.
+func ErrorPages(pages http.FileSystem) ErrorHandler {
+	return ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+		msg, code := toHTTPError(err)
+		f, ferr := pages.Open(path.Join("/", strconv.Itoa(code)+".html"))
+		if ferr != nil {
+			http.Error(w, msg, code)
+			return
+		}
+		defer f.Close()
+
+		h := w.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		h.Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(code)
+		if r.Method != "HEAD" {
+			io.Copy(w, f)
+		}
+	})
+}
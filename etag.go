@@ -0,0 +1,73 @@
+// Entity tag policies
+
+package midserve
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// etagPolicies lists the values of -etag: weak tags from the
+// modification time and size, strong tags from the SHA-256 of the
+// content, or none at all.
+var etagPolicies = map[string]bool{
+	"weak":   true,
+	"strong": true,
+	"none":   true,
+}
+
+// checkETagPolicy reports an error if policy, an -etag value, is
+// unknown.
+func checkETagPolicy(policy string) error {
+	if policy != "" && !etagPolicies[policy] {
+		return fmt.Errorf("etag: %q is not weak, strong or none", policy)
+	}
+	return nil
+}
+
+// fileETag returns the weak entity tag of a file, derived from its
+// modification time and size. The time is taken in whole seconds, the
+// precision copies with rsync -t or cp -p keep on every file system, so
+// replicas of the same files agree on their tags.
+func fileETag(d fs.FileInfo) string {
+	return fmt.Sprintf(`W/"%x-%x"`, d.ModTime().Unix(), d.Size())
+}
+
+// etag returns the entity tag of the regular file name with info d
+// under the configured policy, or "" for none. Strong tags only depend
+// on the content, so they are the same on every replica; when the
+// content can't be hashed the weak tag is used.
+func (fh *fileHandler) etag(ctx context.Context, name string, d fs.FileInfo) string {
+	switch fh.etagPolicy {
+	case "none":
+		return ""
+	case "strong":
+		sum, err := fh.fileSHA256(ctx, name, d)
+		if err == nil {
+			return `"` + sum[:32] + `"`
+		}
+	}
+	return fileETag(d)
+}
+
+// derivedETag returns the weak tag of a representation derived from the
+// file with tag etag, such as rendered markdown, which changes with it
+// but also with how it is derived.
+func derivedETag(etag, kind string) string {
+	if etag == "" {
+		return ""
+	}
+	return "W/" + strings.TrimSuffix(strings.TrimPrefix(etag, "W/"), `"`) + "-" + kind + `"`
+}
+
+// encodedETag returns the tag of a content-coded representation of the
+// file with tag etag. Strong tags must differ between representations;
+// weak ones may stay the same.
+func encodedETag(etag, coding string) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + coding + `"`
+}
@@ -0,0 +1,199 @@
+// Event bus for embedders
+
+package midserve
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind identifies what happened in an Event.
+type EventKind int
+
+const (
+	// EventServed is published after a file or directory listing was
+	// sent to a client.
+	EventServed EventKind = iota
+	// EventUploaded is published after an upload was completely written.
+	EventUploaded
+	// EventError is published when a request failed with an error
+	// response.
+	EventError
+	// EventDenied is published when a request was refused by an access
+	// rule, such as an exclusion.
+	EventDenied
+	// EventAborted is published instead of EventServed when a transfer
+	// was cut short because the client went away or the transfer took
+	// longer than allowed. Err tells which.
+	EventAborted
+	// EventDeleted is published after a file or directory was deleted
+	// through the management API.
+	EventDeleted
+	// EventMoved is published after a file or directory was moved or
+	// renamed through the management API. From is its old path.
+	EventMoved
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventServed:
+		return "served"
+	case EventUploaded:
+		return "uploaded"
+	case EventError:
+		return "error"
+	case EventDenied:
+		return "denied"
+	case EventAborted:
+		return "aborted"
+	case EventDeleted:
+		return "deleted"
+	case EventMoved:
+		return "moved"
+	}
+	return "unknown"
+}
+
+// An Event describes something the file server did on behalf of a
+// client.
+type Event struct {
+	Kind       EventKind
+	Time       time.Time
+	Method     string
+	Path       string // '/'-separated, relative to the served root
+	From       string // previous path of an EventMoved
+	RemoteAddr string
+	RequestID  string // also sent to the client in X-Request-Id
+	Status     int    // HTTP status code sent, if any
+	Size       int64  // bytes of the file served or uploaded, -1 if unknown
+	Sent       int64  // bytes of the response body written, -1 if unknown
+	Err        error  // cause of an EventError, never sent to clients
+	Principal  string // name of the client, empty if anonymous
+	Country    string // of the client, with GeoIP databases
+	ASN        uint32 // of the client, with GeoIP databases
+}
+
+// An EventBus fans out events to its subscribers.
+//
+// Publishing never blocks the request being served: a subscriber that
+// doesn't keep up loses events, which are counted in Dropped.
+//
+// A nil *EventBus is valid and discards all events.
+type EventBus struct {
+	dropped uint64 // accessed atomically, first for alignment
+
+	mu   sync.RWMutex
+	subs map[chan Event]struct{}
+}
+
+// NewEventBus returns an EventBus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel receiving every event published from now
+// on, buffering up to buffer events, and a function that cancels the
+// subscription and closes the channel. On a nil bus, which publishes
+// nothing, the channel is closed already.
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	if b == nil {
+		close(ch)
+		return ch, func() {}
+	}
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends e to all subscribers. A zero e.Time is set to the
+// current time.
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns the number of events lost because a subscriber's
+// buffer was full.
+func (b *EventBus) Dropped() uint64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// statusWriter records the status code and body size of the response
+// written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the ResponseWriter's optimized copying, such as
+// sendfile for files, available through the wrapper.
+func (w *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.Copy(w.ResponseWriter, src)
+	w.written += n
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, as
+// the fallback proxy does to hijack the connection for WebSockets.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
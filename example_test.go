@@ -0,0 +1,71 @@
+package midserve_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/hellodword/midserve"
+)
+
+// A program embedding the file server subscribes to its events, here
+// to log what was served.
+func ExampleEventBus() {
+	dir, err := os.MkdirTemp("", "midserve-example-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello"), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := midserve.DefaultConfig()
+	cfg.CacheDir = ""
+	opts, err := cfg.Options()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Events = midserve.NewEventBus()
+	events, cancel := opts.Events.Subscribe(16)
+	defer cancel()
+	h := midserve.NewFileServer(midserve.Dir(dir), opts)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hello.txt", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing.txt", nil))
+	for i := 0; i < 2; i++ {
+		e := <-events
+		fmt.Println(e.Kind, e.Path, e.Status)
+	}
+	// Output:
+	// served /hello.txt 200
+	// error /missing.txt 404
+}
+
+// A program embedding the file server replies to failed requests in its
+// own format.
+func ExampleErrorHandlerFunc() {
+	cfg := midserve.DefaultConfig()
+	cfg.CacheDir = ""
+	opts, err := cfg.Options()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.ErrorHandler = midserve.ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+		msg, code := midserve.ErrorStatus(err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	})
+	h := midserve.NewFileServer(midserve.Dir(os.TempDir()), opts)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/midserve-example-missing", nil))
+	fmt.Print(rec.Code, " ", rec.Body.String())
+	// Output:
+	// 404 {"error":"404 page not found"}
+}
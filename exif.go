@@ -0,0 +1,200 @@
+// Stripping of image metadata
+
+package midserve
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// metadataStrippers maps extensions of images whose metadata can be
+// stripped to the function doing it.
+var metadataStrippers = map[string]func(io.Writer, io.Reader) error{
+	".jpg":  stripJPEGMetadata,
+	".jpeg": stripJPEGMetadata,
+	".png":  stripPNGMetadata,
+}
+
+// unstrippableExts lists extensions of images that carry EXIF and XMP
+// metadata, GPS locations included, which isn't stripped from them.
+// HEIC and HEIF keep it in items of their ISO base media container.
+var unstrippableExts = map[string]bool{
+	".heic": true,
+	".heif": true,
+}
+
+// errUnstrippable refuses an image whose metadata can't be stripped.
+var errUnstrippable = fmt.Errorf("image metadata can't be stripped: %w", fs.ErrPermission)
+
+// metadataStripper returns the function stripping the metadata of the
+// image name, or nil if it goes as it is: without -strip-exif, matching
+// a -no-transform pattern or not being an image with metadata. With
+// -strip-exif, images whose metadata can't be stripped are refused with
+// errUnstrippable rather than given out with it.
+func (fh *fileHandler) metadataStripper(name string) (func(io.Writer, io.Reader) error, error) {
+	if !fh.stripEXIF || fh.pinned(name) {
+		return nil, nil
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if unstrippableExts[ext] {
+		return nil, errUnstrippable
+	}
+	return metadataStrippers[ext], nil
+}
+
+// serveStrippedImage serves the image name without EXIF, XMP and IPTC
+// metadata, using strip and caching the stripped copy.
+func (fh *fileHandler) serveStrippedImage(w http.ResponseWriter, r *http.Request, name string, f io.Reader, d fs.FileInfo, strip func(io.Writer, io.Reader) error) {
+	key := sha256.Sum256([]byte(fmt.Sprintf("strip\x00%s\x00%d\x00%d", name, d.ModTime().UnixNano(), d.Size())))
+	cached := filepath.Join(fh.cacheDir, "stripped", hex.EncodeToString(key[:])+path.Ext(name))
+	fh.dropPurged(name, cached)
+
+	cf, err := os.Open(cached)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fh.produce(r.Context(), cached, func(w io.Writer) error { return strip(w, f) })
+		if err == nil {
+			cf, err = os.Open(cached)
+		}
+	}
+	if err != nil {
+		logf(r, "http: error stripping metadata of %s: %v", name, err)
+		fh.error(w, r, name, err)
+		return
+	}
+	defer cf.Close()
+	fh.serveCached(w, r, name, d, cf)
+}
+
+// stripJPEGMetadata copies the JPEG in src to dst without its APP1
+// (EXIF, XMP) and APP13 (IPTC) segments and comments. Other segments,
+// such as the ICC profile in APP2, are kept.
+func stripJPEGMetadata(dst io.Writer, src io.Reader) error {
+	br := bufio.NewReader(src)
+	bw := bufio.NewWriter(dst)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return err
+	}
+	if soi != [2]byte{0xFF, 0xD8} {
+		return errors.New("not a JPEG file")
+	}
+	bw.Write(soi[:])
+
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil {
+			return err
+		}
+		if marker[0] != 0xFF {
+			return errors.New("invalid JPEG marker")
+		}
+		// Markers may be padded with fill bytes.
+		for marker[1] == 0xFF {
+			b, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			marker[1] = b
+		}
+		switch {
+		case marker[1] == 0xD9: // EOI
+			bw.Write(marker[:])
+			return bw.Flush()
+		case marker[1] >= 0xD0 && marker[1] <= 0xD7, marker[1] == 0x01:
+			// Standalone markers without a length.
+			bw.Write(marker[:])
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if n < 2 {
+			return errors.New("invalid JPEG segment length")
+		}
+		if marker[1] == 0xE1 || marker[1] == 0xED || marker[1] == 0xFE {
+			if _, err := br.Discard(n - 2); err != nil {
+				return err
+			}
+			continue
+		}
+		bw.Write(marker[:])
+		bw.Write(length[:])
+		if _, err := io.CopyN(bw, br, int64(n-2)); err != nil {
+			return err
+		}
+		if marker[1] == 0xDA {
+			// Start of scan: the rest is entropy coded data, which
+			// can't contain metadata segments.
+			if _, err := io.Copy(bw, br); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+	}
+}
+
+// pngSignature starts every PNG file.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks lists the ancillary chunks dropped by
+// stripPNGMetadata.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata copies the PNG in src to dst without its EXIF and
+// text chunks, which is where XMP and other metadata are stored.
+func stripPNGMetadata(dst io.Writer, src io.Reader) error {
+	br := bufio.NewReader(src)
+	bw := bufio.NewWriter(dst)
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(br, sig); err != nil {
+		return err
+	}
+	if !bytes.Equal(sig, pngSignature) {
+		return errors.New("not a PNG file")
+	}
+	bw.Write(sig)
+
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return err
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:4]))
+		typ := string(hdr[4:])
+		// Data followed by the CRC.
+		if pngMetadataChunks[typ] {
+			if _, err := io.CopyN(io.Discard, br, n+4); err != nil {
+				return err
+			}
+			continue
+		}
+		bw.Write(hdr[:])
+		if _, err := io.CopyN(bw, br, n+4); err != nil {
+			return err
+		}
+		if typ == "IEND" {
+			return bw.Flush()
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux && (amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64)
+// +build linux
+// +build amd64 arm64 loong64 mips64 mips64le ppc64 ppc64le riscv64
+
+package midserve
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fadvSequential = 2 // POSIX_FADV_SEQUENTIAL
+	fadvDontNeed   = 4 // POSIX_FADV_DONTNEED
+)
+
+// fadvise64 takes offset and length in one register each only on these
+// 64-bit architectures; s390x numbers the advice differently.
+func fadvise(f *os.File, off, n int64, advice int) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), uintptr(off), uintptr(n), uintptr(advice), 0, 0)
+}
+
+func fadviseSequential(f *os.File) {
+	fadvise(f, 0, 0, fadvSequential)
+}
+
+func fadviseDontNeed(f *os.File, off, n int64) {
+	fadvise(f, off, n, fadvDontNeed)
+}
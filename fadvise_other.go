@@ -0,0 +1,12 @@
+//go:build !linux || !(amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64)
+// +build !linux !amd64,!arm64,!loong64,!mips64,!mips64le,!ppc64,!ppc64le,!riscv64
+
+package midserve
+
+import "os"
+
+// Page cache advice is only implemented on 64-bit Linux.
+
+func fadviseSequential(f *os.File) {}
+
+func fadviseDontNeed(f *os.File, off, n int64) {}
@@ -0,0 +1,37 @@
+// Reverse proxy for paths without a file
+
+package midserve
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// newFallbackProxy returns a reverse proxy to the application server at
+// target, passing on the original host and client as X-Forwarded-*.
+func newFallbackProxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+		},
+	}
+}
+
+// parseFallbackProxy parses the -fallback-proxy URL.
+func parseFallbackProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("fallback-proxy: %q is not an http(s) URL", s)
+	}
+	return u, nil
+}
+
+// proxyFallback passes r on to the fallback proxy.
+func (fh *fileHandler) proxyFallback(w http.ResponseWriter, r *http.Request, name string) {
+	sw := &statusWriter{ResponseWriter: w}
+	fh.fallback.ServeHTTP(sw, r)
+	fh.publishSent(r, name, sw, -1)
+}
@@ -0,0 +1,102 @@
+package midserve
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+// newProxyTestServer returns a server proxying paths without a file to
+// backend.
+func newProxyTestServer(t *testing.T, backend http.Handler) *httptest.Server {
+	t.Helper()
+	app := httptest.NewServer(backend)
+	t.Cleanup(app.Close)
+	target, err := url.Parse(app.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, midservetest.NewFS().File("a.txt", "a").HTTP(), func(o *Options) {
+		o.FallbackProxy = target
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFallbackProxyEvents(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := newProxyTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+
+	// The event must arrive while the stream is still open.
+	line := make(chan string, 1)
+	go func() {
+		res, err := http.Get(srv.URL + "/events")
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		s, _ := bufio.NewReader(res.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		if s != "data: first\n" {
+			t.Fatalf("got %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not flushed through the proxy")
+	}
+}
+
+func TestFallbackProxyUpgrade(t *testing.T) {
+	srv := newProxyTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprint(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET /socket HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d", res.StatusCode)
+	}
+	fmt.Fprint(conn, "ping")
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "ping" {
+		t.Fatalf("echo = %q, %v", b, err)
+	}
+}
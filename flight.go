@@ -0,0 +1,84 @@
+// Coalescing concurrent cache fills
+
+package midserve
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// flightGroup runs one function per key at a time: callers arriving
+// while it runs wait for it and share its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+// flight is a running call of a flightGroup.
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// do runs fn unless a call for key is running, in which case it waits
+// for that call, or for ctx to be done. As a leader's result may only
+// be its own client going away, followers whose ctx is alive then try
+// again rather than share it.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() error) error {
+	for {
+		g.mu.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flight)
+		}
+		if c, ok := g.calls[key]; ok {
+			g.mu.Unlock()
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if (errors.Is(c.err, context.Canceled) || errors.Is(c.err, context.DeadlineExceeded)) && ctx.Err() == nil {
+				continue
+			}
+			return c.err
+		}
+		c := &flight{done: make(chan struct{})}
+		g.calls[key] = c
+		g.mu.Unlock()
+
+		c.err = fn()
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+		return c.err
+	}
+}
+
+// produce creates the cache file name with the content written by fill,
+// unless it exists by now. Concurrent requests for the same missing
+// file wait for the first one to create it and then all serve it.
+// Processes sharing the cache with SharedCache may fill it at the same
+// time, but only the first one to finish renames it into place.
+func (fh *fileHandler) produce(ctx context.Context, name string, fill func(w io.Writer) error) error {
+	return fh.flights.do(ctx, name, func() error {
+		if _, err := os.Stat(name); err == nil {
+			return nil
+		}
+		return fh.temps.writeWith(name, fill, func(tmp, name string) error {
+			unlock, err := fh.lockShared(ctx, name)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+			if _, err := os.Stat(name); err == nil {
+				// Created by another process meanwhile.
+				return nil
+			}
+			return os.Rename(tmp, name)
+		})
+	})
+}
@@ -4,11 +4,14 @@
 
 // HTTP file system request handler
 
-package main
+package midserve
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/fs"
 	"log"
@@ -24,6 +27,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -45,6 +50,16 @@ import (
 // An empty Dir is treated as ".".
 type Dir string
 
+// osPath returns the path in the operating system's file system of name,
+// a slash-separated path below d.
+func (d Dir) osPath(name string) string {
+	dir := string(d)
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
 // mapDirOpenError maps the provided non-nil error from opening name
 // to a possibly better non-nil error. In particular, it turns OS-specific errors
 // about opening files in non-directories into fs.ErrNotExist. See Issue 18984.
@@ -75,11 +90,7 @@ func (d Dir) Open(name string) (http.File, error) {
 	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
 		return nil, errors.New("http: invalid character in file path")
 	}
-	dir := string(d)
-	if dir == "" {
-		dir = "."
-	}
-	fullName := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+	fullName := d.osPath(name)
 	f, err := os.Open(fullName)
 	if err != nil {
 		return nil, mapDirOpenError(err, fullName)
@@ -103,52 +114,89 @@ type anyDirs interface {
 	len() int
 	name(i int) string
 	isDir(i int) bool
+	info(i int) (fs.FileInfo, error)
 }
 
 type fileInfoDirs []fs.FileInfo
 
-func (d fileInfoDirs) len() int          { return len(d) }
-func (d fileInfoDirs) isDir(i int) bool  { return d[i].IsDir() }
-func (d fileInfoDirs) name(i int) string { return d[i].Name() }
+func (d fileInfoDirs) len() int                        { return len(d) }
+func (d fileInfoDirs) isDir(i int) bool                { return d[i].IsDir() }
+func (d fileInfoDirs) name(i int) string               { return d[i].Name() }
+func (d fileInfoDirs) info(i int) (fs.FileInfo, error) { return d[i], nil }
 
 type dirEntryDirs []fs.DirEntry
 
-func (d dirEntryDirs) len() int          { return len(d) }
-func (d dirEntryDirs) isDir(i int) bool  { return d[i].IsDir() }
-func (d dirEntryDirs) name(i int) string { return d[i].Name() }
+func (d dirEntryDirs) len() int                        { return len(d) }
+func (d dirEntryDirs) isDir(i int) bool                { return d[i].IsDir() }
+func (d dirEntryDirs) name(i int) string               { return d[i].Name() }
+func (d dirEntryDirs) info(i int) (fs.FileInfo, error) { return d[i].Info() }
+
+func (fh *fileHandler) dirList(w http.ResponseWriter, r *http.Request, name string, f http.File, d fs.FileInfo) {
+	lang, msgs := fh.language(r)
+	w.Header().Set("Content-Language", lang)
+	if fh.lang == "" {
+		w.Header().Add("Vary", "Accept-Language")
+	}
 
-func dirList(w http.ResponseWriter, r *http.Request, f http.File, excludes []*regexp.Regexp) {
-	// Prefer to use ReadDir instead of Readdir,
-	// because the former doesn't require calling
-	// Stat on every entry of a directory on Unix.
 	var dirs anyDirs
 	var err error
-	if d, ok := f.(fs.ReadDirFile); ok {
-		var list dirEntryDirs
-		list, err = d.ReadDir(-1)
-		dirs = list
+	if fh.listings != nil {
+		var stale bool
+		dirs, stale, err = fh.listings.get(r.Context(), name, f, d.ModTime(), fh.readDirSorted)
+		if stale {
+			// The validators describe the directory as it is now.
+			w.Header().Del("ETag")
+			w.Header().Del("Last-Modified")
+			w.Header().Set("Cache-Control", "no-cache")
+		}
 	} else {
-		var list fileInfoDirs
-		list, err = f.Readdir(-1)
-		dirs = list
+		dirs, err = fh.readDirSorted(r.Context(), f)
 	}
 
+	if r.Context().Err() != nil {
+		// The client is gone, nobody is left to read an error page.
+		return
+	}
 	if err != nil {
 		logf(r, "http: error reading directory: %v", err)
-		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		http.Error(w, msgs.t("Error reading directory"), http.StatusInternalServerError)
 		return
 	}
-	sort.Slice(dirs, func(i, j int) bool { return dirs.name(i) < dirs.name(j) })
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page, skip := fh.listingPage(r)
+	canonical := (&url.URL{Path: r.URL.Path}).String()
+	if page > 1 {
+		canonical += "?page=" + strconv.Itoa(page)
+	}
+	fh.writeListingHead(w, r.URL.Path, fh.baseURL(r)+canonical, lang, msgs)
 	fmt.Fprintf(w, "<pre>\n")
+	var files []string
+	shown, more := 0, false
 	for i, n := 0, dirs.len(); i < n; i++ {
+		if i%dirBatchSize == 0 && r.Context().Err() != nil {
+			// Huge listings stop being rendered for a client that left.
+			return
+		}
+		listed, served := fh.listingEntry(r, r.URL.Path, dirs.name(i), dirs.isDir(i))
+		if !listed {
+			continue
+		}
 		name := dirs.name(i)
 		if dirs.isDir(i) {
 			name += "/"
 		}
-
-		if exclude(filepath.Join(r.URL.Path, name), excludes) {
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if fh.maxEntries > 0 && shown == fh.maxEntries {
+			more = true
+			break
+		}
+		shown++
+		if !served {
+			fmt.Fprintf(w, "%s\n", htmlReplacer.Replace(name))
 			continue
 		}
 
@@ -157,8 +205,124 @@ func dirList(w http.ResponseWriter, r *http.Request, f http.File, excludes []*re
 		// string or fragment.
 		url := url.URL{Path: name}
 		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", url.String(), htmlReplacer.Replace(name))
+		if !dirs.isDir(i) {
+			files = append(files, name)
+			fh.prepareThumbnails(path.Join(r.URL.Path, name))
+		}
 	}
 	fmt.Fprintf(w, "</pre>\n")
+	if page > 1 || more {
+		fh.writeListingPages(w, page, more, msgs)
+	}
+	if fh.archives != "" {
+		fmt.Fprintf(w, "<p><a href=\"?archive=zip\" rel=\"nofollow\" download>%s</a></p>\n", msgs.t("download as zip"))
+	}
+
+	if fh.api && len(files) > 1 {
+		writeDiffForm(w, r.URL.Path, files, msgs)
+	}
+	if fh.copyLinks {
+		fh.writeCopyLinks(w, r, r.URL.Path, msgs)
+	}
+	if fh.sessions != nil {
+		writeSessionBar(w, msgs)
+	}
+	if fh.write {
+		writeUpload(w, r.URL.Path, msgs)
+		writeBulkOps(w, r.URL.Path, msgs)
+	}
+	if fh.changes {
+		writeLiveListing(w, r.URL.Path, msgs)
+	}
+	writeListingFoot(w)
+}
+
+// listingEntry returns whether the entry name of the directory dir is
+// listed to the client of r, and whether it is served.
+func (fh *fileHandler) listingEntry(r *http.Request, dir, name string, isDir bool) (listed, served bool) {
+	if isDir {
+		name += "/"
+	}
+	if exclude(filepath.Join(dir, name), fh.excludes) {
+		return false, false
+	}
+	entry := path.Join(dir, name)
+	if isDir {
+		entry += "/"
+	}
+	if listed, served = fh.visibility(entry); !listed {
+		return false, false
+	}
+	if errors.Is(fh.closedWindow(path.Join(dir, name)), fs.ErrNotExist) {
+		return false, false
+	}
+	if !fh.permitted(r, path.Join(dir, name), RoleRead) {
+		return false, false
+	}
+	return true, served
+}
+
+// readDirSorted reads the directory f in the order of listings.
+func (fh *fileHandler) readDirSorted(ctx context.Context, f http.File) (anyDirs, error) {
+	// Prefer to use ReadDir instead of Readdir,
+	// because the former doesn't require calling
+	// Stat on every entry of a directory on Unix.
+	//
+	// Entries are read in batches so that a huge directory stops being
+	// walked as soon as the client goes away.
+	var dirs anyDirs
+	if d, ok := f.(fs.ReadDirFile); ok {
+		list, err := readDirBatched(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+		dirs = dirEntryDirs(list)
+	} else {
+		list, err := readdirBatched(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+		dirs = fileInfoDirs(list)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return fh.less(dirs.name(i), dirs.name(j)) })
+	return dirs, nil
+}
+
+// dirBatchSize is the number of entries dirList reads at a time.
+const dirBatchSize = 256
+
+func readDirBatched(ctx context.Context, d fs.ReadDirFile) ([]fs.DirEntry, error) {
+	var list []fs.DirEntry
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		batch, err := d.ReadDir(dirBatchSize)
+		list = append(list, batch...)
+		if err == io.EOF {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func readdirBatched(ctx context.Context, f http.File) ([]fs.FileInfo, error) {
+	var list []fs.FileInfo
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		batch, err := f.Readdir(dirBatchSize)
+		list = append(list, batch...)
+		if err == io.EOF {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 }
 
 // errNoOverlap is returned by serveContent's parseRange if first-byte-pos of
@@ -169,6 +333,10 @@ var errNoOverlap = errors.New("invalid range: failed to overlap")
 // if modtime.IsZero(), modtime is unknown.
 // content must be seeked to the beginning of the file.
 // The sizeFunc is called at most once. Its error, if any, is sent in the HTTP response.
+//
+// This is the content serving of net/http, kept here so that it can be
+// extended. HEAD requests get the headers of the corresponding GET,
+// including Content-Length and Content-Range, without a body.
 func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, sizeFunc func() (int64, error), content io.ReadSeeker) {
 	setLastModified(w, modtime)
 	done, rangeReq := checkPreconditions(w, r, modtime)
@@ -285,7 +453,15 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 	w.WriteHeader(code)
 
 	if r.Method != "HEAD" {
-		io.CopyN(w, sendContent, sendSize)
+		var err error
+		if cc, ok := sendContent.(contentCopier); ok {
+			_, err = cc.copyN(w, sendSize)
+		} else {
+			_, err = io.CopyN(w, sendContent, sendSize)
+		}
+		if err != nil && r.Context().Err() == nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			logf(r, "http: error sending %s: %v", name, err)
+		}
 	}
 }
 
@@ -534,7 +710,7 @@ func checkPreconditions(w http.ResponseWriter, r *http.Request, modtime time.Tim
 }
 
 // name is '/'-separated, not filepath.Separator.
-func serveFile(w http.ResponseWriter, r *http.Request, hfs http.FileSystem, name string, redirect bool, excludes []*regexp.Regexp) {
+func (fh *fileHandler) serveFile(w http.ResponseWriter, r *http.Request, name string, redirect bool) {
 	const indexPage = "/index.html"
 
 	// redirect .../index.html to .../
@@ -545,24 +721,33 @@ func serveFile(w http.ResponseWriter, r *http.Request, hfs http.FileSystem, name
 		return
 	}
 
-	var f http.File
-	var err error
-	if exclude(name, excludes) {
-		err = fs.ErrNotExist
-	} else {
-		f, err = hfs.Open(name)
+	if fh.denied(name) {
+		sw := &statusWriter{ResponseWriter: w}
+		fh.errorHandler.ServeError(sw, r, fs.ErrNotExist)
+		fh.publish(r, EventDenied, name, sw.status, -1, nil)
+		return
+	}
+	if err := fh.closedWindow(name); err != nil {
+		sw := &statusWriter{ResponseWriter: w}
+		fh.errorHandler.ServeError(sw, r, err)
+		fh.publish(r, EventDenied, name, sw.status, -1, nil)
+		return
 	}
+
+	f, err := openContext(r.Context(), fh.root, name)
 	if err != nil {
-		msg, code := toHTTPError(err)
-		http.Error(w, msg, code)
+		if fh.fallback != nil && errors.Is(err, fs.ErrNotExist) {
+			fh.proxyFallback(w, r, name)
+			return
+		}
+		fh.error(w, r, name, err)
 		return
 	}
 	defer f.Close()
 
 	d, err := f.Stat()
 	if err != nil {
-		msg, code := toHTTPError(err)
-		http.Error(w, msg, code)
+		fh.error(w, r, name, err)
 		return
 	}
 
@@ -583,6 +768,16 @@ func serveFile(w http.ResponseWriter, r *http.Request, hfs http.FileSystem, name
 		}
 	}
 
+	if d.IsDir() && fh.denied(strings.TrimSuffix(name, "/")+"/") {
+		sw := &statusWriter{ResponseWriter: w}
+		fh.errorHandler.ServeError(sw, r, fs.ErrNotExist)
+		fh.publish(r, EventDenied, name, sw.status, -1, nil)
+		return
+	}
+	if fh.cdn != "" {
+		fh.setCDNHeaders(w, name, d.IsDir())
+	}
+
 	if d.IsDir() {
 		url := r.URL.Path
 		// redirect if the directory name doesn't end in a slash
@@ -590,10 +785,18 @@ func serveFile(w http.ResponseWriter, r *http.Request, hfs http.FileSystem, name
 			localRedirect(w, r, path.Base(url)+"/")
 			return
 		}
+		if !fh.checkCrawler(w, r, name) {
+			return
+		}
+
+		if fh.archives != "" && r.URL.Query().Get("archive") == "zip" {
+			fh.serveArchive(w, r, name, d)
+			return
+		}
 
 		// use contents of index.html for directory, if present
 		index := strings.TrimSuffix(name, "/") + indexPage
-		ff, err := hfs.Open(index)
+		ff, err := openContext(r.Context(), fh.root, index)
 		if err == nil {
 			defer ff.Close()
 			dd, err := ff.Stat()
@@ -607,18 +810,232 @@ func serveFile(w http.ResponseWriter, r *http.Request, hfs http.FileSystem, name
 
 	// Still a directory? (we didn't find an index.html file)
 	if d.IsDir() {
-		if checkIfModifiedSince(r, d.ModTime()) == condFalse {
-			writeNotModified(w)
+		// A listing only shows names, so it changes with the directory's
+		// modification time. Range requests are not supported.
+		if w.Header().Get("ETag") == "" && fh.etagPolicy != "none" {
+			w.Header().Set("ETag", fileETag(d))
+		}
+		setLastModified(w, d.ModTime())
+		if done, _ := checkPreconditions(w, r, d.ModTime()); done {
 			return
 		}
+		fh.dirList(w, r, name, f, d)
+		fh.publish(r, EventServed, name, http.StatusOK, -1, nil)
+		return
+	}
+
+	if fh.usage.cap > 0 && !fh.checkTransferCap(w, r, name) {
+		return
+	}
+	if len(fh.limiters) > 0 {
+		release := fh.acquire(w, r, name)
+		if release == nil {
+			return
+		}
+		defer release()
+	}
+
+	_, download := r.URL.Query()["download"]
+	if download {
+		// Saved under its name, as is.
+		w.Header().Set("Content-Disposition", fh.contentDisposition("attachment", d.Name()))
+	}
+	asIs := fh.noTransform(r, name)
+	if asIs {
+		// Nor may proxies on the way transform it.
+		addDirective(w.Header(), "Cache-Control", "no-transform")
+	}
+	if fh.renderMarkdown && !asIs && isMarkdown(name) && r.URL.Query().Get("raw") == "" && !download {
+		if etag := derivedETag(fh.etag(r.Context(), name, d), "md"); etag != "" && w.Header().Get("ETag") == "" {
+			w.Header().Set("ETag", etag)
+		}
 		setLastModified(w, d.ModTime())
-		dirList(w, r, f, excludes)
+		if done, _ := checkPreconditions(w, r, d.ModTime()); done {
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		fh.serveMarkdown(sw, r, name, f)
+		if sw.status < 400 {
+			fh.publishSent(r, name, sw, d.Size())
+		}
 		return
 	}
 
+	if fh.logViewer && !asIs && isLogView(r, name) {
+		if r.URL.Query().Get("follow") == "1" {
+			// Accounted as it goes.
+			fh.followLog(w, r, name, f, d.Size())
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		fh.serveLogView(sw, r, name, f, d.Size())
+		if sw.status < 400 {
+			fh.publishSent(r, name, sw, -1)
+		}
+		return
+	}
+
+	if fh.prettyViewer && !asIs && isPrettyView(r, name, d.Size()) {
+		sw := &statusWriter{ResponseWriter: w}
+		fh.servePrettyView(sw, r, name, f)
+		if sw.status < 400 {
+			fh.publishSent(r, name, sw, d.Size())
+		}
+		return
+	}
+
+	if format := r.URL.Query().Get("format"); fh.metafiles && format != "" {
+		fh.serveMetafile(w, r, name, f, d, format)
+		return
+	}
+
+	if rule, ok := fh.transformFor(r, name); ok && !asIs {
+		if rule == nil {
+			http.Error(w, "unknown transform", http.StatusBadRequest)
+			return
+		}
+		fh.serveTransformed(w, r, name, f, d, rule)
+		return
+	}
+
+	if fh.resizeImages && !asIs && resizableExts[strings.ToLower(path.Ext(name))] != "" {
+		p, ok, err := parseImageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok {
+			// Re-encoding drops all metadata, no need to strip it.
+			if fh.serveResizedImage(w, r, name, f, d, p) {
+				return
+			}
+		}
+	}
+	if strip, err := fh.metadataStripper(name); err != nil {
+		fh.error(w, r, name, err)
+		return
+	} else if strip != nil {
+		fh.serveStrippedImage(w, r, name, f, d, strip)
+		return
+	}
+
+	if !fh.pinned(name) && isSSI(name, fh.ssiExts) {
+		// The output depends on the included files and variables, so
+		// no Last-Modified and no conditional requests.
+		sw := &statusWriter{ResponseWriter: w}
+		fh.serveSSI(sw, r, name, f, d.ModTime())
+		if sw.status < 400 {
+			fh.publishSent(r, name, sw, d.Size())
+		}
+		return
+	}
+
+	if fh.dev && !asIs && isHTML(name) {
+		fh.serveDevHTML(w, r, name, f, d)
+		return
+	}
+
+	if fh.growing && fh.serveGrowing(w, r, name, f, &d) {
+		return
+	}
+
+	if w.Header().Get("ETag") == "" {
+		if etag := fh.etag(r.Context(), name, d); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+	}
+	fh.prepare(name, d)
+
+	// The content type is still derived from the name of the original
+	// file when serving its sidecar.
+	ctypeName := d.Name()
+	sidecar := false
+	if fh.precompressed && !asIs {
+		if sf, sd, coding := fh.openSidecar(w, r, name, d); sf != nil {
+			defer sf.Close()
+			w.Header().Set("Content-Encoding", coding)
+			if etag := w.Header().Get("ETag"); etag != "" {
+				w.Header().Set("ETag", encodedETag(etag, coding))
+			}
+			f, d = sf, sd
+			sidecar = true
+		}
+	}
+
+	size := d.Size()
+	var content io.ReadSeeker
+	if fh.hot != nil && !sidecar {
+		if data := fh.hotContent(w, r, name, d, !asIs); data != nil {
+			content, size = bytes.NewReader(data), int64(len(data))
+		}
+	}
+	if content == nil {
+		content = fh.tuneFile(f, d.Size())
+	}
+
 	// serveContent will check modification time
-	sizeFunc := func() (int64, error) { return d.Size(), nil }
-	serveContent(w, r, d.Name(), d.ModTime(), sizeFunc, f)
+	sizeFunc := func() (int64, error) { return size, nil }
+	tw, done := fh.transfers.track(w, r, name)
+	defer done()
+	sw := &statusWriter{ResponseWriter: tw}
+	serveContent(sw, r, ctypeName, d.ModTime(), sizeFunc, content)
+	if sw.status < 400 {
+		fh.publishSent(r, name, sw, size)
+	}
+}
+
+// error replies to the request with the HTTP error mapped from err, which
+// occurred while serving name.
+func (fh *fileHandler) error(w http.ResponseWriter, r *http.Request, name string, err error) {
+	sw := &statusWriter{ResponseWriter: w}
+	fh.errorHandler.ServeError(sw, r, err)
+	fh.publish(r, EventError, name, sw.status, -1, err)
+}
+
+func (fh *fileHandler) publish(r *http.Request, kind EventKind, name string, status int, size int64, err error) {
+	fh.events.Publish(Event{
+		Kind:       kind,
+		Method:     r.Method,
+		Path:       name,
+		RemoteAddr: r.RemoteAddr,
+		RequestID:  requestID(r),
+		Principal:  principalName(r),
+		Country:    geoOf(r).Country,
+		ASN:        geoOf(r).ASN,
+		Status:     status,
+		Size:       size,
+		Sent:       -1,
+		Err:        err,
+	})
+}
+
+// publishSent publishes an EventServed for the response written through
+// sw, including the number of body bytes actually sent, or an
+// EventAborted if the request's context ended meanwhile.
+func (fh *fileHandler) publishSent(r *http.Request, name string, sw *statusWriter, size int64) {
+	kind, err := EventServed, r.Context().Err()
+	if err != nil {
+		kind = EventAborted
+		fh.aborted.add(r.Context(), sw.written)
+	}
+	fh.usage.add(usageClient(r), sw.written)
+	if fh.index != nil && kind == EventServed && sw.status == http.StatusOK && r.Method == "GET" {
+		fh.index.count(name)
+	}
+	fh.events.Publish(Event{
+		Kind:       kind,
+		Method:     r.Method,
+		Path:       name,
+		RemoteAddr: r.RemoteAddr,
+		RequestID:  requestID(r),
+		Principal:  principalName(r),
+		Country:    geoOf(r).Country,
+		ASN:        geoOf(r).ASN,
+		Status:     sw.status,
+		Size:       size,
+		Sent:       sw.written,
+		Err:        err,
+	})
 }
 
 // toHTTPError returns a non-specific HTTP error message and status code
@@ -626,12 +1043,24 @@ func serveFile(w http.ResponseWriter, r *http.Request, hfs http.FileSystem, name
 // actually return err.Error(), since msg and httpStatus are returned to users,
 // and historically Go's ServeContent always returned just "404 Not Found" for
 // all errors. We don't want to start leaking information in error messages.
+//
+// Each call counts err in its class; see classifyError.
 func toHTTPError(err error) (msg string, httpStatus int) {
-	if errors.Is(err, fs.ErrNotExist) {
+	class := classifyError(err)
+	atomic.AddUint64(&errorCounts[class], 1)
+	switch class {
+	case classNotExist, classNotDir, classNameTooLong:
 		return "404 page not found", http.StatusNotFound
-	}
-	if errors.Is(err, fs.ErrPermission) {
+	case classPermission:
 		return "403 Forbidden", http.StatusForbidden
+	case classLoop:
+		return "508 Loop Detected", http.StatusLoopDetected
+	case classTooManyFiles, classCanceled:
+		return "503 Service Unavailable", http.StatusServiceUnavailable
+	case classSlowBackend:
+		return "504 Gateway Timeout: storage not responding", http.StatusGatewayTimeout
+	case classBadPath:
+		return "400 Bad Request", http.StatusBadRequest
 	}
 	// Default:
 	return "500 Internal Server Error", http.StatusInternalServerError
@@ -650,6 +1079,525 @@ func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
 type fileHandler struct {
 	root     http.FileSystem
 	excludes []*regexp.Regexp
+	events   *EventBus
+
+	errorHandler    ErrorHandler
+	noTransforms    []*regexp.Regexp
+	headers         http.Header
+	maxTransfer     time.Duration
+	aborted         *abortCounts
+	windows         []AccessWindow
+	visibilityRules []VisibilityRule
+	limiters        []*limiter
+	readBuffer      int
+	dropPageCache   int64
+	workers         *workerPool
+	thumbSizes      recentSizes
+	transfers       *transferTable
+	less            func(a, b string) bool
+	lang            string
+	theme           string
+	customCSS       string
+	copyLinks       bool
+	publicURL       string
+	write           bool
+	shortLinks      *shortLinks
+	maxBody         int64
+	minBodyRate     int64
+	maxUpload       int64
+	uploadPolicies  []UploadPolicy
+	uploads         *uploadTable
+	methodOverride  bool
+	etagPolicy      string
+	adminToken      string
+	purges          purgeLog
+	listings        *listingCache
+	maxEntries      int
+	usage           *usageMeter
+	fallback        http.Handler
+	cdn             string
+	cdnRules        []CDNRule
+	signedURLs      string
+	signKey         []byte
+	signingKey      *MinisignKey
+	signedPrefixes  []string
+	writeRoot       Dir
+	precompressed   bool
+	hot             *hotCache
+
+	renderMarkdown   bool
+	markdownTemplate *template.Template
+
+	ssiExts []string
+
+	cacheDir        string
+	sharedCache     bool
+	index           *metaIndex
+	archives        string
+	archiveMaxFiles int
+	archiveMaxBytes int64
+	archiveNormal   bool
+	transliterate   bool
+	crawlers        *crawlerGuard
+	shedder         *loadShedder
+	honeypots       *honeypots
+	geoip           *geoIP
+	perms           *permissions
+	sessions        *sessionStore
+	integrity       *integrityChecker
+	pullSync        *pullSync
+	retention       *retention
+	journal         *journal
+	bandwidth       *bandwidth
+	temps           *tempFiles
+	writeTemps      *tempFiles
+	flights         flightGroup
+	resizeImages    bool
+	stripEXIF       bool
+	transforms      []TransformRule
+	hls             *hlsPackager
+	logViewer       bool
+	prettyViewer    bool
+	api             bool
+	cas             bool
+	casMu           sync.Mutex // held while pruning the store
+	checksums       *checksumCache
+	sitemap         *sitemap
+	dev             bool
+	changes         bool
+	debugEcho       bool
+	tail            bool
+	tailRate        int
+	watcher         *watcher
+	growing         bool
+	metafiles       bool
+}
+
+// Options configures the handler returned by NewFileServer.
+type Options struct {
+	// Excludes hides every path matching one of the expressions, with
+	// the leading '/' removed, from listings and requests.
+	Excludes []*regexp.Regexp
+
+	// NoTransforms lists expressions, matched like Excludes, of the
+	// files always served byte for byte as they are, with
+	// Cache-Control: no-transform, despite the options transforming
+	// files. Requests with Cache-Control: no-transform get any file so,
+	// but still with metadata stripped and server-side includes
+	// expanded, which clients may not opt out of.
+	NoTransforms []*regexp.Regexp
+
+	// Events, if non-nil, receives an Event for each file served,
+	// request denied, and error.
+	Events *EventBus
+
+	// ErrorHandler, if non-nil, replies to requests that failed.
+	// The default is DefaultErrorHandler.
+	ErrorHandler ErrorHandler
+
+	// Headers are set on every response as its header is written,
+	// replacing those set by midserve and by wrapping handlers. A header with only an empty value is removed,
+	// for example to hide a Server header added by a proxy library.
+	Headers http.Header
+
+	// MaxTransfer, if positive, is the time after which a request is
+	// aborted, with its reads from the root and writes to the client
+	// failing. This includes event streams, which clients reconnect.
+	MaxTransfer time.Duration
+
+	// FSTimeout, if positive, bounds how long opening a file, reading
+	// its metadata or a directory may take, as on a stalled network
+	// file system. Requests waiting longer fail with 504 Gateway
+	// Timeout, counted as slow_backend at /_admin/errors, instead of
+	// hanging for as long as the file system does.
+	FSTimeout time.Duration
+
+	// Precompressed serves "name.br" or "name.gz" in place of name to
+	// clients accepting Brotli or gzip, if they have the modification
+	// time of name. The precompress command writes gzip ones only, as
+	// there is no Brotli encoder in the standard library; "brotli -k"
+	// writes Brotli ones.
+	Precompressed bool
+
+	// HotCacheSize, if positive, keeps the files of up to 1 MiB that are
+	// requested most, such as several times within seconds, in memory,
+	// that many bytes together, along with a gzip variant served to
+	// clients accepting gzip if they compress.
+	HotCacheSize int64
+
+	// RenderMarkdown serves markdown files as HTML pages, unless the
+	// query has raw=1. MarkdownTemplate, if non-nil, is the page layout,
+	// executed with a markdownPage.
+	RenderMarkdown   bool
+	MarkdownTemplate *template.Template
+
+	// SSIExts lists the lower case extensions, including the dot, of
+	// files whose server-side include directives are expanded.
+	SSIExts []string
+
+	// CacheDir is the directory derived files, such as resized images,
+	// are cached in. It is required by ResizeImages and StripEXIF.
+	CacheDir string
+
+	// Archives, if set, serves directories requested with ?archive=zip
+	// as zip files of what their listings show, "stream" zipping them
+	// as they are sent, without a length, "spool" in CacheDir first,
+	// so that downloads can be resumed. ArchiveMaxFiles and
+	// ArchiveMaxBytes, if positive, refuse larger directories.
+	Archives        string
+	ArchiveMaxFiles int
+	ArchiveMaxBytes int64
+	// ArchiveNormalize gives all files in archives the same time and
+	// permissions, so that archives of trees with the same names and
+	// contents are identical byte for byte, wherever they were copied.
+	ArchiveNormalize bool
+
+	// Transliterate replaces letters with diacritics and Cyrillic ones
+	// in the ASCII file names of Content-Disposition headers, for clients
+	// that don't understand the UTF-8 ones, instead of underscores.
+	// Files are sent as attachments with ?download.
+	Transliterate bool
+
+	// CrawlerLimit, if positive, logs clients requesting more than this
+	// many distinct query variants of directory URLs within a minute,
+	// the mark of crawlers looping through listing links. CrawlerBlock
+	// replies 429 Too Many Requests to them for the rest of the minute.
+	CrawlerLimit int
+	CrawlerBlock bool
+
+	// MaxInFlight, if positive, turns away requests of the classes in
+	// Shed with 503 Service Unavailable as the requests in flight near
+	// it, those of the first class first: of n classes, the i-th from
+	// i*MaxInFlight/n requests. Other classes are never turned away.
+	MaxInFlight int
+	Shed        []string
+
+	// TempDir, if set, holds cache files while they are written; it must
+	// be on the file system of CacheDir. By default they are written to
+	// .midserve-tmp in CacheDir, and uploaded and pulled files to
+	// .midserve-tmp in the root, which must not span file systems then.
+	// Temporary files left behind there by an interrupted run are
+	// removed on start.
+	TempDir string
+
+	// SharedCache coordinates with other processes using the same
+	// CacheDir and Index, such as behind a port shared with -reuse-port,
+	// so that they use the cache files and checksums the others computed
+	// and only one rescans the index per IndexInterval. Each cache file
+	// is renamed into place under the lock file next to it. Index and
+	// CacheDir must be on a file system with working file locks.
+	SharedCache bool
+
+	// ResizeImages serves images requested with w, h or q query
+	// parameters scaled down to fit, re-encoded with quality q.
+	ResizeImages bool
+
+	// StripEXIF serves JPEG and PNG images without EXIF, XMP and IPTC
+	// metadata, such as GPS locations. HEIC and HEIF images, whose
+	// metadata isn't stripped, are refused with 403 Forbidden and left
+	// out of archives.
+	StripEXIF bool
+
+	// Transforms are offered as ?transform=<name> and cached in
+	// CacheDir.
+	Transforms []TransformRule
+
+	// AccessWindows restrict when paths can be accessed, for example
+	// to publish an embargoed release at a given time.
+	AccessWindows []AccessWindow
+
+	// Visibility rules decide per path whether it is listed and
+	// served; the first matching rule applies.
+	Visibility []VisibilityRule
+
+	// ConcurrencyLimits bound the simultaneous downloads of popular
+	// files, so they don't saturate the disk for everything else.
+	ConcurrencyLimits []ConcurrencyLimit
+
+	// ReadBuffer is the size of the buffer files are sent with. Zero
+	// keeps the default of net/http.
+	ReadBuffer int
+
+	// DropPageCache, if positive, is the size from which files are
+	// read with sequential access advice and their pages are dropped
+	// from the page cache once sent. Only effective on Linux.
+	DropPageCache int64
+
+	// Workers, if positive, is the number of background workers
+	// computing the checksums of served files ahead of their use by the
+	// API and metafiles, the gzip variants of hot files, and with
+	// ResizeImages the variants of listed images in the sizes requested
+	// last, such as thumbnails.
+	Workers int
+
+	// Sort orders directory listings: "lexical", the default,
+	// "natural" for file2 before file10, or "locale" for natural and
+	// case-insensitive. Unknown values are lexical.
+	Sort string
+
+	// Lang fixes the language of listings, e.g. "de". By default it is
+	// negotiated from Accept-Language.
+	Lang string
+
+	// Theme styles listings: "light", "dark", or "auto" to follow the
+	// browser's preference. Empty leaves the browser's defaults.
+	Theme string
+
+	// CustomCSS is added to the style of listings after the theme.
+	CustomCSS string
+
+	// CopyLinks adds buttons to listings that copy the URL of a file, or
+	// a curl or wget command downloading it, to the clipboard.
+	CopyLinks bool
+
+	// BaseURL is the externally visible URL of the root, such as
+	// "https://files.example.com", used where absolute URLs are shown.
+	// By default it is taken from the request.
+	BaseURL string
+
+	// Write enables the management API, /_api/upload, /_api/delete and
+	// /_api/move, and uploads and bulk operations in listings using it,
+	// as well as PUT and DELETE of file paths. It requires API and a
+	// root of type Dir, and is ignored otherwise.
+	Write bool
+
+	// ShortLinks, if set, is the file storing short links: /s/<id>
+	// redirects to the path it was created for with POST
+	// /_api/shorten?path=, which requires API and the upload role.
+	ShortLinks string
+
+	// MaxBodySize bounds the request bodies of endpoints that change
+	// files; 0 means 1 MiB. MinBodyRate, if positive, is the average
+	// rate in bytes per second below which such a body is cut off,
+	// after a grace period of 10 seconds.
+	MaxBodySize int64
+	MinBodyRate int64
+
+	// MaxUploadSize bounds the request bodies of /_api/upload, 0 means
+	// no limit. MinBodyRate applies to them as well.
+	MaxUploadSize int64
+
+	// UploadPolicies constrain the names of uploaded files per
+	// directory: their extensions, a pattern, lower case, and numbered
+	// names instead of refusal when a name is taken.
+	UploadPolicies []UploadPolicy
+
+	// MethodOverride treats POST requests with an
+	// X-HTTP-Method-Override header of PUT or DELETE as using that
+	// method, for clients that can only send GET and POST.
+	MethodOverride bool
+
+	// ETag is the entity tag policy of files: "weak", the default, for
+	// tags from the modification time and size, "strong" for tags from
+	// the SHA-256 of the content, or "none".
+	ETag string
+
+	// AdminToken, if set, enables the endpoints under /_admin/, such as
+	// /_admin/purge, for requests with it as their bearer token.
+	AdminToken string
+
+	// ListingCache, if positive, caches the entries of directories for
+	// that long while their modification time is unchanged. Expired
+	// entries are still served for up to ListingMaxStale longer while
+	// they are refreshed in the background.
+	ListingCache    time.Duration
+	ListingMaxStale time.Duration
+
+	// ListingMaxEntries, if positive, limits listings to that many
+	// entries, with links to the next pages, ?page=2 and on, so that
+	// huge directories don't produce pages no browser can render.
+	ListingMaxEntries int
+
+	// TransferCap, if positive, is the number of bytes a client, as
+	// identified by its principal or else its IP address, may be sent
+	// during TransferWindow, by default 24 hours. Beyond, requests for
+	// files get 429 until older transfers leave the rolling window,
+	// and followed logs end. Usage is reported at /_admin/usage either
+	// way.
+	TransferCap    int64
+	TransferWindow time.Duration
+
+	// FallbackProxy, if set, gets the requests for paths that don't
+	// exist and those with methods files don't allow, so that the files
+	// can be served in front of an application server.
+	FallbackProxy *url.URL
+
+	// CDN, if set, adds the surrogate cache headers of a CDN, "generic",
+	// "fastly", "cloudflare" or "akamai", to files and listings: the
+	// policy and tags of CDNRules, and tags for the directories a path
+	// is in. /_admin/cdn-tags tells the tags to purge for a path.
+	CDN      string
+	CDNRules []CDNRule
+
+	// SignedURLs, if set, requires files and listings below
+	// SignedPrefixes, or everywhere if there are none, to be requested
+	// with a URL signed with SignKey, rejecting others with 403
+	// Forbidden. The scheme is "hmac", as created by "midserve sign",
+	// or "cloudflare" or "akamai" for the tokens of those CDNs. API
+	// requests about such paths are rejected likewise, and the API,
+	// admin and debug routes are refused where signatures are required.
+	SignedURLs     string
+	SignKey        []byte
+	SignedPrefixes []string
+
+	// MinisignKey, if set, signs files requested with the extension
+	// .minisig or .sig appended, for minisign -V, unless such a file
+	// exists. Signatures are cached in CacheDir. The public key is
+	// served as /_signing-key.pub.
+	MinisignKey *MinisignKey
+
+	// Honeypots are decoy paths, such as /wp-admin or /.env, which no
+	// legitimate client requests. Requests for them, and below them,
+	// get HoneypotStatus, 404 by default, and their clients are listed
+	// at /_admin/honeypots. If HoneypotBan is positive, all requests of
+	// such clients are refused with 403 Forbidden for that long.
+	Honeypots      []string
+	HoneypotStatus int
+	HoneypotBan    time.Duration
+
+	// GeoIP are MaxMind DB files, of countries or ASNs, that the
+	// country and ASN of clients in events are looked up in. If GeoAllow
+	// is set, only clients from those countries are served, and those
+	// from GeoDeny never are; they are refused with 403 Forbidden.
+	// Countries are ISO 3166-1 codes, "-" stands for unknown ones.
+	GeoIP    []*MMDB
+	GeoAllow []string
+	GeoDeny  []string
+
+	// Principals, if any, are the clients identified by bearer tokens,
+	// with their grants; Anonymous are the grants of requests without a
+	// token. Every request then needs the role it takes for its paths:
+	// read for files, listings and the API reporting on them, upload for
+	// /_api/upload, manage for /_api/delete and /_api/move, and admin on
+	// the root for /_admin/, besides AdminToken.
+	Principals []Principal
+	Anonymous  []Grant
+	// APIKeys, if set, is the state file of API keys managed with
+	// "midserve token", principals as well. It is read again when it
+	// changes.
+	APIKeys string
+
+	// Sessions lets browsers sign in with the token of a principal at
+	// /_login, keeping them signed in with a cookie for SessionTTL or
+	// until they sign out at /_logout. State-changing requests in a
+	// session must repeat the token of the midserve_csrf cookie in an
+	// X-CSRF-Token header. It requires Principals or APIKeys; /_whoami tells the
+	// principal of a request either way.
+	Sessions   bool
+	SessionTTL time.Duration
+
+	// HLS serves videos packaged for HTTP Live Streaming under
+	// "<file>/hls/index.m3u8", running FFmpeg (default "ffmpeg") on
+	// first access and caching the result in CacheDir.
+	HLS    bool
+	FFmpeg string
+
+	// LogViewer serves .log and .txt files requested with ?view=log in
+	// a page that follows the file as it grows, rendering ANSI colors.
+	LogViewer bool
+
+	// PrettyViewer serves .json and .yaml files requested with
+	// ?view=pretty as a collapsible, highlighted tree.
+	PrettyViewer bool
+
+	// API enables the endpoints under /_api/, such as /_api/diff.
+	API bool
+
+	// CAS serves snapshots of files under /_cas/<sha256>, taken by
+	// /_api/resolve?path= and stored in CacheDir.
+	CAS bool
+
+	// SitemapBase, if non-nil, enables /sitemap.xml listing the HTML
+	// files with URLs relative to it, regenerated every SitemapRefresh,
+	// by default every hour.
+	SitemapBase    *url.URL
+	SitemapRefresh time.Duration
+
+	// Index, if set, is the file keeping an index of the tree, rescanned
+	// every IndexInterval, with the checksums of files once computed and
+	// how often they were downloaded. /_api/search searches and sorts
+	// it; its checksums survive restarts.
+	Index         string
+	IndexInterval time.Duration
+
+	// PullFrom, if set, is the root URL of another instance serving the
+	// API, whose tree is mirrored into the root, a Dir, every
+	// PullInterval: files that changed according to its manifest are
+	// downloaded, at up to PullRate bytes per second if positive, and
+	// checked against their checksums. Of files changed locally, only
+	// the blocks that differ are downloaded. PullConflict decides
+	// whether a local file that differs is replaced: "upstream" (the
+	// default) always, "newer" if the upstream file is newer, "keep"
+	// never. PullDelete removes files missing upstream, unless
+	// PullConflict is "keep", but none if the manifest is empty or more
+	// than PullDeleteMax, if positive, would go.
+	PullFrom      *url.URL
+	PullInterval  time.Duration
+	PullRate      int64
+	PullConflict  string
+	PullDelete    bool
+	PullDeleteMax int
+
+	// VerifyInterval, if positive, re-hashes VerifyFraction of the files
+	// with a checksum in the Index that often, least recently verified
+	// first. Files whose content changed while their size and
+	// modification time did not are logged, reported at
+	// /_admin/integrity and posted to VerifyWebhook, if set.
+	VerifyInterval time.Duration
+	VerifyFraction float64
+	VerifyWebhook  string
+
+	// Bandwidth, if positive, limits all responses together to that
+	// many bytes per second, except while a rule of BandwidthSchedule
+	// sets another rate, 0 for no limit.
+	Bandwidth         int64
+	BandwidthSchedule []BandwidthRule
+
+	// Journal, if set, is the file uploads, deletions and moves through
+	// the management API are appended to, each before it is made and
+	// again once it is done, listed at /_admin/journal.
+	Journal string
+
+	// Retention rules delete old entries of directories that only grow,
+	// such as drop folders, every RetentionInterval, or only log what
+	// they would delete with RetentionDryRun. They need a Dir root.
+	Retention         []RetentionRule
+	RetentionInterval time.Duration
+	RetentionDryRun   bool
+
+	// Dev injects a script into HTML pages that reloads them when
+	// anything in the tree changes, and disables their caching.
+	Dev bool
+
+	// Changes enables /_events, streaming the files created, modified
+	// and removed below the directory given by its path parameter.
+	Changes bool
+
+	// DebugEcho enables /_debug/echo, reflecting the headers of requests,
+	// the client address, the TLS connection and the route and policies
+	// of the path following it, for debugging proxies and rewrites. Any
+	// client may use it, and see the headers proxies add.
+	DebugEcho bool
+
+	// Tail enables /_tail, streaming the lines appended to a text file
+	// given by its path parameter, at most TailRate a second to each
+	// client, or any number if zero.
+	Tail     bool
+	TailRate int
+
+	// WatchInterval is how often the tree is scanned for changes while
+	// a client follows them. Zero means once a second.
+	WatchInterval time.Duration
+
+	// Growing supports files that are still being written: follow=1
+	// streams a file from offset as it grows, and wait=<duration> holds
+	// a range request past the current end until the file reaches it.
+	Growing bool
+
+	// Metafiles serves ?format=torrent and ?format=metalink documents
+	// for files, with their checksums and URL as web seed. The
+	// checksums are cached in CacheDir.
+	Metafiles bool
 }
 
 // FileServer returns a handler that serves HTTP requests
@@ -662,14 +1610,211 @@ type fileHandler struct {
 // To use the operating system's file system implementation,
 // use http.Dir:
 //
-//     http.Handle("/", http.FileServer(http.Dir("/tmp")))
+//	http.Handle("/", http.FileServer(http.Dir("/tmp")))
 //
 // To use an fs.FS implementation, use http.FS to convert it:
 //
 //	http.Handle("/", http.FileServer(http.FS(fsys)))
-//
 func FileServer(root http.FileSystem, excludes []*regexp.Regexp) http.Handler {
-	return &fileHandler{root, excludes}
+	return NewFileServer(root, Options{Excludes: excludes})
+}
+
+// NewFileServer is like FileServer but takes its configuration from opts.
+func NewFileServer(root http.FileSystem, opts Options) http.Handler {
+	served := root
+	if opts.FSTimeout > 0 {
+		served = &timeoutFS{fs: root, timeout: opts.FSTimeout}
+	}
+	fh := &fileHandler{
+		root:            served,
+		excludes:        opts.Excludes,
+		noTransforms:    opts.NoTransforms,
+		events:          opts.Events,
+		errorHandler:    opts.ErrorHandler,
+		headers:         opts.Headers,
+		maxTransfer:     opts.MaxTransfer,
+		windows:         opts.AccessWindows,
+		visibilityRules: opts.Visibility,
+		limiters:        newLimiters(opts.ConcurrencyLimits),
+		shedder:         newLoadShedder(opts.MaxInFlight, opts.Shed),
+		readBuffer:      opts.ReadBuffer,
+		dropPageCache:   opts.DropPageCache,
+		precompressed:   opts.Precompressed,
+
+		renderMarkdown:   opts.RenderMarkdown,
+		markdownTemplate: opts.MarkdownTemplate,
+
+		ssiExts: opts.SSIExts,
+
+		cacheDir:        opts.CacheDir,
+		sharedCache:     opts.SharedCache,
+		archives:        opts.Archives,
+		archiveMaxFiles: opts.ArchiveMaxFiles,
+		archiveMaxBytes: opts.ArchiveMaxBytes,
+		archiveNormal:   opts.ArchiveNormalize,
+		transliterate:   opts.Transliterate,
+		temps:           &tempFiles{dir: opts.TempDir},
+		resizeImages:    opts.ResizeImages,
+		stripEXIF:       opts.StripEXIF,
+		transforms:      opts.Transforms,
+		logViewer:       opts.LogViewer,
+		prettyViewer:    opts.PrettyViewer,
+		api:             opts.API,
+		cas:             opts.CAS,
+		checksums:       newChecksumCache(),
+		transfers:       newTransferTable(),
+		aborted:         new(abortCounts),
+		less:            lexicalLess,
+		lang:            opts.Lang,
+		maxBody:         opts.MaxBodySize,
+		minBodyRate:     opts.MinBodyRate,
+		maxUpload:       opts.MaxUploadSize,
+		uploadPolicies:  opts.UploadPolicies,
+		uploads:         newUploadTable(),
+		methodOverride:  opts.MethodOverride,
+		etagPolicy:      opts.ETag,
+		adminToken:      opts.AdminToken,
+		maxEntries:      opts.ListingMaxEntries,
+		usage:           newUsageMeter(opts.TransferWindow, opts.TransferCap),
+		cdn:             opts.CDN,
+		cdnRules:        opts.CDNRules,
+		signedURLs:      opts.SignedURLs,
+		signKey:         opts.SignKey,
+		signingKey:      opts.MinisignKey,
+		signedPrefixes:  opts.SignedPrefixes,
+		theme:           opts.Theme,
+		customCSS:       opts.CustomCSS,
+		copyLinks:       opts.CopyLinks,
+		publicURL:       strings.TrimSuffix(opts.BaseURL, "/"),
+	}
+	if d, ok := root.(Dir); ok && opts.Write && opts.API {
+		fh.write, fh.writeRoot = true, d
+	}
+	if opts.Bandwidth > 0 || len(opts.BandwidthSchedule) > 0 {
+		fh.bandwidth = &bandwidth{rate: opts.Bandwidth, schedule: opts.BandwidthSchedule}
+	}
+	if fh.write && opts.Journal != "" {
+		fh.journal = newJournal(opts.Journal)
+	}
+	if opts.FallbackProxy != nil {
+		fh.fallback = newFallbackProxy(opts.FallbackProxy)
+	}
+	if opts.ListingCache > 0 {
+		fh.listings = newListingCache(served, opts.ListingCache, opts.ListingMaxStale)
+	}
+	if opts.ShortLinks != "" {
+		// The store may be on any file system.
+		fh.shortLinks = newShortLinks(opts.ShortLinks, &tempFiles{})
+	}
+	if less, err := nameOrder(opts.Sort); err == nil {
+		fh.less = less
+	}
+	if opts.TempDir == "" && opts.CacheDir != "" {
+		fh.temps.dir = filepath.Join(opts.CacheDir, tempDirName)
+	}
+	if fh.temps.dir != "" {
+		go cleanTemps(fh.temps.dir)
+	}
+	if d, ok := root.(Dir); ok && opts.PullFrom != nil {
+		conflict := opts.PullConflict
+		if conflict == "" {
+			conflict = "upstream"
+		}
+		fh.writeRoot = d
+		fh.pullSync = &pullSync{
+			from:      opts.PullFrom,
+			interval:  opts.PullInterval,
+			rate:      opts.PullRate,
+			conflict:  conflict,
+			delete:    opts.PullDelete,
+			deleteMax: opts.PullDeleteMax,
+			client:    &http.Client{Timeout: time.Hour},
+		}
+	}
+	if fh.write || fh.pullSync != nil {
+		// Uploads and pulls write their temporary files to a directory
+		// of their own in the root, on its file system, never next to
+		// the files of users.
+		fh.writeTemps = &tempFiles{dir: fh.writeRoot.osPath("/" + tempDirName)}
+		go cleanTemps(fh.writeTemps.dir)
+	}
+	if fh.pullSync != nil {
+		go fh.runPull()
+	}
+	if d, ok := root.(Dir); ok && len(opts.Retention) > 0 {
+		interval := opts.RetentionInterval
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		fh.retention = &retention{root: d, rules: opts.Retention, interval: interval, dryRun: opts.RetentionDryRun}
+		go fh.runRetention()
+	}
+	if opts.Index != "" {
+		fh.index = newMetaIndex(opts.Index, root, opts.Excludes, opts.IndexInterval)
+		fh.index.shared = opts.SharedCache
+		go fh.index.run(fh.checksums)
+		if opts.VerifyInterval > 0 {
+			fh.integrity = &integrityChecker{index: fh.index, interval: opts.VerifyInterval, fraction: opts.VerifyFraction, webhook: opts.VerifyWebhook}
+			go fh.integrity.run()
+		}
+	}
+	if opts.Workers > 0 {
+		fh.workers = newWorkerPool(opts.Workers)
+	}
+	if opts.HotCacheSize > 0 {
+		fh.hot = newHotCache(opts.HotCacheSize)
+	}
+	if len(opts.Principals) > 0 || opts.APIKeys != "" {
+		var keys *apiKeys
+		if opts.APIKeys != "" {
+			keys = newAPIKeys(opts.APIKeys)
+		}
+		fh.perms = newPermissions(opts.Principals, keys, opts.Anonymous)
+		if opts.Sessions {
+			ttl := opts.SessionTTL
+			if ttl <= 0 {
+				ttl = 12 * time.Hour
+			}
+			fh.sessions = newSessionStore(ttl)
+		}
+	}
+	if len(opts.GeoIP) > 0 {
+		fh.geoip = newGeoIP(opts.GeoIP, opts.GeoAllow, opts.GeoDeny)
+	}
+	if len(opts.Honeypots) > 0 {
+		status := opts.HoneypotStatus
+		if status == 0 {
+			status = http.StatusNotFound
+		}
+		fh.honeypots = newHoneypots(opts.Honeypots, status, opts.HoneypotBan)
+	}
+	if opts.CrawlerLimit > 0 {
+		fh.crawlers = newCrawlerGuard(opts.CrawlerLimit, opts.CrawlerBlock)
+	}
+	fh.dev = opts.Dev
+	fh.changes = opts.Changes
+	fh.debugEcho = opts.DebugEcho
+	fh.tail = opts.Tail
+	fh.tailRate = opts.TailRate
+	fh.growing = opts.Growing
+	fh.metafiles = opts.Metafiles
+	if fh.dev || fh.changes {
+		fh.watcher = newWatcher(root, opts.Excludes, opts.WatchInterval)
+	}
+	if opts.SitemapBase != nil {
+		fh.sitemap = newSitemap(opts.SitemapBase, opts.SitemapRefresh)
+		go fh.runSitemap()
+	}
+	if opts.HLS {
+		fh.hls = newHLSPackager(opts.FFmpeg)
+	}
+	if fh.markdownTemplate == nil {
+		fh.markdownTemplate = defaultMarkdownTemplate
+	}
+	if fh.errorHandler == nil {
+		fh.errorHandler = DefaultErrorHandler
+	}
+	return fh
 }
 
 func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -678,7 +1823,121 @@ func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		upath = "/" + upath
 		r.URL.Path = upath
 	}
-	serveFile(w, r, f.root, path.Clean(upath), true, f.excludes)
+	r = withRequestID(w, r)
+	r = f.withGeo(r)
+	w = f.decorate(w)
+	name, ok := f.checkPath(w, r, upath)
+	if !ok {
+		return
+	}
+	done := f.admit(w, r, name)
+	if done == nil {
+		return
+	}
+	defer done()
+	if f.maxTransfer > 0 {
+		// Reads from the root fail once the context is done, writes to
+		// a client that stopped reading once the deadline passed.
+		ctx, cancel := context.WithTimeout(r.Context(), f.maxTransfer)
+		defer cancel()
+		r = r.WithContext(ctx)
+		rc := http.NewResponseController(w)
+		if rc.SetWriteDeadline(time.Now().Add(f.maxTransfer)) == nil {
+			defer rc.SetWriteDeadline(time.Time{})
+		}
+	}
+	if f.bandwidth != nil {
+		w = &bandwidthWriter{ResponseWriter: w, b: f.bandwidth, ctx: r.Context()}
+	}
+	if !strings.HasPrefix(name, adminPrefix) && (!f.checkHoneypot(w, r, name) || !f.checkGeo(w, r, name)) {
+		return
+	}
+	if f.methodOverride {
+		r = overrideMethod(r)
+	}
+	if !f.checkMethod(w, r, name) {
+		return
+	}
+	if r = f.authenticate(w, r, name); r == nil {
+		return
+	}
+	if r = f.withSession(w, r, name); r == nil {
+		return
+	}
+	if f.sessions != nil && (name == loginPath || name == logoutPath) {
+		if name == loginPath {
+			f.serveLogin(w, r)
+		} else {
+			f.serveLogout(w, r)
+		}
+		return
+	}
+	if f.perms != nil && name == whoamiPath {
+		f.serveWhoami(w, r)
+		return
+	}
+	if (strings.HasPrefix(name, apiPrefix) || strings.HasPrefix(name, adminPrefix) || underPrefix(name, debugEchoPath)) &&
+		!f.checkSignedRoute(w, r, name) {
+		return
+	}
+	if f.debugEcho && underPrefix(name, debugEchoPath) {
+		f.serveDebugEcho(w, r, name)
+		return
+	}
+	if f.api && strings.HasPrefix(name, apiPrefix) {
+		f.serveAPI(w, r, name)
+		return
+	}
+	if (f.adminToken != "" || f.perms != nil) && strings.HasPrefix(name, adminPrefix) {
+		f.serveAdmin(w, r, name)
+		return
+	}
+	if r.Method == "PUT" || r.Method == "DELETE" {
+		// Only allowed in write mode.
+		f.serveFileMethod(w, r, name)
+		return
+	}
+	if !f.checkSignature(w, r, name) || !f.checkPermitted(w, r, name, RoleRead) {
+		return
+	}
+	if f.shortLinks != nil && strings.HasPrefix(name, shortLinkPrefix) {
+		f.serveShortLink(w, r, name)
+		return
+	}
+	if f.changes && name == changesPath {
+		f.serveChanges(w, r)
+		return
+	}
+	if f.tail && name == tailPath {
+		f.serveTail(w, r)
+		return
+	}
+	if f.dev && name == devReloadPath {
+		f.serveDevReload(w, r)
+		return
+	}
+	if f.signingKey != nil && name == signingKeyPath {
+		f.serveSigningKey(w, r)
+		return
+	}
+	if f.sitemap != nil && name == sitemapPath {
+		f.serveSitemap(w, r)
+		return
+	}
+	if f.cas && strings.HasPrefix(name, casPrefix) {
+		f.serveCAS(w, r, name)
+		return
+	}
+	if f.hls != nil {
+		if m := hlsPathRe.FindStringSubmatch(name); m != nil {
+			f.serveHLS(w, r, m[1], m[2])
+			return
+		}
+	}
+	if f.signingKey != nil && f.serveSignature(w, r, name) {
+		return
+	}
+	f.serveFile(w, r, name, true)
 }
 
 // httpRange specifies the byte range to be sent to the client.
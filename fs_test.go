@@ -0,0 +1,207 @@
+package midserve
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+// newTestServer serves root with the options of the default
+// configuration changed by set, if not nil.
+func newTestServer(t *testing.T, root http.FileSystem, set func(*Options)) http.Handler {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.CacheDir = t.TempDir()
+	opts, err := cfg.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set != nil {
+		set(&opts)
+	}
+	return NewFileServer(root, opts)
+}
+
+func TestServeFile(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.txt", "hello").
+		File("docs/b.txt", "b").
+		HTTP()
+	h := newTestServer(t, root, nil)
+
+	midservetest.Get(t, h, "/a.txt").
+		Status(http.StatusOK).
+		Header("Content-Length", "5").
+		Header("Last-Modified", "Fri, 01 Jan 2021 00:00:00 GMT").
+		Body("hello")
+	midservetest.Get(t, h, "/missing.txt").
+		Status(http.StatusNotFound)
+	midservetest.Get(t, h, "/docs").
+		Status(http.StatusMovedPermanently).
+		Header("Location", "docs/")
+	midservetest.Get(t, h, "/docs/").
+		Status(http.StatusOK).
+		BodyContains("b.txt")
+}
+
+func TestExcludes(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.txt", "a").
+		File(".git/config", "secret").
+		HTTP()
+	h := newTestServer(t, root, nil)
+
+	midservetest.Get(t, h, "/.git/config").
+		Status(http.StatusNotFound)
+	midservetest.Get(t, h, "/").
+		Status(http.StatusOK).
+		BodyContains("a.txt").
+		BodyNotContains(".git")
+}
+
+func TestDirPreconditions(t *testing.T) {
+	mod := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	root := midservetest.NewFS().
+		Dir("docs").
+		File("docs/a.txt", "a").
+		HTTP()
+	h := newTestServer(t, root, nil)
+
+	res := midservetest.Get(t, h, "/docs/").
+		Status(http.StatusOK).
+		Header("Last-Modified", mod.Format(http.TimeFormat))
+	etag := res.Result().Header.Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("ETag = %q, want a weak tag", etag)
+	}
+
+	for _, tc := range []struct {
+		header []string
+		code   int
+	}{
+		{[]string{"If-None-Match", etag}, http.StatusNotModified},
+		{[]string{"If-None-Match", "*"}, http.StatusNotModified},
+		{[]string{"If-None-Match", `"other"`}, http.StatusOK},
+		{[]string{"If-Modified-Since", mod.Format(http.TimeFormat)}, http.StatusNotModified},
+		{[]string{"If-Modified-Since", mod.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK},
+		// If-None-Match takes precedence.
+		{[]string{"If-None-Match", `"other"`, "If-Modified-Since", mod.Format(http.TimeFormat)}, http.StatusOK},
+		// Weak tags never match strongly.
+		{[]string{"If-Match", etag}, http.StatusPreconditionFailed},
+		{[]string{"If-Match", "*"}, http.StatusOK},
+		{[]string{"If-Unmodified-Since", mod.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusPreconditionFailed},
+		{[]string{"If-Unmodified-Since", mod.Format(http.TimeFormat)}, http.StatusOK},
+		// Listings are sent whole.
+		{[]string{"Range", "bytes=0-9"}, http.StatusOK},
+	} {
+		midservetest.Get(t, h, "/docs/", tc.header...).Status(tc.code)
+	}
+	midservetest.Head(t, h, "/docs/", "If-None-Match", etag).
+		Status(http.StatusNotModified).
+		Body("")
+}
+
+func TestMarkdownPreconditions(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.md", "# A").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) { o.RenderMarkdown = true })
+
+	res := midservetest.Get(t, h, "/a.md").
+		Status(http.StatusOK).
+		BodyContains("<h1")
+	etag := res.Result().Header.Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) || !strings.HasSuffix(etag, `-md"`) {
+		t.Fatalf("ETag = %q, want a weak tag of the rendering", etag)
+	}
+	raw := midservetest.Get(t, h, "/a.md?raw=1").Status(http.StatusOK)
+	if raw.Result().Header.Get("ETag") == etag {
+		t.Errorf("source and rendering share ETag %q", etag)
+	}
+
+	midservetest.Get(t, h, "/a.md", "If-None-Match", etag).
+		Status(http.StatusNotModified).
+		Body("")
+	midservetest.Get(t, h, "/a.md", "If-None-Match", `W/"other"`).
+		Status(http.StatusOK)
+	midservetest.Get(t, h, "/a.md", "If-Match", `"other"`).
+		Status(http.StatusPreconditionFailed)
+}
+
+func TestRanges(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, Dir(dir), nil)
+
+	midservetest.Head(t, h, "/a.txt").
+		Status(http.StatusOK).
+		Header("Content-Length", "10").
+		Header("Accept-Ranges", "bytes").
+		Body("")
+	midservetest.Get(t, h, "/a.txt", "Range", "bytes=2-5").
+		Status(http.StatusPartialContent).
+		Header("Content-Range", "bytes 2-5/10").
+		Header("Content-Length", "4").
+		Body("2345")
+	midservetest.Get(t, h, "/a.txt", "Range", "bytes=-3").
+		Status(http.StatusPartialContent).
+		Header("Content-Range", "bytes 7-9/10").
+		Body("789")
+	midservetest.Head(t, h, "/a.txt", "Range", "bytes=2-5").
+		Status(http.StatusPartialContent).
+		Header("Content-Length", "4").
+		Body("")
+	res := midservetest.Get(t, h, "/a.txt", "Range", "bytes=0-1,8-9").
+		Status(http.StatusPartialContent).
+		BodyContains("Content-Range: bytes 0-1/10\r\n", "\r\n\r\n01\r\n", "Content-Range: bytes 8-9/10\r\n", "\r\n\r\n89\r\n")
+	if ct := res.Result().Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/byteranges; boundary=") {
+		t.Errorf("Content-Type = %q, want multipart/byteranges", ct)
+	}
+	midservetest.Get(t, h, "/a.txt", "Range", "bytes=20-30").
+		Status(http.StatusRequestedRangeNotSatisfiable).
+		Header("Content-Range", "bytes */10")
+}
+
+// TestLargeRange sends a range larger than progressChunk over a real
+// connection, where the file reaches the connection's io.ReaderFrom.
+func TestLargeRange(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 2*progressChunk+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "big"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newTestServer(t, Dir(dir), nil))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/big", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=10-%d", len(data)-11))
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", res.StatusCode)
+	}
+	if !bytes.Equal(body, data[10:len(data)-10]) {
+		t.Errorf("body of %d bytes differs from the range", len(body))
+	}
+}
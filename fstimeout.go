@@ -0,0 +1,144 @@
+// Timeouts of file system operations
+
+package midserve
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// errSlowFS is the error of a file system operation that didn't
+// complete within the timeout.
+var errSlowFS = errors.New("file system not responding")
+
+// slowFSMaxStalled bounds the operations left running after their
+// timeout. Beyond it, operations fail at once rather than pile up
+// goroutines stuck in the file system.
+const slowFSMaxStalled = 256
+
+// timeoutFS is a ContextFileSystem whose Open, Stat, Readdir and
+// ReadDir fail with errSlowFS when they take longer than timeout, as
+// they do on a stalled network file system, rather than hang. The
+// operation itself can't be interrupted: it is left to complete in the
+// background, and a file it opens meanwhile is closed.
+type timeoutFS struct {
+	fs      http.FileSystem
+	timeout time.Duration
+	stalled int64 // atomic
+}
+
+func (t *timeoutFS) Open(name string) (http.File, error) {
+	return t.OpenContext(context.Background(), name)
+}
+
+// OpenContext implements ContextFileSystem.
+func (t *timeoutFS) OpenContext(ctx context.Context, name string) (http.File, error) {
+	var f http.File
+	_, err := t.do(ctx, func() (err error) {
+		f, err = openContext(ctx, t.fs, name)
+		return err
+	}, func() {
+		if f != nil {
+			f.Close()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	tf := &timeoutFile{File: f, t: t, ctx: ctx}
+	if rd, ok := f.(fs.ReadDirFile); ok {
+		return &timeoutDirFile{tf, rd}, nil
+	}
+	return tf, nil
+}
+
+// do runs fn and returns its error, unless it takes longer than the
+// timeout or ctx is done first. Then fn is left running, abandoned is
+// called after it, if not nil, and do returns errSlowFS or ctx.Err().
+// completed tells which; only then may results of fn be used.
+func (t *timeoutFS) do(ctx context.Context, fn func() error, abandoned func()) (completed bool, err error) {
+	if atomic.LoadInt64(&t.stalled) >= slowFSMaxStalled {
+		return false, errSlowFS
+	}
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	err = errSlowFS
+	select {
+	case err := <-done:
+		return true, err
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	atomic.AddInt64(&t.stalled, 1)
+	go func() {
+		<-done
+		atomic.AddInt64(&t.stalled, -1)
+		if abandoned != nil {
+			abandoned()
+		}
+	}()
+	return false, err
+}
+
+// timeoutFile is a file of a timeoutFS. Reads aren't bounded: once
+// part of a file was sent, a timeout can't be reported anyway.
+type timeoutFile struct {
+	http.File
+	t   *timeoutFS
+	ctx context.Context
+}
+
+// timeoutDirFile is a timeoutFile whose underlying file supports
+// fs.ReadDirFile.
+type timeoutDirFile struct {
+	*timeoutFile
+	rd fs.ReadDirFile
+}
+
+func (f *timeoutFile) Stat() (fs.FileInfo, error) {
+	var fi fs.FileInfo
+	if ok, err := f.t.do(f.ctx, func() (err error) {
+		fi, err = f.File.Stat()
+		return err
+	}, nil); !ok || err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (f *timeoutFile) Readdir(count int) ([]fs.FileInfo, error) {
+	var fis []fs.FileInfo
+	ok, err := f.t.do(f.ctx, func() (err error) {
+		fis, err = f.File.Readdir(count)
+		return err
+	}, nil)
+	if !ok {
+		return nil, err
+	}
+	return fis, err
+}
+
+// copyN keeps sendfile available for the underlying file.
+func (f *timeoutFile) copyN(w io.Writer, n int64) (int64, error) {
+	return copyFileN(w, f.File, n)
+}
+
+func (f *timeoutDirFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	var des []fs.DirEntry
+	ok, err := f.t.do(f.ctx, func() (err error) {
+		des, err = f.rd.ReadDir(count)
+		return err
+	}, nil)
+	if !ok {
+		return nil, err
+	}
+	return des, err
+}
@@ -0,0 +1,364 @@
+// GeoIP lookups in MaxMind DB files and access rules by country
+
+package midserve
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB
+// file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errMMDB = errors.New("invalid MaxMind DB")
+
+// An MMDB is a MaxMind DB file, such as GeoLite2-Country or
+// GeoLite2-ASN, read into memory.
+// See https://maxmind.github.io/MaxMind-DB/.
+type MMDB struct {
+	file       string
+	buf        []byte // the search tree
+	data       []byte // the data section
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint // node of ::/96, where IPv4 addresses start
+	ipVersion  uint
+}
+
+// OpenMMDB reads the MaxMind DB file.
+func OpenMMDB(file string) (*MMDB, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: %v: no metadata", file, errMMDB)
+	}
+	meta := b[i+len(mmdbMetadataMarker):]
+	v, _, err := mmdbDecode(meta, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	m, _ := v.(map[string]interface{})
+	db := &MMDB{file: file}
+	for k, p := range map[string]*uint{"node_count": &db.nodeCount, "record_size": &db.recordSize, "ip_version": &db.ipVersion} {
+		n, ok := m[k].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("%s: %v: no %s", file, errMMDB, k)
+		}
+		*p = uint(n)
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("%s: %v: record size %d", file, errMMDB, db.recordSize)
+	}
+	// Checked by division, as the product may overflow.
+	if db.nodeCount > uint(i)/(db.recordSize/4) {
+		return nil, fmt.Errorf("%s: %v: truncated", file, errMMDB)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%s: %v: truncated", file, errMMDB)
+	}
+	db.buf, db.data = b[:treeSize], b[treeSize+16:i]
+	if db.ipVersion == 6 {
+		for j := 0; j < 96 && db.ipv4Start < db.nodeCount; j++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *MMDB) record(node, bit uint) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// lookup returns the record of ip, nil if there is none.
+func (db *MMDB) lookup(ip net.IP) (map[string]interface{}, error) {
+	node, bits := uint(0), ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		node, bits = db.ipv4Start, ip4
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodeCount {
+		// Past the end of the address, or explicitly nothing.
+		return nil, nil
+	}
+	if node < db.nodeCount+16 {
+		// In the separator between the tree and the data.
+		return nil, fmt.Errorf("%s: %v: record %d points into the separator", db.file, errMMDB, node)
+	}
+	v, _, err := mmdbDecode(db.data, node-db.nodeCount-16, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", db.file, err)
+	}
+	m, _ := v.(map[string]interface{})
+	return m, nil
+}
+
+// mmdbDecode decodes the value at offset in the data section d, which
+// pointers are relative to, returning it and the offset after it.
+// Integers decode to uint64 or int64, floats to float64, maps to
+// map[string]interface{} and arrays to []interface{}.
+func mmdbDecode(d []byte, offset uint, depth int) (interface{}, uint, error) {
+	if depth > 32 {
+		return nil, 0, fmt.Errorf("%v: nested too deeply", errMMDB)
+	}
+	next := func(n uint) ([]byte, error) {
+		// Not offset+n, which may overflow.
+		if offset > uint(len(d)) || n > uint(len(d))-offset {
+			return nil, fmt.Errorf("%v: data out of bounds", errMMDB)
+		}
+		b := d[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	typ, size := uint(ctrl>>5), uint(ctrl&0x1f)
+	if typ == 1 {
+		ss, vvv := uint(ctrl>>3&3), uint(ctrl&7)
+		p, err := next(ss + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ptr uint
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | uint(p[0])
+		case 1:
+			ptr = (vvv<<16 | uint(p[0])<<8 | uint(p[1])) + 2048
+		case 2:
+			ptr = (vvv<<24 | uint(p[0])<<16 | uint(p[1])<<8 | uint(p[2])) + 526336
+		default:
+			ptr = uint(binary.BigEndian.Uint32(p))
+		}
+		v, _, err := mmdbDecode(d, ptr, depth+1)
+		return v, offset, err
+	}
+	if typ == 0 {
+		if b, err = next(1); err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+	}
+	if size >= 29 {
+		n := size - 28
+		if b, err = next(n); err != nil {
+			return nil, 0, err
+		}
+		var x uint
+		for _, c := range b {
+			x = x<<8 | uint(c)
+		}
+		size = []uint{29, 285, 65821}[n-1] + x
+	}
+	if (typ == 7 || typ == 11) && size > uint(len(d))-offset {
+		// Each entry takes a byte at least; don't let a corrupt size
+		// allocate more.
+		return nil, 0, fmt.Errorf("%v: data out of bounds", errMMDB)
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, o, err := mmdbDecode(d, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%v: map key is not a string", errMMDB)
+			}
+			v, o, err := mmdbDecode(d, o, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], offset = v, o
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, o, err := mmdbDecode(d, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, v), o
+		}
+		return a, offset, nil
+	case 14: // boolean
+		return size != 0, offset, nil
+	}
+	if b, err = next(size); err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case 2:
+		return string(b), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%v: double of %d bytes", errMMDB, size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%v: float of %d bytes", errMMDB, size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 9:
+		var x uint64
+		for _, c := range b {
+			x = x<<8 | uint64(c)
+		}
+		return x, offset, nil
+	case 8:
+		var x uint32
+		for _, c := range b {
+			x = x<<8 | uint32(c)
+		}
+		return int64(int32(x)), offset, nil
+	case 4, 10:
+		// Bytes, and uint128, which nothing here needs as a number.
+		return b, offset, nil
+	}
+	return nil, 0, fmt.Errorf("%v: data type %d", errMMDB, typ)
+}
+
+// geoInfo is what the GeoIP databases tell about a client.
+type geoInfo struct {
+	Country string // ISO 3166-1 alpha-2 code, empty if unknown
+	ASN     uint32 // autonomous system number, 0 if unknown
+}
+
+// geoIP looks up clients in MaxMind DB files, country and ASN databases
+// alike, and enforces access rules by country.
+type geoIP struct {
+	dbs   []*MMDB
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// geoUnknown stands for clients without a country in the allow and
+// deny lists.
+const geoUnknown = "-"
+
+func newGeoIP(dbs []*MMDB, allow, deny []string) *geoIP {
+	g := &geoIP{dbs: dbs}
+	set := func(codes []string) map[string]bool {
+		if len(codes) == 0 {
+			return nil
+		}
+		m := make(map[string]bool)
+		for _, c := range codes {
+			m[strings.ToUpper(c)] = true
+		}
+		return m
+	}
+	g.allow, g.deny = set(allow), set(deny)
+	return g
+}
+
+// lookup returns what the databases know about the address host.
+func (g *geoIP) lookup(host string) geoInfo {
+	var gi geoInfo
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return gi
+	}
+	for _, db := range g.dbs {
+		m, err := db.lookup(ip)
+		if err != nil || m == nil {
+			continue
+		}
+		if gi.Country == "" {
+			for _, k := range []string{"country", "registered_country"} {
+				if c, ok := m[k].(map[string]interface{}); ok {
+					if code, ok := c["iso_code"].(string); ok {
+						gi.Country = code
+						break
+					}
+				}
+			}
+		}
+		if n, ok := m["autonomous_system_number"].(uint64); ok && gi.ASN == 0 {
+			gi.ASN = uint32(n)
+		}
+	}
+	return gi
+}
+
+// allowed reports whether the rules let clients from country in.
+func (g *geoIP) allowed(country string) bool {
+	if country == "" {
+		country = geoUnknown
+	}
+	if g.deny[country] {
+		return false
+	}
+	return g.allow == nil || g.allow[country]
+}
+
+type geoKey struct{}
+
+// withGeo returns r with what the GeoIP databases know of its client,
+// if there are any.
+func (fh *fileHandler) withGeo(r *http.Request) *http.Request {
+	if fh.geoip == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), geoKey{}, fh.geoip.lookup(clientAddr(r))))
+}
+
+// geoOf returns what is known of the location of the client of r.
+func geoOf(r *http.Request) geoInfo {
+	gi, _ := r.Context().Value(geoKey{}).(geoInfo)
+	return gi
+}
+
+// checkGeo replies with 403 Forbidden and returns false if the country
+// of the client of r is not allowed.
+func (fh *fileHandler) checkGeo(w http.ResponseWriter, r *http.Request, name string) bool {
+	if fh.geoip == nil || fh.geoip.allowed(geoOf(r).Country) {
+		return true
+	}
+	country := geoOf(r).Country
+	if country == "" {
+		country = "unknown country"
+	}
+	logf(r, "geoip: %s (%s) denied", clientAddr(r), country)
+	sw := &statusWriter{ResponseWriter: w}
+	fh.errorHandler.ServeError(sw, r, fs.ErrPermission)
+	fh.publish(r, EventDenied, name, sw.status, -1, nil)
+	return false
+}
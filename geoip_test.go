@@ -0,0 +1,40 @@
+package midserve
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMMDBLookupBounds(t *testing.T) {
+	for _, rec := range []uint{0, 1, 5, 16} {
+		// One node, both records pointing at 1+rec: nothing at the node
+		// count, 1, the 16 byte separator below 17, then the data.
+		db := &MMDB{
+			buf:        []byte{0, 0, byte(1 + rec), 0, 0, byte(1 + rec)},
+			data:       []byte{0x40}, // an empty string
+			nodeCount:  1,
+			recordSize: 24,
+			ipVersion:  4,
+		}
+		_, err := db.lookup(net.IPv4(192, 0, 2, 1))
+		if (err != nil) != (rec > 0 && rec < 16) {
+			t.Errorf("record %d: err = %v", 1+rec, err)
+		}
+	}
+}
+
+func TestMMDBDecodeBounds(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+	}{
+		{"pointer past the end", "\x38\xff\xff\xff\xff"},
+		{"string past the end", "\x45abc"},
+		{"huge map", "\xff\xff\xff\xff"},
+		{"huge array", "\x1f\x04\xff\xff\xff"},
+	} {
+		if _, _, err := mmdbDecode([]byte(tc.data), 0, 0); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
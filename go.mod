@@ -1,5 +1,5 @@
 module github.com/hellodword/midserve
 
-go 1.15
+go 1.21
 
 // keep clean for min size
\ No newline at end of file
@@ -0,0 +1,171 @@
+// Serving files that are still being written
+
+package midserve
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// growPollInterval is how often a growing file is checked for new
+	// bytes.
+	growPollInterval = 250 * time.Millisecond
+	// growMaxWait bounds the wait parameter.
+	growMaxWait = time.Minute
+	// growIdleTimeout ends a followed download once the file stopped
+	// growing for that long.
+	growIdleTimeout = 30 * time.Second
+)
+
+// rangeStart returns the first byte position of a single "bytes=N-" or
+// "bytes=N-M" range header, and whether there is one.
+func rangeStart(s string) (int64, bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, false
+	}
+	i := strings.Index(s, "-")
+	if i <= len("bytes=") {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s[len("bytes="):i]), 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// waitForGrowth polls f until it is larger than offset, returning its
+// new stat, or until timeout returning the last one.
+func waitForGrowth(ctx context.Context, f http.File, offset int64, timeout time.Duration) (fs.FileInfo, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(growPollInterval)
+	defer tick.Stop()
+	for {
+		d, err := f.Stat()
+		if err != nil || d.Size() > offset {
+			return d, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline.C:
+			return d, nil
+		case <-tick.C:
+		}
+	}
+}
+
+// growWait returns the wait parameter of r, capped at growMaxWait.
+func growWait(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("wait")
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid wait duration")
+	}
+	if d > growMaxWait {
+		d = growMaxWait
+	}
+	return d, nil
+}
+
+// followFile streams f from offset as it grows, without a
+// Content-Length, until it stops growing for growIdleTimeout, shrinks,
+// or the client goes away.
+func (fh *fileHandler) followFile(w http.ResponseWriter, r *http.Request, name string, f http.File, offset int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	h := w.Header()
+	h.Set("Content-Type", ctype)
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	var sent int64
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := io.CopyBuffer(w, f, buf)
+		sent += n
+		offset += n
+		if err != nil {
+			break
+		}
+		flusher.Flush()
+		d, err := waitForGrowth(r.Context(), f, offset, growIdleTimeout)
+		if err != nil {
+			break
+		}
+		if d.Size() < offset {
+			logf(r, "http: following %s: file truncated", name)
+		}
+		if d.Size() <= offset {
+			break
+		}
+	}
+	fh.usage.add(usageClient(r), sent)
+	fh.publish(r, EventServed, name, http.StatusOK, sent, nil)
+}
+
+// serveGrowing handles the follow and wait parameters for files that may
+// still be growing. It returns false, with d updated, if the request is
+// to be served as usual.
+func (fh *fileHandler) serveGrowing(w http.ResponseWriter, r *http.Request, name string, f http.File, d *fs.FileInfo) bool {
+	q := r.URL.Query()
+	if q.Get("follow") == "1" {
+		var offset int64
+		if s := q.Get("offset"); s != "" {
+			var err error
+			if offset, err = strconv.ParseInt(s, 10, 64); err != nil || offset < 0 {
+				http.Error(w, "invalid offset", http.StatusBadRequest)
+				return true
+			}
+		}
+		fh.followFile(w, r, name, f, offset)
+		return true
+	}
+
+	wait, err := growWait(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	// Without a wait, a range starting at or past the end is answered
+	// with 416 and the current size, so a client can poll.
+	if start, ok := rangeStart(r.Header.Get("Range")); ok && wait > 0 && start >= (*d).Size() {
+		nd, err := waitForGrowth(r.Context(), f, start, wait)
+		if err != nil {
+			if r.Context().Err() == nil {
+				fh.error(w, r, name, err)
+			}
+			return true
+		}
+		*d = nd
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+// Response headers set on every response
+
+package midserve
+
+import (
+	"io"
+	"net/http"
+)
+
+// decorate returns w applying the configured headers when the header is
+// written, so that they replace headers set by the handlers, error
+// responses included.
+func (fh *fileHandler) decorate(w http.ResponseWriter) http.ResponseWriter {
+	if len(fh.headers) == 0 {
+		return w
+	}
+	return &headerWriter{ResponseWriter: w, headers: fh.headers}
+}
+
+// headerWriter sets headers on a response as its header is written.
+type headerWriter struct {
+	http.ResponseWriter
+	headers     http.Header
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.wroteHeader = true
+		h := w.Header()
+		for name, values := range w.headers {
+			name = http.CanonicalHeaderKey(name)
+			if len(values) == 1 && values[0] == "" {
+				h.Del(name)
+				continue
+			}
+			h[name] = append([]string(nil), values...)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps the ResponseWriter's optimized copying, such as
+// sendfile for files, available through the wrapper.
+func (w *headerWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+func (w *headerWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,46 @@
+package midserve
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestHeaders(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.txt", "a").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) {
+		o.Headers = http.Header{
+			"X-Frame-Options":        {"DENY"},
+			"X-Content-Type-Options": {""},
+			"Content-Type":           {"text/x-test"},
+		}
+	})
+
+	// Headers replace those set while serving, error responses included.
+	midservetest.Get(t, h, "/a.txt").
+		Status(http.StatusOK).
+		Header("X-Frame-Options", "DENY").
+		Header("Content-Type", "text/x-test").
+		Body("a")
+	midservetest.Get(t, h, "/missing").
+		Status(http.StatusNotFound).
+		Header("X-Frame-Options", "DENY").
+		Header("X-Content-Type-Options", "").
+		Header("Content-Type", "text/x-test")
+}
+
+func TestErrorsWithErrorPages(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ErrorPages = t.TempDir()
+	cfg.Errors = "descriptive"
+	if _, err := cfg.Options(); err == nil {
+		t.Error("descriptive errors with error pages are accepted")
+	}
+	cfg.Errors = "terse"
+	if _, err := cfg.Options(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,267 @@
+// HLS packaging of videos
+
+package midserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hlsPathRe matches requests for the HLS rendition of a video, served
+// under "<file>/hls/".
+var hlsPathRe = regexp.MustCompile(`^(.+\.(?i:mp4|m4v|mkv|mov|webm|avi))/hls/(index\.m3u8|seg\d{5}\.ts)$`)
+
+// hlsStartTimeout bounds how long the first request for a playlist
+// waits for ffmpeg to write it.
+const hlsStartTimeout = 30 * time.Second
+
+// hlsDoneFile marks a completely packaged rendition.
+const hlsDoneFile = ".done"
+
+// hlsMaxRunning bounds the ffmpeg processes running at once; further
+// jobs wait for one of them to finish.
+const hlsMaxRunning = 2
+
+// hlsRetryDelay is how long a failed job is reported to requests before
+// one may start it again.
+const hlsRetryDelay = time.Minute
+
+// hlsPackager runs at most one ffmpeg per rendition, and at most
+// hlsMaxRunning in all.
+type hlsPackager struct {
+	ffmpeg  string
+	running chan struct{}
+
+	mu   sync.Mutex
+	jobs map[string]*hlsJob // by output directory, until done or retried
+}
+
+type hlsJob struct {
+	done   chan struct{}
+	err    error
+	failed time.Time // once done with err
+}
+
+func newHLSPackager(ffmpeg string) *hlsPackager {
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+	return &hlsPackager{
+		ffmpeg:  ffmpeg,
+		running: make(chan struct{}, hlsMaxRunning),
+		jobs:    make(map[string]*hlsJob),
+	}
+}
+
+// serveHLS serves asset of the HLS rendition of the video name, starting
+// ffmpeg on first access. The playlist is written as segments are
+// produced, so playback can start before packaging is complete. The
+// rendition is subject to the exclusions, access windows and
+// permissions of the video itself.
+func (fh *fileHandler) serveHLS(w http.ResponseWriter, r *http.Request, name, asset string) {
+	if !fh.checkPermitted(w, r, name, RoleRead) {
+		return
+	}
+	if fh.usage.cap > 0 && !fh.checkTransferCap(w, r, name) {
+		return
+	}
+	f, d, err := fh.openRegular(r, name)
+	if err != nil {
+		if errors.Is(err, errNotRegular) {
+			err = fs.ErrNotExist
+		}
+		fh.error(w, r, name, err)
+		return
+	}
+	f.Close()
+
+	key := sha256.Sum256([]byte(fmt.Sprintf("hls\x00%s\x00%d\x00%d", name, d.ModTime().UnixNano(), d.Size())))
+	dir := filepath.Join(fh.cacheDir, "hls", hex.EncodeToString(key[:]))
+	if fh.stalePurged(name, dir) {
+		fh.hls.forget(dir)
+	}
+	job := fh.hls.start(fh.root, name, dir)
+
+	file := filepath.Join(dir, asset)
+	deadline := time.NewTimer(hlsStartTimeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(200 * time.Millisecond)
+	defer poll.Stop()
+wait:
+	for {
+		if _, err := os.Stat(file); err == nil {
+			break
+		}
+		select {
+		case <-job.done:
+			if _, err := os.Stat(file); err == nil {
+				break wait
+			}
+			err := job.err
+			if err == nil {
+				err = fs.ErrNotExist
+			} else {
+				logf(r, "http: error packaging %s: %v", name, err)
+			}
+			fh.error(w, r, name, err)
+			return
+		case <-deadline.C:
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "503 packaging in progress", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		case <-poll.C:
+		}
+	}
+
+	cf, err := os.Open(file)
+	if err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	defer cf.Close()
+	if asset == "index.m3u8" {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		select {
+		case <-job.done:
+		default:
+			// The playlist still grows.
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+	} else {
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	fh.serveCached(w, r, path.Join(name, "hls", asset), d, cf)
+}
+
+// start returns the job packaging name into dir, starting it unless
+// it is queued, running, already completed or failed recently. Jobs are
+// dropped once completed, which the done file then tells, and failed
+// ones hlsRetryDelay after.
+func (p *hlsPackager) start(root http.FileSystem, name, dir string) *hlsJob {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if job, ok := p.jobs[dir]; ok && (job.failed.IsZero() || time.Since(job.failed) < hlsRetryDelay) {
+		return job
+	}
+	for d, job := range p.jobs {
+		if !job.failed.IsZero() && time.Since(job.failed) >= hlsRetryDelay {
+			delete(p.jobs, d)
+		}
+	}
+	job := &hlsJob{done: make(chan struct{})}
+	if _, err := os.Stat(filepath.Join(dir, hlsDoneFile)); err == nil {
+		close(job.done)
+		return job
+	}
+	p.jobs[dir] = job
+	go func() {
+		p.running <- struct{}{}
+		err := p.run(root, name, dir)
+		<-p.running
+		p.mu.Lock()
+		if job.err = err; err != nil {
+			job.failed = time.Now()
+		} else {
+			delete(p.jobs, dir)
+		}
+		p.mu.Unlock()
+		close(job.done)
+	}()
+	return job
+}
+
+// forget drops the job packaging into dir and its output, so that the
+// next request starts over. Queued and running jobs are left alone.
+func (p *hlsPackager) forget(dir string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if job, ok := p.jobs[dir]; ok {
+		select {
+		case <-job.done:
+		default:
+			return
+		}
+		delete(p.jobs, dir)
+	}
+	os.RemoveAll(dir)
+}
+
+func (p *hlsPackager) run(root http.FileSystem, name, dir string) error {
+	// Leftovers of an interrupted run.
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	input := "pipe:0"
+	var stdin io.ReadCloser
+	if local, ok := localPath(root, name); ok {
+		// ffmpeg needs to seek in most containers. The protocol
+		// keeps it from reading names such as http:x.mp4 or concat:a|b
+		// as URLs of other protocols.
+		input = "file:" + local
+	} else {
+		f, err := root.Open(name)
+		if err != nil {
+			return err
+		}
+		stdin = f
+		defer f.Close()
+	}
+
+	cmd := exec.Command(p.ffmpeg,
+		"-hide_banner", "-loglevel", "error", "-nostdin",
+		"-i", input,
+		"-c:v", "libx264", "-preset", "veryfast", "-c:a", "aac",
+		// Segments are written to temporary files and renamed once
+		// complete, as is the playlist of an event, so that only
+		// complete ones are served.
+		"-f", "hls", "-hls_time", "6", "-hls_playlist_type", "event", "-hls_flags", "temp_file",
+		"-hls_segment_filename", filepath.Join(dir, "seg%05d.ts"),
+		filepath.Join(dir, "index.m3u8"))
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("%s: %v: %s", p.ffmpeg, err, strings.TrimSpace(string(out)))
+	}
+	return os.WriteFile(filepath.Join(dir, hlsDoneFile), nil, 0644)
+}
+
+// localPath returns the absolute native path of name in root, if root is
+// a Dir.
+func localPath(root http.FileSystem, name string) (string, bool) {
+	if t, ok := root.(*timeoutFS); ok {
+		root = t.fs
+	}
+	d, ok := root.(Dir)
+	if !ok {
+		return "", false
+	}
+	dir := string(d)
+	if dir == "" {
+		dir = "."
+	}
+	p, err := filepath.Abs(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name))))
+	if err != nil {
+		return "", false
+	}
+	return p, true
+}
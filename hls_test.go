@@ -0,0 +1,71 @@
+package midserve
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestHLSAccess(t *testing.T) {
+	root := midservetest.NewFS().
+		File("open.mp4", "video").
+		File("closed/v.mp4", "video").
+		File(".git/v.mp4", "video").
+		Dir("dir.mp4").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) {
+		o.HLS = true
+		o.FFmpeg = "/nonexistent/ffmpeg"
+		o.AccessWindows = []AccessWindow{{
+			Prefix:    "/closed",
+			NotBefore: time.Now().Add(time.Hour),
+			Status:    http.StatusForbidden,
+		}}
+	})
+
+	// Refused before packaging starts, which would fail with 500 here.
+	midservetest.Get(t, h, "/closed/v.mp4/hls/index.m3u8").
+		Status(http.StatusForbidden)
+	midservetest.Get(t, h, "/.git/v.mp4/hls/index.m3u8").
+		Status(http.StatusNotFound)
+	midservetest.Get(t, h, "/dir.mp4/hls/index.m3u8").
+		Status(http.StatusNotFound)
+	midservetest.Get(t, h, "/open.mp4/hls/index.m3u8").
+		Status(http.StatusInternalServerError)
+}
+
+func TestHLSLocalInput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as ffmpeg")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"http:x.mp4": "video"})
+	args := filepath.Join(dir, "args")
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte("#!/bin/sh\nprintf '%s\\n' \"$@\" > "+args+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &hlsPackager{ffmpeg: ffmpeg}
+	if err := p.run(Dir(dir), "/http:x.mp4", filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-i\nfile:" + filepath.Join(dir, "http:x.mp4") + "\n"
+	if !strings.Contains(string(b), want) {
+		t.Errorf("ffmpeg arguments %q, want %q", b, want)
+	}
+
+	if p, ok := localPath(Dir(""), "/a.mp4"); !ok || !filepath.IsAbs(p) {
+		t.Errorf("localPath in the working directory = %q, %v", p, ok)
+	}
+}
@@ -0,0 +1,178 @@
+// Honeypot paths and temporary bans
+
+package midserve
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// honeypotMaxClients bounds the clients remembered for having
+	// requested a honeypot. Those whose last hit is oldest are
+	// forgotten first.
+	honeypotMaxClients = 10000
+	// honeypotMaxPaths bounds the paths remembered per client.
+	honeypotMaxPaths = 20
+)
+
+// honeypots replies to requests for decoy paths that no legitimate
+// client asks for, such as /wp-admin or /.env, with status, recording
+// the clients as candidates for blocking and, if ban is positive,
+// refusing all their requests for that long.
+type honeypots struct {
+	paths  []string
+	status int
+	ban    time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*honeypotClient
+}
+
+// honeypotClient is what /_admin/honeypots reports about a client that
+// requested a honeypot.
+type honeypotClient struct {
+	Addr        string     `json:"addr"`
+	Hits        int        `json:"hits"`
+	First       time.Time  `json:"first"`
+	Last        time.Time  `json:"last"`
+	Paths       []string   `json:"paths"`
+	BannedUntil *time.Time `json:"banned_until,omitempty"`
+}
+
+func newHoneypots(paths []string, status int, ban time.Duration) *honeypots {
+	return &honeypots{paths: paths, status: status, ban: ban, clients: make(map[string]*honeypotClient)}
+}
+
+// match reports whether name is one of the honeypots.
+func (hp *honeypots) match(name string) bool {
+	for _, p := range hp.paths {
+		if underPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// hit records that addr requested the honeypot name.
+func (hp *honeypots) hit(addr, name string) {
+	now := time.Now().UTC()
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	c, ok := hp.clients[addr]
+	if !ok {
+		if len(hp.clients) >= honeypotMaxClients {
+			var oldest *honeypotClient
+			for _, o := range hp.clients {
+				if oldest == nil || o.Last.Before(oldest.Last) {
+					oldest = o
+				}
+			}
+			delete(hp.clients, oldest.Addr)
+		}
+		c = &honeypotClient{Addr: addr, First: now}
+		hp.clients[addr] = c
+	}
+	c.Hits++
+	c.Last = now
+	seen := false
+	for _, p := range c.Paths {
+		seen = seen || p == name
+	}
+	if !seen && len(c.Paths) < honeypotMaxPaths {
+		c.Paths = append(c.Paths, name)
+	}
+	if hp.ban > 0 {
+		until := now.Add(hp.ban)
+		c.BannedUntil = &until
+	}
+}
+
+// banned reports whether addr is banned.
+func (hp *honeypots) banned(addr string) bool {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	c, ok := hp.clients[addr]
+	return ok && c.BannedUntil != nil && time.Now().Before(*c.BannedUntil)
+}
+
+// checkHoneypot replies to requests for honeypots and to those of
+// banned clients, returning false if it did.
+func (fh *fileHandler) checkHoneypot(w http.ResponseWriter, r *http.Request, name string) bool {
+	hp := fh.honeypots
+	if hp == nil {
+		return true
+	}
+	addr := clientAddr(r)
+	var err error
+	switch {
+	case hp.match(name):
+		hp.hit(addr, name)
+		logf(r, "honeypot: %s requested %s", addr, name)
+		// Just like any missing or forbidden file.
+		err = fs.ErrNotExist
+		if hp.status == http.StatusForbidden {
+			err = fs.ErrPermission
+		}
+	case hp.banned(addr):
+		err = fs.ErrPermission
+	default:
+		return true
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	fh.errorHandler.ServeError(sw, r, err)
+	fh.publish(r, EventDenied, name, sw.status, -1, nil)
+	return false
+}
+
+// serveHoneypots implements GET /_admin/honeypots, the clients that
+// requested honeypots, those hit most first.
+func (fh *fileHandler) serveHoneypots(w http.ResponseWriter, r *http.Request) {
+	hp := fh.honeypots
+	if hp == nil {
+		apiError(w, errors.New("no honeypots: requires -honeypot"), http.StatusNotFound)
+		return
+	}
+	hp.mu.Lock()
+	clients := make([]honeypotClient, 0, len(hp.clients))
+	for _, c := range hp.clients {
+		cc := *c
+		cc.Paths = append([]string{}, c.Paths...)
+		clients = append(clients, cc)
+	}
+	hp.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Hits != clients[j].Hits {
+			return clients[i].Hits > clients[j].Hits
+		}
+		return clients[i].Addr < clients[j].Addr
+	})
+	writeJSON(w, r, clients)
+}
+
+// serveUnban implements POST /_admin/unban?addr=, lifting the ban of
+// the client addr and forgetting its honeypot hits.
+func (fh *fileHandler) serveUnban(w http.ResponseWriter, r *http.Request) {
+	hp := fh.honeypots
+	if hp == nil {
+		apiError(w, errors.New("no honeypots: requires -honeypot"), http.StatusNotFound)
+		return
+	}
+	addr := r.URL.Query().Get("addr")
+	hp.mu.Lock()
+	_, ok := hp.clients[addr]
+	delete(hp.clients, addr)
+	hp.mu.Unlock()
+	if !ok {
+		apiError(w, errors.New("unknown client"), http.StatusNotFound)
+		return
+	}
+	logf(r, "honeypot: unbanned %s", addr)
+	writeJSON(w, r, struct {
+		Addr string `json:"addr"`
+	}{addr})
+}
@@ -0,0 +1,267 @@
+// Adaptive in-memory caching of hot files
+
+package midserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hotHalfLife is how fast the request scores of files decay.
+	hotHalfLife = time.Minute
+	// hotThreshold is the score from which a file is kept in memory,
+	// such as that many requests within a few seconds.
+	hotThreshold = 8
+	// hotMaxTracked bounds the files scored; scores that decayed are
+	// forgotten to make room.
+	hotMaxTracked = 10000
+	// hotMaxFile is the size of the largest file kept in memory.
+	hotMaxFile = 1 << 20
+	// hotMaxLoads bounds the files read into memory at once.
+	hotMaxLoads = 2
+	// hotMinGzip is the size from which a gzip variant is made.
+	hotMinGzip = 1024
+)
+
+// hotCache scores the requests for each file, a request adding 1 to a
+// score halving every hotHalfLife, and keeps the files scoring at least
+// hotThreshold in memory, up to max bytes together, along with a gzip
+// variant if they compress. The least recently used go first.
+type hotCache struct {
+	max int64
+
+	mu      sync.Mutex
+	scores  map[string]*hotScore
+	files   map[string]*hotFile
+	size    int64
+	loading map[string]bool
+}
+
+type hotScore struct {
+	score float64
+	at    time.Time
+}
+
+// hotFile is a file kept in memory, as of its size and modification
+// time.
+type hotFile struct {
+	modTime  time.Time
+	size     int64
+	data, gz []byte
+	hits     uint64
+	used     time.Time
+}
+
+func newHotCache(max int64) *hotCache {
+	return &hotCache{
+		max:     max,
+		scores:  make(map[string]*hotScore),
+		files:   make(map[string]*hotFile),
+		loading: make(map[string]bool),
+	}
+}
+
+// hit records a request for the file name with info d. It returns the
+// file if in memory and up to date, and whether it just became hot and
+// should be loaded.
+func (c *hotCache) hit(name string, d fs.FileInfo) (hf *hotFile, load bool) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hf := c.files[name]; hf != nil {
+		if hf.modTime.Equal(d.ModTime()) && hf.size == d.Size() {
+			hf.hits++
+			hf.used = now
+			return hf, false
+		}
+		c.drop(name)
+	}
+	if d.Size() > hotMaxFile || d.Size() > c.max {
+		return nil, false
+	}
+	s := c.scores[name]
+	if s == nil {
+		if len(c.scores) >= hotMaxTracked {
+			c.forgetCold(now)
+			if len(c.scores) >= hotMaxTracked {
+				return nil, false
+			}
+		}
+		s = &hotScore{at: now}
+		c.scores[name] = s
+	}
+	s.score = decayed(s, now) + 1
+	s.at = now
+	if s.score < hotThreshold || c.loading[name] || len(c.loading) >= hotMaxLoads {
+		return nil, false
+	}
+	c.loading[name] = true
+	return nil, true
+}
+
+func decayed(s *hotScore, now time.Time) float64 {
+	return s.score * math.Exp2(-float64(now.Sub(s.at))/float64(hotHalfLife))
+}
+
+// forgetCold forgets the scores that decayed below 1, as of a single
+// request. It must be called with mu held.
+func (c *hotCache) forgetCold(now time.Time) {
+	for name, s := range c.scores {
+		if decayed(s, now) < 1 {
+			delete(c.scores, name)
+		}
+	}
+}
+
+// add keeps hf as the file name in memory, evicting the least recently
+// used files as needed, and ends its loading.
+func (c *hotCache) add(name string, hf *hotFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.loading, name)
+	if hf == nil {
+		return
+	}
+	c.drop(name)
+	need := int64(len(hf.data) + len(hf.gz))
+	for c.size+need > c.max && len(c.files) > 0 {
+		var lru string
+		for n, f := range c.files {
+			if lru == "" || f.used.Before(c.files[lru].used) {
+				lru = n
+			}
+		}
+		c.drop(lru)
+	}
+	if c.size+need > c.max {
+		return
+	}
+	hf.used = time.Now()
+	c.files[name] = hf
+	c.size += need
+}
+
+// drop removes the file name from memory. It must be called with mu
+// held.
+func (c *hotCache) drop(name string) {
+	if hf := c.files[name]; hf != nil {
+		c.size -= int64(len(hf.data) + len(hf.gz))
+		delete(c.files, name)
+	}
+}
+
+// purge removes the files below prefix from memory and forgets their
+// scores.
+func (c *hotCache) purge(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.files {
+		if underPrefix(name, prefix) {
+			c.drop(name)
+		}
+	}
+	for name := range c.scores {
+		if underPrefix(name, prefix) {
+			delete(c.scores, name)
+		}
+	}
+}
+
+// hotContent records the request r for the file name with info d and,
+// if the file is in memory, returns its content: the gzip variant if
+// there is one, encode allows it and the client accepts it, with the
+// headers set for that. Otherwise it returns nil, loading the file into
+// memory in the background once it became hot, by a worker if there
+// are any.
+func (fh *fileHandler) hotContent(w http.ResponseWriter, r *http.Request, name string, d fs.FileInfo, encode bool) []byte {
+	hf, load := fh.hot.hit(name, d)
+	if load {
+		load := func() { fh.hot.add(name, fh.loadHot(name, d)) }
+		if !fh.workers.submit("hot\x00"+name, func(context.Context) error { load(); return nil }) {
+			go load()
+		}
+	}
+	if hf == nil {
+		return nil
+	}
+	if hf.gz == nil || !encode {
+		return hf.data
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsEncoding(r, "gzip") {
+		return hf.data
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	if etag := w.Header().Get("ETag"); etag != "" {
+		w.Header().Set("ETag", encodedETag(etag, "gzip"))
+	}
+	return hf.gz
+}
+
+// loadHot reads the file name with info d and compresses it unless it
+// is of a compressed format, returning nil if it can't be read or
+// changed meanwhile.
+func (fh *fileHandler) loadHot(name string, d fs.FileInfo) *hotFile {
+	f, err := openContext(context.Background(), fh.root, name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, hotMaxFile+1))
+	if err != nil || int64(len(data)) != d.Size() {
+		return nil
+	}
+	if fi, err := f.Stat(); err != nil || !fi.ModTime().Equal(d.ModTime()) || fi.Size() != d.Size() {
+		return nil
+	}
+	hf := &hotFile{modTime: d.ModTime(), size: d.Size(), data: data}
+	if len(data) >= hotMinGzip && !incompressibleExts[strings.ToLower(path.Ext(name))] {
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		zw.Write(data)
+		// Not worth a second copy otherwise.
+		if zw.Close() == nil && buf.Len() < len(data)*9/10 {
+			hf.gz = buf.Bytes()
+		}
+	}
+	return hf
+}
+
+// serveHot implements /_admin/hot, the files kept in memory, most
+// requested first.
+func (fh *fileHandler) serveHot(w http.ResponseWriter, r *http.Request) {
+	type file struct {
+		Path     string    `json:"path"`
+		Size     int64     `json:"size"`
+		GzipSize int       `json:"gzip_size,omitempty"`
+		Hits     uint64    `json:"hits"`
+		Used     time.Time `json:"used"`
+	}
+	files := []file{}
+	var size, max int64
+	if c := fh.hot; c != nil {
+		c.mu.Lock()
+		for name, hf := range c.files {
+			files = append(files, file{name, hf.size, len(hf.gz), hf.hits, hf.used})
+		}
+		size, max = c.size, c.max
+		c.mu.Unlock()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Hits > files[j].Hits })
+	writeJSON(w, r, struct {
+		Size  int64  `json:"size"`
+		Max   int64  `json:"max"`
+		Files []file `json:"files"`
+	}{size, max, files})
+}
@@ -0,0 +1,265 @@
+// Localization of listing strings
+
+package midserve
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// messages maps the English strings of the listing UI to their
+// translation in one language. Missing strings stay English.
+type messages map[string]string
+
+// t returns the translation of s.
+func (m messages) t(s string) string {
+	if t, ok := m[s]; ok {
+		return t
+	}
+	return s
+}
+
+// catalogs holds the embedded translations by base language tag.
+var catalogs = map[string]messages{
+	"en": {},
+	"de": {
+		"short link":              "Kurzlink",
+		"delete":                  "löschen",
+		"move":                    "verschieben",
+		"rename":                  "umbenennen",
+		"Delete these?":           "Diese löschen?",
+		"Move to directory:":      "In Verzeichnis verschieben:",
+		"New name:":               "Neuer Name:",
+		"Some operations failed:": "Einige Vorgänge sind fehlgeschlagen:",
+		"Index of %s":             "Index von %s",
+		"Skip to files":           "Zu den Dateien springen",
+		"copy link":               "Link kopieren",
+		"copied":                  "kopiert",
+		"compare":                 "vergleiche",
+		"with":                    "mit",
+		"diff":                    "Unterschiede",
+		"bytes":                   "Bytes",
+		"Error reading directory": "Fehler beim Lesen des Verzeichnisses",
+		"Listing truncated to %d entries per page.": "Liste auf %d Einträge pro Seite gekürzt.",
+		"previous page":    "vorherige Seite",
+		"next page":        "nächste Seite",
+		"download as zip":  "als ZIP herunterladen",
+		"upload":           "hochladen",
+		"%d s remaining":   "noch %d s",
+		"Sign in":          "Anmelden",
+		"Token":            "Token",
+		"Invalid token.":   "Ungültiges Token.",
+		"sign in":          "anmelden",
+		"sign out":         "abmelden",
+		"Signed in as %s.": "Angemeldet als %s.",
+	},
+	"es": {
+		"short link":              "enlace corto",
+		"delete":                  "eliminar",
+		"move":                    "mover",
+		"rename":                  "renombrar",
+		"Delete these?":           "¿Eliminar estos?",
+		"Move to directory:":      "Mover al directorio:",
+		"New name:":               "Nuevo nombre:",
+		"Some operations failed:": "Algunas operaciones fallaron:",
+		"Index of %s":             "Índice de %s",
+		"Skip to files":           "Saltar a los archivos",
+		"copy link":               "copiar enlace",
+		"copied":                  "copiado",
+		"compare":                 "comparar",
+		"with":                    "con",
+		"diff":                    "diferencias",
+		"bytes":                   "bytes",
+		"Error reading directory": "Error al leer el directorio",
+		"Listing truncated to %d entries per page.": "Listado limitado a %d entradas por página.",
+		"previous page":    "página anterior",
+		"next page":        "página siguiente",
+		"download as zip":  "descargar como zip",
+		"upload":           "subir",
+		"%d s remaining":   "quedan %d s",
+		"Sign in":          "Iniciar sesión",
+		"Token":            "Token",
+		"Invalid token.":   "Token no válido.",
+		"sign in":          "iniciar sesión",
+		"sign out":         "cerrar sesión",
+		"Signed in as %s.": "Sesión iniciada como %s.",
+	},
+	"fr": {
+		"short link":              "lien court",
+		"delete":                  "supprimer",
+		"move":                    "déplacer",
+		"rename":                  "renommer",
+		"Delete these?":           "Supprimer ceux-ci ?",
+		"Move to directory:":      "Déplacer vers le répertoire :",
+		"New name:":               "Nouveau nom :",
+		"Some operations failed:": "Certaines opérations ont échoué :",
+		"Index of %s":             "Index de %s",
+		"Skip to files":           "Aller aux fichiers",
+		"copy link":               "copier le lien",
+		"copied":                  "copié",
+		"compare":                 "comparer",
+		"with":                    "avec",
+		"diff":                    "différences",
+		"bytes":                   "octets",
+		"Error reading directory": "Erreur de lecture du répertoire",
+		"Listing truncated to %d entries per page.": "Liste limitée à %d entrées par page.",
+		"previous page":    "page précédente",
+		"next page":        "page suivante",
+		"download as zip":  "télécharger en zip",
+		"upload":           "téléverser",
+		"%d s remaining":   "%d s restantes",
+		"Sign in":          "Connexion",
+		"Token":            "Jeton",
+		"Invalid token.":   "Jeton invalide.",
+		"sign in":          "se connecter",
+		"sign out":         "se déconnecter",
+		"Signed in as %s.": "Connecté en tant que %s.",
+	},
+	"ja": {
+		"short link":              "短縮リンク",
+		"delete":                  "削除",
+		"move":                    "移動",
+		"rename":                  "名前を変更",
+		"Delete these?":           "これらを削除しますか?",
+		"Move to directory:":      "移動先のディレクトリ:",
+		"New name:":               "新しい名前:",
+		"Some operations failed:": "一部の操作に失敗しました:",
+		"Index of %s":             "%s の一覧",
+		"Skip to files":           "ファイル一覧へ移動",
+		"copy link":               "リンクをコピー",
+		"copied":                  "コピーしました",
+		"compare":                 "比較",
+		"with":                    "と",
+		"diff":                    "差分",
+		"bytes":                   "バイト",
+		"Error reading directory": "ディレクトリの読み込みエラー",
+		"Listing truncated to %d entries per page.": "一覧は1ページあたり%d件に制限されています。",
+		"previous page":    "前のページ",
+		"next page":        "次のページ",
+		"download as zip":  "ZIPでダウンロード",
+		"upload":           "アップロード",
+		"%d s remaining":   "残り %d 秒",
+		"Sign in":          "サインイン",
+		"Token":            "トークン",
+		"Invalid token.":   "無効なトークンです。",
+		"sign in":          "サインイン",
+		"sign out":         "サインアウト",
+		"Signed in as %s.": "%s としてサインイン中。",
+	},
+	"zh": {
+		"short link":              "短链接",
+		"delete":                  "删除",
+		"move":                    "移动",
+		"rename":                  "重命名",
+		"Delete these?":           "删除这些吗?",
+		"Move to directory:":      "移动到目录:",
+		"New name:":               "新名称:",
+		"Some operations failed:": "部分操作失败:",
+		"Index of %s":             "%s 的索引",
+		"Skip to files":           "跳到文件列表",
+		"copy link":               "复制链接",
+		"copied":                  "已复制",
+		"compare":                 "比较",
+		"with":                    "与",
+		"diff":                    "差异",
+		"bytes":                   "字节",
+		"Error reading directory": "读取目录出错",
+		"Listing truncated to %d entries per page.": "列表每页限制为 %d 个条目。",
+		"previous page":    "上一页",
+		"next page":        "下一页",
+		"download as zip":  "下载为 zip",
+		"upload":           "上传",
+		"%d s remaining":   "剩余 %d 秒",
+		"Sign in":          "登录",
+		"Token":            "令牌",
+		"Invalid token.":   "令牌无效。",
+		"sign in":          "登录",
+		"sign out":         "退出登录",
+		"Signed in as %s.": "已登录为 %s。",
+	},
+}
+
+// checkLang reports an error if lang, a -lang value, has no catalog.
+func checkLang(lang string) error {
+	if lang == "" {
+		return nil
+	}
+	if _, ok := catalogs[baseLang(lang)]; !ok {
+		var known []string
+		for l := range catalogs {
+			known = append(known, l)
+		}
+		sort.Strings(known)
+		return fmt.Errorf("lang: no translation for %q, have %s", lang, strings.Join(known, ", "))
+	}
+	return nil
+}
+
+// language returns the language listings are shown in for r and its
+// messages: the -lang override if set, otherwise the best match for
+// Accept-Language, falling back to English.
+func (fh *fileHandler) language(r *http.Request) (string, messages) {
+	if fh.lang != "" {
+		l := baseLang(fh.lang)
+		return l, catalogs[l]
+	}
+	for _, l := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if l == "*" {
+			break
+		}
+		if m, ok := catalogs[baseLang(l)]; ok {
+			return baseLang(l), m
+		}
+	}
+	return "en", catalogs["en"]
+}
+
+// baseLang returns the primary subtag of a language tag, e.g. "pt" for
+// "pt-BR".
+func baseLang(tag string) string {
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// acceptedLanguages returns the tags of an Accept-Language header in
+// order of preference, leaving out those with q=0.
+func acceptedLanguages(h string) []string {
+	type tag struct {
+		name string
+		q    float64
+	}
+	var tags []tag
+	for _, part := range strings.Split(h, ",") {
+		name, params := part, ""
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			name, params = part[:i], part[i+1:]
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, tag{name, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.name
+	}
+	return names
+}
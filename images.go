@@ -0,0 +1,256 @@
+// On-the-fly image resizing
+
+package midserve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // decoder for resizing GIFs
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxImageDimension bounds requested widths and heights, so that a
+// request can't make the server allocate arbitrarily large images.
+const maxImageDimension = 4096
+
+// maxImagePixels bounds the size of images resized, which are decoded
+// into memory whole, twice. Larger ones are served as they are.
+const maxImagePixels = 40 << 20
+
+// resizeSlots bounds the images being resized at once, and with
+// maxImagePixels the memory they take.
+var resizeSlots = make(chan struct{}, 2)
+
+// resizableExts maps the extensions of images that can be resized to
+// the format of the variants written for them.
+var resizableExts = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "png",
+}
+
+// imageParams are the parsed w, h and q query parameters.
+type imageParams struct {
+	width, height int
+	quality       int
+}
+
+var errBadImageParams = errors.New("invalid image parameters")
+
+// parseImageParams parses the resize parameters of r. ok is false when
+// the request doesn't ask for resizing.
+func parseImageParams(r *http.Request) (p imageParams, ok bool, err error) {
+	q := r.URL.Query()
+	if q.Get("w") == "" && q.Get("h") == "" {
+		return p, false, nil
+	}
+	p.quality = jpeg.DefaultQuality
+	for _, v := range []struct {
+		key      string
+		dst      *int
+		min, max int
+	}{
+		{"w", &p.width, 1, maxImageDimension},
+		{"h", &p.height, 1, maxImageDimension},
+		{"q", &p.quality, 1, 100},
+	} {
+		s := q.Get(v.key)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < v.min || n > v.max {
+			return p, true, errBadImageParams
+		}
+		*v.dst = n
+	}
+	return p, true, nil
+}
+
+// fit returns the size of an image of size src scaled down to fit in
+// the requested box, keeping the aspect ratio. Images are never scaled
+// up.
+func (p imageParams) fit(src image.Point) image.Point {
+	w, h := int64(src.X), int64(src.Y)
+	if pw := int64(p.width); pw > 0 && w > pw {
+		h = h * pw / w
+		w = pw
+	}
+	if ph := int64(p.height); ph > 0 && h > ph {
+		w = w * ph / h
+		h = ph
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return image.Pt(int(w), int(h))
+}
+
+// errImageTooLarge is returned for images exceeding maxImagePixels.
+var errImageTooLarge = errors.New("image too large to resize")
+
+// serveResizedImage serves the variant of the image name described by
+// p, generating it into the cache directory if needed. It returns false,
+// with f rewound, when the image is too large to resize, to serve it as
+// it is instead.
+func (fh *fileHandler) serveResizedImage(w http.ResponseWriter, r *http.Request, name string, f io.ReadSeeker, d fs.FileInfo, p imageParams) bool {
+	format := resizableExts[strings.ToLower(path.Ext(name))]
+	cached := fh.resizedPath(name, d, format, p)
+	fh.dropPurged(name, cached)
+	fh.thumbSizes.add(p)
+
+	cf, err := os.Open(cached)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fh.produce(r.Context(), cached, func(w io.Writer) error { return resizeImage(r.Context(), w, f, format, p) })
+		if err == nil {
+			cf, err = os.Open(cached)
+		}
+	}
+	if errors.Is(err, errImageTooLarge) {
+		if _, err = f.Seek(0, io.SeekStart); err == nil {
+			return false
+		}
+	}
+	if err != nil {
+		logf(r, "http: error resizing %s: %v", name, err)
+		fh.error(w, r, name, err)
+		return true
+	}
+	defer cf.Close()
+	w.Header().Set("Content-Type", "image/"+format)
+	fh.serveCached(w, r, name, d, cf)
+	return true
+}
+
+// resizedPath returns the cache file of the variant of the image name
+// with info d described by p.
+func (fh *fileHandler) resizedPath(name string, d fs.FileInfo, format string, p imageParams) string {
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%dx%d@%d",
+		name, d.ModTime().UnixNano(), d.Size(), p.width, p.height, p.quality)))
+	return filepath.Join(fh.cacheDir, "images", hex.EncodeToString(key[:])+"."+format)
+}
+
+// thumbMaxSizes is how many of the image sizes requested last are
+// prepared for the images of listings.
+const thumbMaxSizes = 4
+
+// recentSizes holds the distinct image parameters requested last, most
+// recent first, such as the thumbnail sizes of a gallery.
+type recentSizes struct {
+	mu   sync.Mutex
+	list []imageParams
+}
+
+func (s *recentSizes) add(p imageParams) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := append(s.list[:0:0], p)
+	for _, q := range s.list {
+		if q != p && len(list) < thumbMaxSizes {
+			list = append(list, q)
+		}
+	}
+	s.list = list
+}
+
+func (s *recentSizes) get() []imageParams {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list
+}
+
+// resizeImage decodes src, scales it and writes it to dst in format, or
+// returns errImageTooLarge. It waits for a slot in resizeSlots unless
+// ctx is done first.
+func resizeImage(ctx context.Context, dst io.Writer, src io.ReadSeeker, format string, p imageParams) error {
+	cfg, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return errImageTooLarge
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	select {
+	case resizeSlots <- struct{}{}:
+		defer func() { <-resizeSlots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return err
+	}
+	img = scaleImage(img, p.fit(img.Bounds().Size()))
+	if format == "jpeg" {
+		return jpeg.Encode(dst, img, &jpeg.Options{Quality: p.quality})
+	}
+	return png.Encode(dst, img)
+}
+
+// scaleImage scales src down to size by averaging the source pixels
+// covered by each destination pixel.
+func scaleImage(src image.Image, size image.Point) image.Image {
+	sb := src.Bounds()
+	if sb.Size() == size {
+		return src
+	}
+	// Work on premultiplied RGBA so that averaging respects alpha.
+	s := image.NewRGBA(image.Rect(0, 0, sb.Dx(), sb.Dy()))
+	draw.Draw(s, s.Bounds(), src, sb.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	// Offsets are computed in int64, as their products overflow 32 bits.
+	sw, sh := int64(sb.Dx()), int64(sb.Dy())
+	for y := 0; y < size.Y; y++ {
+		y0, y1 := int(int64(y)*sh/int64(size.Y)), int(int64(y+1)*sh/int64(size.Y))
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < size.X; x++ {
+			x0, x1 := int(int64(x)*sw/int64(size.X)), int(int64(x+1)*sw/int64(size.X))
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				i := s.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(s.Pix[i])
+					g += uint64(s.Pix[i+1])
+					b += uint64(s.Pix[i+2])
+					a += uint64(s.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,63 @@
+package midserve
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func encodePNG(t *testing.T, w, h int) string {
+	t.Helper()
+	img := image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.White, color.Black})
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestResizeImage(t *testing.T) {
+	small, large := encodePNG(t, 200, 100), encodePNG(t, 8000, 8000)
+	root := midservetest.NewFS().
+		File("small.png", small).
+		File("large.png", large).
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) { o.ResizeImages = true })
+
+	res := midservetest.Get(t, h, "/small.png?w=50").Status(http.StatusOK)
+	cfg, err := png.DecodeConfig(res.ResponseRecorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 50 || cfg.Height != 25 {
+		t.Errorf("resized to %dx%d, want 50x25", cfg.Width, cfg.Height)
+	}
+
+	// Too large to decode, served as it is.
+	midservetest.Get(t, h, "/large.png?w=50").
+		Status(http.StatusOK).
+		Body(large)
+}
+
+func TestImageFit(t *testing.T) {
+	for _, tc := range []struct {
+		p         imageParams
+		src, want image.Point
+	}{
+		{imageParams{width: 100}, image.Pt(400, 200), image.Pt(100, 50)},
+		{imageParams{height: 100}, image.Pt(400, 200), image.Pt(200, 100)},
+		{imageParams{width: 500}, image.Pt(400, 200), image.Pt(400, 200)},
+		{imageParams{width: 1}, image.Pt(400, 1), image.Pt(1, 1)},
+		// Products beyond 32 bits.
+		{imageParams{width: 4096}, image.Pt(1<<20, 1<<20), image.Pt(4096, 4096)},
+	} {
+		if got := tc.p.fit(tc.src); got != tc.want {
+			t.Errorf("%+v.fit(%v) = %v, want %v", tc.p, tc.src, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Persistent metadata index
+
+package midserve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexSearchLimit bounds the results of a single search.
+const indexSearchLimit = 10000
+
+// metaIndex keeps the metadata of every file in the tree, its checksum
+// once known and its download count, in a file, so that searching and
+// sorting a huge tree doesn't walk it. Rescans only update what changed.
+type metaIndex struct {
+	file     string
+	root     http.FileSystem
+	excludes []*regexp.Regexp
+	interval time.Duration
+	temps    *tempFiles
+
+	mu      sync.RWMutex
+	entries map[string]*indexEntry
+	scanned time.Time
+	dirty   bool
+	// gen changes with the entries. It starts from the time the index
+	// was created, so that it doesn't repeat across restarts.
+	gen uint64
+
+	// shared merges the index with other processes saving it; see
+	// merge. pending are the downloads counted since the last merge.
+	shared  bool
+	pending map[string]int64
+	// The log and index files last read, and how far the log was read,
+	// guarded by the index lock file.
+	logInfo, indexInfo fs.FileInfo
+	logOff             int64
+}
+
+// indexEntry is what the index records of one path. It is also what
+// /_api/search reports.
+type indexEntry struct {
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"dir,omitempty"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Downloads int64     `json:"downloads"`
+	Verified  time.Time `json:"-"` // by the integrity checker
+}
+
+// indexFile is the format of the index file, encoded with gob.
+type indexFile struct {
+	Scanned time.Time
+	Entries []indexEntry
+}
+
+func newMetaIndex(file string, root http.FileSystem, excludes []*regexp.Regexp, interval time.Duration) *metaIndex {
+	return &metaIndex{
+		file:     file,
+		root:     root,
+		excludes: excludes,
+		interval: interval,
+		temps:    &tempFiles{},
+		entries:  make(map[string]*indexEntry),
+		pending:  make(map[string]int64),
+		gen:      uint64(time.Now().UnixNano()),
+	}
+}
+
+// run loads the index, then rescans the tree every interval, saving
+// the index after each scan. Checksums found in the index seed sums.
+// A shared index is synchronized with the other processes instead.
+func (x *metaIndex) run(sums *checksumCache) {
+	if x.shared {
+		for {
+			x.syncShared(sums)
+			time.Sleep(x.interval)
+		}
+	}
+	if err := x.load(sums); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("index: %v, rebuilding it", err)
+	}
+	for {
+		if err := x.scan(context.Background(), sums); err != nil {
+			log.Printf("index: scan failed: %v", err)
+		}
+		if err := x.save(); err != nil {
+			log.Printf("index: %v", err)
+		}
+		time.Sleep(x.interval)
+	}
+}
+
+func (x *metaIndex) load(sums *checksumCache) error {
+	data, err := readIndexFile(x.file)
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.scanned = data.Scanned
+	x.gen++
+	for i := range data.Entries {
+		e := &data.Entries[i]
+		x.entries[e.Path] = e
+		if e.SHA256 != "" {
+			sums.put(e.Path, e.Size, e.ModTime, e.SHA256)
+		}
+	}
+	return nil
+}
+
+func (x *metaIndex) save() error {
+	x.mu.Lock()
+	if !x.dirty {
+		x.mu.Unlock()
+		return nil
+	}
+	data := indexFile{Scanned: x.scanned, Entries: make([]indexEntry, 0, len(x.entries))}
+	for _, e := range x.entries {
+		data.Entries = append(data.Entries, *e)
+	}
+	x.dirty = false
+	x.mu.Unlock()
+	return x.temps.write(x.file, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(data)
+	})
+}
+
+// scan walks the tree, keeping the entries of unchanged files with
+// their checksums, and picking up checksums computed since from sums.
+func (x *metaIndex) scan(ctx context.Context, sums *checksumCache) error {
+	start := time.Now()
+	seen := make(map[string]bool)
+	err := walkFS(ctx, x.root, "/", x.excludes, func(name string, fi fs.FileInfo) error {
+		seen[name] = true
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		e, ok := x.entries[name]
+		if !ok || e.IsDir != fi.IsDir() || e.Size != fi.Size() || !e.ModTime.Equal(fi.ModTime()) {
+			downloads := int64(0)
+			if ok {
+				downloads = e.Downloads
+			}
+			e = &indexEntry{Path: name, IsDir: fi.IsDir(), Size: fi.Size(), ModTime: fi.ModTime(), Downloads: downloads}
+			x.entries[name] = e
+			x.dirty = true
+			x.gen++
+		}
+		if e.SHA256 == "" && !e.IsDir {
+			if sum, ok := sums.get(name, e.Size, e.ModTime); ok {
+				e.SHA256 = sum
+				x.dirty = true
+				x.gen++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Entries not seen may still exist.
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for name := range x.entries {
+		if !seen[name] {
+			delete(x.entries, name)
+			x.gen++
+		}
+	}
+	x.scanned, x.dirty = start, true
+	return nil
+}
+
+// count records a download of the file name.
+func (x *metaIndex) count(name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.entries[name]; ok && !e.IsDir {
+		e.Downloads++
+		if x.shared {
+			x.pending[name]++
+		}
+		x.dirty = true
+		x.gen++
+	}
+}
+
+// indexOrders maps the sort parameter of /_api/search to comparisons.
+var indexOrders = map[string]func(a, b *indexEntry) bool{
+	"name":      func(a, b *indexEntry) bool { return a.Path < b.Path },
+	"size":      func(a, b *indexEntry) bool { return a.Size < b.Size },
+	"mtime":     func(a, b *indexEntry) bool { return a.ModTime.Before(b.ModTime) },
+	"downloads": func(a, b *indexEntry) bool { return a.Downloads < b.Downloads },
+}
+
+// serveSearch implements /_api/search?q=&path=&sort=&desc=&limit=,
+// the indexed paths below path whose name contains q, ignoring case.
+func (fh *fileHandler) serveSearch(w http.ResponseWriter, r *http.Request) {
+	if fh.index == nil {
+		apiError(w, errors.New("no index: requires -index"), http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	order := q.Get("sort")
+	if order == "" {
+		order = "name"
+	}
+	less, ok := indexOrders[order]
+	if !ok {
+		apiError(w, errors.New("sort must be name, size, mtime or downloads"), http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > indexSearchLimit {
+			apiError(w, errors.New("limit must be between 1 and "+strconv.Itoa(indexSearchLimit)), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	dir := path.Clean("/" + q.Get("path"))
+	needle := strings.ToLower(q.Get("q"))
+
+	// The results only change with the index, unless access windows
+	// open and close, so the generation tells whether the client has
+	// them already without searching. The scan time isn't covered.
+	var results []indexEntry
+	fh.index.mu.RLock()
+	if len(fh.windows) == 0 {
+		key := sha256.Sum256([]byte(principalName(r) + "\x00" + r.URL.RawQuery))
+		w.Header().Set("Etag", fmt.Sprintf(`W/"i%x-%x"`, fh.index.gen, key[:8]))
+		if checkIfNoneMatch(w, r) == condFalse {
+			fh.index.mu.RUnlock()
+			writeNotModified(w)
+			return
+		}
+	}
+	scanned := fh.index.scanned
+	for name, e := range fh.index.entries {
+		if !underPrefix(name, dir) || name == dir || !strings.Contains(strings.ToLower(path.Base(name)), needle) {
+			continue
+		}
+		if fh.closedWindow(name) != nil || fh.unlistedEntry(name, e.IsDir) || !fh.permitted(r, name, RoleRead) {
+			continue
+		}
+		results = append(results, *e)
+	}
+	fh.index.mu.RUnlock()
+
+	desc := q.Get("desc") == "1"
+	sort.Slice(results, func(i, j int) bool {
+		a, b := &results[i], &results[j]
+		if desc {
+			a, b = b, a
+		}
+		if less(a, b) != less(b, a) {
+			return less(a, b)
+		}
+		return results[i].Path < results[j].Path
+	})
+	total := len(results)
+	if total > limit {
+		results = results[:limit]
+	}
+	if results == nil {
+		results = []indexEntry{}
+	}
+	writeJSON(w, r, struct {
+		Scanned time.Time    `json:"scanned"`
+		Total   int          `json:"total"`
+		Results []indexEntry `json:"results"`
+	}{scanned.UTC(), total, results})
+}
@@ -0,0 +1,208 @@
+// Background integrity verification
+
+package midserve
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// integrityMaxReports bounds the corrupt files remembered for
+// /_admin/integrity.
+const integrityMaxReports = 1000
+
+// integrityChecker periodically re-hashes the least recently verified
+// fraction of the indexed files with a checksum and reports those whose
+// content changed while their size and modification time did not, the
+// sign of a failing disk rather than of an edit.
+type integrityChecker struct {
+	index    *metaIndex
+	interval time.Duration
+	fraction float64
+	webhook  string
+
+	mu      sync.Mutex
+	runs    int64
+	checked int64
+	last    time.Time
+	corrupt []corruptFile
+}
+
+// corruptFile is what /_admin/integrity and the webhook report about a
+// file failing verification.
+type corruptFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	Want     string    `json:"want_sha256"`
+	Got      string    `json:"got_sha256"`
+	Detected time.Time `json:"detected"`
+}
+
+// errCorrupt reports a file failing verification.
+var errCorrupt = errors.New("checksum mismatch")
+
+func (c *integrityChecker) run() {
+	for {
+		time.Sleep(c.interval)
+		c.verify(context.Background())
+	}
+}
+
+// verify checks the share of files due in this run.
+func (c *integrityChecker) verify(ctx context.Context) {
+	x := c.index
+	x.mu.RLock()
+	var due []*indexEntry
+	for _, e := range x.entries {
+		if e.SHA256 != "" {
+			due = append(due, e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Verified.Before(due[j].Verified) })
+	n := int(math.Ceil(float64(len(due)) * c.fraction))
+	if n > len(due) {
+		n = len(due)
+	}
+	// Copies, as rescans replace entries.
+	batch := make([]indexEntry, n)
+	for i := range batch {
+		batch[i] = *due[i]
+	}
+	x.mu.RUnlock()
+
+	checked := 0
+	for _, e := range batch {
+		got, err := c.hash(ctx, e)
+		if err != nil {
+			// Changed or gone: the next rescan picks that up.
+			continue
+		}
+		checked++
+		x.verified(e.Path, e.SHA256)
+		if got != e.SHA256 {
+			c.report(corruptFile{e.Path, e.Size, e.ModTime.UTC(), e.SHA256, got, time.Now().UTC()})
+		}
+	}
+
+	c.mu.Lock()
+	c.runs++
+	c.checked += int64(checked)
+	c.last = time.Now()
+	c.mu.Unlock()
+}
+
+// errChanged is returned by hash for a file that no longer matches its
+// index entry.
+var errChanged = errors.New("changed since indexed")
+
+// hash returns the SHA-256 of the file of e, as long as its size and
+// modification time are those indexed before and after reading it.
+func (c *integrityChecker) hash(ctx context.Context, e indexEntry) (string, error) {
+	f, err := openContext(ctx, c.index.root, e.Path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	unchanged := func() bool {
+		d, err := f.Stat()
+		return err == nil && d.Size() == e.Size && d.ModTime().Equal(e.ModTime)
+	}
+	if !unchanged() {
+		return "", errChanged
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if !unchanged() {
+		return "", errChanged
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// report logs cf, remembers it and posts it to the webhook, unless the
+// same corruption was already reported.
+func (c *integrityChecker) report(cf corruptFile) {
+	c.mu.Lock()
+	for _, seen := range c.corrupt {
+		if seen.Path == cf.Path && seen.Got == cf.Got && seen.Want == cf.Want {
+			c.mu.Unlock()
+			return
+		}
+	}
+	if len(c.corrupt) == integrityMaxReports {
+		c.corrupt = c.corrupt[1:]
+	}
+	c.corrupt = append(c.corrupt, cf)
+	c.mu.Unlock()
+	log.Printf("integrity: %s: %v: want sha256 %s, got %s", cf.Path, errCorrupt, cf.Want, cf.Got)
+	if c.webhook == "" {
+		return
+	}
+	body, _ := json.Marshal(struct {
+		Event string `json:"event"`
+		corruptFile
+	}{"corrupt", cf})
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(c.webhook, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Printf("integrity: webhook: %v", err)
+	}
+}
+
+// verified records that the entry of name was verified against sum.
+func (x *metaIndex) verified(name, sum string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.entries[name]; ok && e.SHA256 == sum {
+		e.Verified = time.Now()
+		x.dirty = true
+	}
+}
+
+// serveIntegrity implements GET /_admin/integrity, the progress of the
+// verification and the corrupt files found.
+func (fh *fileHandler) serveIntegrity(w http.ResponseWriter, r *http.Request) {
+	c := fh.integrity
+	if c == nil {
+		apiError(w, errors.New("no verification: requires -verify-interval"), http.StatusNotFound)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := struct {
+		Interval string        `json:"interval"`
+		Fraction float64       `json:"fraction"`
+		Runs     int64         `json:"runs"`
+		Checked  int64         `json:"checked"`
+		Last     *time.Time    `json:"last_run,omitempty"`
+		Corrupt  []corruptFile `json:"corrupt"`
+	}{c.interval.String(), c.fraction, c.runs, c.checked, nil, c.corrupt}
+	if !c.last.IsZero() {
+		last := c.last.UTC()
+		report.Last = &last
+	}
+	if report.Corrupt == nil {
+		report.Corrupt = []corruptFile{}
+	}
+	writeJSON(w, r, report)
+}
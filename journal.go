@@ -0,0 +1,239 @@
+// Journal of changes made through the management API
+
+package midserve
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// journalPageSize is how many entries /_admin/journal returns by
+	// default, journalMaxPage at most.
+	journalPageSize = 1000
+	journalMaxPage  = 10000
+)
+
+var errJournal = errors.New("journal unavailable")
+
+// journalEntry records an operation changing files. It is written
+// twice: pending before the change is made, so that no change goes
+// unrecorded, and done or failed after, with only the fields needed to
+// tell which operation it ends.
+type journalEntry struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Op         string    `json:"op"` // upload, delete or move
+	Path       string    `json:"path"`
+	From       string    `json:"from,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	SHA256     string    `json:"sha256,omitempty"`
+	Principal  string    `json:"principal,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	State      string    `json:"state"` // pending, done or failed
+	Error      string    `json:"error,omitempty"`
+}
+
+// journal appends journalEntries to a file as JSON lines, synced one by
+// one. The file is opened on first use, continuing its sequence.
+type journal struct {
+	file string
+
+	mu  sync.Mutex
+	f   *os.File
+	seq uint64
+}
+
+func newJournal(file string) *journal {
+	return &journal{file: file}
+}
+
+// open opens the file. It must be called with mu held.
+func (j *journal) open() error {
+	if j.f != nil {
+		return nil
+	}
+	f, err := os.OpenFile(j.file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	err = scanJournal(f, func(e *journalEntry) {
+		if e.Seq > j.seq {
+			j.seq = e.Seq
+		}
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.f = f
+	return nil
+}
+
+// append writes e, numbering it first if it has no sequence number.
+func (j *journal) append(e *journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.open(); err != nil {
+		return err
+	}
+	if e.Seq == 0 {
+		j.seq++
+		e.Seq = j.seq
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// scanJournal calls fn for each entry of the journal r, skipping lines
+// that don't parse, such as one cut short by a crash.
+func scanJournal(r io.Reader, fn func(e *journalEntry)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var e journalEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil && e.Seq > 0 {
+			fn(&e)
+		}
+	}
+	return sc.Err()
+}
+
+// journalBegin records that op is about to change name, moved from
+// from, of size bytes with the checksum sum if known. Without a journal
+// it does nothing; if the journal can't be written, the change must not
+// be made.
+func (fh *fileHandler) journalBegin(r *http.Request, op, name, from string, size int64, sum string) (*journalEntry, error) {
+	if fh.journal == nil {
+		return nil, nil
+	}
+	e := &journalEntry{
+		Time:       time.Now().UTC(),
+		Op:         op,
+		Path:       name,
+		From:       from,
+		Size:       size,
+		SHA256:     sum,
+		Principal:  principalName(r),
+		RemoteAddr: r.RemoteAddr,
+		RequestID:  requestID(r),
+		State:      "pending",
+	}
+	if err := fh.journal.append(e); err != nil {
+		log.Printf("journal: %v", err)
+		return nil, errJournal
+	}
+	return e, nil
+}
+
+// journalEnd records the outcome of the change begun as e.
+func (fh *fileHandler) journalEnd(e *journalEntry, err error) {
+	if e == nil {
+		return
+	}
+	end := &journalEntry{Seq: e.Seq, Time: time.Now().UTC(), Op: e.Op, Path: e.Path, State: "done"}
+	if err != nil {
+		end.State, end.Error = "failed", manageError(err)
+	}
+	if err := fh.journal.append(end); err != nil {
+		log.Printf("journal: %v", err)
+	}
+}
+
+// knownSum returns the size of the file name with info fi and its
+// checksum if cached, as hashing it again may take long. Directories
+// have neither.
+func (fh *fileHandler) knownSum(name string, fi fs.FileInfo) (int64, string) {
+	if !fi.Mode().IsRegular() {
+		return 0, ""
+	}
+	sum, _ := fh.checksums.get(name, fi.Size(), fi.ModTime())
+	return fi.Size(), sum
+}
+
+// serveJournal implements /_admin/journal?since=&path=&limit=, the
+// journaled operations after the sequence number since below path, each
+// with its latest state, and the sequence number to ask for next.
+// Operations still pending were interrupted or are in progress.
+func (fh *fileHandler) serveJournal(w http.ResponseWriter, r *http.Request) {
+	if fh.journal == nil {
+		apiError(w, errors.New("no journal"), http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	since, limit := uint64(0), journalPageSize
+	if s := q.Get("since"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			apiError(w, errors.New("since must be a sequence number"), http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > journalMaxPage {
+			apiError(w, errors.New("limit must be between 1 and "+strconv.Itoa(journalMaxPage)), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	prefix := "/"
+	if p := q.Get("path"); p != "" {
+		prefix = path.Clean("/" + p)
+	}
+
+	f, err := os.Open(fh.journal.file)
+	if err != nil && !os.IsNotExist(err) {
+		apiError(w, err, http.StatusInternalServerError)
+		return
+	}
+	entries := []*journalEntry{}
+	bySeq := make(map[uint64]*journalEntry)
+	next := since
+	if f != nil {
+		defer f.Close()
+		err = scanJournal(f, func(e *journalEntry) {
+			if e.Seq <= since {
+				return
+			}
+			if len(entries) < limit && e.Seq > next {
+				// Entries elsewhere don't need to be scanned again.
+				next = e.Seq
+			}
+			if begun, ok := bySeq[e.Seq]; ok {
+				begun.State, begun.Error = e.State, e.Error
+				return
+			}
+			if len(entries) < limit && (underPrefix(e.Path, prefix) || e.From != "" && underPrefix(e.From, prefix)) {
+				entries = append(entries, e)
+				bySeq[e.Seq] = e
+			}
+		})
+		if err != nil {
+			apiError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, r, struct {
+		Entries []*journalEntry `json:"entries"`
+		Next    uint64          `json:"next"`
+	}{entries, next})
+}
@@ -0,0 +1,87 @@
+// Per-path download concurrency limits
+
+package midserve
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// A ConcurrencyLimit allows at most Max simultaneous downloads of the
+// files below Prefix, together. Further requests wait up to Wait for a
+// slot and then get 503 Service Unavailable.
+type ConcurrencyLimit struct {
+	Prefix string // '/'-separated, a directory or a single file
+	Max    int
+	Wait   time.Duration
+}
+
+// limiter enforces a ConcurrencyLimit.
+type limiter struct {
+	ConcurrencyLimit
+	slots   chan struct{}
+	waiting int64 // accessed atomically
+}
+
+func newLimiters(limits []ConcurrencyLimit) []*limiter {
+	var ls []*limiter
+	for _, cl := range limits {
+		if cl.Max > 0 {
+			ls = append(ls, &limiter{ConcurrencyLimit: cl, slots: make(chan struct{}, cl.Max)})
+		}
+	}
+	return ls
+}
+
+// acquire takes a slot of every limit covering name, waiting as they
+// allow. On success it returns the function releasing the slots,
+// otherwise it replies to the request and returns nil.
+func (fh *fileHandler) acquire(w http.ResponseWriter, r *http.Request, name string) func() {
+	var held []*limiter
+	release := func() {
+		for _, l := range held {
+			<-l.slots
+		}
+	}
+	for _, l := range fh.limiters {
+		if !underPrefix(name, l.Prefix) {
+			continue
+		}
+		if !l.take(r, l.Wait) {
+			release()
+			if r.Context().Err() != nil {
+				return nil
+			}
+			// The more are waiting per slot, the longer to stay away.
+			load := float64(atomic.LoadInt64(&l.waiting)) / float64(l.Max)
+			fh.overloaded(w, r, name, http.StatusServiceUnavailable, "too many downloads", retryAfter(l.Wait, load), nil)
+			return nil
+		}
+		held = append(held, l)
+	}
+	return release
+}
+
+// take waits up to wait for a slot.
+func (l *limiter) take(r *http.Request, wait time.Duration) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+	atomic.AddInt64(&l.waiting, 1)
+	defer atomic.AddInt64(&l.waiting, -1)
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+// Cached directory listings, served stale while revalidating
+
+package midserve
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// listingCacheMax bounds the number of directories cached.
+	listingCacheMax = 4096
+	// listingRefreshTimeout bounds a background refresh.
+	listingRefreshTimeout = time.Minute
+)
+
+// listingCache keeps the sorted entries of directories. An entry is
+// fresh while the directory's modification time is unchanged and it is
+// younger than ttl. Past that, it is still served for up to maxStale
+// while a background refresh reads the directory again, so that huge
+// directories don't hold up browsing.
+type listingCache struct {
+	root     http.FileSystem
+	ttl      time.Duration
+	maxStale time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cachedListing
+}
+
+type cachedListing struct {
+	dirs       anyDirs
+	modTime    time.Time // of the directory when read
+	fetched    time.Time
+	refreshing bool
+}
+
+func newListingCache(root http.FileSystem, ttl, maxStale time.Duration) *listingCache {
+	return &listingCache{root: root, ttl: ttl, maxStale: maxStale, entries: make(map[string]*cachedListing)}
+}
+
+// get returns the entries of the directory name, open as f with
+// modification time modTime, read with read, and whether they are a
+// stale copy being refreshed.
+func (c *listingCache) get(ctx context.Context, name string, f http.File, modTime time.Time, read func(context.Context, http.File) (anyDirs, error)) (anyDirs, bool, error) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if ok {
+		age := now.Sub(e.fetched)
+		if e.modTime.Equal(modTime) && age < c.ttl {
+			c.mu.Unlock()
+			return e.dirs, false, nil
+		}
+		if age < c.ttl+c.maxStale {
+			if !e.refreshing {
+				e.refreshing = true
+				go c.refresh(name, read)
+			}
+			c.mu.Unlock()
+			return e.dirs, true, nil
+		}
+	}
+	c.mu.Unlock()
+
+	dirs, err := read(ctx, f)
+	if err != nil {
+		return nil, false, err
+	}
+	c.put(name, dirs, modTime, now)
+	return dirs, false, nil
+}
+
+// refresh reads the directory name again in the background.
+func (c *listingCache) refresh(name string, read func(context.Context, http.File) (anyDirs, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), listingRefreshTimeout)
+	defer cancel()
+	now := time.Now()
+	dirs, modTime, err := func() (anyDirs, time.Time, error) {
+		f, err := openContext(ctx, c.root, name)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		defer f.Close()
+		d, err := f.Stat()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		dirs, err := read(ctx, f)
+		return dirs, d.ModTime(), err
+	}()
+	if err != nil {
+		log.Printf("http: error refreshing listing of %s: %v", name, err)
+		// Requests read the directory themselves once the entry expires.
+		c.mu.Lock()
+		if e, ok := c.entries[name]; ok {
+			e.refreshing = false
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.put(name, dirs, modTime, now)
+}
+
+func (c *listingCache) put(name string, dirs anyDirs, modTime, fetched time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[name]; !ok && len(c.entries) >= listingCacheMax {
+		// Evict the entry read longest ago.
+		var oldest string
+		for n, e := range c.entries {
+			if oldest == "" || e.fetched.Before(c.entries[oldest].fetched) {
+				oldest = n
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[name] = &cachedListing{dirs: dirs, modTime: modTime, fetched: fetched}
+}
+
+// purge drops the listings of the directories below prefix.
+func (c *listingCache) purge(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.entries {
+		if underPrefix(name, prefix) {
+			delete(c.entries, name)
+		}
+	}
+}
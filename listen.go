@@ -0,0 +1,126 @@
+// Listening addresses
+
+package midserve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultPort is used for listen addresses given without one.
+const defaultPort = "8000"
+
+// listenNetwork returns the network to listen on for an IP version:
+// "4" and "6" only accept that version, "dual" or empty both, where the
+// platform supports it.
+func listenNetwork(ipVersion string) (string, error) {
+	switch ipVersion {
+	case "", "dual":
+		return "tcp", nil
+	case "4":
+		return "tcp4", nil
+	case "6":
+		return "tcp6", nil
+	}
+	return "", fmt.Errorf("ip-version: %q is not 4, 6 or dual", ipVersion)
+}
+
+// normalizeListen returns addr as host:port. A host name, IPv4 address
+// or bracketed IPv6 address without a port gets defaultPort. IPv6
+// addresses must be bracketed, as in ::1:8000 the port is ambiguous.
+func normalizeListen(addr string) (string, error) {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr, nil
+	}
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		if ip := net.ParseIP(addr[1 : len(addr)-1]); ip != nil {
+			return addr + ":" + defaultPort, nil
+		}
+	}
+	if strings.Count(addr, ":") > 1 {
+		return "", fmt.Errorf("listen: IPv6 address %q must be in brackets, e.g. [::1]:%s", addr, defaultPort)
+	}
+	if addr != "" && !strings.Contains(addr, ":") {
+		return net.JoinHostPort(addr, defaultPort), nil
+	}
+	return "", fmt.Errorf("listen: invalid address %q", addr)
+}
+
+// listen opens a listener on addr for the configured IP version,
+// checking that an IP literal in addr matches it.
+func (c *Config) listen(addr string) (net.Listener, error) {
+	network, err := listenNetwork(c.IPVersion)
+	if err != nil {
+		return nil, err
+	}
+	addr, err = normalizeListen(addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip != nil {
+		if network == "tcp4" && ip.To4() == nil || network == "tcp6" && ip.To4() != nil {
+			return nil, fmt.Errorf("listen: %s is not an IPv%s address", host, c.IPVersion)
+		}
+	}
+	lc := net.ListenConfig{KeepAlive: time.Duration(c.TCPKeepAlive)}
+	if c.ReusePort {
+		lc.Control = func(network, address string, conn syscall.RawConn) error {
+			var err error
+			if cerr := conn.Control(func(fd uintptr) { err = setReusePort(fd) }); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.Backlog > 0 {
+		if err := setListenBacklog(l, c.Backlog); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("backlog: %v", err)
+		}
+	}
+	return l, nil
+}
+
+func setListenBacklog(l net.Listener, n int) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return errors.New("not a socket")
+	}
+	conn, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if cerr := conn.Control(func(fd uintptr) { err = setBacklog(fd, n) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// newServer returns a server for addr with the configured timeouts.
+func (c *Config) newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: time.Duration(c.ReadHeaderTimeout),
+		IdleTimeout:       time.Duration(c.IdleTimeout),
+	}
+}
+
+// serveListener serves srv on l, with TLS if c has a certificate.
+func (c *Config) serveListener(srv *http.Server, l net.Listener, useTLS bool) error {
+	if !useTLS {
+		return srv.Serve(l)
+	}
+	return srv.ServeTLS(l, c.TLSCert, c.TLSKey)
+}
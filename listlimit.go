@@ -0,0 +1,38 @@
+// Limits on the size of directory listings
+
+package midserve
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// listingPage returns the page of a listing requested with ?page=,
+// counting from 1, and the number of entries before it.
+func (fh *fileHandler) listingPage(r *http.Request) (page, skip int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 || fh.maxEntries <= 0 {
+		return 1, 0
+	}
+	// Keep skip from overflowing; such pages are empty anyway.
+	if page > math.MaxInt32/fh.maxEntries {
+		page = math.MaxInt32 / fh.maxEntries
+	}
+	return page, (page - 1) * fh.maxEntries
+}
+
+// writeListingPages writes the notice that a listing is truncated to
+// maxEntries entries, with links to the neighboring pages.
+func (fh *fileHandler) writeListingPages(w io.Writer, page int, more bool, msgs messages) {
+	fmt.Fprintf(w, "<nav class=\"pages\"><p>%s", htmlReplacer.Replace(fmt.Sprintf(msgs.t("Listing truncated to %d entries per page."), fh.maxEntries)))
+	if page > 1 {
+		fmt.Fprintf(w, " <a href=\"?page=%d\" rel=\"prev nofollow\">%s</a>", page-1, msgs.t("previous page"))
+	}
+	if more {
+		fmt.Fprintf(w, " <a href=\"?page=%d\" rel=\"next nofollow\">%s</a>", page+1, msgs.t("next page"))
+	}
+	fmt.Fprintf(w, "</p></nav>\n")
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+// Advisory file locks between processes
+
+package midserve
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes an exclusive lock on f unless another open file
+// holds one, reporting whether it did.
+func tryLockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,69 @@
+// Log output
+
+package midserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// setupLogging directs the standard logger according to format: "text"
+// to stderr, "json" as one JSON object per line to stdout, or by
+// default JSON unless stdout is a terminal, as in containers. It returns
+// where the startup banner goes.
+func setupLogging(format string) (io.Writer, error) {
+	switch format {
+	case "text":
+		return os.Stderr, nil
+	case "", "auto":
+		if isTerminal(os.Stdout) {
+			return os.Stderr, nil
+		}
+	case "json":
+	default:
+		return nil, fmt.Errorf("log-format: %q is not text, json or auto", format)
+	}
+	log.SetFlags(0)
+	log.SetOutput(&jsonLogWriter{w: os.Stdout})
+	return logLineWriter{}, nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// jsonLogWriter writes each line logged as a JSON object with its time
+// and message. The standard logger serializes calls to Write.
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (jw *jsonLogWriter) Write(p []byte) (int, error) {
+	b, err := json.Marshal(struct {
+		Time string `json:"time"`
+		Msg  string `json:"msg"`
+	}{time.Now().UTC().Format(time.RFC3339Nano), string(bytes.TrimSuffix(p, []byte("\n")))})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := jw.w.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logLineWriter logs every line written to it.
+type logLineWriter struct{}
+
+func (logLineWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimSuffix(p, []byte("\n")), []byte("\n")) {
+		log.Print(string(bytes.TrimSpace(line)))
+	}
+	return len(p), nil
+}
@@ -0,0 +1,401 @@
+// Live log viewer
+
+package midserve
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logViewExts lists the extensions offered in the log viewer.
+var logViewExts = map[string]bool{
+	".log": true,
+	".txt": true,
+}
+
+const (
+	// logWindow is the number of trailing bytes shown initially and
+	// the most sent in a single update.
+	logWindow = 64 << 10
+	// logPollInterval is how often a followed file is checked for
+	// growth.
+	logPollInterval = time.Second
+)
+
+func isLogView(r *http.Request, name string) bool {
+	return r.URL.Query().Get("view") == "log" && logViewExts[strings.ToLower(path.Ext(name))]
+}
+
+var logViewTemplate = template.Must(template.New("log").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<title>{{.Name}}</title>
+<style>
+body { margin: 0; background: #1e1e1e; color: #ddd; }
+header { position: sticky; top: 0; padding: .5em 1em; background: #333; font-family: sans-serif; }
+header a { color: #9cf; }
+pre { margin: 0; padding: 1em; white-space: pre-wrap; word-break: break-all; font-family: monospace; }
+</style>
+</head>
+<body>
+<header>{{.Name}} &middot; <span id="state">following</span> &middot; <a href="?">raw</a>
+<label><input type="checkbox" id="scroll" checked> auto-scroll</label></header>
+<pre id="log">{{.Content}}</pre>
+<script>
+(function() {
+	var log = document.getElementById("log");
+	var state = document.getElementById("state");
+	var scroll = document.getElementById("scroll");
+	function bottom() { if (scroll.checked) window.scrollTo(0, document.body.scrollHeight); }
+	bottom();
+	var es = new EventSource("?view=log&follow=1&offset={{.Offset}}");
+	es.onmessage = function(e) {
+		log.insertAdjacentHTML("beforeend", JSON.parse(e.data));
+		// Keep the page bounded like the initial window.
+		while (log.textContent.length > {{.Window}} * 4 && log.firstChild) log.removeChild(log.firstChild);
+		bottom();
+	};
+	es.addEventListener("reset", function() { log.innerHTML = ""; });
+	es.onerror = function() { state.textContent = "disconnected, retrying"; };
+	es.onopen = function() { state.textContent = "following"; };
+})();
+</script>
+</body>
+</html>
+`))
+
+// serveLogView serves the log viewer page for name.
+func (fh *fileHandler) serveLogView(w http.ResponseWriter, r *http.Request, name string, f http.File, size int64) {
+	start := size - logWindow
+	if start < 0 {
+		start = 0
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	buf, err := io.ReadAll(io.LimitReader(f, size-start))
+	if err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	var conv ansiConverter
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	logViewTemplate.Execute(w, struct {
+		Name    string
+		Content template.HTML
+		Offset  int64
+		Window  int
+	}{path.Base(name), template.HTML(conv.convert(buf)), start + int64(len(buf)), logWindow})
+}
+
+// followLog implements ?view=log&follow=1&offset=, streaming what is
+// appended to f, of size, after offset as server-sent events carrying
+// HTML fragments, until the client goes away or uses up its transfer
+// cap.
+func (fh *fileHandler) followLog(w http.ResponseWriter, r *http.Request, name string, f http.File, size int64) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 || offset > size {
+		offset = size
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	fh.publish(r, EventServed, name, http.StatusOK, -1, nil)
+
+	// Sent bytes are accounted as they are flushed, as the log may be
+	// followed for days.
+	sw := &statusWriter{ResponseWriter: w}
+	var accounted int64
+
+	var conv ansiConverter
+	buf := make([]byte, logWindow)
+	tick := time.NewTicker(logPollInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+		}
+		d, err := f.Stat()
+		if err != nil {
+			return
+		}
+		size := d.Size()
+		if size < offset {
+			// Truncated or rotated in place.
+			fmt.Fprint(sw, "event: reset\ndata: {}\n\n")
+			offset = 0
+			conv = ansiConverter{}
+		}
+		if size-offset > logWindow {
+			// Skip what can't be shown anyway.
+			offset = size - logWindow
+		}
+		for offset < size {
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				return
+			}
+			n, err := f.Read(buf[:min64(size-offset, logWindow)])
+			if n > 0 {
+				fmt.Fprintf(sw, "data: %s\n\n", jsonString(conv.convert(buf[:n])))
+				offset += int64(n)
+			}
+			if err != nil {
+				break
+			}
+		}
+		flusher.Flush()
+		if sw.written > accounted {
+			fh.usage.add(usageClient(r), sw.written-accounted)
+			accounted = sw.written
+			if over, _ := fh.usage.over(usageClient(r)); over {
+				return
+			}
+		}
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// jsonString returns s as a JSON string literal, which can't contain
+// newlines and so fits on one SSE data line.
+func jsonString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x2028 || r == 0x2029:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// ansiConverter converts text with ANSI SGR escape sequences to HTML.
+// It keeps the current style across calls, as sequences and the text
+// they apply to may arrive in separate chunks.
+type ansiConverter struct {
+	fg, bg         string
+	bold, italic   bool
+	underline, dim bool
+	pending        []byte // incomplete escape sequence
+}
+
+// maxPendingEscape bounds the incomplete escape sequence kept between
+// calls. A longer one is dropped rather than buffered.
+const maxPendingEscape = 256
+
+// ansiColors are the 16 basic terminal colors.
+var ansiColors = [16]string{
+	"#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+	"#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+}
+
+func (c *ansiConverter) style() string {
+	var s []string
+	if c.fg != "" {
+		s = append(s, "color:"+c.fg)
+	}
+	if c.bg != "" {
+		s = append(s, "background:"+c.bg)
+	}
+	if c.bold {
+		s = append(s, "font-weight:bold")
+	}
+	if c.dim {
+		s = append(s, "opacity:.7")
+	}
+	if c.italic {
+		s = append(s, "font-style:italic")
+	}
+	if c.underline {
+		s = append(s, "text-decoration:underline")
+	}
+	return strings.Join(s, ";")
+}
+
+func (c *ansiConverter) convert(p []byte) string {
+	if len(c.pending) > 0 {
+		p = append(c.pending, p...)
+		c.pending = nil
+	}
+	var b strings.Builder
+	open := false
+	openSpan := func() {
+		if st := c.style(); st != "" {
+			b.WriteString(`<span style="` + st + `">`)
+			open = true
+		}
+	}
+	closeSpan := func() {
+		if open {
+			b.WriteString("</span>")
+			open = false
+		}
+	}
+	openSpan()
+	text := 0
+	for i := 0; i < len(p); i++ {
+		if p[i] != 0x1b {
+			continue
+		}
+		b.WriteString(template.HTMLEscapeString(string(p[text:i])))
+		// Find the end of the CSI sequence.
+		if i+1 >= len(p) {
+			c.pending = append([]byte(nil), p[i:]...)
+			text = len(p)
+			break
+		}
+		if p[i+1] != '[' {
+			// Not CSI, drop ESC and the next byte.
+			i++
+			text = i + 1
+			continue
+		}
+		j := i + 2
+		for j < len(p) && (p[j] < 0x40 || p[j] > 0x7e) {
+			j++
+		}
+		if j >= len(p) {
+			if len(p)-i <= maxPendingEscape {
+				c.pending = append([]byte(nil), p[i:]...)
+			}
+			text = len(p)
+			break
+		}
+		if p[j] == 'm' {
+			closeSpan()
+			c.sgr(string(p[i+2 : j]))
+			openSpan()
+		}
+		i = j
+		text = j + 1
+	}
+	if text < len(p) {
+		b.WriteString(template.HTMLEscapeString(string(p[text:])))
+	}
+	closeSpan()
+	return b.String()
+}
+
+// sgr applies the parameters of a Select Graphic Rendition sequence.
+func (c *ansiConverter) sgr(params string) {
+	if params == "" {
+		params = "0"
+	}
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		n, _ := strconv.Atoi(codes[i])
+		switch {
+		case n == 0:
+			*c = ansiConverter{}
+		case n == 1:
+			c.bold = true
+		case n == 2:
+			c.dim = true
+		case n == 3:
+			c.italic = true
+		case n == 4:
+			c.underline = true
+		case n == 22:
+			c.bold, c.dim = false, false
+		case n == 23:
+			c.italic = false
+		case n == 24:
+			c.underline = false
+		case n >= 30 && n <= 37:
+			c.fg = ansiColors[n-30]
+		case n >= 90 && n <= 97:
+			c.fg = ansiColors[n-90+8]
+		case n == 39:
+			c.fg = ""
+		case n >= 40 && n <= 47:
+			c.bg = ansiColors[n-40]
+		case n >= 100 && n <= 107:
+			c.bg = ansiColors[n-100+8]
+		case n == 49:
+			c.bg = ""
+		case n == 38 || n == 48:
+			color, skip := extendedColor(codes[i+1:])
+			i += skip
+			if n == 38 {
+				c.fg = color
+			} else {
+				c.bg = color
+			}
+		}
+	}
+}
+
+// extendedColor parses the 256 color ("5;n") or true color ("2;r;g;b")
+// arguments of SGR 38 and 48, returning the CSS color and the number of
+// parameters consumed.
+func extendedColor(args []string) (string, int) {
+	if len(args) >= 2 && args[0] == "5" {
+		n, err := strconv.Atoi(args[1])
+		switch {
+		case err != nil || n < 0 || n > 255:
+			return "", 2
+		case n < 16:
+			return ansiColors[n], 2
+		case n < 232:
+			n -= 16
+			level := func(v int) int {
+				if v == 0 {
+					return 0
+				}
+				return 55 + v*40
+			}
+			return fmt.Sprintf("#%02x%02x%02x", level(n/36), level(n/6%6), level(n%6)), 2
+		default:
+			v := 8 + (n-232)*10
+			return fmt.Sprintf("#%02x%02x%02x", v, v, v), 2
+		}
+	}
+	if len(args) >= 4 && args[0] == "2" {
+		var rgb [3]int
+		for i := range rgb {
+			n, err := strconv.Atoi(args[1+i])
+			if err != nil || n < 0 || n > 255 {
+				return "", 4
+			}
+			rgb[i] = n
+		}
+		return fmt.Sprintf("#%02x%02x%02x", rgb[0], rgb[1], rgb[2]), 4
+	}
+	return "", len(args)
+}
@@ -0,0 +1,46 @@
+package midserve
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtendedColor(t *testing.T) {
+	for _, tc := range []struct {
+		args  string
+		color string
+		skip  int
+	}{
+		{"5;1", "#cd3131", 2},
+		{"5;16", "#000000", 2},
+		{"5;255", "#eeeeee", 2},
+		{"5;-1", "", 2},
+		{"5;256", "", 2},
+		{"5;x", "", 2},
+		{"2;1;2;3", "#010203", 4},
+		{"2;1;2;300", "", 4},
+		{"2;-1;2;3", "", 4},
+		{"2;1", "", 2},
+	} {
+		color, skip := extendedColor(strings.Split(tc.args, ";"))
+		if color != tc.color || skip != tc.skip {
+			t.Errorf("extendedColor(%q) = %q, %d, want %q, %d", tc.args, color, skip, tc.color, tc.skip)
+		}
+	}
+}
+
+func TestANSIPending(t *testing.T) {
+	var c ansiConverter
+	if got := c.convert([]byte("a\x1b[3")); got != "a" {
+		t.Errorf("convert = %q", got)
+	}
+	if got := c.convert([]byte("1mb")); got != `<span style="color:#cd3131">b</span>` {
+		t.Errorf("convert = %q", got)
+	}
+
+	c = ansiConverter{}
+	c.convert([]byte("\x1b[" + strings.Repeat("1;", maxPendingEscape)))
+	if len(c.pending) != 0 {
+		t.Errorf("kept %d bytes of an overlong sequence", len(c.pending))
+	}
+}
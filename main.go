@@ -1,20 +1,111 @@
-package main
+package midserve
 
 import (
+	"errors"
 	"flag"
-	"net/http"
-	"regexp"
+	"fmt"
+	"os"
+	"strings"
 )
 
-func main() {
-	flag.Parse()
+// A command is a midserve subcommand.
+type command struct {
+	name  string
+	usage string // arguments after the command name
+	short string
+	run   func(c *command, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		serveCommand,
+		shareCommand,
+		genCertCommand,
+		hashCommand,
+		dupesCommand,
+		signCommand,
+		tokenCommand,
+		precompressCommand,
+		checkConfigCommand,
+		serviceCommand,
+		versionCommand,
+		helpCommand,
+	}
+}
+
+var helpCommand = &command{
+	name:  "help",
+	short: "show this help",
+	run: func(c *command, args []string) error {
+		usage()
+		return nil
+	},
+}
 
-	http.Handle("/", FileServer(Dir("."), []*regexp.Regexp{
-		regexp.MustCompile(`^\.git`),
-		regexp.MustCompile(`^\.vscode`),
-		regexp.MustCompile(`^\.idea`),
-	}))
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: midserve [command] [flags] [args]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.short)
+	}
+	fmt.Fprintf(os.Stderr, "\nwithout a command, midserve runs serve.\n")
+	fmt.Fprintf(os.Stderr, "run \"midserve <command> -h\" for its flags.\n")
+}
+
+// errUsage is returned for invalid flags, which the FlagSet reported
+// along with the usage already.
+var errUsage = errors.New("invalid flags")
+
+// parseFlags parses args with flags, returning errUsage or flag.ErrHelp
+// on failure.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		return errUsage
+	}
+	return err
+}
+
+// flagSet returns a FlagSet for c whose usage lists c's flags.
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("midserve "+c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: midserve %s [flags] %s\n\n%s\n\nflags:\n", c.name, c.usage, c.short)
+		fs.PrintDefaults()
+	}
+	return fs
+}
 
-	http.ListenAndServe(":8000", nil)
+// Main runs the midserve command named by os.Args, by default serve,
+// and exits. It is all the midserve command does.
+func Main() {
+	args := os.Args[1:]
+	cmd := serveCommand
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd = nil
+		for _, c := range commands {
+			if c.name == args[0] {
+				cmd = c
+			}
+		}
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "midserve: unknown command %q\n\n", args[0])
+			usage()
+			os.Exit(2)
+		}
+		args = args[1:]
+	}
 
+	if err := cmd.run(cmd, args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "midserve %s: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
 }
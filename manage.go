@@ -0,0 +1,382 @@
+// File management API and bulk operations in listings
+
+package midserve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// manageMaxPaths bounds the number of files a single delete or move
+// request may act on.
+const manageMaxPaths = 1000
+
+var (
+	errRootChange = errors.New("the root can't be deleted or moved")
+	errExists     = errors.New("destination exists")
+	errIntoSelf   = errors.New("can't move a directory into itself")
+)
+
+// manageResult is what the delete and move endpoints report about one
+// path.
+type manageResult struct {
+	Path  string `json:"path"`
+	From  string `json:"from,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// manageRequest decodes the JSON body of a delete or move request into
+// v, replying with an error and returning false if that isn't possible
+// or management is off.
+//
+// Requiring a JSON content type keeps other sites from sending these
+// requests from a browser without a CORS preflight, which is refused.
+func (fh *fileHandler) manageRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if !fh.write {
+		http.NotFound(w, r)
+		return false
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		apiError(w, errors.New("content type must be application/json"), http.StatusUnsupportedMediaType)
+		return false
+	}
+	if err := json.NewDecoder(fh.limitBody(w, r)).Decode(v); err != nil {
+		code := bodyError(err)
+		if code != http.StatusBadRequest {
+			// Don't wait for the rest of the body.
+			w.Header().Set("Connection", "close")
+		}
+		apiError(w, err, code)
+		return false
+	}
+	return true
+}
+
+// writable checks that name may be changed as role allows: it isn't the
+// root, the principal of r has role below it, and the same rules that
+// would hide it from a request allow it.
+func (fh *fileHandler) writable(r *http.Request, name string, role Role) error {
+	if name == "/" {
+		return errRootChange
+	}
+	if !fh.permitted(r, name, role) {
+		fh.publish(r, EventDenied, name, http.StatusForbidden, -1, nil)
+		return fs.ErrPermission
+	}
+	if fh.denied(name) {
+		fh.publish(r, EventDenied, name, http.StatusNotFound, -1, nil)
+		return fs.ErrNotExist
+	}
+	if err := fh.closedWindow(name); err != nil {
+		_, code := toHTTPError(err)
+		fh.publish(r, EventDenied, name, code, -1, nil)
+		return err
+	}
+	return nil
+}
+
+// writableBelow checks with writable every file and directory below
+// name, so that grants, exclusions and access windows narrower than a
+// directory aren't bypassed by deleting or moving it. If to isn't
+// empty, they are also checked where they would be moved to below to.
+func (fh *fileHandler) writableBelow(r *http.Request, name, to string, role Role) error {
+	root := fh.writeRoot.osPath(name)
+	return filepath.WalkDir(root, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if err := fh.writable(r, path.Join(name, rel), role); err != nil {
+			return err
+		}
+		if to != "" {
+			return fh.writable(r, path.Join(to, rel), role)
+		}
+		return nil
+	})
+}
+
+// manageError returns the message reported for err, which like other
+// file system errors doesn't reveal details.
+func manageError(err error) string {
+	switch err {
+	case errRootChange, errExists, errIntoSelf, errJournal, errBadFileName, errUploadExt, errUploadName:
+		return err.Error()
+	}
+	if errors.Is(err, errBadPath) {
+		return err.Error()
+	}
+	msg, _ := toHTTPError(err)
+	return msg
+}
+
+// manageStatus returns the status code of the errors manageError
+// reveals, and 0, for apiError to map, of others.
+func manageStatus(err error) int {
+	switch err {
+	case errRootChange:
+		return http.StatusForbidden
+	case errExists, errIntoSelf:
+		return http.StatusConflict
+	case errJournal:
+		return http.StatusServiceUnavailable
+	case errBadFileName, errUploadExt, errUploadName:
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, errBadPath) {
+		return http.StatusBadRequest
+	}
+	return 0
+}
+
+// serveDelete implements POST /_api/delete with a body of
+// {"paths": [...]}, deleting the files and, with their contents, the
+// directories given.
+func (fh *fileHandler) serveDelete(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Paths []string `json:"paths"`
+	}
+	if !fh.manageRequest(w, r, &req) {
+		return
+	}
+	if len(req.Paths) > manageMaxPaths {
+		apiError(w, fmt.Errorf("at most %d paths per request", manageMaxPaths), http.StatusBadRequest)
+		return
+	}
+	results := make([]manageResult, len(req.Paths))
+	for i, name := range req.Paths {
+		results[i].Path = name
+		name, err := canonicalPath(name)
+		if err != nil {
+			results[i].Error = manageError(err)
+			continue
+		}
+		results[i].Path = name
+		if err := fh.delete(r, name); err != nil {
+			results[i].Error = manageError(err)
+		}
+	}
+	writeJSON(w, r, results)
+}
+
+// delete deletes the file or, with its contents, the directory name.
+func (fh *fileHandler) delete(r *http.Request, name string) error {
+	if err := fh.writable(r, name, RoleManage); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(fh.writeRoot.osPath(name))
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if err := fh.writableBelow(r, name, "", RoleManage); err != nil {
+			return err
+		}
+	}
+	size, sum := fh.knownSum(name, fi)
+	je, err := fh.journalBegin(r, "delete", name, "", size, sum)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(fh.writeRoot.osPath(name))
+	fh.journalEnd(je, err)
+	if err != nil {
+		return err
+	}
+	fh.publish(r, EventDeleted, name, http.StatusOK, -1, nil)
+	return nil
+}
+
+// serveFileMethod implements, in write mode, PUT of a file path, storing
+// the body as the file in the manner of an upload, and DELETE, deleting
+// it in the manner of /_api/delete.
+func (fh *fileHandler) serveFileMethod(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method == "DELETE" {
+		if err := fh.delete(r, name); err != nil {
+			apiError(w, err, manageStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	dir, fn := path.Split(name)
+	if dir != "/" {
+		if err := fh.writable(r, path.Clean(dir), RoleUpload); err != nil {
+			apiError(w, err, 0)
+			return
+		}
+	}
+	if fi, err := os.Stat(fh.writeRoot.osPath(dir)); err != nil || !fi.IsDir() {
+		if err == nil {
+			err = fs.ErrNotExist
+		}
+		apiError(w, err, 0)
+		return
+	}
+	name, err := fh.storeFile(r, nil, path.Clean(dir), fn, fh.limitUpload(w, r))
+	var be *uploadBodyError
+	if errors.As(err, &be) {
+		code := bodyError(be.err)
+		if code != http.StatusBadRequest {
+			// Don't wait for the rest of the body.
+			w.Header().Set("Connection", "close")
+		}
+		apiError(w, be.err, code)
+		return
+	}
+	if err != nil {
+		apiError(w, err, manageStatus(err))
+		return
+	}
+	// The upload policy may have stored it under another name.
+	w.Header().Set("Location", (&url.URL{Path: name}).EscapedPath())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveMove implements POST /_api/move with a body of
+// {"moves": [{"from": ..., "to": ...}]}, moving or renaming each file or
+// directory. Existing files are never replaced.
+func (fh *fileHandler) serveMove(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Moves []struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		} `json:"moves"`
+	}
+	if !fh.manageRequest(w, r, &req) {
+		return
+	}
+	if len(req.Moves) > manageMaxPaths {
+		apiError(w, fmt.Errorf("at most %d moves per request", manageMaxPaths), http.StatusBadRequest)
+		return
+	}
+	results := make([]manageResult, len(req.Moves))
+	for i, m := range req.Moves {
+		results[i].From, results[i].Path = m.From, m.To
+		from, err := canonicalPath(m.From)
+		if err != nil {
+			results[i].Error = manageError(err)
+			continue
+		}
+		to, err := canonicalPath(m.To)
+		if err != nil {
+			results[i].Error = manageError(err)
+			continue
+		}
+		results[i].From, results[i].Path = from, to
+		if err := fh.move(r, from, to); err != nil {
+			results[i].Error = manageError(err)
+			continue
+		}
+		fh.events.Publish(Event{
+			Kind:       EventMoved,
+			Method:     r.Method,
+			Path:       to,
+			From:       from,
+			RemoteAddr: r.RemoteAddr,
+			RequestID:  requestID(r),
+			Principal:  principalName(r),
+			Country:    geoOf(r).Country,
+			ASN:        geoOf(r).ASN,
+			Status:     http.StatusOK,
+			Size:       -1,
+			Sent:       -1,
+		})
+	}
+	writeJSON(w, r, results)
+}
+
+func (fh *fileHandler) move(r *http.Request, from, to string) error {
+	if err := fh.writable(r, from, RoleManage); err != nil {
+		return err
+	}
+	if err := fh.writable(r, to, RoleManage); err != nil {
+		return err
+	}
+	if underPrefix(to, from) {
+		return errIntoSelf
+	}
+	src, dst := fh.writeRoot.osPath(from), fh.writeRoot.osPath(to)
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if err := fh.writableBelow(r, from, to, RoleManage); err != nil {
+			return err
+		}
+	}
+	// Rename replaces files silently, so refuse existing destinations,
+	// here for a clear error before journaling, and in renameNoReplace
+	// for those created in between.
+	if _, err := os.Lstat(dst); err == nil {
+		return errExists
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	size, sum := fh.knownSum(from, fi)
+	je, err := fh.journalBegin(r, "move", to, from, size, sum)
+	if err != nil {
+		return err
+	}
+	err = renameNoReplace(src, dst)
+	fh.journalEnd(je, err)
+	return err
+}
+
+// bulkOpsScript adds a checkbox to every entry of a listing and a
+// toolbar deleting, moving or renaming the selected entries through the
+// management API. The live listing calls bulkSelect for entries it adds.
+const bulkOpsScript = `<script>(function(){
+var dir="%s",api="` + apiPrefix + `",t={del:"%s",move:"%s",rename:"%s",confirm:"%s",to:"%s",name:"%s",failed:"%s"};
+var pre=document.querySelector("pre"),bar=document.createElement("div");bar.setAttribute("role","toolbar");
+function button(label,fn){var b=document.createElement("button");b.type="button";b.textContent=label;b.onclick=fn;bar.appendChild(b);return b}
+function selected(){var cs=pre.querySelectorAll("input.select:checked"),ns=[];
+for(var i=0;i<cs.length;i++)ns.push(cs[i].value);return ns}
+function csrf(){var m=document.cookie.match(/(?:^|; )` + csrfCookie + `=([^;]*)/);return m?m[1]:""}
+function post(op,body){fetch(api+op,{method:"POST",headers:{"Content-Type":"application/json","X-CSRF-Token":csrf()},body:JSON.stringify(body)})
+.then(function(r){return r.json()}).then(function(rs){var errs=(rs.error?[rs]:rs).filter(function(x){return x.error})
+.map(function(x){return (x.path||"")+": "+x.error});if(errs.length)alert(t.failed+"\n"+errs.join("\n"));location.reload()})}
+function strip(n){return n.replace(/\/$/,"")}
+window.bulkSelect=function(a){var c=document.createElement("input");c.type="checkbox";c.className="select";
+c.value=dir+strip(a.textContent);c.setAttribute("aria-label",a.textContent);
+var s=document.createElement("span");s.appendChild(document.createTextNode(" "));s.appendChild(c);
+a.parentNode.insertBefore(s,a.nextSibling)};
+button(t.del,function(){var ns=selected();if(ns.length&&confirm(t.confirm+"\n"+ns.join("\n")))post("delete",{paths:ns})});
+button(t.move,function(){var ns=selected();if(!ns.length)return;var to=prompt(t.to,dir);if(!to)return;
+to=to.replace(/\/?$/,"/");post("move",{moves:ns.map(function(n){return {from:n,to:to+n.slice(n.lastIndexOf("/")+1)}})})});
+button(t.rename,function(){var ns=selected();if(ns.length!==1)return;var n=ns[0],base=n.slice(n.lastIndexOf("/")+1);
+var to=prompt(t.name,base);if(to&&to!==base&&to.indexOf("/")<0)post("move",{moves:[{from:n,to:dir+to}]})});
+pre.parentNode.insertBefore(bar,pre);
+var as=pre.getElementsByTagName("a");for(var i=as.length-1;i>=0;i--)bulkSelect(as[i]);
+})();</script>
+`
+
+// writeBulkOps writes the script adding bulk operations to the listing
+// of dir.
+func writeBulkOps(w io.Writer, dir string, msgs messages) {
+	js := func(s string) string { return template.JSEscapeString(msgs.t(s)) }
+	fmt.Fprintf(w, bulkOpsScript, template.JSEscapeString(strings.TrimSuffix(dir, "/")+"/"),
+		js("delete"), js("move"), js("rename"), js("Delete these?"), js("Move to directory:"), js("New name:"), js("Some operations failed:"))
+}
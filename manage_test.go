@@ -0,0 +1,109 @@
+package midserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+// writeFiles creates the files of content, keyed by slash-separated
+// name, below dir.
+func writeFiles(t *testing.T, dir string, content map[string]string) {
+	t.Helper()
+	for name, s := range content {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// manage posts body to the management endpoint target and returns the
+// errors reported, keyed by path.
+func manage(t *testing.T, h http.Handler, target, body string) map[string]string {
+	t.Helper()
+	req := httptest.NewRequest("POST", target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	res := midservetest.Do(t, h, req).Status(http.StatusOK)
+	var results []manageResult
+	if err := json.Unmarshal(res.ResponseRecorder.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	errs := map[string]string{}
+	for _, r := range results {
+		errs[r.Path] = r.Error
+	}
+	return errs
+}
+
+func TestManageSubtree(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"plain/a.txt":      "a",
+		"repo/a.txt":       "a",
+		"repo/.git/config": "secret",
+		"later/a.txt":      "a",
+		"later/embargo/b":  "b",
+	})
+	h := newTestServer(t, Dir(dir), func(o *Options) {
+		o.API = true
+		o.Write = true
+		o.Excludes = append(o.Excludes, regexp.MustCompile(`(^|/)\.git(/|$)`))
+		o.AccessWindows = []AccessWindow{
+			{Prefix: "/later/embargo", NotBefore: time.Now().Add(time.Hour), Status: http.StatusNotFound},
+		}
+	})
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	// Excluded files and closed windows below a directory keep it.
+	errs := manage(t, h, "/_api/delete", `{"paths": ["/repo", "/later"]}`)
+	if errs["/repo"] == "" || errs["/later"] == "" {
+		t.Errorf("directories with protected files deleted: %v", errs)
+	}
+	if !exists("repo/.git/config") || !exists("later/embargo/b") {
+		t.Error("protected files deleted with their directory")
+	}
+	errs = manage(t, h, "/_api/move", `{"moves": [{"from": "/repo", "to": "/repo2"}, {"from": "/plain", "to": "/moved"}]}`)
+	if errs["/repo2"] == "" || errs["/moved"] != "" {
+		t.Errorf("moves = %v, want only /repo refused", errs)
+	}
+	if !exists("repo/.git/config") || !exists("moved/a.txt") {
+		t.Error("moves not done as checked")
+	}
+
+	// Nor may a directory be moved into a closed window.
+	writeFiles(t, dir, map[string]string{"x/embargo/c": "c"})
+	if errs := manage(t, h, "/_api/move", `{"moves": [{"from": "/x", "to": "/moved/x"}]}`); errs["/moved/x"] != "" {
+		t.Errorf("move refused: %v", errs)
+	}
+	if errs := manage(t, h, "/_api/move", `{"moves": [{"from": "/moved/x", "to": "/y"}]}`); errs["/y"] != "" {
+		t.Errorf("move refused: %v", errs)
+	}
+	if errs := manage(t, h, "/_api/move", `{"moves": [{"from": "/y", "to": "/moved"}]}`); errs["/moved"] == "" {
+		t.Errorf("move onto existing directory accepted")
+	}
+	if errs := manage(t, h, "/_api/move", `{"moves": [{"from": "/y", "to": "/later/embargo/y"}]}`); errs["/later/embargo/y"] == "" {
+		t.Errorf("move into closed window accepted")
+	}
+
+	if errs := manage(t, h, "/_api/delete", `{"paths": ["/moved"]}`); errs["/moved"] != "" {
+		t.Errorf("delete refused: %v", errs)
+	}
+	if exists("moved") {
+		t.Error("directory without protected files not deleted")
+	}
+}
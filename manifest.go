@@ -0,0 +1,98 @@
+// Mirror manifests
+
+package midserve
+
+import (
+	"encoding/csv"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestEntry describes a file in a manifest.
+type manifestEntry struct {
+	Path    string    `json:"path"` // relative to the manifest's directory
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// serveManifest implements /_api/manifest?path=&format=json|csv, listing
+// every regular file below a directory in lexical order, so that the
+// same tree always gives the same manifest.
+func (fh *fileHandler) serveManifest(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		apiError(w, errors.New("format must be json or csv"), http.StatusBadRequest)
+		return
+	}
+	dir := path.Clean("/" + q.Get("path"))
+	if fh.denied(dir + "/") {
+		fh.publish(r, EventDenied, dir, http.StatusNotFound, -1, nil)
+		apiError(w, fs.ErrNotExist, 0)
+		return
+	}
+
+	if err := fh.closedWindow(dir); err != nil {
+		_, code := toHTTPError(err)
+		fh.publish(r, EventDenied, dir, code, -1, nil)
+		apiError(w, err, 0)
+		return
+	}
+
+	entries := []manifestEntry{}
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	err := walkFS(r.Context(), fh.root, dir, fh.excludes, func(name string, fi fs.FileInfo) error {
+		if fh.closedWindow(name) != nil || fh.unlistedEntry(name, fi.IsDir()) {
+			return skipEntry(fi)
+		}
+		if !fh.permitted(r, name, RoleRead) {
+			// A grant below may still allow what is inside.
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		sum, err := fh.fileSHA256(r.Context(), name, fi)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, manifestEntry{
+			Path:    strings.TrimPrefix(name, prefix),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime().UTC().Truncate(time.Second),
+			SHA256:  sum,
+		})
+		return nil
+	})
+	if r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		apiError(w, err, 0)
+		return
+	}
+
+	if format == "json" {
+		writeJSON(w, r, entries)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"path", "size", "mtime", "sha256"})
+	for _, e := range entries {
+		cw.Write([]string{e.Path, strconv.FormatInt(e.Size, 10), e.ModTime.Format(time.RFC3339), e.SHA256})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,821 @@
+// Markdown rendering
+//
+// This is a small CommonMark-ish renderer covering what documentation
+// folders typically use: headings, paragraphs, lists, block quotes,
+// fenced and indented code, tables, links, images and emphasis. Raw HTML
+// in the source is escaped, never passed through.
+
+package midserve
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// markdownExts lists the extensions rendered by -render-markdown.
+var markdownExts = map[string]bool{
+	".md":       true,
+	".markdown": true,
+}
+
+func isMarkdown(name string) bool {
+	return markdownExts[strings.ToLower(path.Ext(name))]
+}
+
+// markdownPage is the data passed to the markdown layout template.
+type markdownPage struct {
+	Title   string
+	Path    string
+	Content template.HTML
+}
+
+// defaultMarkdownLayout is used unless -markdown-template is given.
+const defaultMarkdownLayout = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<title>{{.Title}}</title>
+<style>
+body { max-width: 50em; margin: 2em auto; padding: 0 1em; font-family: sans-serif; line-height: 1.5; }
+pre { background: #f6f8fa; padding: 1em; overflow: auto; }
+code { font-family: monospace; background: #f6f8fa; }
+blockquote { margin-left: 0; padding-left: 1em; border-left: .25em solid #ddd; color: #555; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ddd; padding: .3em .6em; }
+img { max-width: 100%; }
+.hl-k { color: #d73a49; } .hl-s { color: #032f62; } .hl-c { color: #6a737d; } .hl-n { color: #005cc5; }
+</style>
+</head>
+<body>
+<p><a href="?raw=1">raw</a></p>
+{{.Content}}
+</body>
+</html>
+`
+
+var defaultMarkdownTemplate = template.Must(template.New("markdown").Parse(defaultMarkdownLayout))
+
+// serveMarkdown renders the markdown file f as an HTML page.
+func (fh *fileHandler) serveMarkdown(w http.ResponseWriter, r *http.Request, name string, f io.Reader) {
+	src, err := io.ReadAll(f)
+	if err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	content := renderMarkdown(src)
+	page := markdownPage{
+		Title:   markdownTitle(src, path.Base(name)),
+		Path:    name,
+		Content: template.HTML(content),
+	}
+
+	var buf bytes.Buffer
+	if err := fh.markdownTemplate.Execute(&buf, page); err != nil {
+		logf(r, "http: error rendering markdown template: %v", err)
+		fh.error(w, r, name, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(buf.Bytes())
+	}
+}
+
+// markdownTitle returns the text of the first heading in src, or def.
+func markdownTitle(src []byte, def string) string {
+	for _, line := range strings.Split(string(src), "\n") {
+		if m := atxHeadingRe.FindStringSubmatch(line); m != nil {
+			return strings.TrimSpace(m[2])
+		}
+	}
+	return def
+}
+
+// renderMarkdown converts markdown source to an HTML fragment.
+func renderMarkdown(src []byte) string {
+	text := strings.ReplaceAll(string(src), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\t", "    ")
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(text, "\n"), 0)
+	return b.String()
+}
+
+var (
+	atxHeadingRe   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?[ \t#]*$`)
+	fenceRe        = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([^ \t`]*)")
+	hrRe           = regexp.MustCompile(`^ {0,3}((\*[ \t]*){3,}|(-[ \t]*){3,}|(_[ \t]*){3,})$`)
+	listItemRe     = regexp.MustCompile(`^( {0,3})([-*+]|(\d{1,9})[.)])( +|$)`)
+	setextRe       = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	tableDelimRe   = regexp.MustCompile(`^ *\|? *:?-+:? *(\| *:?-+:? *)*\|? *$`)
+	blockquoteRe   = regexp.MustCompile(`^ {0,3}> ?`)
+	indentedCodeRe = regexp.MustCompile(`^    `)
+)
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// startsBlock reports whether line interrupts a paragraph.
+func startsBlock(line string) bool {
+	return atxHeadingRe.MatchString(line) || fenceRe.MatchString(line) ||
+		hrRe.MatchString(line) || blockquoteRe.MatchString(line) ||
+		listItemRe.MatchString(line)
+}
+
+// maxMarkdownDepth bounds the nesting of block quotes and lists. Deeper
+// markers are rendered as text, so a crafted file can't exhaust the stack.
+const maxMarkdownDepth = 32
+
+// renderBlocks renders lines nested depth block quotes and lists deep.
+func renderBlocks(b *strings.Builder, lines []string, depth int) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+
+		case fenceRe.MatchString(line):
+			m := fenceRe.FindStringSubmatch(line)
+			fence, lang := m[1], m[2]
+			i++
+			var code []string
+			for ; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), fence[:3]) &&
+					strings.Trim(strings.TrimSpace(lines[i]), fence[:1]) == "" &&
+					len(strings.TrimSpace(lines[i])) >= len(fence) {
+					i++
+					break
+				}
+				code = append(code, lines[i])
+			}
+			writeCode(b, lang, strings.Join(code, "\n"))
+
+		case atxHeadingRe.MatchString(line):
+			m := atxHeadingRe.FindStringSubmatch(line)
+			writeHeading(b, len(m[1]), m[2])
+			i++
+
+		case hrRe.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+
+		case indentedCodeRe.MatchString(line):
+			var code []string
+			for ; i < len(lines) && (indentedCodeRe.MatchString(lines[i]) || isBlank(lines[i])); i++ {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			writeCode(b, "", strings.Join(code, "\n"))
+
+		case blockquoteRe.MatchString(line) && depth < maxMarkdownDepth:
+			var quoted []string
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				quoted = append(quoted, blockquoteRe.ReplaceAllString(lines[i], ""))
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted, depth+1)
+			b.WriteString("</blockquote>\n")
+
+		case listItemRe.MatchString(line) && depth < maxMarkdownDepth:
+			i = renderList(b, lines, i, depth)
+
+		case i+1 < len(lines) && strings.Contains(line, "|") && tableDelimRe.MatchString(lines[i+1]):
+			i = renderTable(b, lines, i)
+
+		default:
+			var para []string
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				if len(para) > 0 && setextRe.MatchString(lines[i]) {
+					level := 2
+					if strings.TrimSpace(lines[i])[0] == '=' {
+						level = 1
+					}
+					writeHeading(b, level, strings.Join(para, "\n"))
+					para = nil
+					i++
+					break
+				}
+				if len(para) > 0 && startsBlock(lines[i]) {
+					break
+				}
+				para = append(para, lines[i])
+			}
+			if len(para) > 0 {
+				b.WriteString("<p>")
+				b.WriteString(renderInline(strings.TrimSpace(strings.Join(para, "\n"))))
+				b.WriteString("</p>\n")
+			}
+		}
+	}
+}
+
+func writeHeading(b *strings.Builder, level int, text string) {
+	text = strings.TrimSpace(text)
+	tag := "h" + strconv.Itoa(level)
+	b.WriteString("<" + tag + ` id="` + template.HTMLEscapeString(slugify(text)) + `">`)
+	b.WriteString(renderInline(text))
+	b.WriteString("</" + tag + ">\n")
+}
+
+// slugify turns heading text into a fragment identifier.
+func slugify(text string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+			dash = false
+		case !dash && b.Len() > 0:
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+func writeCode(b *strings.Builder, lang, code string) {
+	if lang != "" {
+		b.WriteString(`<pre><code class="language-` + template.HTMLEscapeString(lang) + `">`)
+	} else {
+		b.WriteString("<pre><code>")
+	}
+	b.WriteString(highlightCode(lang, code))
+	b.WriteString("</code></pre>\n")
+}
+
+// renderList renders the list starting at lines[i], nested depth deep,
+// and returns the index of the first line after it.
+func renderList(b *strings.Builder, lines []string, i, depth int) int {
+	first := listItemRe.FindStringSubmatch(lines[i])
+	ordered := first[3] != ""
+	if ordered {
+		if first[3] != "1" {
+			b.WriteString(`<ol start="` + strings.TrimLeft(first[3], "0") + `">` + "\n")
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		m := listItemRe.FindStringSubmatch(lines[i])
+		if m == nil || (m[3] != "") != ordered {
+			break
+		}
+		indent := len(m[0])
+		if strings.TrimSpace(m[4]) == "" && len(m[4]) > 4 {
+			indent = len(m[1]) + len(m[2]) + 1
+		}
+		item := []string{lines[i][indent:]}
+		i++
+		for i < len(lines) {
+			line := lines[i]
+			if isBlank(line) {
+				// A blank line continues the item only if indented
+				// content follows.
+				j := i
+				for j < len(lines) && isBlank(lines[j]) {
+					j++
+				}
+				if j < len(lines) && leadingSpaces(lines[j]) >= indent {
+					item = append(item, lines[i:j]...)
+					loose = true
+					i = j
+					continue
+				}
+				if j < len(lines) && leadingSpaces(lines[j]) < indent {
+					if m := listItemRe.FindStringSubmatch(lines[j]); m != nil && (m[3] != "") == ordered {
+						loose = true
+					}
+				}
+				i = j
+				break
+			}
+			if leadingSpaces(line) >= indent {
+				item = append(item, line[indent:])
+			} else if listItemRe.MatchString(line) || startsBlock(line) {
+				break
+			} else {
+				// Lazy paragraph continuation.
+				item = append(item, line)
+			}
+			i++
+		}
+		items = append(items, item)
+		if i < len(lines) && !listItemRe.MatchString(lines[i]) {
+			break
+		}
+	}
+
+	for _, item := range items {
+		b.WriteString("<li>")
+		var inner strings.Builder
+		renderBlocks(&inner, item, depth+1)
+		html := inner.String()
+		if !loose {
+			// Tight lists don't wrap their paragraphs.
+			html = strings.ReplaceAll(html, "<p>", "")
+			html = strings.ReplaceAll(html, "</p>\n", "\n")
+		}
+		b.WriteString(task(strings.TrimSuffix(html, "\n")))
+		b.WriteString("</li>\n")
+	}
+
+	if ordered {
+		b.WriteString("</ol>\n")
+	} else {
+		b.WriteString("</ul>\n")
+	}
+	return i
+}
+
+// task renders a leading "[ ]" or "[x]" of a list item as a checkbox.
+func task(html string) string {
+	prefix := ""
+	if strings.HasPrefix(html, "<p>") {
+		prefix, html = "<p>", html[3:]
+	}
+	switch {
+	case strings.HasPrefix(html, "[ ] "):
+		return prefix + `<input type="checkbox" disabled> ` + html[4:]
+	case strings.HasPrefix(html, "[x] "), strings.HasPrefix(html, "[X] "):
+		return prefix + `<input type="checkbox" checked disabled> ` + html[4:]
+	}
+	return prefix + html
+}
+
+func leadingSpaces(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// renderTable renders the GFM table starting at lines[i] and returns the
+// index of the first line after it.
+func renderTable(b *strings.Builder, lines []string, i int) int {
+	header := splitTableRow(lines[i])
+	var align []string
+	for _, d := range splitTableRow(lines[i+1]) {
+		d = strings.TrimSpace(d)
+		switch {
+		case strings.HasPrefix(d, ":") && strings.HasSuffix(d, ":"):
+			align = append(align, "center")
+		case strings.HasSuffix(d, ":"):
+			align = append(align, "right")
+		case strings.HasPrefix(d, ":"):
+			align = append(align, "left")
+		default:
+			align = append(align, "")
+		}
+	}
+	cell := func(tag string, col int, text string) {
+		b.WriteString("<" + tag)
+		if col < len(align) && align[col] != "" {
+			b.WriteString(` style="text-align: ` + align[col] + `"`)
+		}
+		b.WriteString(">" + renderInline(strings.TrimSpace(text)) + "</" + tag + ">")
+	}
+
+	b.WriteString("<table>\n<thead>\n<tr>")
+	for col, h := range header {
+		cell("th", col, h)
+	}
+	b.WriteString("</tr>\n</thead>\n<tbody>\n")
+	for i += 2; i < len(lines) && !isBlank(lines[i]) && !startsBlock(lines[i]); i++ {
+		b.WriteString("<tr>")
+		row := splitTableRow(lines[i])
+		for col := range header {
+			text := ""
+			if col < len(row) {
+				text = row[col]
+			}
+			cell("td", col, text)
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cur strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cur.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(line[i])
+		}
+	}
+	return append(cells, cur.String())
+}
+
+// renderInline renders the inline elements of a paragraph or heading.
+//
+// It makes a single pass over s. The brackets and parentheses of links
+// are paired up front, and emphasis openers wait on a stack until their
+// closer turns up, so no delimiter makes it scan the rest of s again.
+// Output goes to pieces so that an opener, written as text, can become a
+// tag once it is closed.
+func renderInline(s string) string {
+	brackets := matchPairs(s, '[', ']')
+	parens := matchPairs(s, '(', ')')
+	var ticks map[int][]int
+
+	var out []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			out = append(out, cur.String())
+			cur.Reset()
+		}
+	}
+	piece := func(text string) int {
+		flush()
+		out = append(out, text)
+		return len(out) - 1
+	}
+
+	// The emphasis openers by delimiter, as the pieces holding them,
+	// and the links whose text is being rendered. Emphasis doesn't
+	// cross the text of a link.
+	openers := map[string][]int{}
+	type openLink struct {
+		piece, close, end int
+	}
+	var links []openLink
+	limit, floor := len(s), -1
+
+	for i := 0; i < len(s); {
+		if n := len(links); n > 0 && i >= links[n-1].close {
+			l := links[n-1]
+			links = links[:n-1]
+			dropOpeners(openers, l.piece)
+			cur.WriteString("</a>")
+			i = l.end
+			limit, floor = len(s), -1
+			if n > 1 {
+				limit, floor = links[n-2].close, links[n-2].piece
+			}
+			continue
+		}
+
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < limit && strings.IndexByte("\\`*_{}[]()#+-.!|~<>", s[i+1]) >= 0:
+			cur.WriteString(template.HTMLEscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '\\' && i+1 < limit && s[i+1] == '\n':
+			cur.WriteString("<br>\n")
+			i += 2
+			continue
+
+		case c == '`':
+			n := countRun(s[i:limit], '`')
+			if ticks == nil {
+				ticks = backtickRuns(s)
+			}
+			runs := ticks[n]
+			if k := sort.SearchInts(runs, i+n); k < len(runs) && runs[k]+n <= limit {
+				end := runs[k]
+				code := strings.TrimSpace(strings.ReplaceAll(s[i+n:end], "\n", " "))
+				cur.WriteString("<code>" + template.HTMLEscapeString(code) + "</code>")
+				i = end + n
+				continue
+			}
+			cur.WriteString(s[i : i+n])
+			i += n
+			continue
+
+		case c == '!' && i+1 < limit && s[i+1] == '[':
+			if text, dest, title, end, ok := parseLink(s, i+1, brackets, parens); ok && end <= limit {
+				cur.WriteString(`<img src="` + template.HTMLEscapeString(safeURL(dest)) + `" alt="` + template.HTMLEscapeString(text) + `"`)
+				if title != "" {
+					cur.WriteString(` title="` + template.HTMLEscapeString(title) + `"`)
+				}
+				cur.WriteString(">")
+				i = end
+				continue
+			}
+
+		case c == '[':
+			if _, dest, title, end, ok := parseLink(s, i, brackets, parens); ok && end <= limit {
+				tag := `<a href="` + template.HTMLEscapeString(safeURL(dest)) + `"`
+				if title != "" {
+					tag += ` title="` + template.HTMLEscapeString(title) + `"`
+				}
+				l := openLink{piece: piece(tag + ">"), close: brackets[i], end: end}
+				links = append(links, l)
+				limit, floor = l.close, l.piece
+				i++
+				continue
+			}
+
+		case c == '<':
+			j := i + 1
+			for j < limit && strings.IndexByte(" \t\n<>", s[j]) < 0 {
+				j++
+			}
+			if j < limit && s[j] == '>' && autolinkRe.MatchString(s[i+1:j]) {
+				u := s[i+1 : j]
+				cur.WriteString(`<a href="` + template.HTMLEscapeString(safeURL(u)) + `">` + template.HTMLEscapeString(u) + "</a>")
+				i = j + 1
+				continue
+			}
+
+		case c == '*' || c == '_' || c == '~':
+			n := countRun(s[i:limit], c)
+			// A closer follows text and has the length of its opener.
+			// Intraword underscores neither open nor close emphasis.
+			if i > 0 && s[i-1] != ' ' && (c != '_' || i+n == len(s) || !isWordByte(s[i+n])) {
+				stack := openers[s[i:i+n]]
+				if k := len(stack) - 1; k >= 0 && stack[k] > floor && (stack[k] < len(out)-1 || cur.Len() > 0) {
+					open := stack[k]
+					dropOpeners(openers, open)
+					flush()
+					tag := "em"
+					switch {
+					case c == '~':
+						tag = "del"
+					case n == 2:
+						tag = "strong"
+					}
+					out[open] = "<" + tag + ">"
+					cur.WriteString("</" + tag + ">")
+					i += n
+					continue
+				}
+			}
+			m := n
+			if m > 2 {
+				m = 2
+			}
+			if (c != '~' || n == 2) && i+m < len(s) && s[i+m] != ' ' && (c != '_' || i == 0 || !isWordByte(s[i-1])) {
+				delim := s[i : i+m]
+				openers[delim] = append(openers[delim], piece(delim))
+				i += m
+				n -= m
+			}
+			cur.WriteString(s[i : i+n])
+			i += n
+			continue
+
+		case c == ' ':
+			n := countRun(s[i:limit], ' ')
+			if n >= 2 && i+n < limit && s[i+n] == '\n' {
+				cur.WriteString("<br>")
+			} else {
+				cur.WriteString(s[i : i+n])
+			}
+			i += n
+			continue
+
+		case (c == 'h' || c == 'w') && (i == 0 || !isWordByte(s[i-1])):
+			if m := bareURLRe.FindString(s[i:limit]); m != "" {
+				m = strings.TrimRight(m, ".,;:!?)")
+				href := m
+				if strings.HasPrefix(m, "www.") {
+					href = "http://" + m
+				}
+				cur.WriteString(`<a href="` + template.HTMLEscapeString(href) + `">` + template.HTMLEscapeString(m) + "</a>")
+				i += len(m)
+				continue
+			}
+		}
+		cur.WriteString(template.HTMLEscapeString(s[i : i+1]))
+		i++
+	}
+	flush()
+	return strings.Join(out, "")
+}
+
+var (
+	autolinkRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]{1,31}:[^\s<>]*$`)
+	bareURLRe  = regexp.MustCompile(`^(https?://|www\.)[^\s<]+`)
+)
+
+func countRun(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// dropOpeners forgets the emphasis openers from the piece from on, which
+// stay text.
+func dropOpeners(openers map[string][]int, from int) {
+	for delim, stack := range openers {
+		for len(stack) > 0 && stack[len(stack)-1] >= from {
+			stack = stack[:len(stack)-1]
+		}
+		openers[delim] = stack
+	}
+}
+
+// backtickRuns returns the offsets of the runs of backticks in s by
+// their length, in order.
+func backtickRuns(s string) map[int][]int {
+	runs := map[int][]int{}
+	for i := 0; i < len(s); {
+		if s[i] != '`' {
+			i++
+			continue
+		}
+		n := countRun(s[i:], '`')
+		runs[n] = append(runs[n], i)
+		i += n
+	}
+	return runs
+}
+
+// matchPairs returns the offsets in s of the closing byte matching each
+// opening one, by the offset of the latter. Escaped bytes are skipped.
+func matchPairs(s string, open, close byte) map[int]int {
+	pairs := map[int]int{}
+	var stack []int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case open:
+			stack = append(stack, i)
+		case close:
+			if len(stack) > 0 {
+				pairs[stack[len(stack)-1]] = i
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return pairs
+}
+
+// parseLink parses "[text](dest "title")" at s[i], given the pairs of
+// brackets and parentheses in s, and returns its parts and end.
+func parseLink(s string, i int, brackets, parens map[int]int) (text, dest, title string, end int, ok bool) {
+	closeBracket, found := brackets[i]
+	if !found || closeBracket+1 >= len(s) || s[closeBracket+1] != '(' {
+		return "", "", "", 0, false
+	}
+	// The destination may contain balanced parentheses.
+	end, found = parens[closeBracket+1]
+	if !found {
+		return "", "", "", 0, false
+	}
+	inner := strings.TrimSpace(s[closeBracket+2 : end])
+	dest = inner
+	if i := strings.IndexAny(inner, " \t"); i >= 0 {
+		dest = inner[:i]
+		t := strings.TrimSpace(inner[i:])
+		if len(t) >= 2 && (t[0] == '"' || t[0] == '\'') && t[len(t)-1] == t[0] {
+			title = t[1 : len(t)-1]
+		}
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+	return s[i+1 : closeBracket], dest, title, end + 1, true
+}
+
+// safeURL neutralizes URLs with script-executing schemes. Browsers
+// ignore ASCII whitespace and control characters in a scheme, so that
+// "java\nscript:" is one too.
+func safeURL(u string) string {
+	stripped := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, u)
+	if i := strings.IndexAny(stripped, ":/?#"); i >= 0 && stripped[i] == ':' {
+		switch strings.ToLower(stripped[:i]) {
+		case "javascript", "vbscript", "data":
+			return "#"
+		}
+	}
+	return u
+}
+
+// highlightCode escapes code and marks up comments, strings, numbers and
+// common keywords with hl-* classes. It is deliberately language
+// agnostic: good enough for reading, not a real lexer.
+func highlightCode(lang, code string) string {
+	if lang == "" || lang == "text" || lang == "plain" {
+		return template.HTMLEscapeString(code)
+	}
+	hashComments := hashCommentLangs[strings.ToLower(lang)]
+	var b strings.Builder
+	span := func(class, text string) {
+		b.WriteString(`<span class="hl-` + class + `">` + template.HTMLEscapeString(text) + "</span>")
+	}
+	for i := 0; i < len(code); {
+		c := code[i]
+		switch {
+		case c == '/' && i+1 < len(code) && code[i+1] == '/' && !hashComments,
+			c == '#' && hashComments,
+			c == '-' && i+1 < len(code) && code[i+1] == '-' && lang == "sql":
+			end := strings.IndexByte(code[i:], '\n')
+			if end < 0 {
+				end = len(code) - i
+			}
+			span("c", code[i:i+end])
+			i += end
+		case c == '/' && i+1 < len(code) && code[i+1] == '*':
+			end := strings.Index(code[i+2:], "*/")
+			if end < 0 {
+				end = len(code) - i
+			} else {
+				end += 4
+			}
+			span("c", code[i:i+end])
+			i += end
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			for j < len(code) && code[j] != c && (c == '`' || code[j] != '\n') {
+				if code[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j < len(code) {
+				j++
+			}
+			if j > len(code) {
+				j = len(code)
+			}
+			span("s", code[i:j])
+			i = j
+		case c >= '0' && c <= '9' && (i == 0 || !isWordByte(code[i-1])):
+			j := i
+			for j < len(code) && (isWordByte(code[j]) || code[j] == '.') {
+				j++
+			}
+			span("n", code[i:j])
+			i = j
+		case isWordByte(c) && (i == 0 || !isWordByte(code[i-1])):
+			j := i
+			for j < len(code) && isWordByte(code[j]) {
+				j++
+			}
+			if codeKeywords[code[i:j]] {
+				span("k", code[i:j])
+			} else {
+				b.WriteString(template.HTMLEscapeString(code[i:j]))
+			}
+			i = j
+		default:
+			b.WriteString(template.HTMLEscapeString(code[i : i+1]))
+			i++
+		}
+	}
+	return b.String()
+}
+
+var hashCommentLangs = map[string]bool{
+	"sh": true, "bash": true, "shell": true, "zsh": true, "python": true, "py": true,
+	"ruby": true, "rb": true, "yaml": true, "yml": true, "toml": true, "perl": true,
+	"dockerfile": true, "makefile": true, "make": true, "ini": true, "conf": true,
+}
+
+var codeKeywords = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`
+		break case catch class const continue def default defer do elif else
+		end enum export extends false fi final finally fn for from func function
+		go goto if impl import in interface let loop match module mut nil none
+		None null package private protected pub public return select self static
+		struct super switch then this throw true True False try type typeof use var
+		void while with yield async await lambda and or not as is`) {
+		codeKeywords[k] = true
+	}
+}
@@ -0,0 +1,97 @@
+package midserve
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSafeURL(t *testing.T) {
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{"https://example.com/", "https://example.com/"},
+		{"docs/a.md", "docs/a.md"},
+		{"javascript:alert(1)", "#"},
+		{"JavaScript:alert(1)", "#"},
+		{" javascript:alert(1)", "#"},
+		{"java\nscript:alert(1)", "#"},
+		{"java\tscript:alert(1)", "#"},
+		{"\x01javascript:alert(1)", "#"},
+		{"vbscript:msgbox", "#"},
+		{"data:text/html,<script>", "#"},
+		{"a/javascript:b", "a/javascript:b"},
+	} {
+		if got := safeURL(tc.url); got != tc.want {
+			t.Errorf("safeURL(%q) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestMarkdownLinks(t *testing.T) {
+	for _, src := range []string{
+		"<javascript:alert(1)>",
+		"[x](javascript:alert(1))",
+		"![x](javascript:alert(1))",
+	} {
+		if html := renderMarkdown([]byte(src)); strings.Contains(html, `="javascript:`) {
+			t.Errorf("renderMarkdown(%q) = %q, links to script", src, html)
+		}
+	}
+	if html := renderMarkdown([]byte("<https://example.com/>")); !strings.Contains(html, `href="https://example.com/"`) {
+		t.Errorf("autolink not rendered: %q", html)
+	}
+}
+
+func TestMarkdownInline(t *testing.T) {
+	for _, tc := range []struct {
+		src, want string
+	}{
+		{"*a* **b** ~~c~~ `d`", "<em>a</em> <strong>b</strong> <del>c</del> <code>d</code>"},
+		{"*a **b** c*", "<em>a <strong>b</strong> c</em>"},
+		{"*a *b* c*", "<em>a <em>b</em> c</em>"},
+		{"a*b*c snake_case_name _a_b_", "a<em>b</em>c snake_case_name <em>a_b</em>"},
+		{"*a **b", "*a **b"},
+		{"**** `` ` ``", "**** <code>`</code>"},
+		{"`a*` b*", "<code>a*</code> b*"},
+		{"[*a*](x) *[b](y)*", `<a href="x"><em>a</em></a> <em><a href="y">b</a></em>`},
+		{"*[a*](x)", `*<a href="x">a*</a>`},
+		{"[a [b](c) d](e)", `<a href="e">a <a href="c">b</a> d</a>`},
+		{"[a](b(c)) [a] (b) [a](b", `<a href="b(c)">a</a> [a] (b) [a](b`},
+		{"a  \nb", "a<br>\nb"},
+	} {
+		if got := renderInline(tc.src); got != tc.want {
+			t.Errorf("renderInline(%q) = %q, want %q", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestMarkdownNesting(t *testing.T) {
+	html := renderMarkdown([]byte(strings.Repeat(">", 100000) + " a\n\n" + strings.Repeat("- ", 100000) + "b"))
+	if n := strings.Count(html, "<blockquote>"); n != maxMarkdownDepth {
+		t.Errorf("%d block quotes", n)
+	}
+	if n := strings.Count(html, "<ul>"); n != maxMarkdownDepth {
+		t.Errorf("%d lists", n)
+	}
+}
+
+// TestMarkdownLinear renders paragraphs full of delimiters that are
+// never closed, which take minutes if each one rescans the rest.
+func TestMarkdownLinear(t *testing.T) {
+	for _, src := range []string{
+		strings.Repeat("*a ", 100000),
+		strings.Repeat("_a **b ", 100000),
+		strings.Repeat("[", 100000),
+		strings.Repeat("[a](", 100000),
+		strings.Repeat("<", 100000),
+		strings.Repeat("` `` ", 100000),
+		strings.Repeat("a  \n", 100000),
+	} {
+		start := time.Now()
+		renderMarkdown([]byte(src))
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%.10q...: %v", src, d)
+		}
+	}
+}
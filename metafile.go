@@ -0,0 +1,250 @@
+// Torrent and Metalink documents for large files
+
+package midserve
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	// minPieceLength and maxPieceLength bound the piece length chosen
+	// for a file, which is doubled until there are at most maxPieces.
+	minPieceLength = 256 << 10
+	maxPieceLength = 16 << 20
+	maxPieces      = 2000
+)
+
+// metafileFormats maps the format parameter to the writer of the
+// document and its content type and extension.
+var metafileFormats = map[string]struct {
+	write       func(w io.Writer, name, u string, d fs.FileInfo, fd *fileDigests) error
+	contentType string
+	ext         string
+}{
+	"torrent":  {writeTorrent, "application/x-bittorrent", ".torrent"},
+	"metalink": {writeMetalink, "application/metalink4+xml", ".meta4"},
+}
+
+// fileDigests are the checksums of a file needed by the documents: its
+// SHA-256 and the SHA-1 of every piece of pieceLength bytes.
+type fileDigests struct {
+	pieceLength int64
+	sha256      string
+	pieces      []byte
+}
+
+func pieceLength(size int64) int64 {
+	n := int64(minPieceLength)
+	for n < maxPieceLength && size/n >= maxPieces {
+		n *= 2
+	}
+	return n
+}
+
+// digests returns the digests of the file name, computing and caching
+// them on first use, as that requires reading the whole file.
+func (fh *fileHandler) digests(name string, f io.Reader, d fs.FileInfo) (*fileDigests, error) {
+	key := sha256.Sum256([]byte(fmt.Sprintf("digests\x00%s\x00%d\x00%d", name, d.ModTime().UnixNano(), d.Size())))
+	cached := filepath.Join(fh.cacheDir, "digests", hex.EncodeToString(key[:]))
+	fh.dropPurged(name, cached)
+
+	// The cache file is the piece length and SHA-256 on a line each,
+	// followed by the piece hashes.
+	b, err := os.ReadFile(cached)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fh.produce(context.Background(), cached, func(w io.Writer) error {
+			fd, err := computeDigests(f, pieceLength(d.Size()))
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "%d\n%s\n%s", fd.pieceLength, fd.sha256, fd.pieces)
+			return err
+		})
+		if err == nil {
+			b, err = os.ReadFile(cached)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	parts := bytes.SplitN(b, []byte("\n"), 3)
+	if len(parts) != 3 {
+		return nil, errors.New("corrupt digests cache file " + cached)
+	}
+	fd := &fileDigests{sha256: string(parts[1]), pieces: parts[2]}
+	if fd.pieceLength, err = strconv.ParseInt(string(parts[0]), 10, 64); err != nil {
+		return nil, err
+	}
+	fh.checksums.put(name, d.Size(), d.ModTime(), fd.sha256)
+	return fd, nil
+}
+
+func computeDigests(r io.Reader, pieceLength int64) (*fileDigests, error) {
+	fd := &fileDigests{pieceLength: pieceLength}
+	whole := sha256.New()
+	piece := sha1.New()
+	for {
+		piece.Reset()
+		n, err := io.CopyN(io.MultiWriter(whole, piece), r, pieceLength)
+		if n > 0 {
+			fd.pieces = piece.Sum(fd.pieces)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	fd.sha256 = hex.EncodeToString(whole.Sum(nil))
+	return fd, nil
+}
+
+// serveMetafile serves the torrent or Metalink document of the file name
+// in the given format, pointing to its URL on this server.
+func (fh *fileHandler) serveMetafile(w http.ResponseWriter, r *http.Request, name string, f io.Reader, d fs.FileInfo, format string) {
+	mf, ok := metafileFormats[format]
+	if !ok {
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return
+	}
+	fd, err := fh.digests(name, f, d)
+	if err != nil {
+		logf(r, "http: error hashing %s: %v", name, err)
+		fh.error(w, r, name, err)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	u := (&url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path}).String()
+	var buf bytes.Buffer
+	if err := mf.write(&buf, d.Name(), u, d, fd); err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", mf.contentType)
+	w.Header().Set("Content-Disposition", fh.contentDisposition("attachment", d.Name()+mf.ext))
+	sw := &statusWriter{ResponseWriter: w}
+	sizeFunc := func() (int64, error) { return int64(buf.Len()), nil }
+	serveContent(sw, r, name, d.ModTime(), sizeFunc, bytes.NewReader(buf.Bytes()))
+	fh.publishSent(r, name, sw, int64(buf.Len()))
+}
+
+// writeTorrent writes a single file torrent without trackers, with u as
+// its web seed (BEP 19).
+func writeTorrent(w io.Writer, name, u string, d fs.FileInfo, fd *fileDigests) error {
+	return bencode(w, map[string]interface{}{
+		"created by":    "midserve",
+		"creation date": d.ModTime().Unix(),
+		"info": map[string]interface{}{
+			"length":       d.Size(),
+			"name":         name,
+			"piece length": fd.pieceLength,
+			"pieces":       fd.pieces,
+		},
+		"url-list": u,
+	})
+}
+
+// bencode writes v, made of strings, byte slices, integers and maps with
+// string keys, in the BitTorrent encoding.
+func bencode(w io.Writer, v interface{}) error {
+	var err error
+	switch v := v.(type) {
+	case string:
+		_, err = fmt.Fprintf(w, "%d:%s", len(v), v)
+	case []byte:
+		_, err = fmt.Fprintf(w, "%d:%s", len(v), v)
+	case int64:
+		_, err = fmt.Fprintf(w, "i%de", v)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if _, err = io.WriteString(w, "d"); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err = bencode(w, k); err != nil {
+				return err
+			}
+			if err = bencode(w, v[k]); err != nil {
+				return err
+			}
+		}
+		_, err = io.WriteString(w, "e")
+	default:
+		err = fmt.Errorf("bencode: unsupported type %T", v)
+	}
+	return err
+}
+
+// writeMetalink writes a Metalink 4 document (RFC 5854) for the file.
+func writeMetalink(w io.Writer, name, u string, d fs.FileInfo, fd *fileDigests) error {
+	type hash struct {
+		Type  string `xml:"type,attr,omitempty"`
+		Value string `xml:",chardata"`
+	}
+	type pieces struct {
+		Length int64  `xml:"length,attr"`
+		Type   string `xml:"type,attr"`
+		Hashes []hash `xml:"hash"`
+	}
+	type file struct {
+		Name   string `xml:"name,attr"`
+		Size   int64  `xml:"size"`
+		Hash   hash   `xml:"hash"`
+		Pieces pieces `xml:"pieces"`
+		URL    string `xml:"url"`
+	}
+	doc := struct {
+		XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:metalink metalink"`
+		Generator string   `xml:"generator"`
+		Published string   `xml:"published"`
+		File      file     `xml:"file"`
+	}{
+		Generator: "midserve",
+		Published: d.ModTime().UTC().Format("2006-01-02T15:04:05Z"),
+		File: file{
+			Name:   name,
+			Size:   d.Size(),
+			Hash:   hash{"sha-256", fd.sha256},
+			Pieces: pieces{Length: fd.pieceLength, Type: "sha-1"},
+			URL:    u,
+		},
+	}
+	for i := 0; i+sha1.Size <= len(fd.pieces); i += sha1.Size {
+		doc.File.Pieces.Hashes = append(doc.File.Pieces.Hashes, hash{Value: hex.EncodeToString(fd.pieces[i : i+sha1.Size])})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,119 @@
+// Allowed methods, OPTIONS and method override
+
+package midserve
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	readMethods  = "GET, HEAD, OPTIONS"
+	writeMethods = "POST, OPTIONS"
+	formMethods  = "GET, HEAD, POST, OPTIONS"
+	fileMethods  = "GET, HEAD, PUT, DELETE, OPTIONS"
+)
+
+// apiWriteEndpoints lists the API endpoints that change files, which
+// take POST requests and only exist in write mode.
+var apiWriteEndpoints = map[string]bool{
+	"delete": true,
+	"move":   true,
+	"upload": true,
+}
+
+// overrideMethods are the methods a POST request may ask to be treated
+// as with X-HTTP-Method-Override, those files take in write mode.
+var overrideMethods = map[string]bool{
+	"PUT":    true,
+	"DELETE": true,
+}
+
+// allow returns the value of the Allow header for name, the methods
+// requests for it can use with the current options.
+func (fh *fileHandler) allow(name string) string {
+	if fh.api && fh.write && strings.HasPrefix(name, apiPrefix) && apiWriteEndpoints[strings.TrimPrefix(name, apiPrefix)] {
+		return writeMethods
+	}
+	if fh.cas && name == apiPrefix+"resolve" || fh.shortLinks != nil && name == apiPrefix+"shorten" {
+		return writeMethods
+	}
+	if fh.debugEcho && underPrefix(name, debugEchoPath) {
+		return formMethods
+	}
+	if fh.sessions != nil {
+		switch name {
+		case loginPath:
+			return formMethods
+		case logoutPath:
+			return writeMethods
+		}
+	}
+	if (fh.adminToken != "" || fh.perms != nil) && strings.HasPrefix(name, adminPrefix) {
+		if ep, ok := adminEndpoints[strings.TrimPrefix(name, adminPrefix)]; ok && ep.method == "POST" {
+			return writeMethods
+		}
+	}
+	if fh.write && fileMethodPath(name) {
+		return fileMethods
+	}
+	return readMethods
+}
+
+// changesState reports whether r may change state: its method is not
+// a safe one, or name is an endpoint that only takes POST, whatever
+// method r uses, so that no route added later escapes the checks
+// of state-changing requests by accepting GET.
+func (fh *fileHandler) changesState(r *http.Request, name string) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return fh.allow(name) == writeMethods
+	}
+	return true
+}
+
+// fileMethodPath reports whether name is a file path, rather than one of
+// the endpoints, for PUT and DELETE.
+func fileMethodPath(name string) bool {
+	return !strings.HasPrefix(name, apiPrefix) && !strings.HasPrefix(name, adminPrefix)
+}
+
+// checkMethod answers OPTIONS requests with the methods allowed for
+// name and refuses requests using any other, or passes them on to the
+// fallback proxy, returning whether r is left to be served.
+func (fh *fileHandler) checkMethod(w http.ResponseWriter, r *http.Request, name string) bool {
+	allow := fh.allow(name)
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", allow)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	for _, m := range strings.Split(allow, ", ") {
+		if r.Method == m {
+			return true
+		}
+	}
+	if fh.fallback != nil && (allow == readMethods || allow == fileMethods) {
+		fh.proxyFallback(w, r, name)
+		return false
+	}
+	w.Header().Set("Allow", allow)
+	http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+	fh.publish(r, EventDenied, name, http.StatusMethodNotAllowed, -1, nil)
+	return false
+}
+
+// overrideMethod returns r with the method given in the
+// X-HTTP-Method-Override header of a POST request, for clients and
+// proxies that only let GET and POST through.
+func overrideMethod(r *http.Request) *http.Request {
+	m := strings.ToUpper(strings.TrimSpace(r.Header.Get("X-HTTP-Method-Override")))
+	if r.Method != "POST" || !overrideMethods[m] {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Method = m
+	return r2
+}
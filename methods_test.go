@@ -0,0 +1,80 @@
+package midserve
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+// withBody returns req sending body.
+func withBody(req *http.Request, body string) *http.Request {
+	req.Body = io.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return req
+}
+
+func TestFileMethods(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"docs/a.txt": "a"})
+	h := newTestServer(t, Dir(dir), func(o *Options) {
+		o.API = true
+		o.Write = true
+	})
+
+	midservetest.Do(t, h, midservetest.NewRequest("OPTIONS", "/docs/a.txt")).
+		Header("Allow", fileMethods)
+
+	midservetest.Do(t, h, withBody(midservetest.NewRequest("PUT", "/docs/b.txt"), "b")).
+		Status(http.StatusCreated).
+		Header("Location", "/docs/b.txt")
+	if b, err := os.ReadFile(filepath.Join(dir, "docs", "b.txt")); err != nil || string(b) != "b" {
+		t.Fatalf("docs/b.txt = %q, %v", b, err)
+	}
+	midservetest.Do(t, h, withBody(midservetest.NewRequest("PUT", "/docs/b.txt"), "c")).
+		Status(http.StatusConflict)
+	midservetest.Do(t, h, withBody(midservetest.NewRequest("PUT", "/missing/b.txt"), "b")).
+		Status(http.StatusNotFound)
+
+	midservetest.Do(t, h, midservetest.NewRequest("DELETE", "/docs/a.txt")).
+		Status(http.StatusNoContent)
+	if _, err := os.Stat(filepath.Join(dir, "docs", "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("docs/a.txt not deleted: %v", err)
+	}
+	midservetest.Do(t, h, midservetest.NewRequest("DELETE", "/docs/a.txt")).
+		Status(http.StatusNotFound)
+}
+
+func TestFileMethodsReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a"})
+	h := newTestServer(t, Dir(dir), func(o *Options) { o.API = true })
+
+	midservetest.Do(t, h, withBody(midservetest.NewRequest("PUT", "/b.txt"), "b")).
+		Status(http.StatusMethodNotAllowed)
+	midservetest.Do(t, h, midservetest.NewRequest("DELETE", "/a.txt")).
+		Status(http.StatusMethodNotAllowed)
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a"})
+	h := newTestServer(t, Dir(dir), func(o *Options) {
+		o.API = true
+		o.Write = true
+		o.MethodOverride = true
+	})
+
+	midservetest.Do(t, h, midservetest.NewRequest("POST", "/a.txt", "X-HTTP-Method-Override", "DELETE")).
+		Status(http.StatusNoContent)
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("a.txt not deleted: %v", err)
+	}
+}
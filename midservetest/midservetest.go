@@ -0,0 +1,216 @@
+// Package midservetest provides utilities for testing midserve handlers
+// and configurations.
+//
+// A typical test builds a file tree in memory, serves it with the
+// handler under test and checks the responses:
+//
+//	root := midservetest.NewFS().
+//		File("index.html", "<h1>hi</h1>").
+//		File("docs/a.txt", "a").
+//		HTTP()
+//	h := newHandler(root)
+//	midservetest.Get(t, h, "/docs/").
+//		Status(http.StatusOK).
+//		Golden("testdata/docs.golden")
+package midservetest
+
+import (
+	"bytes"
+	"flag"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// update makes Golden rewrite the golden files instead of comparing
+// against them, as in "go test -args -midservetest.update".
+var update = flag.Bool("midservetest.update", false, "update midservetest golden files")
+
+// FS builds an in-memory file tree.
+type FS struct {
+	m       fstest.MapFS
+	modTime time.Time
+}
+
+// NewFS returns an empty FS. Files added to it have a fixed modification
+// time so that Last-Modified headers are reproducible.
+func NewFS() *FS {
+	return &FS{
+		m:       fstest.MapFS{},
+		modTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// ModTime sets the modification time of files and directories added
+// after it.
+func (b *FS) ModTime(t time.Time) *FS {
+	b.modTime = t
+	return b
+}
+
+// File adds a regular file with the given '/'-separated name and content.
+// Missing parent directories are created implicitly.
+func (b *FS) File(name, content string) *FS {
+	b.m[clean(name)] = &fstest.MapFile{
+		Data:    []byte(content),
+		Mode:    0644,
+		ModTime: b.modTime,
+	}
+	return b
+}
+
+// Dir adds an empty directory.
+func (b *FS) Dir(name string) *FS {
+	b.m[clean(name)] = &fstest.MapFile{
+		Mode:    fs.ModeDir | 0755,
+		ModTime: b.modTime,
+	}
+	return b
+}
+
+// FS returns the tree as an fs.FS.
+func (b *FS) FS() fs.FS {
+	return b.m
+}
+
+// HTTP returns the tree as an http.FileSystem.
+func (b *FS) HTTP() http.FileSystem {
+	return http.FS(b.m)
+}
+
+func clean(name string) string {
+	return strings.Trim(filepath.ToSlash(name), "/")
+}
+
+// A Response is the recorded response of a request, with chainable
+// assertions. Failed assertions are reported with t.Errorf.
+type Response struct {
+	*httptest.ResponseRecorder
+	t   testing.TB
+	req *http.Request
+}
+
+// Do serves req with h and records the response.
+func Do(t testing.TB, h http.Handler, req *http.Request) *Response {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return &Response{ResponseRecorder: rec, t: t, req: req}
+}
+
+// Get serves a GET request for target with h. Optional header arguments
+// are key, value pairs added to the request.
+func Get(t testing.TB, h http.Handler, target string, header ...string) *Response {
+	t.Helper()
+	return Do(t, h, NewRequest("GET", target, header...))
+}
+
+// Head is like Get but sends a HEAD request.
+func Head(t testing.TB, h http.Handler, target string, header ...string) *Response {
+	t.Helper()
+	return Do(t, h, NewRequest("HEAD", target, header...))
+}
+
+// NewRequest returns a request suitable for passing to Do, with header
+// holding key, value pairs. It panics if header has an odd length.
+func NewRequest(method, target string, header ...string) *http.Request {
+	if len(header)%2 != 0 {
+		panic("midservetest: odd number of header arguments")
+	}
+	req := httptest.NewRequest(method, target, nil)
+	for i := 0; i < len(header); i += 2 {
+		req.Header.Add(header[i], header[i+1])
+	}
+	return req
+}
+
+func (r *Response) errorf(format string, args ...interface{}) {
+	r.t.Helper()
+	args = append([]interface{}{r.req.Method, r.req.URL}, args...)
+	r.t.Errorf("%s %s: "+format, args...)
+}
+
+// Status asserts the response status code.
+func (r *Response) Status(code int) *Response {
+	r.t.Helper()
+	if r.Code != code {
+		r.errorf("status = %d, want %d", r.Code, code)
+	}
+	return r
+}
+
+// Header asserts the first value of the response header key. An empty
+// want asserts that the header is absent.
+func (r *Response) Header(key, want string) *Response {
+	r.t.Helper()
+	if got := r.Result().Header.Get(key); got != want {
+		r.errorf("header %s = %q, want %q", key, got, want)
+	}
+	return r
+}
+
+// Body asserts the complete response body.
+func (r *Response) Body(want string) *Response {
+	r.t.Helper()
+	if got := r.ResponseRecorder.Body.String(); got != want {
+		r.errorf("body = %q, want %q", got, want)
+	}
+	return r
+}
+
+// BodyContains asserts that the response body contains each of subs.
+func (r *Response) BodyContains(subs ...string) *Response {
+	r.t.Helper()
+	body := r.ResponseRecorder.Body.String()
+	for _, sub := range subs {
+		if !strings.Contains(body, sub) {
+			r.errorf("body does not contain %q:\n%s", sub, body)
+		}
+	}
+	return r
+}
+
+// BodyNotContains asserts that the response body contains none of subs,
+// e.g. names of excluded files in a listing.
+func (r *Response) BodyNotContains(subs ...string) *Response {
+	r.t.Helper()
+	body := r.ResponseRecorder.Body.String()
+	for _, sub := range subs {
+		if strings.Contains(body, sub) {
+			r.errorf("body unexpectedly contains %q:\n%s", sub, body)
+		}
+	}
+	return r
+}
+
+// Golden asserts that the response body equals the content of the
+// golden file, typically a snapshot of a directory listing under
+// testdata. Running the tests with -midservetest.update rewrites the
+// file instead.
+func (r *Response) Golden(file string) *Response {
+	r.t.Helper()
+	got := r.ResponseRecorder.Body.Bytes()
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := os.WriteFile(file, got, 0644); err != nil {
+			r.t.Fatal(err)
+		}
+		return r
+	}
+	want, err := os.ReadFile(file)
+	if err != nil {
+		r.t.Fatalf("%v (run with -midservetest.update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		r.errorf("body does not match %s:\ngot:\n%s\nwant:\n%s", file, got, want)
+	}
+	return r
+}
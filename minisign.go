@@ -0,0 +1,174 @@
+// Detached minisign signatures of files
+
+package midserve
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// signingKeyPath serves the public key of -minisign-key.
+const signingKeyPath = "/_signing-key.pub"
+
+// signatureExts are the extensions of the signature of a file: minisign
+// looks for .minisig, others for .sig.
+var signatureExts = []string{".minisig", ".sig"}
+
+var errMinisignKey = errors.New("invalid minisign secret key")
+
+// A MinisignKey is a minisign secret key that files are signed with.
+// See https://jedisct1.github.io/minisign/.
+type MinisignKey struct {
+	id  [8]byte
+	key ed25519.PrivateKey
+}
+
+// LoadMinisignKey reads a minisign secret key file. Only keys not
+// encrypted with a password, as created by minisign -G -W, can be read.
+func LoadMinisignKey(file string) (*MinisignKey, error) {
+	b, err := minisignFile(file)
+	if err != nil {
+		return nil, err
+	}
+	// Ed, kdf, B2, kdf salt, ops and memory limits, id, key, checksum
+	if len(b) != 158 || string(b[:2]) != "Ed" || string(b[4:6]) != "B2" {
+		return nil, errMinisignKey
+	}
+	if string(b[2:4]) != "\x00\x00" {
+		return nil, fmt.Errorf("%s: encrypted with a password; create a key with minisign -G -W", file)
+	}
+	k := &MinisignKey{key: ed25519.PrivateKey(append([]byte(nil), b[62:126]...))}
+	copy(k.id[:], b[54:62])
+	sum := newBLAKE2b(32)
+	sum.Write(b[:2])
+	sum.Write(b[54:126])
+	if !bytes.Equal(sum.Sum(nil), b[126:]) {
+		return nil, fmt.Errorf("%s: checksum mismatch", file)
+	}
+	if !bytes.Equal(ed25519.NewKeyFromSeed(k.key.Seed()), k.key) {
+		return nil, errMinisignKey
+	}
+	return k, nil
+}
+
+// minisignFile returns the decoded data of a minisign key file, the
+// line after the untrusted comment.
+func minisignFile(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() || !strings.HasPrefix(sc.Text(), "untrusted comment:") || !sc.Scan() {
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errMinisignKey
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sc.Text()))
+	if err != nil {
+		return nil, errMinisignKey
+	}
+	return b, nil
+}
+
+// PublicKey returns the public key file of k, for minisign -V -p.
+func (k *MinisignKey) PublicKey() string {
+	b := append([]byte("Ed"), k.id[:]...)
+	b = append(b, k.key.Public().(ed25519.PublicKey)...)
+	return fmt.Sprintf("untrusted comment: minisign public key %016X\n%s\n", binary.LittleEndian.Uint64(k.id[:]), base64.StdEncoding.EncodeToString(b))
+}
+
+// sign writes the signature of the file name read from r, signed at t.
+// The file is prehashed with BLAKE2b-512, as minisign does by default,
+// so it need not fit into memory.
+func (k *MinisignKey) sign(w io.Writer, r io.Reader, name string, t time.Time) error {
+	h := newBLAKE2b(64)
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	sig := ed25519.Sign(k.key, h.Sum(nil))
+	trusted := fmt.Sprintf("timestamp:%d\tfile:%s\thashed", t.Unix(), path.Base(name))
+	global := ed25519.Sign(k.key, append(append([]byte(nil), sig...), trusted...))
+	b := append([]byte("ED"), k.id[:]...)
+	b = append(b, sig...)
+	_, err := fmt.Fprintf(w, "untrusted comment: signature from midserve secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(b), trusted, base64.StdEncoding.EncodeToString(global))
+	return err
+}
+
+// serveSignature serves the signature of a file requested as name, the
+// file with a signature extension, signing it on first request, and
+// reports whether it replied. Signatures on disk are served as they are.
+func (fh *fileHandler) serveSignature(w http.ResponseWriter, r *http.Request, name string) bool {
+	base := ""
+	for _, ext := range signatureExts {
+		if strings.HasSuffix(name, ext) {
+			base = strings.TrimSuffix(name, ext)
+		}
+	}
+	if base == "" || strings.HasSuffix(base, "/") {
+		return false
+	}
+	if f, err := openContext(r.Context(), fh.root, name); err == nil {
+		f.Close()
+		return false
+	}
+	f, d, err := fh.openRegular(r, base)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errNotRegular) {
+		// No signature then, as of no file.
+		return false
+	}
+	if err != nil {
+		fh.error(w, r, name, err)
+		return true
+	}
+	defer f.Close()
+	if !fh.checkPermitted(w, r, base, RoleRead) {
+		return true
+	}
+
+	key := sha256.Sum256([]byte(fmt.Sprintf("minisig\x00%s\x00%d\x00%d\x00%x", base, d.ModTime().UnixNano(), d.Size(), fh.signingKey.id)))
+	cached := filepath.Join(fh.cacheDir, "minisig", hex.EncodeToString(key[:]))
+	fh.dropPurged(base, cached)
+	cf, err := os.Open(cached)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fh.produce(r.Context(), cached, func(w io.Writer) error {
+			return fh.signingKey.sign(w, f, base, time.Now())
+		})
+		if err == nil {
+			cf, err = os.Open(cached)
+		}
+	}
+	if err != nil {
+		logf(r, "http: error signing %s: %v", base, err)
+		fh.error(w, r, name, err)
+		return true
+	}
+	defer cf.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fh.serveCached(w, r, name, d, cf)
+	return true
+}
+
+// serveSigningKey serves the public key files are signed with.
+func (fh *fileHandler) serveSigningKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, fh.signingKey.PublicKey())
+}
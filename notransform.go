@@ -0,0 +1,52 @@
+// Byte-identical delivery
+
+package midserve
+
+import (
+	"net/http"
+	"strings"
+)
+
+// noTransform reports whether the file name must be served byte for
+// byte as it is, without rendering, resizing, transforms or
+// precompressed sidecars: because the request has Cache-Control:
+// no-transform, or because fh.pinned(name).
+func (fh *fileHandler) noTransform(r *http.Request, name string) bool {
+	return hasDirective(r.Header, "Cache-Control", "no-transform") || fh.pinned(name)
+}
+
+// pinned reports whether name matches a -no-transform pattern, such as
+// those of signed files whose signatures would no longer match. Only
+// those are served without stripping metadata or expanding includes,
+// which the operator asked for: a client may not have them undone.
+func (fh *fileHandler) pinned(name string) bool {
+	return exclude(name, fh.noTransforms)
+}
+
+// hasDirective reports whether the header key of h, a list of
+// directives such as Cache-Control, has the directive d.
+func hasDirective(h http.Header, key, d string) bool {
+	for _, v := range h.Values(key) {
+		for _, part := range strings.Split(v, ",") {
+			if i := strings.Index(part, "="); i >= 0 {
+				part = part[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(part), d) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addDirective adds the directive d to the header key of h, a list of
+// directives, unless it is there already.
+func addDirective(h http.Header, key, d string) {
+	if hasDirective(h, key, d) {
+		return
+	}
+	if v := h.Get(key); v != "" {
+		d = v + ", " + d
+	}
+	h.Set(key, d)
+}
@@ -0,0 +1,43 @@
+package midserve
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestNoTransformRequest(t *testing.T) {
+	// A JPEG with an APP1 (EXIF) segment.
+	jpeg := "\xff\xd8\xff\xe1\x00\x06Exif\xff\xd9"
+	root := midservetest.NewFS().
+		File("p.jpg", jpeg).
+		File("a.shtml", `<!--#echo var="DOCUMENT_NAME" -->`).
+		File("pinned/p.jpg", jpeg).
+		File("pinned/a.shtml", `<!--#echo var="DOCUMENT_NAME" -->`).
+		File("c.heic", "heic").
+		File("pinned/c.heic", "heic").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) {
+		o.StripEXIF = true
+		o.SSIExts = []string{".shtml"}
+		o.NoTransforms = []*regexp.Regexp{regexp.MustCompile(`^pinned/`)}
+	})
+
+	// Clients may not opt out of what the operator asked for.
+	for _, tc := range []struct{ path, body string }{
+		{"/p.jpg", "\xff\xd8\xff\xd9"},
+		{"/a.shtml", "a.shtml"},
+		{"/pinned/p.jpg", jpeg},
+		{"/pinned/a.shtml", `<!--#echo var="DOCUMENT_NAME" -->`},
+		{"/pinned/c.heic", "heic"},
+	} {
+		midservetest.Get(t, h, tc.path, "Cache-Control", "no-transform").
+			Status(http.StatusOK).
+			Body(tc.body)
+	}
+	// HEIC metadata isn't stripped, so the image isn't served at all.
+	midservetest.Get(t, h, "/c.heic", "Cache-Control", "no-transform").
+		Status(http.StatusForbidden)
+}
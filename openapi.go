@@ -0,0 +1,119 @@
+// OpenAPI description of the API
+
+package midserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// openAPIDoc describes the endpoints under /_api/ in OpenAPI 3.0. Each
+// version of apiVersion keeps the schemas compatible: fields may be
+// added, but none removed or changed.
+const openAPIDoc = `{
+  "openapi": "3.0.3",
+  "info": {"title": "midserve API", "description": "Endpoints under /_api/. Responses carry the X-Midserve-API-Version header; requests may send it to insist on a version."},
+  "paths": {
+    "/_api/list": {"get": {"summary": "Entries of a directory, as its listing shows them", "parameters": [{"$ref": "#/components/parameters/path"}, {"name": "page", "in": "query", "schema": {"type": "integer", "minimum": 1}, "description": "page of listings truncated by -listing-max-entries"}],
+      "responses": {"200": {"description": "the listing", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Listing"}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/stat": {"get": {"summary": "What a HEAD request for each path would report", "parameters": [{"name": "path", "in": "query", "required": true, "schema": {"type": "array", "items": {"type": "string"}}, "style": "form", "explode": true}],
+      "responses": {"200": {"description": "one entry per path, in order", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/StatEntry"}}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/manifest": {"get": {"summary": "Every file below a directory with its SHA-256", "parameters": [{"$ref": "#/components/parameters/path"}, {"name": "format", "in": "query", "schema": {"type": "string", "enum": ["json", "csv"], "default": "json"}}],
+      "responses": {"200": {"description": "files in lexical order", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ManifestEntry"}}}, "text/csv": {"schema": {"type": "string"}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/dupes": {"get": {"summary": "Files below a directory with the same content", "parameters": [{"$ref": "#/components/parameters/path"}, {"name": "min_size", "in": "query", "schema": {"type": "integer", "format": "int64", "minimum": 0, "default": 1}}],
+      "responses": {"200": {"description": "the groups of duplicates, the most wasteful first", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Dupes"}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/blocks": {"get": {"summary": "Block checksums of a file, for delta downloads", "parameters": [{"$ref": "#/components/parameters/requiredPath"}, {"name": "block_size", "in": "query", "description": "the default or a power of two", "schema": {"type": "integer", "minimum": 512, "maximum": 1048576}}],
+      "responses": {"200": {"description": "the checksums", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BlockList"}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/segments": {"get": {"summary": "Byte ranges of a file with their checksums, for parallel downloads", "parameters": [{"$ref": "#/components/parameters/requiredPath"}, {"name": "parts", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 64, "default": 4}}],
+      "responses": {"200": {"description": "the segments, fewer than parts for small files", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SegmentList"}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/diff": {"get": {"summary": "Differences between two text files", "parameters": [{"name": "a", "in": "query", "required": true, "schema": {"type": "string"}}, {"name": "b", "in": "query", "required": true, "schema": {"type": "string"}}, {"name": "view", "in": "query", "schema": {"type": "string", "enum": ["unified", "split", "raw"], "default": "unified"}}],
+      "responses": {"200": {"description": "the differences, as a page or a unified diff", "content": {"text/html": {"schema": {"type": "string"}}, "text/plain": {"schema": {"type": "string"}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/search": {"get": {"summary": "Indexed paths whose name contains q", "parameters": [{"name": "q", "in": "query", "schema": {"type": "string"}}, {"$ref": "#/components/parameters/path"}, {"name": "sort", "in": "query", "schema": {"type": "string", "enum": ["name", "size", "mtime", "downloads"], "default": "name"}}, {"name": "desc", "in": "query", "schema": {"type": "string", "enum": ["1"]}}, {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "default": 100}}],
+      "responses": {"200": {"description": "the results", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SearchResults"}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/shorten": {"post": {"summary": "Short link of a path", "parameters": [{"$ref": "#/components/parameters/requiredPath"}],
+      "responses": {"200": {"description": "the link", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ShortLink"}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/resolve": {"post": {"summary": "Content-addressed URL of the current content of a file", "parameters": [{"$ref": "#/components/parameters/requiredPath"}],
+      "responses": {"200": {"description": "the URL", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Resolved"}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/workers": {"get": {"summary": "Counters of the background workers",
+      "responses": {"200": {"description": "the counters", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Workers"}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/delete": {"post": {"summary": "Delete files and directories", "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "required": ["paths"], "properties": {"paths": {"type": "array", "items": {"type": "string"}}}}}}},
+      "responses": {"200": {"description": "one result per path", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ManageResult"}}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/move": {"post": {"summary": "Move or rename files and directories", "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "required": ["moves"], "properties": {"moves": {"type": "array", "items": {"type": "object", "required": ["from", "to"], "properties": {"from": {"type": "string"}, "to": {"type": "string"}}}}}}}}},
+      "responses": {"200": {"description": "one result per move", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ManageResult"}}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/upload": {"post": {"summary": "Upload new files into a directory", "parameters": [{"$ref": "#/components/parameters/path"}, {"name": "X-Upload-ID", "in": "header", "required": true, "schema": {"type": "string", "pattern": "^[A-Za-z0-9_-]{8,64}$"}}],
+      "requestBody": {"required": true, "content": {"multipart/form-data": {"schema": {"type": "object", "properties": {"file": {"type": "array", "items": {"type": "string", "format": "binary"}}}}}}},
+      "responses": {"200": {"description": "one result per file", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ManageResult"}}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/upload-progress": {"get": {"summary": "Progress of an upload", "parameters": [{"name": "id", "in": "query", "required": true, "schema": {"type": "string"}}],
+      "responses": {"200": {"description": "the progress, or a stream of progress and done events", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UploadProgress"}}, "text/event-stream": {"schema": {"type": "string"}}}}, "default": {"$ref": "#/components/responses/Error"}}}},
+    "/_api/openapi.json": {"get": {"summary": "This document",
+      "responses": {"200": {"description": "the OpenAPI document", "content": {"application/json": {"schema": {"type": "object"}}}}}}}
+  },
+  "components": {
+    "parameters": {
+      "path": {"name": "path", "in": "query", "schema": {"type": "string", "default": "/"}},
+      "requiredPath": {"name": "path", "in": "query", "required": true, "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {"description": "an error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer"}
+    },
+    "schemas": {
+      "Error": {"type": "object", "required": ["error"], "properties": {"error": {"type": "string"}}},
+      "Listing": {"type": "object", "required": ["version", "path", "entries"], "properties": {"version": {"type": "integer"}, "path": {"type": "string"}, "entries": {"type": "array", "items": {"$ref": "#/components/schemas/ListingEntry"}}, "next_page": {"type": "integer"}}},
+      "ListingEntry": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}, "dir": {"type": "boolean"}, "size": {"type": "integer", "format": "int64"}, "mtime": {"type": "string", "format": "date-time"}, "unserved": {"type": "boolean"}}},
+      "StatEntry": {"type": "object", "required": ["path"], "properties": {"path": {"type": "string"}, "error": {"type": "string"}, "dir": {"type": "boolean"}, "size": {"type": "integer", "format": "int64"}, "mtime": {"type": "string", "format": "date-time"}, "mode": {"type": "string"}, "etag": {"type": "string"}, "content_type": {"type": "string"}}},
+      "ManifestEntry": {"type": "object", "required": ["path", "size", "mtime", "sha256"], "properties": {"path": {"type": "string"}, "size": {"type": "integer", "format": "int64"}, "mtime": {"type": "string", "format": "date-time"}, "sha256": {"type": "string"}}},
+      "Dupes": {"type": "object", "properties": {"path": {"type": "string"}, "files": {"type": "integer"}, "groups": {"type": "array", "items": {"type": "object", "properties": {"size": {"type": "integer", "format": "int64"}, "sha256": {"type": "string"}, "paths": {"type": "array", "items": {"type": "string"}}, "wasted": {"type": "integer", "format": "int64"}}}}, "wasted": {"type": "integer", "format": "int64"}}},
+      "BlockList": {"type": "object", "properties": {"path": {"type": "string"}, "size": {"type": "integer", "format": "int64"}, "sha256": {"type": "string"}, "block_size": {"type": "integer", "format": "int64"}, "blocks": {"type": "array", "items": {"type": "object", "properties": {"weak": {"type": "integer", "format": "int64"}, "strong": {"type": "string"}}}}}},
+      "SegmentList": {"type": "object", "properties": {"path": {"type": "string"}, "size": {"type": "integer", "format": "int64"}, "sha256": {"type": "string"}, "etag": {"type": "string"}, "last_modified": {"type": "string"}, "segments": {"type": "array", "items": {"type": "object", "properties": {"start": {"type": "integer", "format": "int64"}, "end": {"type": "integer", "format": "int64"}, "range": {"type": "string"}, "sha256": {"type": "string"}}}}}},
+      "SearchResults": {"type": "object", "properties": {"scanned": {"type": "string", "format": "date-time"}, "total": {"type": "integer"}, "results": {"type": "array", "items": {"type": "object", "properties": {"path": {"type": "string"}, "dir": {"type": "boolean"}, "size": {"type": "integer", "format": "int64"}, "mtime": {"type": "string", "format": "date-time"}, "sha256": {"type": "string"}, "downloads": {"type": "integer", "format": "int64"}}}}}},
+      "ShortLink": {"type": "object", "properties": {"path": {"type": "string"}, "id": {"type": "string"}, "url": {"type": "string"}}},
+      "Resolved": {"type": "object", "properties": {"path": {"type": "string"}, "size": {"type": "integer", "format": "int64"}, "sha256": {"type": "string"}, "url": {"type": "string"}}},
+      "Workers": {"type": "object", "properties": {"queued": {"type": "integer"}, "pending": {"type": "integer"}, "done": {"type": "integer"}, "failed": {"type": "integer"}, "dropped": {"type": "integer"}}},
+      "ManageResult": {"type": "object", "required": ["path"], "properties": {"path": {"type": "string"}, "from": {"type": "string"}, "error": {"type": "string"}}},
+      "UploadProgress": {"type": "object", "properties": {"received": {"type": "integer", "format": "int64"}, "total": {"type": "integer", "format": "int64"}, "rate": {"type": "number"}, "eta": {"type": "number"}, "current": {"type": "string"}, "files": {"type": "array", "items": {"$ref": "#/components/schemas/ManageResult"}}, "done": {"type": "boolean"}, "error": {"type": "string"}}}
+    }
+  }
+}`
+
+// apiAvailable reports whether the endpoint ep does anything with the
+// current options, rather than replying 404 Not Found.
+func (fh *fileHandler) apiAvailable(ep string) bool {
+	switch {
+	case apiWriteEndpoints[ep] || ep == "upload-progress":
+		return fh.write
+	case ep == "search":
+		return fh.index != nil
+	case ep == "shorten":
+		return fh.shortLinks != nil
+	case ep == "resolve":
+		return fh.cas
+	}
+	return true
+}
+
+// serveOpenAPI implements /_api/openapi.json, describing the endpoints
+// available with the current options.
+func (fh *fileHandler) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(openAPIDoc), &doc); err != nil {
+		apiError(w, err, http.StatusInternalServerError)
+		return
+	}
+	paths := doc["paths"].(map[string]interface{})
+	for p := range paths {
+		if !fh.apiAvailable(strings.TrimPrefix(p, apiPrefix)) {
+			delete(paths, p)
+		}
+	}
+	doc["info"].(map[string]interface{})["version"] = strconv.Itoa(apiVersion)
+	doc["servers"] = []interface{}{map[string]interface{}{"url": fh.baseURL(r)}}
+	if fh.perms != nil {
+		doc["security"] = []interface{}{map[string]interface{}{"bearer": []interface{}{}}, map[string]interface{}{}}
+	}
+	writeJSON(w, r, doc)
+}
@@ -0,0 +1,194 @@
+// Load shedding and overload replies
+
+package midserve
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Classes of requests, which a load shedding policy orders.
+const (
+	ShedListings  = "listings"  // directory listings, HTML or JSON
+	ShedArchives  = "archives"  // directories as zip archives
+	ShedAPI       = "api"       // requests below /_api/
+	ShedStreams   = "streams"   // /_events and /_tail
+	ShedDownloads = "downloads" // everything else
+)
+
+// ShedClasses are the classes of requests load may be shed from.
+var ShedClasses = [...]string{ShedListings, ShedArchives, ShedAPI, ShedStreams, ShedDownloads}
+
+const (
+	// shedRetry is the Retry-After of requests shed at full load.
+	shedRetry = 2 * time.Second
+	// maxRetryAfter bounds all Retry-After derived from load.
+	maxRetryAfter = 5 * time.Minute
+)
+
+// loadShedder counts the requests in flight and turns away those of the
+// classes of its policy as their number nears max: of n classes, the
+// first from max/n requests, the second from 2*max/n and the last from
+// max. Classes not in the policy are never turned away.
+type loadShedder struct {
+	max    int64
+	policy []string
+
+	inflight int64                    // accessed atomically
+	shed     [len(ShedClasses)]uint64 // by index in ShedClasses, accessed atomically
+}
+
+// shedClass reports whether class is one of ShedClasses.
+func shedClass(class string) bool {
+	for _, c := range ShedClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func newLoadShedder(max int, policy []string) *loadShedder {
+	if max <= 0 {
+		return nil
+	}
+	return &loadShedder{max: int64(max), policy: policy}
+}
+
+// threshold returns the number of requests in flight from which requests
+// of class are shed, 0 for never.
+func (ls *loadShedder) threshold(class string) int64 {
+	for i, c := range ls.policy {
+		if c == class {
+			return (ls.max*int64(i+1) + int64(len(ls.policy)) - 1) / int64(len(ls.policy))
+		}
+	}
+	return 0
+}
+
+// load returns the requests in flight relative to max.
+func (ls *loadShedder) load() float64 {
+	return float64(atomic.LoadInt64(&ls.inflight)) / float64(ls.max)
+}
+
+// requestClass returns the class of the request r for name.
+func requestClass(r *http.Request, name string) string {
+	switch {
+	case r.URL.Query().Get("archive") != "":
+		return ShedArchives
+	case underPrefix(name, strings.TrimSuffix(apiPrefix, "/")):
+		return ShedAPI
+	case name == changesPath || name == tailPath:
+		return ShedStreams
+	case strings.HasSuffix(r.URL.Path, "/"):
+		return ShedListings
+	}
+	return ShedDownloads
+}
+
+// admit counts the request r for name as in flight and returns the
+// function ending it, or, if the class of r is shed at the current load,
+// replies with 503 Service Unavailable and returns nil. Admin requests
+// are never shed.
+func (fh *fileHandler) admit(w http.ResponseWriter, r *http.Request, name string) func() {
+	ls := fh.shedder
+	if ls == nil {
+		return func() {}
+	}
+	n := atomic.AddInt64(&ls.inflight, 1)
+	done := func() { atomic.AddInt64(&ls.inflight, -1) }
+	if strings.HasPrefix(name, adminPrefix) {
+		return done
+	}
+	class := requestClass(r, name)
+	if t := ls.threshold(class); t == 0 || n <= t {
+		return done
+	}
+	done()
+	for i, c := range ShedClasses {
+		if c == class {
+			atomic.AddUint64(&ls.shed[i], 1)
+		}
+	}
+	fh.overloaded(w, r, name, http.StatusServiceUnavailable, "server overloaded", retryAfter(shedRetry, ls.load()), nil)
+	return nil
+}
+
+// retryAfter returns the seconds to wait before retrying: base at no
+// load, growing with it, from 1 up to maxRetryAfter.
+func retryAfter(base time.Duration, load float64) int {
+	d := time.Duration(float64(base) * (1 + load))
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+// overloaded replies to a request turned away by a limit with code, 429
+// Too Many Requests for limits of the client or 503 Service Unavailable
+// for those of the server, asking to retry after retry seconds.
+func (fh *fileHandler) overloaded(w http.ResponseWriter, r *http.Request, name string, code int, msg string, retry int, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	http.Error(w, fmt.Sprintf("%d %s: %s, retry later", code, http.StatusText(code), msg), code)
+	fh.publish(r, EventDenied, name, code, -1, err)
+}
+
+// abortCounts counts the transfers aborted since start.
+type abortCounts struct {
+	aborted  uint64 // accessed atomically, as are the others
+	timedOut uint64 // aborted by MaxTransfer
+	sent     uint64 // bytes sent by aborted transfers
+}
+
+// add counts a transfer whose context ctx ended after it sent sent
+// bytes. Once the deadline set by MaxTransfer passed, the connection may
+// be closed, canceling ctx, before ctx times out itself.
+func (c *abortCounts) add(ctx context.Context, sent int64) {
+	atomic.AddUint64(&c.aborted, 1)
+	if dl, ok := ctx.Deadline(); ok && !time.Now().Before(dl) {
+		atomic.AddUint64(&c.timedOut, 1)
+	}
+	if sent > 0 {
+		atomic.AddUint64(&c.sent, uint64(sent))
+	}
+}
+
+// serveLoad implements /_admin/load, the requests in flight, the policy,
+// the requests shed of each class and the transfers aborted since start.
+func (fh *fileHandler) serveLoad(w http.ResponseWriter, r *http.Request) {
+	ls := fh.shedder
+	if ls == nil {
+		ls = &loadShedder{}
+	}
+	type class struct {
+		Class     string `json:"class"`
+		Threshold int64  `json:"threshold,omitempty"`
+		Shed      uint64 `json:"shed"`
+	}
+	classes := []class{}
+	for i, c := range ShedClasses {
+		classes = append(classes, class{c, ls.threshold(c), atomic.LoadUint64(&ls.shed[i])})
+	}
+	writeJSON(w, r, struct {
+		InFlight     int64   `json:"in_flight"`
+		MaxInFlight  int64   `json:"max_in_flight"`
+		Classes      []class `json:"classes"`
+		Aborted      uint64  `json:"aborted"`
+		TimedOut     uint64  `json:"timed_out"`
+		AbortedBytes uint64  `json:"aborted_bytes"`
+	}{
+		atomic.LoadInt64(&ls.inflight), ls.max, classes,
+		atomic.LoadUint64(&fh.aborted.aborted),
+		atomic.LoadUint64(&fh.aborted.timedOut),
+		atomic.LoadUint64(&fh.aborted.sent),
+	})
+}
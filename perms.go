@@ -0,0 +1,215 @@
+// Principals, roles and per-path permissions
+
+package midserve
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// A Role is what a principal may do below a path. Each role includes
+// those before it.
+type Role int
+
+const (
+	// RoleNone allows nothing.
+	RoleNone Role = iota
+	// RoleRead allows downloading files and listing directories.
+	RoleRead
+	// RoleUpload also allows uploading new files.
+	RoleUpload
+	// RoleManage also allows deleting, moving and renaming files.
+	RoleManage
+	// RoleAdmin also allows the endpoints under /_admin/, if granted for
+	// the root.
+	RoleAdmin
+)
+
+var roleNames = []string{"none", "read", "upload", "manage", "admin"}
+
+func (r Role) String() string {
+	if r >= 0 && int(r) < len(roleNames) {
+		return roleNames[r]
+	}
+	return "unknown"
+}
+
+// parseRole parses the name of a role.
+func parseRole(s string) (Role, error) {
+	for i, n := range roleNames {
+		if s == n {
+			return Role(i), nil
+		}
+	}
+	return RoleNone, fmt.Errorf("role: %q is not none, read, upload, manage or admin", s)
+}
+
+// A Grant gives Role below Prefix. Of the grants of a principal, the
+// one with the longest Prefix covering a path applies, so that a
+// subtree can be given less than its parent.
+type Grant struct {
+	Prefix string // '/'-separated, a directory or a single file
+	Role   Role
+}
+
+// A Principal is a client identified by a bearer token, such as a
+// person or a CI job, with its grants.
+type Principal struct {
+	Name   string
+	Token  string
+	Grants []Grant
+}
+
+// permissions resolves the roles of principals and anonymous clients.
+type permissions struct {
+	byToken   map[[sha256.Size]byte]*Principal
+	keys      *apiKeys // nil without a state file
+	anonymous []Grant
+}
+
+var errUnknownToken = errors.New("unknown token")
+
+func newPermissions(principals []Principal, keys *apiKeys, anonymous []Grant) *permissions {
+	p := &permissions{byToken: make(map[[sha256.Size]byte]*Principal), keys: keys, anonymous: anonymous}
+	for i := range principals {
+		// Hashed, so that finding a token takes no time that depends on
+		// how much of it matches.
+		p.byToken[sha256.Sum256([]byte(principals[i].Token))] = &principals[i]
+	}
+	return p
+}
+
+// lookup returns the principal token belongs to, that of the
+// configuration or of an unexpired API key, nil if there is none.
+func (ps *permissions) lookup(token string) *Principal {
+	if token == "" {
+		return nil
+	}
+	h := sha256.Sum256([]byte(token))
+	if p, ok := ps.byToken[h]; ok {
+		return p
+	}
+	if ps.keys != nil {
+		return ps.keys.lookup(h)
+	}
+	return nil
+}
+
+// grantedRole returns the role of the longest grant covering name.
+func grantedRole(grants []Grant, name string) Role {
+	role, longest := RoleNone, -1
+	for _, g := range grants {
+		if underPrefix(name, g.Prefix) && len(g.Prefix) > longest {
+			role, longest = g.Role, len(g.Prefix)
+		}
+	}
+	return role
+}
+
+// role returns the role of p, nil for anonymous clients, below name.
+// Principals have at least the role of anonymous clients.
+func (ps *permissions) role(p *Principal, name string) Role {
+	role := grantedRole(ps.anonymous, name)
+	if p != nil {
+		if pr := grantedRole(p.Grants, name); pr > role {
+			role = pr
+		}
+	}
+	return role
+}
+
+type principalKey struct{}
+
+// principal returns the principal making the request r, nil if it is
+// anonymous.
+func principal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// principalName returns the name of the principal of r, empty if it is
+// anonymous.
+func principalName(r *http.Request) string {
+	if p := principal(r); p != nil {
+		return p.Name
+	}
+	return ""
+}
+
+// bearerToken returns the bearer token of r, empty if it has none.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+// authenticate returns r with the principal its bearer token belongs
+// to, configured or an API key. It replies with 401 Unauthorized and returns nil for tokens that
+// belong to nobody, except the admin token below /_admin/.
+func (fh *fileHandler) authenticate(w http.ResponseWriter, r *http.Request, name string) *http.Request {
+	token := bearerToken(r)
+	if fh.perms == nil || token == "" || (token == fh.adminToken && strings.HasPrefix(name, adminPrefix)) {
+		return r
+	}
+	p := fh.perms.lookup(token)
+	if p == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="midserve"`)
+		apiError(w, errUnknownToken, http.StatusUnauthorized)
+		fh.publish(r, EventDenied, name, http.StatusUnauthorized, -1, nil)
+		return nil
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// permitted reports whether the principal of r has role below name.
+// Without principals, everything is.
+func (fh *fileHandler) permitted(r *http.Request, name string, role Role) bool {
+	return fh.perms == nil || fh.perms.role(principal(r), name) >= role
+}
+
+// checkPermitted replies and returns false unless the principal of r
+// has role below name: anonymous clients are asked to authenticate,
+// principals are refused with 403 Forbidden.
+func (fh *fileHandler) checkPermitted(w http.ResponseWriter, r *http.Request, name string, role Role) bool {
+	if fh.permitted(r, name, role) {
+		return true
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	if principal(r) == nil && fh.sessions != nil && r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		// A browser, which can sign in.
+		u := url.URL{Path: loginPath, RawQuery: url.Values{"next": {r.URL.RequestURI()}}.Encode()}
+		http.Redirect(sw, r, u.String(), http.StatusSeeOther)
+	} else if principal(r) == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="midserve"`)
+		http.Error(sw, "401 Unauthorized", http.StatusUnauthorized)
+	} else {
+		fh.errorHandler.ServeError(sw, r, fs.ErrPermission)
+	}
+	fh.publish(r, EventDenied, name, sw.status, -1, nil)
+	return false
+}
+
+// apiReadPaths returns the paths a read request to the API is about,
+// the root for those about none.
+func apiReadPaths(r *http.Request) []string {
+	q := r.URL.Query()
+	var names []string
+	for _, k := range pathParams {
+		for _, v := range q[k] {
+			names = append(names, path.Clean("/"+v))
+		}
+	}
+	if len(names) == 0 {
+		names = []string{"/"}
+	}
+	return names
+}
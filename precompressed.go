@@ -0,0 +1,92 @@
+// Serving of precompressed sidecar files
+
+package midserve
+
+import (
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// sidecarCodings are the content codings of precompressed sidecars by
+// extension, in order of preference.
+var sidecarCodings = []struct{ ext, coding string }{
+	{".br", "br"},
+	{".gz", "gzip"},
+}
+
+// openSidecar opens the first of the sidecars of the file name with info
+// d, in sidecarCodings, that exists, is up to date and whose coding the
+// client accepts, and returns it along with that coding. Otherwise it
+// returns a nil File.
+//
+// As the response then depends on Accept-Encoding, openSidecar adds it
+// to Vary whenever a usable sidecar exists.
+func (fh *fileHandler) openSidecar(w http.ResponseWriter, r *http.Request, name string, d fs.FileInfo) (http.File, fs.FileInfo, string) {
+	if isSidecar(name, func(base string) bool {
+		f, err := openContext(r.Context(), fh.root, base)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		return err == nil && fi.Mode().IsRegular()
+	}) {
+		return nil, nil, ""
+	}
+	vary := false
+	for _, sc := range sidecarCodings {
+		if exclude(name+sc.ext, fh.excludes) {
+			continue
+		}
+		sf, err := openContext(r.Context(), fh.root, name+sc.ext)
+		if err != nil {
+			continue
+		}
+		sd, err := sf.Stat()
+		// precompress stamps sidecars with the modification time of
+		// their source, as gzip -k and brotli -k do, anything else is
+		// stale.
+		if err != nil || !sd.ModTime().Equal(d.ModTime()) {
+			sf.Close()
+			continue
+		}
+		if !vary {
+			w.Header().Add("Vary", "Accept-Encoding")
+			vary = true
+		}
+		if !acceptsEncoding(r, sc.coding) {
+			sf.Close()
+			continue
+		}
+		return sf, sd, sc.coding
+	}
+	return nil, nil, ""
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of r allows
+// the content coding enc.
+func acceptsEncoding(r *http.Request, enc string) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			coding, params := part, ""
+			if i := strings.Index(part, ";"); i >= 0 {
+				coding, params = part[:i], part[i+1:]
+			}
+			coding = strings.TrimSpace(coding)
+			if coding != enc && coding != "*" {
+				continue
+			}
+			params = strings.TrimSpace(params)
+			if strings.HasPrefix(params, "q=") {
+				q, err := strconv.ParseFloat(params[2:], 64)
+				if err != nil || q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
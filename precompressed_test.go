@@ -0,0 +1,58 @@
+package midserve
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestIsSidecar(t *testing.T) {
+	files := map[string]bool{"a.txt": true, "dir/b.css": true}
+	exists := func(name string) bool { return files[name] }
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"a.txt.gz", true},
+		{"a.txt.br", true},
+		{"dir/b.css.gz", true},
+		{"t.tar.gz", false},
+		{"a.txt", false},
+		{".gz", false},
+		{"dir/.br", false},
+	} {
+		if got := isSidecar(tc.name, exists); got != tc.want {
+			t.Errorf("isSidecar(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSidecarCodings(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.css", "plain").File("a.css.br", "brotli").File("a.css.gz", "gzip").
+		File("b.css", "plain").File("b.css.gz", "gzip").
+		File("c.css", "plain").
+		ModTime(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)).
+		File("c.css.br", "stale").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) { o.Precompressed = true })
+
+	for _, tc := range []struct {
+		target, accept, body, coding string
+	}{
+		{"/a.css", "gzip, br", "brotli", "br"},
+		{"/a.css", "gzip", "gzip", "gzip"},
+		{"/a.css", "br;q=0, gzip", "gzip", "gzip"},
+		{"/a.css", "", "plain", ""},
+		{"/b.css", "br, gzip", "gzip", "gzip"},
+	} {
+		midservetest.Get(t, h, tc.target, "Accept-Encoding", tc.accept).
+			Status(200).Body(tc.body).
+			Header("Content-Encoding", tc.coding).
+			Header("Content-Type", "text/css; charset=utf-8").
+			Header("Vary", "Accept-Encoding")
+	}
+	midservetest.Get(t, h, "/c.css", "Accept-Encoding", "br").
+		Status(200).Body("plain").Header("Content-Encoding", "").Header("Vary", "")
+}
@@ -0,0 +1,267 @@
+// Pretty viewer for JSON and YAML files
+
+package midserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// prettyMaxSize is the largest file shown in the pretty viewer, larger
+// ones are served raw.
+const prettyMaxSize = 8 << 20
+
+// prettyViewExts maps extensions offered in the pretty viewer to the
+// function rendering them.
+var prettyViewExts = map[string]func([]byte) (string, error){
+	".json": prettyJSON,
+	".yaml": prettyYAML,
+	".yml":  prettyYAML,
+}
+
+func isPrettyView(r *http.Request, name string, size int64) bool {
+	return r.URL.Query().Get("view") == "pretty" && size <= prettyMaxSize &&
+		prettyViewExts[strings.ToLower(path.Ext(name))] != nil
+}
+
+var prettyViewTemplate = template.Must(template.New("pretty").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width">
+<title>{{.Name}}</title>
+<style>
+body { font-family: monospace; margin: 1em; }
+header { font-family: sans-serif; margin-bottom: 1em; }
+details { margin-left: 1.5em; }
+summary { margin-left: -1.5em; cursor: pointer; }
+.line { margin-left: 1.5em; white-space: pre-wrap; }
+.k { color: #881391; } .s { color: #c41a16; } .n { color: #1c00cf; } .b { color: #0d22aa; } .c { color: #6a737d; }
+.count { color: #999; }
+.err { color: #c00; font-family: sans-serif; }
+</style>
+</head>
+<body>
+<header>{{.Name}} &middot; <a href="?">raw</a> &middot; <button id="copy">copy raw</button>
+<button onclick="document.querySelectorAll('details').forEach(function(d){d.open=true})">expand all</button>
+<button onclick="document.querySelectorAll('details').forEach(function(d){d.open=false})">collapse all</button></header>
+{{.Content}}
+<script>
+document.getElementById("copy").onclick = function() {
+	var b = this;
+	fetch("?").then(function(r) { return r.text(); }).then(function(t) {
+		return navigator.clipboard.writeText(t);
+	}).then(function() { b.textContent = "copied"; }, function() { b.textContent = "copy failed"; });
+};
+</script>
+</body>
+</html>
+`))
+
+// servePrettyView serves the pretty viewer page for name.
+func (fh *fileHandler) servePrettyView(w http.ResponseWriter, r *http.Request, name string, f io.Reader) {
+	src, err := io.ReadAll(f)
+	if err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	render := prettyViewExts[strings.ToLower(path.Ext(name))]
+	content, err := render(src)
+	if err != nil {
+		// Still show the source, an invalid file is worth seeing too.
+		content = `<p class="err">` + template.HTMLEscapeString(err.Error()) + "</p><pre>" +
+			template.HTMLEscapeString(string(src)) + "</pre>"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	prettyViewTemplate.Execute(w, struct {
+		Name    string
+		Content template.HTML
+	}{path.Base(name), template.HTML(content)})
+}
+
+// prettyJSON renders a JSON document as a tree of collapsible nodes,
+// keeping the order of object keys.
+func prettyJSON(src []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(src))
+	dec.UseNumber()
+	var b strings.Builder
+	if err := prettyJSONValue(&b, dec, "", 0); err != nil {
+		return "", err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return "", errors.New("invalid JSON: data after the top-level value")
+	}
+	return b.String(), nil
+}
+
+func prettyJSONValue(b *strings.Builder, dec *json.Decoder, key string, depth int) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	label := ""
+	if key != "" {
+		label = `<span class="k">` + template.HTMLEscapeString(key) + "</span>: "
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		closing, unit := "]", "items"
+		if t == '{' {
+			closing, unit = "}", "keys"
+		}
+		var inner strings.Builder
+		n := 0
+		for dec.More() {
+			childKey := ""
+			if t == '{' {
+				k, err := dec.Token()
+				if err != nil {
+					return fmt.Errorf("invalid JSON: %v", err)
+				}
+				childKey = jsonQuote(k.(string))
+			}
+			if err := prettyJSONValue(&inner, dec, childKey, depth+1); err != nil {
+				return err
+			}
+			n++
+		}
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("invalid JSON: %v", err)
+		}
+		open := ""
+		if depth < 3 {
+			open = " open"
+		}
+		fmt.Fprintf(b, `<details%s><summary>%s%c <span class="count">%d %s</span></summary>%s</details><div class="line">%s</div>`,
+			open, label, t, n, unit, inner.String(), closing)
+	case string:
+		b.WriteString(`<div class="line">` + label + `<span class="s">` + template.HTMLEscapeString(jsonQuote(t)) + "</span></div>")
+	case json.Number:
+		b.WriteString(`<div class="line">` + label + `<span class="n">` + template.HTMLEscapeString(t.String()) + "</span></div>")
+	case bool:
+		fmt.Fprintf(b, `<div class="line">%s<span class="b">%t</span></div>`, label, t)
+	case nil:
+		b.WriteString(`<div class="line">` + label + `<span class="b">null</span></div>`)
+	}
+	return nil
+}
+
+// jsonQuote quotes s as in the source. HTML escaping is left to the
+// caller.
+func jsonQuote(s string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+var (
+	yamlKeyRe     = regexp.MustCompile(`^(\s*(?:- )?)((?:"[^"]*"|'[^']*'|[^\s#'"][^:#]*?)\s*:)(\s|$)(.*)$`)
+	yamlNumberRe  = regexp.MustCompile(`^[-+]?(\d[\d_]*(\.\d*)?([eE][-+]?\d+)?|0x[0-9a-fA-F]+|\.inf|\.nan)$`)
+	yamlKeywordRe = regexp.MustCompile(`^(true|false|yes|no|on|off|null|~)$`)
+)
+
+// prettyYAML renders a YAML document as highlighted lines, collapsible
+// where the following lines are indented deeper. It doesn't parse YAML,
+// so it works on any document but can't validate it.
+func prettyYAML(src []byte) (string, error) {
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(string(src), "\r\n", "\n"), "\n"), "\n")
+	indent := func(i int) int {
+		for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+			i++
+		}
+		if i >= len(lines) {
+			return -1
+		}
+		l := lines[i]
+		return len(l) - len(strings.TrimLeft(l, " -"))
+	}
+
+	var b strings.Builder
+	var stack []int // indentation of the open <details>
+	for i, line := range lines {
+		cur := indent(i)
+		if strings.TrimSpace(line) == "" {
+			b.WriteString(`<div class="line"> </div>`)
+			continue
+		}
+		for len(stack) > 0 && cur <= stack[len(stack)-1] {
+			b.WriteString("</details>")
+			stack = stack[:len(stack)-1]
+		}
+		html := highlightYAMLLine(line)
+		if next := indent(i + 1); next > cur {
+			b.WriteString("<details open><summary>" + html + "</summary>")
+			stack = append(stack, cur)
+			continue
+		}
+		b.WriteString(`<div class="line">` + html + "</div>")
+	}
+	for range stack {
+		b.WriteString("</details>")
+	}
+	return b.String(), nil
+}
+
+func highlightYAMLLine(line string) string {
+	comment := ""
+	if i := yamlCommentIndex(line); i >= 0 {
+		comment = `<span class="c">` + template.HTMLEscapeString(line[i:]) + "</span>"
+		line = line[:i]
+	}
+	if m := yamlKeyRe.FindStringSubmatch(line); m != nil {
+		return template.HTMLEscapeString(m[1]) + `<span class="k">` + template.HTMLEscapeString(m[2]) + "</span>" +
+			m[3] + highlightYAMLScalar(m[4]) + comment
+	}
+	trimmed := strings.TrimLeft(line, " ")
+	lead := line[:len(line)-len(trimmed)]
+	if strings.HasPrefix(trimmed, "- ") {
+		lead += "- "
+		trimmed = trimmed[2:]
+	}
+	return template.HTMLEscapeString(lead) + highlightYAMLScalar(trimmed) + comment
+}
+
+func highlightYAMLScalar(v string) string {
+	t := strings.TrimSpace(v)
+	switch {
+	case t == "":
+		return template.HTMLEscapeString(v)
+	case t[0] == '"' || t[0] == '\'':
+		return `<span class="s">` + template.HTMLEscapeString(v) + "</span>"
+	case yamlNumberRe.MatchString(t):
+		return `<span class="n">` + template.HTMLEscapeString(v) + "</span>"
+	case yamlKeywordRe.MatchString(strings.ToLower(t)):
+		return `<span class="b">` + template.HTMLEscapeString(v) + "</span>"
+	}
+	return template.HTMLEscapeString(v)
+}
+
+// yamlCommentIndex returns the index of the comment in line, ignoring
+// '#' inside quotes and not preceded by a space, or -1.
+func yamlCommentIndex(line string) int {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return i
+		}
+	}
+	return -1
+}
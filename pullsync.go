@@ -0,0 +1,521 @@
+// Pulling a mirror from another instance
+
+package midserve
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pullConflicts lists the -pull-conflict rules deciding whether a local
+// file that differs from the upstream one is replaced:
+//
+//	upstream  always, the mirror follows upstream exactly
+//	newer     only if the upstream file was modified later
+//	keep      never, only missing files are pulled
+var pullConflicts = map[string]bool{"upstream": true, "newer": true, "keep": true}
+
+// pullMaxRanges bounds the ranges asked for in one request, keeping
+// the Range header well below the server's header limit.
+const pullMaxRanges = 100
+
+// pullSync mirrors the tree of another midserve instance, with -api,
+// into the root: the upstream manifest tells what changed, the files
+// that did are downloaded at up to rate bytes per second, only their
+// changed blocks if there is a local copy.
+type pullSync struct {
+	from      *url.URL
+	interval  time.Duration
+	rate      int64
+	conflict  string
+	delete    bool
+	deleteMax int // 0 for no limit
+	client    *http.Client
+}
+
+// pullStats counts what a pull did.
+type pullStats struct {
+	pulled, deleted, kept, failed int
+	bytes                         int64
+}
+
+// parsePullFrom parses the -pull-from URL of the upstream root.
+func parsePullFrom(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("pull from: %q is not an http or https URL", s)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// runPull pulls from upstream every interval.
+func (fh *fileHandler) runPull() {
+	for {
+		start := time.Now()
+		st, err := fh.pull(context.Background())
+		if err != nil {
+			log.Printf("pull: %v", err)
+		} else {
+			log.Printf("pull: %d files (%d bytes) pulled, %d deleted, %d kept, %d failed in %v",
+				st.pulled, st.bytes, st.deleted, st.kept, st.failed, time.Since(start).Round(time.Millisecond))
+		}
+		time.Sleep(fh.pullSync.interval)
+	}
+}
+
+// pull brings the root up to date with the upstream manifest.
+func (fh *fileHandler) pull(ctx context.Context) (pullStats, error) {
+	var st pullStats
+	ps := fh.pullSync
+	u := *ps.from
+	u.Path += apiPrefix + "manifest"
+	u.RawQuery = "path=/&format=json"
+	resp, err := ps.client.Get(u.String())
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("manifest: %s", resp.Status)
+	}
+	var entries []manifestEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return st, fmt.Errorf("manifest: %v", err)
+	}
+
+	upstream := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		name := path.Clean("/" + e.Path)
+		upstream[name] = true
+		if name == "/" || fh.denied(name) {
+			continue
+		}
+		switch pulled, err := fh.pullFile(ctx, name, e); {
+		case err != nil:
+			log.Printf("pull: %s: %v", name, err)
+			st.failed++
+		case pulled < 0:
+			st.kept++
+		case pulled > 0:
+			st.pulled++
+			st.bytes += pulled
+		}
+	}
+
+	if !ps.delete || ps.conflict == "keep" {
+		return st, nil
+	}
+	var gone []string
+	err = walkFS(ctx, fh.writeRoot, "/", fh.excludes, func(name string, fi fs.FileInfo) error {
+		if fi.Mode().IsRegular() && !upstream[name] && !fh.denied(name) {
+			gone = append(gone, name)
+		}
+		return nil
+	})
+	if err != nil || len(gone) == 0 {
+		return st, err
+	}
+	// Rather an upstream that lost its files, or a manifest of the
+	// wrong directory, than a mirror that lost them too.
+	if len(entries) == 0 {
+		return st, fmt.Errorf("upstream manifest is empty, not deleting %d files", len(gone))
+	}
+	if ps.deleteMax > 0 && len(gone) > ps.deleteMax {
+		return st, fmt.Errorf("not deleting %d files, more than -pull-delete-max %d", len(gone), ps.deleteMax)
+	}
+	for _, name := range gone {
+		if err := os.Remove(fh.writeRoot.osPath(name)); err != nil {
+			log.Printf("pull: %v", err)
+			st.failed++
+		} else {
+			st.deleted++
+		}
+	}
+	return st, nil
+}
+
+// pullFile brings the file name up to date with the upstream entry e.
+// It returns the bytes downloaded, or -1 if a local change was kept.
+func (fh *fileHandler) pullFile(ctx context.Context, name string, e manifestEntry) (int64, error) {
+	ps := fh.pullSync
+	dst := fh.writeRoot.osPath(name)
+	if fi, err := os.Stat(dst); err == nil {
+		if !fi.Mode().IsRegular() {
+			return -1, nil
+		}
+		local := fi.ModTime().UTC().Truncate(time.Second)
+		if fi.Size() == e.Size && local.Equal(e.ModTime) {
+			return 0, nil
+		}
+		if sum, err := fh.fileSHA256(ctx, name, fi); err == nil && sum == e.SHA256 {
+			// Same content: only the times differ.
+			return 0, os.Chtimes(dst, e.ModTime, e.ModTime)
+		}
+		if ps.conflict == "keep" || ps.conflict == "newer" && !e.ModTime.After(local) {
+			return -1, nil
+		}
+	}
+
+	var (
+		local   *os.File
+		list    *blockList
+		offsets []int64
+	)
+	if f, err := os.Open(dst); err == nil {
+		defer f.Close()
+		local = f
+		list, offsets = fh.planDelta(ctx, name, e, f)
+	}
+
+	tmp, err := fh.writeTemps.create(filepath.Dir(dst))
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	var n int64
+	if list != nil {
+		n, err = fh.pullDelta(ctx, name, local, list, offsets, io.MultiWriter(tmp, h))
+	} else {
+		n, err = fh.pullWhole(ctx, name, io.MultiWriter(tmp, h))
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != e.SHA256 {
+		// Changed upstream since the manifest; the next pull gets it.
+		return 0, fmt.Errorf("sha256 %s, manifest has %s", sum, e.SHA256)
+	}
+	os.Chmod(tmp.Name(), 0644)
+	if err := os.Chtimes(tmp.Name(), e.ModTime, e.ModTime); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), dst)
+}
+
+// pullWhole downloads the upstream file name to w.
+func (fh *fileHandler) pullWhole(ctx context.Context, name string, w io.Writer) (int64, error) {
+	ps := fh.pullSync
+	u := *ps.from
+	u.Path += name
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New(resp.Status)
+	}
+	return io.Copy(w, &throttledReader{r: resp.Body, rate: ps.rate, start: time.Now()})
+}
+
+// planDelta fetches the upstream block checksums of name, of which local
+// is an outdated copy, and returns them with the offsets in local of the
+// blocks it already has, as matchBlocks. It returns a nil list if none
+// are, or the checksums can't be had, to download the whole file.
+func (fh *fileHandler) planDelta(ctx context.Context, name string, e manifestEntry, local *os.File) (*blockList, []int64) {
+	ps := fh.pullSync
+	u := *ps.from
+	u.Path += apiPrefix + "blocks"
+	u.RawQuery = "path=" + url.QueryEscape(name)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, nil
+	}
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		log.Printf("pull: %s: blocks: %v", name, err)
+		return nil, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("pull: %s: blocks: %s", name, resp.Status)
+		return nil, nil
+	}
+	var list blockList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		log.Printf("pull: %s: blocks: %v", name, err)
+		return nil, nil
+	}
+	if list.SHA256 != e.SHA256 || list.BlockSize <= 0 || int64(len(list.Blocks)) != (list.Size+list.BlockSize-1)/list.BlockSize {
+		// Changed upstream since the manifest.
+		return nil, nil
+	}
+	offsets, err := matchBlocks(local, &list)
+	if err != nil {
+		log.Printf("pull: %s: %v", name, err)
+		return nil, nil
+	}
+	for _, off := range offsets {
+		if off >= 0 {
+			return &list, offsets
+		}
+	}
+	return nil, nil
+}
+
+// matchBlocks returns, for each block of list, the offset of the same
+// content in local, or -1 if it has none. As rsync does, it rolls the
+// weak checksum over local a byte at a time and confirms its matches
+// with the strong one. The last block is only matched if it is whole.
+func matchBlocks(local io.Reader, list *blockList) ([]int64, error) {
+	bs := int(list.BlockSize)
+	offsets := make([]int64, len(list.Blocks))
+	weak := make(map[uint32][]int)
+	for i, b := range list.Blocks {
+		offsets[i] = -1
+		if int64(i+1)*list.BlockSize <= list.Size {
+			weak[b.Weak] = append(weak[b.Weak], i)
+		}
+	}
+	if len(weak) == 0 {
+		return offsets, nil
+	}
+
+	br := bufio.NewReaderSize(local, 64<<10)
+	win := make([]byte, bs) // a ring starting at head
+	line := make([]byte, bs)
+	var head int
+	var off int64
+	var a, b uint32
+	// fill reads the next whole window, reporting false at the end.
+	fill := func() (bool, error) {
+		_, err := io.ReadFull(br, win)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		head, a, b = 0, 0, 0
+		for i, c := range win {
+			a += uint32(c)
+			b += uint32(bs-i) * uint32(c)
+		}
+		return true, nil
+	}
+	if ok, err := fill(); !ok {
+		return offsets, err
+	}
+	for {
+		if idx, ok := weak[a&0xffff|b<<16]; ok {
+			copy(line, win[head:])
+			copy(line[bs-head:], win[:head])
+			sum := sha256.Sum256(line)
+			strong := hex.EncodeToString(sum[:16])
+			hit := false
+			for _, i := range idx {
+				if list.Blocks[i].Strong == strong {
+					hit = true
+					if offsets[i] < 0 {
+						offsets[i] = off
+					}
+				}
+			}
+			if hit {
+				// Go on after the block rather than inside it.
+				off += int64(bs)
+				if ok, err := fill(); !ok {
+					return offsets, err
+				}
+				continue
+			}
+		}
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return offsets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		out := win[head]
+		win[head] = c
+		head = (head + 1) % bs
+		a += uint32(c) - uint32(out)
+		b += a - uint32(bs)*uint32(out)
+		off++
+	}
+}
+
+// pullDelta writes the upstream file name, described by list, to w: the
+// blocks at offsets in local from there, the others downloaded with
+// multi-range requests. It returns the bytes downloaded.
+func (fh *fileHandler) pullDelta(ctx context.Context, name string, local io.ReaderAt, list *blockList, offsets []int64, w io.Writer) (int64, error) {
+	// Runs of blocks, local ones with start as their offset in local.
+	type run struct {
+		httpRange
+		local bool
+	}
+	var runs []run
+	var remote []httpRange
+	for i, off := range offsets {
+		start := int64(i) * list.BlockSize
+		length := min64(list.BlockSize, list.Size-start)
+		if off < 0 {
+			if k := len(remote) - 1; k >= 0 && remote[k].start+remote[k].length == start {
+				remote[k].length += length
+			} else {
+				remote = append(remote, httpRange{start, length})
+			}
+			start = -1
+		} else {
+			start = off
+		}
+		if k := len(runs) - 1; k >= 0 && runs[k].local == (off >= 0) && (off < 0 || runs[k].start+runs[k].length == off) {
+			runs[k].length += length
+			continue
+		}
+		runs = append(runs, run{httpRange{start, length}, off >= 0})
+	}
+
+	rf := &rangeFetcher{fh: fh, ctx: ctx, name: name, ranges: remote}
+	defer rf.close()
+	for _, ru := range runs {
+		var err error
+		if ru.local {
+			_, err = io.Copy(w, io.NewSectionReader(local, ru.start, ru.length))
+		} else {
+			err = rf.copyNext(w)
+		}
+		if err != nil {
+			return rf.n, err
+		}
+	}
+	return rf.n, nil
+}
+
+// rangeFetcher downloads ranges of an upstream file in order, up to
+// pullMaxRanges a request.
+type rangeFetcher struct {
+	fh     *fileHandler
+	ctx    context.Context
+	name   string
+	ranges []httpRange // yet to copy
+	n      int64       // bytes downloaded
+
+	resp    *http.Response
+	parts   *multipart.Reader // nil for a single range
+	pending int               // ranges left in resp
+}
+
+// copyNext copies the next range to w.
+func (rf *rangeFetcher) copyNext(w io.Writer) error {
+	if rf.pending == 0 {
+		if err := rf.request(); err != nil {
+			return err
+		}
+	}
+	ra := rf.ranges[0]
+	var body io.Reader = rf.resp.Body
+	contentRange := rf.resp.Header.Get("Content-Range")
+	if rf.parts != nil {
+		part, err := rf.parts.NextPart()
+		if err != nil {
+			return err
+		}
+		body, contentRange = part, part.Header.Get("Content-Range")
+	}
+	if !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-%d/", ra.start, ra.start+ra.length-1)) {
+		return fmt.Errorf("got range %q, want %d-%d", contentRange, ra.start, ra.start+ra.length-1)
+	}
+	n, err := io.CopyN(w, &throttledReader{r: body, rate: rf.fh.pullSync.rate, start: time.Now()}, ra.length)
+	rf.n += n
+	if err != nil {
+		return err
+	}
+	rf.ranges = rf.ranges[1:]
+	rf.pending--
+	return nil
+}
+
+// request asks for the next ranges.
+func (rf *rangeFetcher) request() error {
+	rf.close()
+	ps := rf.fh.pullSync
+	batch := rf.ranges
+	if len(batch) > pullMaxRanges {
+		batch = batch[:pullMaxRanges]
+	}
+	specs := make([]string, len(batch))
+	for i, ra := range batch {
+		specs[i] = fmt.Sprintf("%d-%d", ra.start, ra.start+ra.length-1)
+	}
+	u := *ps.from
+	u.Path += rf.name
+	req, err := http.NewRequestWithContext(rf.ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes="+strings.Join(specs, ","))
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return err
+	}
+	rf.resp = resp
+	if resp.StatusCode != http.StatusPartialContent {
+		return errors.New(resp.Status)
+	}
+	if len(batch) > 1 {
+		mt, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err != nil || mt != "multipart/byteranges" {
+			return fmt.Errorf("multi-range response of type %q", resp.Header.Get("Content-Type"))
+		}
+		rf.parts = multipart.NewReader(resp.Body, params["boundary"])
+	}
+	rf.pending = len(batch)
+	return nil
+}
+
+func (rf *rangeFetcher) close() {
+	if rf.resp != nil {
+		rf.resp.Body.Close()
+		rf.resp, rf.parts, rf.pending = nil, nil, 0
+	}
+}
+
+// throttledReader reads from r at up to rate bytes per second on
+// average since start, no limit if rate is 0.
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if tr.rate > 0 {
+		if int64(len(p)) > tr.rate {
+			p = p[:tr.rate]
+		}
+		due := tr.start.Add(time.Duration(float64(tr.n) / float64(tr.rate) * float64(time.Second)))
+		time.Sleep(time.Until(due))
+	}
+	n, err := tr.r.Read(p)
+	tr.n += int64(n)
+	return n, err
+}
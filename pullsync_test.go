@@ -0,0 +1,130 @@
+package midserve
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPullTest returns a handler mirroring the Dir upstream into the Dir
+// local, without pulling on its own.
+func newPullTest(t *testing.T, upstream, local string, ps *pullSync) *fileHandler {
+	t.Helper()
+	srv := httptest.NewServer(newTestServer(t, Dir(upstream), func(o *Options) { o.API = true }))
+	t.Cleanup(srv.Close)
+	from, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh := newTestServer(t, Dir(local), nil).(*fileHandler)
+	ps.from, ps.client = from, srv.Client()
+	if ps.conflict == "" {
+		ps.conflict = "upstream"
+	}
+	fh.writeRoot, fh.pullSync = Dir(local), ps
+	fh.writeTemps = &tempFiles{dir: filepath.Join(local, tempDirName)}
+	return fh
+}
+
+func TestMatchBlocks(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	list, err := computeBlocks(bytes.NewReader(content), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list.Size = int64(len(content))
+
+	// Two bytes inserted before the third block shift the rest.
+	local := append(append(append([]byte{}, content[:2048]...), "xx"...), content[2048:]...)
+	offsets, err := matchBlocks(bytes.NewReader(local), list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, off := range offsets {
+		want := int64(i * 1024)
+		if i >= 2 {
+			want += 2
+		}
+		if i == len(offsets)-1 {
+			// Short, so never matched.
+			want = -1
+		}
+		if off != want {
+			t.Errorf("block %d at %d, want %d", i, off, want)
+		}
+	}
+}
+
+func TestPullDelta(t *testing.T) {
+	upstream, local := t.TempDir(), t.TempDir()
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	changed := append([]byte{}, content...)
+	copy(changed[300000:], "changed in the middle")
+	copy(changed[900000:], "and further on")
+	if err := os.WriteFile(filepath.Join(upstream, "f"), changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(local, "f"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Not taken for the same file by size and time.
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(upstream, "f"), later, later)
+	fh := newPullTest(t, upstream, local, &pullSync{})
+
+	st, err := fh.pull(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(local, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, changed) {
+		t.Fatal("pulled file differs from upstream")
+	}
+	if st.pulled != 1 || st.bytes <= 0 || st.bytes > 4*blockSize(int64(len(content))) {
+		t.Fatalf("pulled %d files, %d bytes, want the two changed blocks", st.pulled, st.bytes)
+	}
+}
+
+func TestPullDeleteGuards(t *testing.T) {
+	upstream, local := t.TempDir(), t.TempDir()
+	writeFiles(t, local, map[string]string{"a": "a", "b": "b", "c": "c"})
+
+	// An empty upstream deletes nothing.
+	fh := newPullTest(t, upstream, local, &pullSync{delete: true})
+	if _, err := fh.pull(context.Background()); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Fatalf("err = %v", err)
+	}
+
+	writeFiles(t, upstream, map[string]string{"a": "a"})
+	os.Chtimes(filepath.Join(upstream, "a"), time.Unix(0, 0), time.Unix(0, 0))
+	fh = newPullTest(t, upstream, local, &pullSync{delete: true, deleteMax: 1})
+	if _, err := fh.pull(context.Background()); err == nil || !strings.Contains(err.Error(), "pull-delete-max") {
+		t.Fatalf("err = %v", err)
+	}
+	for _, name := range []string{"b", "c"} {
+		if _, err := os.Stat(filepath.Join(local, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fh = newPullTest(t, upstream, local, &pullSync{delete: true, deleteMax: 2})
+	st, err := fh.pull(context.Background())
+	if err != nil || st.deleted != 2 {
+		t.Fatalf("deleted %d, %v", st.deleted, err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "b")); !os.IsNotExist(err) {
+		t.Fatalf("b not deleted: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+// Cache purging
+
+package midserve
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// purgeMaxMarks bounds the number of purged subtrees remembered. Older
+// marks are forgotten first, which only matters for cache files that
+// weren't used since.
+const purgeMaxMarks = 1024
+
+var errUnauthorized = errors.New("unauthorized")
+
+// purgeLog remembers when subtrees were purged, so that cache files
+// derived from files below them and written before are discarded on
+// their next use. Cache keys include the size and modification time of
+// the source, which doesn't catch content replaced by a copy keeping
+// both, as rsync -t does.
+type purgeLog struct {
+	mu    sync.Mutex
+	marks []purgeMark
+}
+
+type purgeMark struct {
+	prefix string
+	time   time.Time
+}
+
+// add records that prefix was purged at t.
+func (l *purgeLog) add(prefix string, t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Marks below prefix are superseded.
+	marks := l.marks[:0]
+	for _, m := range l.marks {
+		if !underPrefix(m.prefix, prefix) {
+			marks = append(marks, m)
+		}
+	}
+	l.marks = append(marks, purgeMark{prefix, t})
+	if len(l.marks) > purgeMaxMarks {
+		l.marks = l.marks[len(l.marks)-purgeMaxMarks:]
+	}
+}
+
+// since returns when name was last purged, or the zero time.
+func (l *purgeLog) since(name string) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var t time.Time
+	for _, m := range l.marks {
+		if underPrefix(name, m.prefix) && m.time.After(t) {
+			t = m.time
+		}
+	}
+	return t
+}
+
+// stalePurged reports whether the cache file or directory cached,
+// derived from name, was written before name was purged.
+func (fh *fileHandler) stalePurged(name, cached string) bool {
+	purged := fh.purges.since(name)
+	if purged.IsZero() {
+		return false
+	}
+	ci, err := os.Stat(cached)
+	return err == nil && ci.ModTime().Before(purged)
+}
+
+// dropPurged removes the cache file cached, derived from name, if it
+// was written before name was purged.
+func (fh *fileHandler) dropPurged(name, cached string) {
+	if fh.stalePurged(name, cached) {
+		os.RemoveAll(cached)
+	}
+}
+
+// purge invalidates everything cached about the files below prefix:
+// checksums and listings at once, and derived files as they are next
+// used. The
+// sitemap is regenerated in the background.
+func (fh *fileHandler) purge(prefix string) int {
+	fh.purges.add(prefix, time.Now())
+	n := fh.checksums.purge(prefix)
+	if fh.hot != nil {
+		fh.hot.purge(prefix)
+	}
+	if fh.listings != nil {
+		fh.listings.purge(prefix)
+	}
+	if sm := fh.sitemap; sm != nil {
+		sm.regenerate()
+	}
+	return n
+}
+
+// purge removes the checksums of the files below prefix and returns how
+// many there were.
+func (c *checksumCache) purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for name := range c.sums {
+		if underPrefix(name, prefix) {
+			delete(c.sums, name)
+			n++
+		}
+	}
+	return n
+}
+
+// servePurge implements POST /_admin/purge?path=, invalidating the
+// caches of the files below path, by default all of them.
+func (fh *fileHandler) servePurge(w http.ResponseWriter, r *http.Request) {
+	prefix := path.Clean("/" + r.URL.Query().Get("path"))
+	n := fh.purge(strings.TrimSuffix(prefix, "/"))
+	logf(r, "http: purged caches below %s", prefix)
+	writeJSON(w, r, struct {
+		Path      string `json:"path"`
+		Checksums int    `json:"checksums"`
+	}{prefix, n})
+}
@@ -0,0 +1,467 @@
+// QR codes for the terminal
+
+package midserve
+
+import (
+	"errors"
+	"strings"
+)
+
+// qrMaxVersion is the largest QR code version encoded, 57x57 modules
+// holding up to 271 bytes, plenty for a URL.
+const qrMaxVersion = 10
+
+var errQRTooLong = errors.New("qr: data too long")
+
+// Error correction level L, the smallest codes, by version: the error
+// correction codewords per block and the blocks.
+var (
+	qrECCPerBlock = [qrMaxVersion + 1]int{0, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18}
+	qrBlocks      = [qrMaxVersion + 1]int{0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4}
+)
+
+// A qrCode is a QR code as a square of modules, true for dark ones.
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // finder, timing, alignment, format and version
+}
+
+// newQRCode encodes data in byte mode with error correction level L,
+// in the smallest version that holds it, choosing the mask with the
+// least penalty as ISO/IEC 18004 describes.
+func newQRCode(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= qrMaxVersion; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*qrDataCodewords(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+
+	// Mode, count, data, terminator and padding.
+	var bits []bool
+	appendBits := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, v>>uint(i)&1 != 0)
+		}
+	}
+	appendBits(0x4, 4)
+	if version >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	capacity := 8 * qrDataCodewords(version)
+	for i := 0; i < 4 && len(bits) < capacity; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		appendBits(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, b := range bits {
+		if b {
+			codewords[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+
+	q := &qrCode{size: 4*version + 17}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, q.size)
+		q.function[i] = make([]bool, q.size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrInterleave(version, codewords))
+	best, least := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if p := q.penalty(); least < 0 || p < least {
+			best, least = mask, p
+		}
+		q.applyMask(mask) // undoes it
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q, nil
+}
+
+// qrRawModules returns the modules of a version left for data and
+// error correction codewords.
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+// qrDataCodewords returns the data codewords of a version.
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[version]*qrBlocks[version]
+}
+
+// qrAlignment returns the coordinates of the alignment patterns.
+func qrAlignment(version, size int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*4 + n*2 + 1) / (n*2 - 2) * 2
+	pos := make([]int, n)
+	pos[0] = 6
+	for i, p := n-1, size-7; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < q.size && y >= 0 && y < q.size {
+					d := qrMax(qrAbs(dx), qrAbs(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	pos := qrAlignment(version, q.size)
+	for i := range pos {
+		for j := range pos {
+			// Not over the finders.
+			if i == 0 && j == 0 || i == 0 && j == len(pos)-1 || i == len(pos)-1 && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(pos[i]+dx, pos[j]+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// Reserved until the mask is chosen.
+	q.drawFormatBits(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>uint(i)&1 != 0
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// drawFormatBits draws both copies of the error correction level, L,
+// and mask.
+func (q *qrCode) drawFormatBits(mask int) {
+	data := 1<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// qrInterleave splits the data codewords into blocks, appends the error
+// correction codewords of each and interleaves them.
+func qrInterleave(version int, data []byte) []byte {
+	blocks, eccLen := qrBlocks[version], qrECCPerBlock[version]
+	raw := qrRawModules(version) / 8
+	short := blocks - raw%blocks
+	shortLen := raw / blocks
+	divisor := qrRSDivisor(eccLen)
+	var all [][]byte
+	k := 0
+	for i := 0; i < blocks; i++ {
+		n := shortLen - eccLen
+		if i >= short {
+			n++
+		}
+		dat := append([]byte(nil), data[k:k+n]...)
+		k += n
+		ecc := qrRSRemainder(dat, divisor)
+		if i < short {
+			dat = append(dat, 0)
+		}
+		all = append(all, append(dat, ecc...))
+	}
+	var out []byte
+	for i := range all[0] {
+		for j, b := range all {
+			// Skip the padding of short blocks.
+			if i != shortLen-eccLen || j >= short {
+				out = append(out, b[i])
+			}
+		}
+	}
+	return out
+}
+
+// qrRSDivisor returns the Reed-Solomon generator polynomial of degree,
+// highest coefficient, always 1, dropped.
+func qrRSDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = qrMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMul(root, 0x02)
+	}
+	return result
+}
+
+func qrRSRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= qrMul(d, factor)
+		}
+	}
+	return result
+}
+
+// qrMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func qrMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// drawCodewords places data in the zigzag order of the non-function
+// modules, upwards and downwards in columns two wide from the right.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// The vertical timing pattern.
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i>>3]>>uint(7-i&7)&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the non-function modules selected by mask; applying
+// it twice undoes it.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to read: runs of five or more
+// modules of a color, 2x2 blocks of a color, patterns like the finders
+// and an imbalance of dark and light modules.
+func (q *qrCode) penalty() int {
+	p, dark := 0, 0
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 0
+			for x := 0; x < q.size; x++ {
+				if x > 0 && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					if run == 5 {
+						p += 3
+					} else if run > 5 {
+						p++
+					}
+				} else {
+					run = 1
+				}
+				// A finder-like pattern with four light modules on
+				// either side, the border counting as light.
+				if x+7 > q.size {
+					continue
+				}
+				match := true
+				for i, f := range finder {
+					if at(x+i, y, transpose) != f {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				lightBefore, lightAfter := true, true
+				for i := 1; i <= 4; i++ {
+					if x-i >= 0 && at(x-i, y, transpose) {
+						lightBefore = false
+					}
+					if x+6+i < q.size && at(x+6+i, y, transpose) {
+						lightAfter = false
+					}
+				}
+				if lightBefore || lightAfter {
+					p += 40
+				}
+			}
+		}
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			c := q.modules[y][x]
+			if c {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size && c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+				p += 3
+			}
+		}
+	}
+	total := q.size * q.size
+	k := (qrAbs(dark*20-total*10)+total-1)/total - 1
+	return p + k*10
+}
+
+// String renders the code for a terminal with light text on a dark
+// background, two rows of modules per line in half blocks, with a quiet
+// zone of two modules. With dark text on a light background, it shows
+// inverted, which most readers accept.
+func (q *qrCode) String() string {
+	const quiet = 2
+	dark := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x >= 0 && x < q.size && y >= 0 && y < q.size && q.modules[y][x]
+	}
+	var b strings.Builder
+	n := q.size + 2*quiet
+	for y := 0; y < n; y += 2 {
+		for x := 0; x < n; x++ {
+			// Blocks are drawn for light modules.
+			top, bottom := !dark(x, y), y+1 < n && !dark(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func qrAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,351 @@
+package midserve
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// The tables of ISO/IEC 18004 the decoder below checks codes against,
+// independently of the encoder: the format information of level L by
+// mask, the version information of versions 7 and up, the data
+// codewords of each block, their error correction codewords, and the
+// alignment pattern coordinates.
+var (
+	qrTestFormatL   = [8]int{0x77c4, 0x72f3, 0x7daa, 0x789d, 0x662f, 0x6318, 0x6c41, 0x6976}
+	qrTestVersion   = map[int]int{7: 0x07c94, 8: 0x085bc, 9: 0x09a99, 10: 0x0a4d3}
+	qrTestBlocks    = [][]int{1: {19}, {34}, {55}, {80}, {108}, {68, 68}, {78, 78}, {97, 97}, {116, 116}, {68, 68, 69, 69}}
+	qrTestECC       = []int{1: 7, 10, 15, 20, 26, 18, 20, 24, 30, 18}
+	qrTestAlignment = [][]int{2: {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50}}
+)
+
+func TestQRCode(t *testing.T) {
+	for _, tc := range []struct {
+		data    string
+		version int
+	}{
+		{"", 1},
+		{"http://a/", 1},
+		{strings.Repeat("x", 17), 1},
+		{strings.Repeat("x", 18), 2},
+		{"http://192.168.1.20:41235/0123456789abcdef0123456789abcdef/report.pdf", 4},
+		{strings.Repeat("y", 106), 5},
+		{strings.Repeat("z", 107), 6},
+		{strings.Repeat("v", 154), 7},
+		{strings.Repeat("w", 230), 9},
+		{strings.Repeat("u", 231), 10},
+		{strings.Repeat("\xff\x00", 135), 10},
+		{strings.Repeat("t", 271), 10},
+	} {
+		q, err := newQRCode([]byte(tc.data))
+		if err != nil {
+			t.Errorf("%d bytes: %v", len(tc.data), err)
+			continue
+		}
+		if want := 17 + 4*tc.version; q.size != want {
+			t.Errorf("%d bytes: size %d, want %d of version %d", len(tc.data), q.size, want, tc.version)
+			continue
+		}
+		got, problem := qrTestDecode(q.modules, tc.version)
+		if problem != "" {
+			t.Errorf("%d bytes: %s", len(tc.data), problem)
+		} else if !bytes.Equal(got, []byte(tc.data)) {
+			t.Errorf("%d bytes: decoded %q", len(tc.data), got)
+		}
+	}
+
+	if _, err := newQRCode(make([]byte, 272)); err != errQRTooLong {
+		t.Errorf("272 bytes: %v", err)
+	}
+}
+
+func TestQRCodeString(t *testing.T) {
+	q, err := newQRCode([]byte("http://a/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(q.String(), "\n"), "\n")
+	// 21 modules and the quiet zones, two rows a line.
+	if len(lines) != 13 {
+		t.Fatalf("%d lines", len(lines))
+	}
+	for _, l := range lines {
+		if n := len([]rune(l)); n != 25 {
+			t.Fatalf("line of %d columns", n)
+		}
+	}
+	// The top quiet zone, then the first two rows of the finder
+	// patterns, with light modules drawn.
+	finder := " ▄▄▄▄▄ "
+	if lines[0] != strings.Repeat("█", 25) || !strings.HasPrefix(lines[1], "██"+finder+"█") || !strings.HasSuffix(lines[1], "█"+finder+"██") {
+		t.Errorf("first lines %q, %q", lines[0], lines[1])
+	}
+}
+
+// qrTestDecode decodes the modules, dark where true, of a byte mode QR
+// code of version and level L, or returns what is wrong with them.
+func qrTestDecode(m [][]bool, version int) ([]byte, string) {
+	size := len(m)
+	dark := func(x, y int) bool { return m[y][x] }
+
+	// Finder patterns and separators.
+	for _, c := range [][2]int{{0, 0}, {size - 7, 0}, {0, size - 7}} {
+		for dy := -1; dy <= 7; dy++ {
+			for dx := -1; dx <= 7; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || y < 0 || x >= size || y >= size {
+					continue
+				}
+				d := qrMax(qrAbs(dx-3), qrAbs(dy-3))
+				if want := d != 2 && d != 4; dark(x, y) != want {
+					return nil, "bad finder pattern"
+				}
+			}
+		}
+	}
+	// Timing patterns.
+	for i := 8; i < size-8; i++ {
+		if dark(i, 6) != (i%2 == 0) || dark(6, i) != (i%2 == 0) {
+			return nil, "bad timing pattern"
+		}
+	}
+	if !dark(8, size-8) {
+		return nil, "dark module missing"
+	}
+
+	function := make([][]bool, size)
+	for y := range function {
+		function[y] = make([]bool, size)
+	}
+	mark := func(x0, y0, w, h int) {
+		for y := y0; y < y0+h; y++ {
+			for x := x0; x < x0+w; x++ {
+				function[y][x] = true
+			}
+		}
+	}
+	mark(0, 0, 9, 9)
+	mark(size-8, 0, 8, 9)
+	mark(0, size-8, 9, 8)
+	mark(0, 6, size, 1)
+	mark(6, 0, 1, size)
+	if pos := qrTestAlignment[version]; pos != nil {
+		last := len(pos) - 1
+		for i, cy := range pos {
+			for j, cx := range pos {
+				if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+					continue
+				}
+				for dy := -2; dy <= 2; dy++ {
+					for dx := -2; dx <= 2; dx++ {
+						d := qrMax(qrAbs(dx), qrAbs(dy))
+						if dark(cx+dx, cy+dy) != (d != 1) {
+							return nil, "bad alignment pattern"
+						}
+					}
+				}
+				mark(cx-2, cy-2, 5, 5)
+			}
+		}
+	}
+	if version >= 7 {
+		mark(size-11, 0, 3, 6)
+		mark(0, size-11, 6, 3)
+		var a, b int
+		for i := 0; i < 18; i++ {
+			if dark(size-11+i%3, i/3) {
+				a |= 1 << i
+			}
+			if dark(i/3, size-11+i%3) {
+				b |= 1 << i
+			}
+		}
+		if want := qrTestVersion[version]; a != want || b != want {
+			return nil, "bad version information"
+		}
+	}
+
+	// Both copies of the format information.
+	var f1, f2 int
+	bit := func(f *int, x, y, i int) {
+		if dark(x, y) {
+			*f |= 1 << i
+		}
+	}
+	for i := 0; i <= 5; i++ {
+		bit(&f1, 8, i, i)
+	}
+	bit(&f1, 8, 7, 6)
+	bit(&f1, 8, 8, 7)
+	bit(&f1, 7, 8, 8)
+	for i := 9; i < 15; i++ {
+		bit(&f1, 14-i, 8, i)
+	}
+	for i := 0; i < 8; i++ {
+		bit(&f2, size-1-i, 8, i)
+	}
+	for i := 8; i < 15; i++ {
+		bit(&f2, 8, size-15+i, i)
+	}
+	mask := -1
+	for i, f := range qrTestFormatL {
+		if f1 == f && f2 == f {
+			mask = i
+		}
+	}
+	if mask < 0 {
+		return nil, "bad format information"
+	}
+	masked := func(x, y int) bool {
+		switch mask {
+		case 0:
+			return (x+y)%2 == 0
+		case 1:
+			return y%2 == 0
+		case 2:
+			return x%3 == 0
+		case 3:
+			return (x+y)%3 == 0
+		case 4:
+			return (y/2+x/3)%2 == 0
+		case 5:
+			return x*y%2+x*y%3 == 0
+		case 6:
+			return (x*y%2+x*y%3)%2 == 0
+		}
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+
+	// The codewords, in pairs of columns from the right, alternately
+	// upwards and downwards, skipping the vertical timing pattern.
+	var bits []bool
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for v := 0; v < size; v++ {
+			y := v
+			if upward {
+				y = size - 1 - v
+			}
+			for x := right; x >= right-1; x-- {
+				if !function[y][x] {
+					bits = append(bits, dark(x, y) != masked(x, y))
+				}
+			}
+		}
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i := range codewords {
+		for j := 0; j < 8; j++ {
+			if bits[8*i+j] {
+				codewords[i] |= 0x80 >> j
+			}
+		}
+	}
+
+	// Split into blocks, checking their error correction codewords.
+	blocks := qrTestBlocks[version]
+	ecc := qrTestECC[version]
+	total := 0
+	for _, n := range blocks {
+		total += n + ecc
+	}
+	if total != len(codewords) {
+		return nil, "wrong number of codewords"
+	}
+	split := make([][]byte, len(blocks))
+	k := 0
+	for i := 0; i < blocks[len(blocks)-1]; i++ {
+		for b, n := range blocks {
+			if i < n {
+				split[b] = append(split[b], codewords[k])
+				k++
+			}
+		}
+	}
+	for i := 0; i < ecc; i++ {
+		for b := range blocks {
+			split[b] = append(split[b], codewords[k])
+			k++
+		}
+	}
+	var data []byte
+	for b, n := range blocks {
+		// The codewords, as a polynomial, are divisible by the
+		// generator, whose roots are 2^0 to 2^(ecc-1).
+		for r := 0; r < ecc; r++ {
+			x := byte(1)
+			for i := 0; i < r; i++ {
+				x = qrTestMul(x, 2)
+			}
+			var s byte
+			for _, c := range split[b] {
+				s = qrTestMul(s, x) ^ c
+			}
+			if s != 0 {
+				return nil, "error correction codewords don't match"
+			}
+		}
+		data = append(data, split[b][:n]...)
+	}
+
+	// Mode, count, bytes, terminator and padding.
+	pos := 0
+	read := func(n int) int {
+		v := 0
+		for i := 0; i < n; i++ {
+			v = v<<1 | int(data[pos/8]>>(7-pos%8)&1)
+			pos++
+		}
+		return v
+	}
+	if read(4) != 0x4 {
+		return nil, "not byte mode"
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	n := read(countBits)
+	if pos+8*n > 8*len(data) {
+		return nil, "count too large"
+	}
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = byte(read(8))
+	}
+	for i := 0; i < 4 && pos < 8*len(data); i++ {
+		if read(1) != 0 {
+			return nil, "bad terminator"
+		}
+	}
+	for pos%8 != 0 {
+		if read(1) != 0 {
+			return nil, "bad padding bits"
+		}
+	}
+	for i, c := range data[pos/8:] {
+		if want := [2]byte{0xec, 0x11}[i%2]; c != want {
+			return nil, "bad padding codewords"
+		}
+	}
+	return out, ""
+}
+
+// qrTestMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func qrTestMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		hi := z&0x80 != 0
+		z <<= 1
+		if hi {
+			z ^= 0x1d
+		}
+		if y>>i&1 != 0 {
+			z ^= x
+		}
+	}
+	return z
+}
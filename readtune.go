@@ -0,0 +1,106 @@
+// Read buffer and page cache tuning for large files
+
+package midserve
+
+import (
+	"io"
+	"net/http"
+	"os"
+)
+
+// A contentCopier copies n bytes of itself to w in its own way;
+// serveContent uses it instead of io.CopyN.
+type contentCopier interface {
+	copyN(w io.Writer, n int64) (int64, error)
+}
+
+// copyFileN copies n bytes of f to w, letting f copy itself if it is a
+// contentCopier. An *os.File reaches w's io.ReaderFrom as io.CopyN's
+// io.LimitedReader, which net/http sends with sendfile.
+func copyFileN(w io.Writer, f io.Reader, n int64) (int64, error) {
+	if cc, ok := f.(contentCopier); ok {
+		return cc.copyN(w, n)
+	}
+	return io.CopyN(w, f, n)
+}
+
+// tunedFile reads a file with a buffer of bufSize bytes and, with
+// dropCache, advises the kernel to read it sequentially and to drop the
+// pages already sent, so that serving a huge file doesn't evict the
+// page cache of other work on the machine.
+type tunedFile struct {
+	http.File
+	bufSize   int
+	dropCache bool
+	os        *os.File // underlying file for advice, nil if none
+}
+
+// tuneFile wraps f of size bytes according to the handler's settings,
+// or returns it unchanged if there is nothing to tune.
+func (fh *fileHandler) tuneFile(f http.File, size int64) http.File {
+	drop := fh.dropPageCache > 0 && size >= fh.dropPageCache
+	if fh.readBuffer <= 0 && !drop {
+		return f
+	}
+	tf := &tunedFile{File: f, bufSize: fh.readBuffer, dropCache: drop, os: unwrapOSFile(f)}
+	if tf.bufSize <= 0 {
+		tf.bufSize = 32 << 10
+	}
+	if drop && tf.os != nil {
+		fadviseSequential(tf.os)
+	}
+	return tf
+}
+
+// unwrapOSFile returns the *os.File behind f, if any.
+func unwrapOSFile(f http.File) *os.File {
+	for {
+		switch v := f.(type) {
+		case *os.File:
+			return v
+		case *contextFile:
+			f = v.File
+		case *contextDirFile:
+			f = v.contextFile.File
+		case *timeoutFile:
+			f = v.File
+		case *timeoutDirFile:
+			f = v.timeoutFile.File
+		default:
+			return nil
+		}
+	}
+}
+
+// writerOnly hides the io.ReaderFrom of a ResponseWriter, so that
+// io.CopyBuffer uses the given buffer.
+type writerOnly struct {
+	io.Writer
+}
+
+func (f *tunedFile) copyN(w io.Writer, n int64) (int64, error) {
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, f.bufSize)
+	var written int64
+	for written < n {
+		chunk := int64(len(buf)) * 16
+		if chunk > n-written {
+			chunk = n - written
+		}
+		c, err := io.CopyBuffer(writerOnly{w}, io.LimitReader(f.File, chunk), buf)
+		if f.dropCache && f.os != nil && c > 0 {
+			fadviseDontNeed(f.os, start+written, c)
+		}
+		written += c
+		if err != nil {
+			return written, err
+		}
+		if c < chunk {
+			return written, io.EOF
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,78 @@
+package midserve
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchFileSize is the size of the file the read paths are measured
+// with, large enough for the page cache advice to matter.
+const benchFileSize = 64 << 20
+
+func benchFile(b *testing.B) string {
+	b.Helper()
+	name := filepath.Join(b.TempDir(), "large")
+	f, err := os.Create(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	chunk := make([]byte, 1<<20)
+	for i := range chunk {
+		chunk[i] = byte(i)
+	}
+	for n := 0; n < benchFileSize; n += len(chunk) {
+		if _, err := f.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return name
+}
+
+// BenchmarkCopyFile copies a large file to a writer without
+// io.ReaderFrom, as for TLS connections, which can't use sendfile:
+// untuned with io.CopyN's buffer, with -read-buffer, and with
+// -drop-page-cache. As that drops the pages sent, each copy with it
+// reads the file from disk again: the price of leaving the page cache
+// to other work.
+func BenchmarkCopyFile(b *testing.B) {
+	name := benchFile(b)
+	for _, bc := range []struct {
+		name      string
+		bufSize   int
+		dropCache bool
+	}{
+		{"untuned", 0, false},
+		{"buffer=32k", 32 << 10, false},
+		{"buffer=256k", 256 << 10, false},
+		{"buffer=1m", 1 << 20, false},
+		{"buffer=256k/drop-cache", 256 << 10, true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			fh := &fileHandler{readBuffer: bc.bufSize}
+			if bc.dropCache {
+				fh.dropPageCache = 1
+			}
+			f, err := os.Open(name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.Close()
+			tf := fh.tuneFile(f, benchFileSize)
+			b.SetBytes(benchFileSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := tf.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := copyFileN(writerOnly{io.Discard}, tf, benchFileSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Canonical host and HTTPS redirects
+
+package midserve
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// redirectTo redirects r to the same path and query on scheme://host,
+// permanently. Methods other than GET and HEAD get 308 so that clients
+// repeat them unchanged.
+func redirectTo(w http.ResponseWriter, r *http.Request, scheme, host string) {
+	u := *r.URL
+	u.Scheme, u.Host = scheme, host
+	code := http.StatusMovedPermanently
+	if r.Method != "GET" && r.Method != "HEAD" {
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, u.String(), code)
+}
+
+// splitHost returns the host name and port of a Host header, the port
+// being empty if there is none.
+func splitHost(hostport string) (host, port string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport, ""
+	}
+	return host, port
+}
+
+// CanonicalHost returns a handler redirecting requests for any other
+// host name than host, such as www.example.com for example.com, to
+// host, and passing the others to h.
+func CanonicalHost(host string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, port := splitHost(r.Host)
+		if strings.EqualFold(name, host) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		target := host
+		if port != "" {
+			target = net.JoinHostPort(host, port)
+		}
+		redirectTo(w, r, scheme, target)
+	})
+}
+
+// HTTPSRedirect returns the handler of a plain HTTP listener redirecting
+// everything to HTTPS on tlsPort. The host is the requested one unless
+// host is given.
+func HTTPSRedirect(host, tlsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := host
+		if target == "" {
+			target, _ = splitHost(r.Host)
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			target = net.JoinHostPort(target, tlsPort)
+		}
+		redirectTo(w, r, "https", target)
+	})
+}
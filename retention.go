@@ -0,0 +1,143 @@
+// Retention of files in directories that only grow
+
+package midserve
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A RetentionRule deletes old entries of the directory Prefix: files,
+// and subdirectories as a whole, such as those of CI builds. An entry is
+// deleted if it is older than MaxAge, beyond the newest Keep, or if it
+// and the entries newer than it exceed MaxSize bytes, whichever of them
+// are set. The age of a subdirectory is that of the newest file in it.
+type RetentionRule struct {
+	Prefix  string // '/'-separated directory
+	MaxAge  time.Duration
+	Keep    int
+	MaxSize int64
+}
+
+// retention applies RetentionRules to a Dir every interval, or only
+// logs what it would delete if dryRun is set.
+type retention struct {
+	root     Dir
+	rules    []RetentionRule
+	interval time.Duration
+	dryRun   bool
+}
+
+// retentionEntry is an entry of a directory under a RetentionRule.
+type retentionEntry struct {
+	name    string
+	modTime time.Time
+	size    int64
+}
+
+// runRetention applies the retention rules every interval.
+func (fh *fileHandler) runRetention() {
+	rt := fh.retention
+	for {
+		start := time.Now()
+		deleted, freed := 0, int64(0)
+		for _, rule := range rt.rules {
+			n, size, err := fh.applyRetention(context.Background(), rule, start)
+			if err != nil {
+				log.Printf("retention: %s: %v", rule.Prefix, err)
+			}
+			deleted += n
+			freed += size
+		}
+		verb := "deleted"
+		if rt.dryRun {
+			verb = "would delete"
+		}
+		log.Printf("retention: %s %d entries (%d bytes) in %v",
+			verb, deleted, freed, time.Since(start).Round(time.Millisecond))
+		time.Sleep(rt.interval)
+	}
+}
+
+// applyRetention deletes the entries rule expires at now and returns
+// how many there were and their size.
+func (fh *fileHandler) applyRetention(ctx context.Context, rule RetentionRule, now time.Time) (int, int64, error) {
+	rt := fh.retention
+	f, err := openContext(ctx, rt.root, rule.Prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	list, err := readdirBatched(ctx, f)
+	f.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var entries []retentionEntry
+	for _, fi := range list {
+		name := path.Join(rule.Prefix, fi.Name())
+		if fh.denied(name) || (fi.IsDir() && fh.denied(name+"/")) {
+			continue
+		}
+		e := retentionEntry{name: name, modTime: fi.ModTime(), size: fi.Size()}
+		if fi.IsDir() {
+			e.size = 0
+			err := walkFS(ctx, rt.root, name, fh.excludes, func(_ string, fi fs.FileInfo) error {
+				if fi.Mode().IsRegular() {
+					e.size += fi.Size()
+					if fi.ModTime().After(e.modTime) {
+						e.modTime = fi.ModTime()
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.Printf("retention: %s: %v", name, err)
+				continue
+			}
+		} else if !fi.Mode().IsRegular() {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.After(entries[j].modTime) })
+
+	deleted, freed := 0, int64(0)
+	var total int64
+	for i, e := range entries {
+		total += e.size
+		var why []string
+		if rule.MaxAge > 0 && now.Sub(e.modTime) > rule.MaxAge {
+			why = append(why, fmt.Sprintf("older than %v", rule.MaxAge))
+		}
+		if rule.Keep > 0 && i >= rule.Keep {
+			why = append(why, fmt.Sprintf("beyond the newest %d", rule.Keep))
+		}
+		if rule.MaxSize > 0 && total > rule.MaxSize {
+			why = append(why, fmt.Sprintf("beyond %d bytes", rule.MaxSize))
+		}
+		if len(why) == 0 {
+			continue
+		}
+		if rt.dryRun {
+			log.Printf("retention: would delete %s (%s)", e.name, strings.Join(why, ", "))
+		} else if err := os.RemoveAll(rt.root.osPath(e.name)); err != nil {
+			log.Printf("retention: %v", err)
+			continue
+		} else {
+			log.Printf("retention: deleted %s (%s)", e.name, strings.Join(why, ", "))
+		}
+		deleted++
+		freed += e.size
+		// Deleted entries no longer count against the size.
+		total -= e.size
+	}
+	return deleted, freed, nil
+}
@@ -0,0 +1,148 @@
+// Verified segments for parallel downloads
+
+package midserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// segmentMaxParts bounds the parts= of /_api/segments.
+	segmentMaxParts = 64
+	// segmentMinSize is the smallest segment worth a connection of its
+	// own; smaller files get fewer parts than asked for.
+	segmentMinSize = 1 << 20
+	// segmentAlign is what segment boundaries are a multiple of.
+	segmentAlign = 64 << 10
+)
+
+// segmentList is the reply of /_api/segments. ETag and LastModified
+// are those responses for the file carry, for If-Range.
+type segmentList struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified"`
+	Segments     []segment `json:"segments"`
+}
+
+// segment is the byte range of a file from Start to End inclusive, as
+// in a Range header, and the SHA-256 of its content.
+type segment struct {
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	Range  string `json:"range"`
+	SHA256 string `json:"sha256"`
+}
+
+// segmentSize returns the size of the segments splitting a file of size
+// bytes into about parts.
+func segmentSize(size int64, parts int) int64 {
+	n := (size + int64(parts) - 1) / int64(parts)
+	if n < segmentMinSize {
+		n = segmentMinSize
+	}
+	return (n + segmentAlign - 1) / segmentAlign * segmentAlign
+}
+
+// serveSegments implements /_api/segments?path=&parts=, splitting a
+// file into up to parts byte ranges, 4 by default, with the checksum of
+// each and of the whole, so that download managers can fetch the ranges
+// over parallel connections, verify each as it arrives, retry only the
+// bad ones and check the result.
+func (fh *fileHandler) serveSegments(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("path")
+	if name == "" {
+		apiError(w, errors.New("parameter path is required"), http.StatusBadRequest)
+		return
+	}
+	parts := 4
+	if s := q.Get("parts"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > segmentMaxParts {
+			apiError(w, fmt.Errorf("parts must be between 1 and %d", segmentMaxParts), http.StatusBadRequest)
+			return
+		}
+		parts = n
+	}
+	f, d, err := fh.openRegular(r, name)
+	if err != nil {
+		apiError(w, err, 0)
+		return
+	}
+	defer f.Close()
+	name = path.Clean("/" + name)
+	size := segmentSize(d.Size(), parts)
+
+	key := sha256.Sum256([]byte(fmt.Sprintf("segments\x00%s\x00%d\x00%d\x00%d\x00%s", name, d.ModTime().UnixNano(), d.Size(), size, fh.etagPolicy)))
+	cached := filepath.Join(fh.cacheDir, "segments", hex.EncodeToString(key[:]))
+	fh.dropPurged(name, cached)
+	cf, err := os.Open(cached)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fh.produce(r.Context(), cached, func(w io.Writer) error {
+			list, err := computeSegments(f, size)
+			if err != nil {
+				return err
+			}
+			list.Path, list.Size = name, d.Size()
+			// Strong tags come from the checksum, known by now.
+			fh.checksums.put(name, d.Size(), d.ModTime(), list.SHA256)
+			list.ETag = fh.etag(r.Context(), name, d)
+			list.LastModified = d.ModTime().UTC().Format(http.TimeFormat)
+			return json.NewEncoder(w).Encode(list)
+		})
+		if err == nil {
+			cf, err = os.Open(cached)
+		}
+	}
+	if err != nil {
+		logf(r, "http: error computing segments of %s: %v", name, err)
+		apiError(w, err, 0)
+		return
+	}
+	defer cf.Close()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fh.serveCached(w, r, name, d, cf)
+}
+
+func computeSegments(r io.Reader, size int64) (*segmentList, error) {
+	list := &segmentList{Segments: []segment{}}
+	whole := sha256.New()
+	var start int64
+	for {
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(whole, h), io.LimitReader(r, size))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		end := start + n - 1
+		list.Segments = append(list.Segments, segment{
+			Start:  start,
+			End:    end,
+			Range:  fmt.Sprintf("bytes=%d-%d", start, end),
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+		start += n
+		if n < size {
+			break
+		}
+	}
+	list.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return list, nil
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package midserve
+
+import "errors"
+
+var errNoService = errors.New("services are only supported on Windows, use your init system")
+
+func installService(name string, args []string) error { return errNoService }
+
+func uninstallService(name string) error { return errNoService }
+
+func runAsService(name string, args []string) error { return errNoService }
@@ -0,0 +1,197 @@
+//go:build windows
+// +build windows
+
+// Windows service integration using the service control manager API of
+// advapi32 directly, to stay free of dependencies.
+
+package midserve
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procOpenSCManagerW               = advapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW               = advapi32.NewProc("CreateServiceW")
+	procOpenServiceW                 = advapi32.NewProc("OpenServiceW")
+	procDeleteService                = advapi32.NewProc("DeleteService")
+	procCloseServiceHandle           = advapi32.NewProc("CloseServiceHandle")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	scManagerAllAccess     = 0xF003F
+	serviceAllAccess       = 0xF01FF
+	accessDelete           = 0x10000
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceControlStop     = 1
+	serviceControlShutdown = 5
+	serviceAcceptStop      = 1
+	serviceAcceptShutdown  = 4
+)
+
+// serviceStatus is SERVICE_STATUS.
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// serviceTableEntry is SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+func call(p *syscall.LazyProc, args ...uintptr) (uintptr, error) {
+	r, _, err := p.Call(args...)
+	if r == 0 {
+		return 0, err
+	}
+	return r, nil
+}
+
+func openSCManager() (uintptr, error) {
+	return call(procOpenSCManagerW, 0, 0, scManagerAllAccess)
+}
+
+func installService(name string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.Abs(exe)
+	if err != nil {
+		return err
+	}
+	cmd := []string{syscall.EscapeArg(exe), "service", "-name", syscall.EscapeArg(name), "run"}
+	for _, a := range args {
+		cmd = append(cmd, syscall.EscapeArg(a))
+	}
+
+	scm, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+	svc, err := call(procCreateServiceW, scm,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name))),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name+" file server"))),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(strings.Join(cmd, " ")))),
+		0, 0, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	procCloseServiceHandle.Call(svc)
+	return nil
+}
+
+func uninstallService(name string) error {
+	scm, err := openSCManager()
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+	svc, err := call(procOpenServiceW, scm, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name))), accessDelete)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(svc)
+	_, err = call(procDeleteService, svc)
+	return err
+}
+
+// The service control manager calls back into the process, the state
+// of the one service it runs is kept here.
+var service struct {
+	name   string
+	args   []string
+	handle uintptr
+	cancel context.CancelFunc
+	err    error
+}
+
+func setServiceStatus(state, accepts uint32) {
+	st := serviceStatus{
+		serviceType:      serviceWin32OwnProcess,
+		currentState:     state,
+		controlsAccepted: accepts,
+	}
+	if state == serviceStopped && service.err != nil {
+		st.win32ExitCode = 1
+	}
+	procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(&st)))
+}
+
+func serviceHandler(ctrl, eventType uint32, eventData, userData uintptr) uintptr {
+	switch ctrl {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceStatus(serviceStopPending, 0)
+		service.cancel()
+	}
+	return 0
+}
+
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service.cancel = cancel
+	h, err := call(procRegisterServiceCtrlHandlerEx,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(service.name))),
+		syscall.NewCallback(serviceHandler), 0)
+	if err != nil {
+		service.err = err
+		return 0
+	}
+	service.handle = h
+	setServiceStatus(serviceStartPending, 0)
+
+	cfg, err := parseConfig(serveCommand.flagSet(), service.args)
+	if err != nil {
+		service.err = err
+		setServiceStatus(serviceStopped, 0)
+		return 0
+	}
+	cfg.Quiet = true
+	setServiceStatus(serviceRunning, serviceAcceptStop|serviceAcceptShutdown)
+	service.err = serve(ctx, cfg)
+	setServiceStatus(serviceStopped, 0)
+	return 0
+}
+
+func runAsService(name string, args []string) error {
+	service.name, service.args = name, args
+	table := []serviceTableEntry{
+		{syscall.StringToUTF16Ptr(name), syscall.NewCallback(serviceMain)},
+		{nil, 0},
+	}
+	if _, err := call(procStartServiceCtrlDispatcherW, uintptr(unsafe.Pointer(&table[0]))); err != nil {
+		if errors.Is(err, syscall.Errno(1063)) { // ERROR_FAILED_SERVICE_CONTROLLER_CONNECT
+			return errors.New("not started by the service control manager, use serve")
+		}
+		return err
+	}
+	return service.err
+}
@@ -0,0 +1,277 @@
+// Browser sessions
+
+package midserve
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	loginPath  = "/_login"
+	logoutPath = "/_logout"
+	whoamiPath = "/_whoami"
+
+	sessionCookie = "midserve_session"
+	// csrfCookie holds the token state-changing requests in a session
+	// must repeat in the X-CSRF-Token header. Scripts of other sites
+	// can't read it.
+	csrfCookie = "midserve_csrf"
+
+	// sessionMaxCount bounds the sessions kept. Logging in beyond it
+	// ends the session expiring first.
+	sessionMaxCount = 100000
+)
+
+var (
+	errCSRF        = errors.New("missing or invalid X-CSRF-Token")
+	errLoginOrigin = errors.New("login from another origin")
+)
+
+// A session is a browser signed in with a principal's token.
+type session struct {
+	principal *Principal
+	csrf      string
+	expires   time.Time
+}
+
+// sessionStore keeps the sessions in memory, by the hash of their ID;
+// they end with the process.
+type sessionStore struct {
+	ttl time.Duration
+
+	mu sync.Mutex
+	m  map[[sha256.Size]byte]*session
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{ttl: ttl, m: make(map[[sha256.Size]byte]*session)}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// create starts a session of p, returning its ID.
+func (ss *sessionStore) create(p *Principal) (string, *session) {
+	id := randomHex(32)
+	s := &session{principal: p, csrf: randomHex(16), expires: time.Now().Add(ss.ttl)}
+	now := time.Now()
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var first [sha256.Size]byte
+	var firstExpires time.Time
+	for k, o := range ss.m {
+		if now.After(o.expires) {
+			delete(ss.m, k)
+		} else if firstExpires.IsZero() || o.expires.Before(firstExpires) {
+			first, firstExpires = k, o.expires
+		}
+	}
+	if len(ss.m) >= sessionMaxCount {
+		delete(ss.m, first)
+	}
+	ss.m[sha256.Sum256([]byte(id))] = s
+	return id, s
+}
+
+// get returns the unexpired session id, nil if there is none.
+func (ss *sessionStore) get(id string) *session {
+	key := sha256.Sum256([]byte(id))
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.m[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(s.expires) {
+		delete(ss.m, key)
+		return nil
+	}
+	return s
+}
+
+func (ss *sessionStore) end(id string) {
+	ss.mu.Lock()
+	delete(ss.m, sha256.Sum256([]byte(id)))
+	ss.mu.Unlock()
+}
+
+type sessionKey struct{}
+
+// sessionOf returns the session r was made in, nil if it has none.
+func sessionOf(r *http.Request) *session {
+	s, _ := r.Context().Value(sessionKey{}).(*session)
+	return s
+}
+
+// withSession returns r with the principal of its session cookie, if
+// any. Requests in a session that may change state, as changesState
+// tells, must carry its CSRF token, otherwise withSession replies with
+// 403 Forbidden and returns nil.
+// Signing in and out are exempt; the worst another site can do with
+// them is sign the browser out.
+func (fh *fileHandler) withSession(w http.ResponseWriter, r *http.Request, name string) *http.Request {
+	if fh.sessions == nil || principal(r) != nil || bearerToken(r) != "" {
+		return r
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return r
+	}
+	s := fh.sessions.get(c.Value)
+	if s == nil {
+		return r
+	}
+	if fh.changesState(r, name) && name != loginPath && name != logoutPath &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("X-CSRF-Token")), []byte(s.csrf)) != 1 {
+		apiError(w, errCSRF, http.StatusForbidden)
+		fh.publish(r, EventDenied, name, http.StatusForbidden, -1, nil)
+		return nil
+	}
+	ctx := context.WithValue(r.Context(), principalKey{}, s.principal)
+	return r.WithContext(context.WithValue(ctx, sessionKey{}, s))
+}
+
+// setSessionCookies sets the cookies of the session id, or deletes them
+// if id is empty.
+func setSessionCookies(w http.ResponseWriter, r *http.Request, id string, s *session) {
+	secure := r.TLS != nil
+	c := &http.Cookie{Name: sessionCookie, Value: id, Path: "/", HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode}
+	csrf := &http.Cookie{Name: csrfCookie, Path: "/", Secure: secure, SameSite: http.SameSiteStrictMode}
+	if s != nil {
+		c.Expires, csrf.Expires = s.expires, s.expires
+		csrf.Value = s.csrf
+	} else {
+		c.MaxAge, csrf.MaxAge = -1, -1
+	}
+	http.SetCookie(w, c)
+	http.SetCookie(w, csrf)
+}
+
+// sameOrigin reports whether r was sent by a page of this site, as far
+// as the browser tells.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		return r.Header.Get("Sec-Fetch-Site") == "" || r.Header.Get("Sec-Fetch-Site") == "same-origin"
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://") == r.Host
+}
+
+// localNext returns the path to go to after signing in or out, the
+// next parameter if it is a path on this site, or the root.
+func localNext(r *http.Request) string {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// serveLogin implements /_login: GET shows a form asking for a token,
+// POST with the token starts a session and goes to next.
+func (fh *fileHandler) serveLogin(w http.ResponseWriter, r *http.Request) {
+	lang, msgs := fh.language(r)
+	failed := false
+	if r.Method == "POST" {
+		if !sameOrigin(r) {
+			apiError(w, errLoginOrigin, http.StatusForbidden)
+			fh.publish(r, EventDenied, loginPath, http.StatusForbidden, -1, nil)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, defaultMaxBody)
+		if p := fh.perms.lookup(r.PostFormValue("token")); p != nil {
+			id, s := fh.sessions.create(p)
+			setSessionCookies(w, r, id, s)
+			logf(r, "session: %s signed in from %s", p.Name, clientAddr(r))
+			http.Redirect(w, r, localNext(r), http.StatusSeeOther)
+			return
+		}
+		fh.publish(r, EventDenied, loginPath, http.StatusUnauthorized, -1, errUnknownToken)
+		failed = true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Language", lang)
+	if failed {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	title := htmlReplacer.Replace(msgs.t("Sign in"))
+	fmt.Fprintf(w, "<!doctype html>\n<html lang=\"%s\">\n<head>\n<meta charset=\"utf-8\">\n<meta name=\"viewport\" content=\"width=device-width\">\n<meta name=\"robots\" content=\"noindex\">\n<title>%s</title>\n", lang, title)
+	fh.writeListingStyle(w)
+	fmt.Fprintf(w, "</head>\n<body>\n<main>\n<h1>%s</h1>\n", title)
+	if failed {
+		fmt.Fprintf(w, "<p role=\"alert\">%s</p>\n", htmlReplacer.Replace(msgs.t("Invalid token.")))
+	}
+	fmt.Fprintf(w, "<form method=\"post\" action=\"%s\"><input type=\"hidden\" name=\"next\" value=\"%s\"><label>%s <input type=\"password\" name=\"token\" autocomplete=\"current-password\" required autofocus></label> <button>%s</button></form>\n",
+		loginPath, htmlReplacer.Replace(localNext(r)), htmlReplacer.Replace(msgs.t("Token")), title)
+	io.WriteString(w, "</main>\n</body>\n</html>\n")
+}
+
+// serveLogout implements POST /_logout, ending the session and going to
+// next, or replying with 204 No Content to scripts.
+func (fh *fileHandler) serveLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		fh.sessions.end(c.Value)
+	}
+	setSessionCookies(w, r, "", nil)
+	if r.Header.Get("X-CSRF-Token") != "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, localNext(r), http.StatusSeeOther)
+}
+
+// serveWhoami implements GET /_whoami, the principal of the request
+// and how it was authenticated.
+func (fh *fileHandler) serveWhoami(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	var who struct {
+		Principal string     `json:"principal,omitempty"`
+		Via       string     `json:"via"`
+		Expires   *time.Time `json:"expires,omitempty"`
+	}
+	who.Principal, who.Via = principalName(r), "anonymous"
+	if s := sessionOf(r); s != nil {
+		who.Via = "session"
+		expires := s.expires.UTC()
+		who.Expires = &expires
+	} else if who.Principal != "" {
+		who.Via = "token"
+	}
+	writeJSON(w, r, who)
+}
+
+// sessionBarScript shows who is signed in above a listing, with a
+// button to sign out, or a link to sign in.
+const sessionBarScript = `<script>(function(){
+var t={in:"%s",out:"%s",as:"%s"},pre=document.querySelector("pre"),p=document.createElement("p");
+fetch("` + whoamiPath + `").then(function(r){return r.json()}).then(function(who){
+if(who.via==="session"){p.textContent=t.as.replace("%%s",who.principal)+" ";
+var f=document.createElement("form"),b=document.createElement("button");f.method="post";f.action="` + logoutPath + `";f.style.display="inline";
+b.textContent=t.out;f.appendChild(b);p.appendChild(f)}
+else if(who.via==="anonymous"){var a=document.createElement("a");a.href="` + loginPath + `?next="+encodeURIComponent(location.pathname);
+a.textContent=t.in;p.appendChild(a)}else return;
+pre.parentNode.insertBefore(p,pre)})})();</script>
+`
+
+// writeSessionBar writes the script showing the session above a
+// listing.
+func writeSessionBar(w io.Writer, msgs messages) {
+	js := func(s string) string { return template.JSEscapeString(msgs.t(s)) }
+	fmt.Fprintf(w, sessionBarScript, js("sign in"), js("sign out"), js("Signed in as %s."))
+}
@@ -0,0 +1,88 @@
+package midserve
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestSessionCSRF(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a", "b.txt": "b"})
+	h := newTestServer(t, Dir(dir), func(o *Options) {
+		o.API = true
+		o.Write = true
+		o.MethodOverride = true
+		o.Sessions = true
+		o.Principals = []Principal{{Name: "alice", Token: "a", Grants: []Grant{{"/", RoleManage}}}}
+	})
+
+	login := midservetest.NewRequest("POST", loginPath, "Content-Type", "application/x-www-form-urlencoded", "Origin", "http://example.com")
+	login = withBody(login, url.Values{"token": {"a"}}.Encode())
+	res := midservetest.Do(t, h, login).Status(http.StatusSeeOther)
+	var cookies, csrf string
+	for _, c := range res.Result().Cookies() {
+		cookies += c.Name + "=" + c.Value + "; "
+		if c.Name == csrfCookie {
+			csrf = c.Value
+		}
+	}
+
+	// Another site can make the browser send the cookies, not the token.
+	for _, req := range []*http.Request{
+		withBody(midservetest.NewRequest("PUT", "/c.txt", "Cookie", cookies), "c"),
+		midservetest.NewRequest("DELETE", "/a.txt", "Cookie", cookies),
+		midservetest.NewRequest("POST", "/a.txt", "Cookie", cookies, "X-HTTP-Method-Override", "DELETE"),
+		midservetest.NewRequest("POST", "/_api/delete", "Cookie", cookies),
+	} {
+		midservetest.Do(t, h, req).Status(http.StatusForbidden)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	midservetest.Get(t, h, "/a.txt", "Cookie", cookies).Status(http.StatusOK)
+
+	midservetest.Do(t, h, midservetest.NewRequest("DELETE", "/a.txt", "Cookie", cookies, "X-CSRF-Token", csrf)).
+		Status(http.StatusNoContent)
+	req := midservetest.NewRequest("POST", "/_api/delete", "Cookie", cookies, "X-CSRF-Token", csrf, "Content-Type", "application/json")
+	midservetest.Do(t, h, withBody(req, `{"paths":["/b.txt"]}`)).
+		Status(http.StatusOK).
+		BodyNotContains("error")
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s not deleted: %v", name, err)
+		}
+	}
+}
+
+func TestChangesState(t *testing.T) {
+	fh := newTestServer(t, midservetest.NewFS().HTTP(), func(o *Options) {
+		o.API = true
+		o.AdminToken = "secret"
+		o.ShortLinks = filepath.Join(t.TempDir(), "links.json")
+	}).(*fileHandler)
+	for _, tc := range []struct {
+		method, name string
+		want         bool
+	}{
+		{"GET", "/a.txt", false},
+		{"HEAD", "/a.txt", false},
+		{"OPTIONS", "/a.txt", false},
+		{"POST", "/a.txt", true},
+		{"PUT", "/a.txt", true},
+		{"DELETE", "/a.txt", true},
+		{"GET", "/_api/stat", false},
+		{"GET", "/_api/shorten", true},
+		{"GET", "/_admin/purge", true},
+		{"GET", "/_admin/usage", false},
+	} {
+		r := midservetest.NewRequest(tc.method, tc.name)
+		if got := fh.changesState(r, tc.name); got != tc.want {
+			t.Errorf("%s %s: %t, want %t", tc.method, tc.name, got, tc.want)
+		}
+	}
+}
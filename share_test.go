@@ -0,0 +1,121 @@
+package midserve
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startShare runs the share command with args, returning the URL it
+// prints and a channel receiving its result.
+func startShare(t *testing.T, args ...string) (string, <-chan error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan error, 1)
+	go func() {
+		err := runShare(shareCommand, append([]string{"-listen", "127.0.0.1:0", "-qr=false"}, args...))
+		w.Close()
+		done <- err
+	}()
+	line, err := bufio.NewReader(r).ReadString('\n')
+	os.Stdout = stdout
+	go io.Copy(io.Discard, r)
+	if err != nil {
+		t.Fatalf("reading the URL: %v", err)
+	}
+	return strings.TrimSpace(line), done
+}
+
+// shareDone waits for the share command to end, failing if it doesn't
+// within timeout.
+func shareDone(t *testing.T, done <-chan error, timeout time.Duration) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("share still running after %v", timeout)
+	}
+}
+
+func TestShareDownloads(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "0123456789"})
+	u, done := startShare(t, "-downloads", "2", "-ttl", "0", filepath.Join(dir, "a.txt"))
+
+	get := func(header ...string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	// Neither ranges nor other files count.
+	if res := get("Range", "bytes=0-4"); res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("range: %s", res.Status)
+	}
+	if res, err := http.Get(strings.TrimSuffix(u, "a.txt") + "b.txt"); err != nil || res.StatusCode != http.StatusNotFound {
+		t.Fatalf("other file: %v, %v", res, err)
+	}
+	if res := get(); res.StatusCode != http.StatusOK {
+		t.Fatalf("first download: %s", res.Status)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("share ended after one download: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if res := get(); res.StatusCode != http.StatusOK {
+		t.Fatalf("second download: %s", res.Status)
+	}
+	shareDone(t, done, 5*time.Second)
+
+	if res, err := http.Get(u); err == nil {
+		res.Body.Close()
+		t.Fatalf("served after the share ended: %s", res.Status)
+	}
+}
+
+func TestShareTTL(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a"})
+	start := time.Now()
+	u, done := startShare(t, "-ttl", "200ms", filepath.Join(dir, "a.txt"))
+
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	shareDone(t, done, 5*time.Second)
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("share ended after %v", d)
+	}
+	if res, err := http.Get(u); err == nil {
+		res.Body.Close()
+		t.Fatalf("served after the share expired: %s", res.Status)
+	}
+}
@@ -0,0 +1,301 @@
+// Caches shared by processes serving the same tree
+
+package midserve
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lockPollMax bounds the wait between attempts to take a lock held by
+// another process.
+const lockPollMax = 250 * time.Millisecond
+
+// lockFile takes an exclusive lock on the file name, creating it and
+// its directory if needed, waiting while another process or open file
+// holds it. It returns a function releasing the lock, or an error when
+// ctx is done first.
+func lockFile(ctx context.Context, name string) (func(), error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o644)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err = os.MkdirAll(filepath.Dir(name), 0o755); err == nil {
+			f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o644)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	wait := 5 * time.Millisecond
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			f.Close()
+			return nil, ctx.Err()
+		}
+		if wait *= 2; wait > lockPollMax {
+			wait = lockPollMax
+		}
+	}
+}
+
+// lockShared takes the lock of the cache file name held against the
+// other processes sharing CacheDir, the lock file next to it, if
+// SharedCache is set, and otherwise does nothing. It is only held to
+// check for name and rename it into place, so that processes filling
+// other files never wait for each other.
+func (fh *fileHandler) lockShared(ctx context.Context, name string) (func(), error) {
+	if !fh.sharedCache {
+		return func() {}, nil
+	}
+	return lockFile(ctx, name+".lock")
+}
+
+// An index shared by several processes is saved by each of them merged
+// with what the others saved, all under the lock file next to it. The
+// checksums they compute meanwhile are appended to the log file next to
+// it, which the next save folds into the index and removes, so that
+// none is computed twice. Only one process rescans the tree per
+// interval.
+
+func (x *metaIndex) lock(ctx context.Context) (func(), error) {
+	return lockFile(ctx, x.file+".lock")
+}
+
+func (x *metaIndex) sumsLog() string {
+	return x.file + ".sums"
+}
+
+// readIndexFile decodes the index file.
+func readIndexFile(file string) (*indexFile, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var data indexFile
+	if err := gob.NewDecoder(f).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// shareChecksum logs the checksum of e for the other processes.
+func (x *metaIndex) shareChecksum(e indexEntry) {
+	unlock, err := x.lock(context.Background())
+	if err != nil {
+		log.Printf("index: %v", err)
+		return
+	}
+	defer unlock()
+	f, err := os.OpenFile(x.sumsLog(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err == nil {
+		err = json.NewEncoder(f).Encode(e)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Printf("index: %v", err)
+	}
+}
+
+// catchUp puts the checksums logged by other processes since it was
+// last called into sums.
+func (x *metaIndex) catchUp(sums *checksumCache) {
+	unlock, err := x.lock(context.Background())
+	if err != nil {
+		log.Printf("index: %v", err)
+		return
+	}
+	defer unlock()
+	x.readSums(sums)
+}
+
+// readSums puts the checksums logged since the last call into sums and
+// the entries, and returns the size of the log, 0 if there is none. It
+// must be called with the index lock held.
+func (x *metaIndex) readSums(sums *checksumCache) int {
+	if fi, err := os.Stat(x.file); err == nil && (x.indexInfo == nil || !os.SameFile(fi, x.indexInfo)) {
+		// Saved by another process, with the log folded in.
+		if data, err := readIndexFile(x.file); err == nil {
+			for _, e := range data.Entries {
+				if e.SHA256 != "" {
+					sums.put(e.Path, e.Size, e.ModTime, e.SHA256)
+				}
+			}
+		}
+		x.indexInfo = fi
+	}
+	f, err := os.Open(x.sumsLog())
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	if x.logInfo == nil || !os.SameFile(fi, x.logInfo) {
+		x.logInfo, x.logOff = fi, 0
+	}
+	f.Seek(x.logOff, io.SeekStart)
+	dec := json.NewDecoder(io.LimitReader(f, fi.Size()-x.logOff))
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for {
+		var e indexEntry
+		if err := dec.Decode(&e); err != nil {
+			break
+		}
+		sums.put(e.Path, e.Size, e.ModTime, e.SHA256)
+		if o, ok := x.entries[e.Path]; ok && o.SHA256 == "" && o.Size == e.Size && o.ModTime.Equal(e.ModTime) {
+			o.SHA256 = e.SHA256
+			x.gen++
+		}
+	}
+	x.logOff = fi.Size()
+	return int(fi.Size())
+}
+
+// merge combines the index with the one on disk, saved by the other
+// processes, and the logged checksums, and saves the result if it adds
+// anything. Whichever of them was scanned last decides which files
+// exist; checksums and downloads are taken from both.
+func (x *metaIndex) merge(sums *checksumCache) error {
+	unlock, err := x.lock(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	logged := x.readSums(sums)
+	disk, err := readIndexFile(x.file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("index: %v, overwriting it", err)
+	}
+
+	x.mu.Lock()
+	changed := x.dirty || len(x.pending) > 0 || logged > 0
+	same := func(a, b *indexEntry) bool {
+		return a.IsDir == b.IsDir && a.Size == b.Size && a.ModTime.Equal(b.ModTime)
+	}
+	if disk != nil && disk.Scanned.After(x.scanned) {
+		entries := make(map[string]*indexEntry, len(disk.Entries))
+		for i := range disk.Entries {
+			e := &disk.Entries[i]
+			if o, ok := x.entries[e.Path]; ok && same(o, e) {
+				if e.SHA256 == "" {
+					e.SHA256 = o.SHA256
+				}
+				if o.Verified.After(e.Verified) {
+					e.Verified = o.Verified
+				}
+			}
+			e.Downloads += x.pending[e.Path]
+			entries[e.Path] = e
+		}
+		x.entries, x.scanned = entries, disk.Scanned
+	} else if disk != nil {
+		for i := range disk.Entries {
+			e := &disk.Entries[i]
+			o, ok := x.entries[e.Path]
+			if !ok {
+				continue
+			}
+			if same(o, e) {
+				if o.SHA256 == "" {
+					o.SHA256 = e.SHA256
+				}
+				if e.Verified.After(o.Verified) {
+					o.Verified = e.Verified
+				}
+			}
+			o.Downloads = e.Downloads + x.pending[e.Path]
+		}
+	}
+	x.gen++
+	for _, e := range x.entries {
+		if e.SHA256 != "" {
+			sums.put(e.Path, e.Size, e.ModTime, e.SHA256)
+		}
+	}
+	if !changed {
+		x.mu.Unlock()
+		return nil
+	}
+	data := indexFile{Scanned: x.scanned, Entries: make([]indexEntry, 0, len(x.entries))}
+	for _, e := range x.entries {
+		data.Entries = append(data.Entries, *e)
+	}
+	x.dirty = false
+	x.pending = make(map[string]int64)
+	x.mu.Unlock()
+
+	err = x.temps.write(x.file, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(data)
+	})
+	if err != nil {
+		return err
+	}
+	x.indexInfo, _ = os.Stat(x.file)
+	// Folded into the index now.
+	if err := os.Remove(x.sumsLog()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// syncShared merges the index with the one on disk, then rescans the
+// tree and merges again, unless another process scanned it within the
+// interval or is scanning it.
+func (x *metaIndex) syncShared(sums *checksumCache) {
+	if err := x.merge(sums); err != nil {
+		log.Printf("index: %v", err)
+	}
+	x.mu.RLock()
+	fresh := time.Since(x.scanned) < x.interval
+	x.mu.RUnlock()
+	if fresh {
+		return
+	}
+	f, err := os.OpenFile(x.file+".scan", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		log.Printf("index: %v", err)
+		return
+	}
+	defer f.Close()
+	if ok, err := tryLockFile(f); !ok {
+		if err != nil {
+			log.Printf("index: %v", err)
+		}
+		return
+	}
+	defer unlockFile(f)
+	if err := x.scan(context.Background(), sums); err != nil {
+		log.Printf("index: scan failed: %v", err)
+	}
+	if err := x.merge(sums); err != nil {
+		log.Printf("index: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package midserve
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProduceShared(t *testing.T) {
+	fh := newTestServer(t, Dir(t.TempDir()), func(o *Options) { o.SharedCache = true }).(*fileHandler)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cached := filepath.Join(fh.cacheDir, "test", "a")
+
+	// Another process holds the lock of the file while it renames its
+	// own copy into place.
+	unlock, err := fh.lockShared(ctx, cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filling := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- fh.produce(ctx, cached, func(w io.Writer) error {
+			close(filling)
+			_, err := io.WriteString(w, "mine")
+			return err
+		})
+	}()
+	select {
+	case <-filling:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fill waited for the lock")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("produce didn't wait for the lock to rename: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := os.WriteFile(cached, []byte("theirs"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(cached); err != nil || string(b) != "theirs" {
+		t.Fatalf("cached = %q, %v; want the file of the other process kept", b, err)
+	}
+
+	// Other files don't wait for it.
+	unlock, err = fh.lockShared(ctx, cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	other := filepath.Join(fh.cacheDir, "test", "b")
+	if err := fh.produce(ctx, other, func(w io.Writer) error {
+		_, err := io.WriteString(w, "b")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(other); err != nil || string(b) != "b" {
+		t.Fatalf("other = %q, %v", b, err)
+	}
+}
@@ -0,0 +1,214 @@
+// Short links to deep paths
+
+package midserve
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// shortLinkPrefix is the URL path prefix of short links, /s/<id>. A
+// directory of the same name in the root is shadowed while they are
+// enabled.
+const shortLinkPrefix = "/s/"
+
+const (
+	// shortLinkLen is the number of characters of a short link id.
+	shortLinkLen = 7
+	// shortLinkMax bounds the number of links in a store.
+	shortLinkMax = 100000
+)
+
+const shortLinkAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var errShortLinksFull = errors.New("too many short links")
+
+// shortLinks maps short link ids to paths, persisted as a JSON object in
+// a file rewritten on every addition.
+type shortLinks struct {
+	file  string
+	temps *tempFiles
+
+	mu     sync.Mutex
+	paths  map[string]string // by id
+	ids    map[string]string // by path
+	loaded bool
+}
+
+func newShortLinks(file string, temps *tempFiles) *shortLinks {
+	return &shortLinks{file: file, temps: temps}
+}
+
+// load reads the store once. It must be called with mu held.
+func (s *shortLinks) load() error {
+	if s.loaded {
+		return nil
+	}
+	s.paths, s.ids = make(map[string]string), make(map[string]string)
+	data, err := os.ReadFile(s.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &s.paths); err != nil {
+		return err
+	}
+	for id, p := range s.paths {
+		s.ids[p] = id
+	}
+	s.loaded = true
+	return nil
+}
+
+// lookup returns the path of id.
+func (s *shortLinks) lookup(id string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", false, err
+	}
+	p, ok := s.paths[id]
+	return p, ok, nil
+}
+
+// shorten returns the id of name, creating and storing one if it has
+// none yet.
+func (s *shortLinks) shorten(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", err
+	}
+	if id, ok := s.ids[name]; ok {
+		return id, nil
+	}
+	if len(s.paths) >= shortLinkMax {
+		return "", errShortLinksFull
+	}
+	var id string
+	for {
+		var err error
+		if id, err = newShortLinkID(); err != nil {
+			return "", err
+		}
+		if _, taken := s.paths[id]; !taken {
+			break
+		}
+	}
+	s.paths[id], s.ids[name] = name, id
+	err := s.temps.write(s.file, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s.paths)
+	})
+	if err != nil {
+		delete(s.paths, id)
+		delete(s.ids, name)
+		return "", err
+	}
+	return id, nil
+}
+
+func newShortLinkID() (string, error) {
+	b := make([]byte, shortLinkLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		// The bias of the modulo doesn't matter for ids that aren't
+		// secrets.
+		b[i] = shortLinkAlphabet[int(b[i])%len(shortLinkAlphabet)]
+	}
+	return string(b), nil
+}
+
+// serveShortLink redirects /s/<id> to the path it stands for.
+func (fh *fileHandler) serveShortLink(w http.ResponseWriter, r *http.Request, name string) {
+	id := strings.TrimPrefix(name, shortLinkPrefix)
+	p, ok, err := fh.shortLinks.lookup(id)
+	if err != nil {
+		logf(r, "http: error reading short links: %v", err)
+		fh.error(w, r, name, err)
+		return
+	}
+	if !ok {
+		fh.error(w, r, name, fs.ErrNotExist)
+		return
+	}
+	u := url.URL{Path: p, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// serveShorten implements POST /_api/shorten?path=, which returns the
+// short link of path, creating it on first use. As that writes to the
+// store, it takes the upload role, and sessions the CSRF token.
+func (fh *fileHandler) serveShorten(w http.ResponseWriter, r *http.Request) {
+	if fh.shortLinks == nil {
+		apiError(w, fs.ErrNotExist, 0)
+		return
+	}
+	name := r.URL.Query().Get("path")
+	if name == "" {
+		apiError(w, errors.New("parameter path is required"), http.StatusBadRequest)
+		return
+	}
+	name = path.Clean("/" + name)
+	if !fh.checkPermitted(w, r, name, RoleUpload) {
+		return
+	}
+	isDir, err := fh.isDir(r, name)
+	if err != nil {
+		apiError(w, err, 0)
+		return
+	}
+	if isDir && name != "/" {
+		name += "/"
+	}
+	id, err := fh.shortLinks.shorten(name)
+	if err != nil {
+		logf(r, "http: error storing short link: %v", err)
+		apiError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, struct {
+		Path string `json:"path"`
+		ID   string `json:"id"`
+		URL  string `json:"url"`
+	}{name, id, shortLinkPrefix + id})
+}
+
+// isDir reports whether name, which a request could be made for, is a
+// directory.
+func (fh *fileHandler) isDir(r *http.Request, name string) (bool, error) {
+	if fh.denied(name) {
+		return false, fs.ErrNotExist
+	}
+	if err := fh.closedWindow(name); err != nil {
+		return false, err
+	}
+	f, err := openContext(r.Context(), fh.root, name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if d.IsDir() && fh.denied(name+"/") {
+		return false, fs.ErrNotExist
+	}
+	return d.IsDir(), nil
+}
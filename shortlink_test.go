@@ -0,0 +1,58 @@
+package midserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestShorten(t *testing.T) {
+	root := midservetest.NewFS().
+		File("docs/a.txt", "a").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) {
+		o.API = true
+		o.ShortLinks = filepath.Join(t.TempDir(), "links.json")
+	})
+
+	// Creating links writes to the store, which GET must not.
+	midservetest.Get(t, h, "/_api/shorten?path=/docs/a.txt").
+		Status(http.StatusMethodNotAllowed).
+		Header("Allow", writeMethods)
+
+	res := midservetest.Do(t, h, midservetest.NewRequest("POST", "/_api/shorten?path=/docs/a.txt")).
+		Status(http.StatusOK)
+	var link struct{ Path, ID, URL string }
+	if err := json.Unmarshal(res.ResponseRecorder.Body.Bytes(), &link); err != nil {
+		t.Fatal(err)
+	}
+	if link.Path != "/docs/a.txt" || link.URL != shortLinkPrefix+link.ID {
+		t.Fatalf("link = %+v", link)
+	}
+	midservetest.Get(t, h, link.URL).
+		Status(http.StatusFound).
+		Header("Location", "/docs/a.txt")
+}
+
+func TestShortenRole(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.txt", "a").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) {
+		o.API = true
+		o.ShortLinks = filepath.Join(t.TempDir(), "links.json")
+		o.Principals = []Principal{
+			{Name: "reader", Token: "r", Grants: []Grant{{"/", RoleRead}}},
+			{Name: "uploader", Token: "u", Grants: []Grant{{"/", RoleUpload}}},
+		}
+	})
+
+	post := func(token string) *midservetest.Response {
+		return midservetest.Do(t, h, midservetest.NewRequest("POST", "/_api/shorten?path=/a.txt", "Authorization", "Bearer "+token))
+	}
+	post("r").Status(http.StatusForbidden)
+	post("u").Status(http.StatusOK)
+}
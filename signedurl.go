@@ -0,0 +1,284 @@
+// Signed URLs
+
+package midserve
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A signedURLScheme verifies the signature of a request with key,
+// returning nil if it is valid at now.
+type signedURLScheme struct {
+	verify func(r *http.Request, key []byte, now time.Time) error
+	sign   func(path string, key []byte, expires time.Time) string
+}
+
+// signedURLSchemes maps the -signed-urls values to their schemes:
+//
+//	hmac        ?expires=<unix>&signature=<hex HMAC-SHA256 of path and expires>
+//	cloudflare  ?verify=<unix>-<base64 HMAC-SHA256 of path and expiry>
+//	akamai      ?__token__=exp=<unix>~acl=<globs>~hmac=<hex>, EdgeAuth tokens
+//
+// The path is the escaped path of the request.
+var signedURLSchemes = map[string]signedURLScheme{
+	"hmac":       {verifyHMAC, signHMAC},
+	"cloudflare": {verifyCloudflare, signCloudflare},
+	"akamai":     {verifyAkamai, signAkamai},
+}
+
+var (
+	errUnsigned       = errors.New("signature missing")
+	errBadSignature   = errors.New("signature invalid")
+	errExpired        = errors.New("signature expired")
+	errNotYetValid    = errors.New("signature not yet valid")
+	errOutsideACL     = errors.New("path outside the token's acl")
+	errSignKeyMissing = errors.New("signed urls: requires -sign-key")
+)
+
+// checkSignedURLs reports an error if scheme, a -signed-urls value, is
+// unknown, and returns the key to sign with: akamai keys are given in
+// hex like to the EdgeAuth tools.
+func checkSignedURLs(scheme, key string) ([]byte, error) {
+	if scheme == "" {
+		return nil, nil
+	}
+	if _, ok := signedURLSchemes[scheme]; !ok {
+		return nil, fmt.Errorf("signed urls: %q is not hmac, cloudflare or akamai", scheme)
+	}
+	if key == "" {
+		return nil, errSignKeyMissing
+	}
+	if scheme == "akamai" {
+		k, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("signed urls: akamai key is not hex: %v", err)
+		}
+		return k, nil
+	}
+	return []byte(key), nil
+}
+
+// signed reports whether requests for name need a signature.
+func (fh *fileHandler) signed(name string) bool {
+	if fh.signedURLs == "" {
+		return false
+	}
+	if len(fh.signedPrefixes) == 0 {
+		return true
+	}
+	for _, p := range fh.signedPrefixes {
+		if underPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSignature replies with 403 Forbidden and returns false if the
+// request for name lacks a valid signature.
+func (fh *fileHandler) checkSignature(w http.ResponseWriter, r *http.Request, name string) bool {
+	if !fh.signed(name) {
+		return true
+	}
+	err := signedURLSchemes[fh.signedURLs].verify(r, fh.signKey, time.Now())
+	if err == nil {
+		return true
+	}
+	logf(r, "signed url %s: %v", name, err)
+	sw := &statusWriter{ResponseWriter: w}
+	fh.errorHandler.ServeError(sw, r, fs.ErrPermission)
+	fh.publish(r, EventDenied, name, sw.status, -1, nil)
+	return false
+}
+
+// checkSignedRoute replies with 403 Forbidden and returns false if name,
+// an API, admin or debug route, needs a signature. Signatures cover the
+// path only, not the query string those routes take their arguments
+// from, so they can't authorize them.
+func (fh *fileHandler) checkSignedRoute(w http.ResponseWriter, r *http.Request, name string) bool {
+	if !fh.signed(name) {
+		return true
+	}
+	logf(r, "signed url %s: not a file", name)
+	sw := &statusWriter{ResponseWriter: w}
+	fh.errorHandler.ServeError(sw, r, fs.ErrPermission)
+	fh.publish(r, EventDenied, name, sw.status, -1, nil)
+	return false
+}
+
+// mac returns the HMAC-SHA256 of msg with key.
+func mac(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// checkExpiry parses the Unix time expires and reports whether it has
+// passed at now.
+func checkExpiry(expires string, now time.Time) error {
+	t, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errBadSignature
+	}
+	if now.Unix() > t {
+		return errExpired
+	}
+	return nil
+}
+
+func verifyHMAC(r *http.Request, key []byte, now time.Time) error {
+	q := r.URL.Query()
+	expires, sig := q.Get("expires"), q.Get("signature")
+	if expires == "" || sig == "" {
+		return errUnsigned
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac(key, r.URL.EscapedPath()+"\n"+expires)) {
+		return errBadSignature
+	}
+	return checkExpiry(expires, now)
+}
+
+func signHMAC(p string, key []byte, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return "expires=" + exp + "&signature=" + hex.EncodeToString(mac(key, p+"\n"+exp))
+}
+
+// verifyCloudflare verifies the tokens of Cloudflare's signed request
+// example, which HMACs the path directly followed by the expiry.
+func verifyCloudflare(r *http.Request, key []byte, now time.Time) error {
+	v := r.URL.Query().Get("verify")
+	if v == "" {
+		return errUnsigned
+	}
+	i := strings.IndexByte(v, '-')
+	if i < 0 {
+		return errBadSignature
+	}
+	expires := v[:i]
+	// An unescaped '+' decodes to a space.
+	got, err := base64.StdEncoding.DecodeString(strings.Replace(v[i+1:], " ", "+", -1))
+	if err != nil || !hmac.Equal(got, mac(key, r.URL.EscapedPath()+expires)) {
+		return errBadSignature
+	}
+	return checkExpiry(expires, now)
+}
+
+func signCloudflare(p string, key []byte, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return "verify=" + url.QueryEscape(exp+"-"+base64.StdEncoding.EncodeToString(mac(key, p+exp)))
+}
+
+// verifyAkamai verifies EdgeAuth tokens: '~'-separated fields whose
+// HMAC, over all fields but hmac and, for tokens without an acl, the
+// path as "url=<path>", is the hmac field.
+func verifyAkamai(r *http.Request, key []byte, now time.Time) error {
+	token := r.URL.Query().Get("__token__")
+	if token == "" {
+		if c, err := r.Cookie("__token__"); err == nil {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		return errUnsigned
+	}
+	var fields []string
+	var sig, start, expires, acl string
+	for _, f := range strings.Split(token, "~") {
+		k, v := f, ""
+		if i := strings.IndexByte(f, '='); i >= 0 {
+			k, v = f[:i], f[i+1:]
+		}
+		switch k {
+		case "hmac":
+			sig = v
+			continue
+		case "st":
+			start = v
+		case "exp":
+			expires = v
+		case "acl":
+			acl = v
+		}
+		fields = append(fields, f)
+	}
+	p := r.URL.EscapedPath()
+	if acl == "" {
+		fields = append(fields, "url="+p)
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil || expires == "" || !hmac.Equal(got, mac(key, strings.Join(fields, "~"))) {
+		return errBadSignature
+	}
+	if start != "" {
+		t, err := strconv.ParseInt(start, 10, 64)
+		if err != nil {
+			return errBadSignature
+		}
+		if now.Unix() < t {
+			return errNotYetValid
+		}
+	}
+	if err := checkExpiry(expires, now); err != nil {
+		return err
+	}
+	if acl != "" && !matchACL(acl, p) {
+		return errOutsideACL
+	}
+	return nil
+}
+
+func signAkamai(p string, key []byte, expires time.Time) string {
+	token := "exp=" + strconv.FormatInt(expires.Unix(), 10)
+	msg := token + "~url=" + p
+	if strings.HasSuffix(p, "*") {
+		// Sign a prefix instead of a single path.
+		token += "~acl=" + p
+		msg = token
+	}
+	return "__token__=" + url.QueryEscape(token+"~hmac="+hex.EncodeToString(mac(key, msg)))
+}
+
+// matchACL reports whether p matches one of the '!'-separated patterns
+// of acl, in which '*' matches any string.
+func matchACL(acl, p string) bool {
+	for _, pattern := range strings.Split(acl, "!") {
+		if globMatch(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch reports whether s matches pattern, in which '*' matches any
+// string, including one with slashes.
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return len(s) >= len(last) && strings.HasSuffix(s, last)
+}
@@ -0,0 +1,53 @@
+package midserve
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestSignedAPI(t *testing.T) {
+	root := midservetest.NewFS().
+		File("public/a.txt", "a").
+		File("private/b.txt", "b").
+		HTTP()
+	key := []byte("key")
+	h := newTestServer(t, root, func(o *Options) {
+		o.API = true
+		o.AdminToken = "secret"
+		o.SignedURLs = "hmac"
+		o.SignKey = key
+		o.SignedPrefixes = []string{"/private"}
+	})
+
+	midservetest.Get(t, h, "/private/b.txt").Status(http.StatusForbidden)
+	sig := signHMAC("/private/b.txt", key, time.Now().Add(time.Hour))
+	midservetest.Get(t, h, "/private/b.txt?"+sig).Status(http.StatusOK)
+
+	// The API can't tell about signed files without a signature.
+	midservetest.Get(t, h, "/_api/stat?path=/public/a.txt").Status(http.StatusOK)
+	midservetest.Get(t, h, "/_api/stat?path=/private/b.txt").Status(http.StatusForbidden)
+	midservetest.Get(t, h, "/_api/stat?path=/private/b.txt&"+sig).Status(http.StatusForbidden)
+}
+
+func TestSignedRoutes(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.txt", "a").
+		HTTP()
+	key := []byte("key")
+	h := newTestServer(t, root, func(o *Options) {
+		o.API = true
+		o.AdminToken = "secret"
+		o.DebugEcho = true
+		o.SignedURLs = "hmac"
+		o.SignKey = key
+	})
+
+	for _, p := range []string{"/_api/stat", "/_admin/usage", debugEchoPath} {
+		sig := signHMAC(p, key, time.Now().Add(time.Hour))
+		midservetest.Get(t, h, p+"?path=/a.txt&"+sig, "Authorization", "Bearer secret").
+			Status(http.StatusForbidden)
+	}
+}
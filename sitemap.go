@@ -0,0 +1,148 @@
+// sitemap.xml generation
+
+package midserve
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sitemapPath is where the generated sitemap is served, shadowing a file
+// of the same name.
+const sitemapPath = "/sitemap.xml"
+
+// sitemapMaxURLs is the limit of the sitemap protocol for one file.
+const sitemapMaxURLs = 50000
+
+// sitemap holds the sitemap of the HTML pages in the tree, generated
+// in the background at start, every refresh after and when purged.
+type sitemap struct {
+	base    *url.URL
+	refresh time.Duration
+	ready   chan struct{} // closed once first generated
+	purged  chan struct{}
+
+	mu        sync.Mutex
+	xml       []byte
+	generated time.Time
+}
+
+func newSitemap(base *url.URL, refresh time.Duration) *sitemap {
+	if refresh <= 0 {
+		refresh = time.Hour
+	}
+	return &sitemap{base: base, refresh: refresh, ready: make(chan struct{}), purged: make(chan struct{}, 1)}
+}
+
+// regenerate makes runSitemap generate the sitemap again without
+// waiting for the refresh interval to pass.
+func (sm *sitemap) regenerate() {
+	select {
+	case sm.purged <- struct{}{}:
+	default:
+	}
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// runSitemap generates the sitemap now, every refresh after and when
+// purged, each time swapping it in once complete. A sitemap failing to
+// generate is retried, and until then the previous one is served, if
+// any.
+func (fh *fileHandler) runSitemap() {
+	sm := fh.sitemap
+	for {
+		data, err := fh.generateSitemap(context.Background())
+		if err != nil {
+			log.Printf("sitemap: %v", err)
+		} else {
+			sm.mu.Lock()
+			first := sm.xml == nil
+			sm.xml, sm.generated = data, time.Now()
+			sm.mu.Unlock()
+			if first {
+				close(sm.ready)
+			}
+		}
+		t := time.NewTimer(sm.refresh)
+		select {
+		case <-t.C:
+		case <-sm.purged:
+			t.Stop()
+		}
+	}
+}
+
+// serveSitemap serves the sitemap, waiting for it to be generated first.
+func (fh *fileHandler) serveSitemap(w http.ResponseWriter, r *http.Request) {
+	sm := fh.sitemap
+	select {
+	case <-sm.ready:
+	case <-r.Context().Done():
+		return
+	}
+	sm.mu.Lock()
+	data, generated := sm.xml, sm.generated
+	sm.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	serveContent(w, r, "", generated, func() (int64, error) { return int64(len(data)), nil }, bytes.NewReader(data))
+}
+
+// generateSitemap walks the tree for HTML pages, listing index.html
+// files as their directory.
+func (fh *fileHandler) generateSitemap(ctx context.Context) ([]byte, error) {
+	var set sitemapURLSet
+	err := walkFS(ctx, fh.root, "/", fh.excludes, func(name string, fi fs.FileInfo) error {
+		if fh.closedWindow(name) != nil || fh.unlistedEntry(name, fi.IsDir()) {
+			return skipEntry(fi)
+		}
+		if fh.perms != nil && fh.perms.role(nil, name) < RoleRead {
+			// Only what anyone may read.
+			return nil
+		}
+		ext := strings.ToLower(path.Ext(name))
+		if fi.IsDir() || ext != ".html" && ext != ".htm" || len(set.URLs) >= sitemapMaxURLs {
+			return nil
+		}
+		if path.Base(name) == "index.html" {
+			name = strings.TrimSuffix(name, "index.html")
+		}
+		loc := *fh.sitemap.base
+		loc.Path = strings.TrimSuffix(loc.Path, "/") + name
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:     loc.String(),
+			LastMod: fi.ModTime().UTC().Format(time.RFC3339),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(set); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
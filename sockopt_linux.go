@@ -0,0 +1,20 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package midserve
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, missing from package syscall on most
+// Linux architectures.
+const soReusePort = 0xf
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
+
+// setBacklog changes the backlog of a listening socket; Linux allows
+// calling listen again for that.
+func setBacklog(fd uintptr, n int) error {
+	return syscall.Listen(int(fd), n)
+}
@@ -0,0 +1,14 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+// +build !linux mips mipsle mips64 mips64le
+
+package midserve
+
+import "errors"
+
+func setReusePort(fd uintptr) error {
+	return errors.New("reuse-port is only supported on Linux")
+}
+
+func setBacklog(fd uintptr, n int) error {
+	return errors.New("backlog is only supported on Linux")
+}
@@ -0,0 +1,114 @@
+// Ordering of names in listings
+
+package midserve
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// nameOrders maps the -sort values to the functions ordering names.
+// Every order falls back to byte-wise comparison for names it considers
+// equal, so listings are deterministic.
+var nameOrders = map[string]func(a, b string) bool{
+	"lexical": lexicalLess,
+	"natural": naturalLess,
+	"locale":  localeLess,
+}
+
+// nameOrder returns the ordering named order, lexical if empty.
+func nameOrder(order string) (func(a, b string) bool, error) {
+	if order == "" {
+		return lexicalLess, nil
+	}
+	less, ok := nameOrders[order]
+	if !ok {
+		return nil, fmt.Errorf("sort: %q is not lexical, natural or locale", order)
+	}
+	return less, nil
+}
+
+func lexicalLess(a, b string) bool { return a < b }
+
+// naturalLess orders runs of digits by their numeric value, so that
+// file2 comes before file10.
+func naturalLess(a, b string) bool {
+	if c := naturalCompare(a, b); c != 0 {
+		return c < 0
+	}
+	return a < b
+}
+
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			na, ra := digitRun(a)
+			nb, rb := digitRun(b)
+			// Without leading zeros, a longer run is a larger number.
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) - len(tb)
+			}
+			if ta != tb {
+				return strings.Compare(ta, tb)
+			}
+			a, b = ra, rb
+			continue
+		}
+		if a[0] != b[0] {
+			return int(a[0]) - int(b[0])
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) - len(b)
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func digitRun(s string) (run, rest string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// localeLess orders names case-insensitively by Unicode simple case
+// folding and numbers naturally, which is what users of most locales
+// expect. Full collation, such as sorting accented letters next to
+// their base letter, would need tables outside the standard library.
+func localeLess(a, b string) bool {
+	if c := naturalCompare(foldCase(a), foldCase(b)); c != 0 {
+		return c < 0
+	}
+	return a < b
+}
+
+func foldCase(s string) string {
+	var sb strings.Builder
+	for len(s) > 0 {
+		r, n := utf8.DecodeRuneInString(s)
+		sb.WriteRune(unicode.ToLower(r))
+		s = s[n:]
+	}
+	return sb.String()
+}
+
+// pathLess orders the '/'-separated paths a and b element by element
+// with less, so that the files of a directory stay together and each
+// directory is ordered as its listing.
+func pathLess(less func(a, b string) bool, a, b string) bool {
+	for {
+		ea, ra, moreA := strings.Cut(a, "/")
+		eb, rb, moreB := strings.Cut(b, "/")
+		if ea != eb {
+			return less(ea, eb)
+		}
+		if !moreA || !moreB {
+			return !moreA && moreB
+		}
+		a, b = ra, rb
+	}
+}
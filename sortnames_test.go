@@ -0,0 +1,58 @@
+package midserve
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestNameOrders(t *testing.T) {
+	names := []string{"file10", "File2", "file2", "file1"}
+	for _, tc := range []struct {
+		order string
+		want  string
+	}{
+		{"lexical", "File2 file1 file10 file2"},
+		{"natural", "File2 file1 file2 file10"},
+		{"locale", "file1 File2 file2 file10"},
+	} {
+		less, err := nameOrder(tc.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := append([]string(nil), names...)
+		sort.Slice(got, func(i, j int) bool { return less(got[i], got[j]) })
+		if s := strings.Join(got, " "); s != tc.want {
+			t.Errorf("%s: %s, want %s", tc.order, s, tc.want)
+		}
+	}
+	if _, err := nameOrder("bogus"); err == nil {
+		t.Error("unknown order accepted")
+	}
+}
+
+func TestPathLess(t *testing.T) {
+	less, _ := nameOrder("natural")
+	paths := []string{"d10/a", "d2/b", "d2/a", "d2", "d2-x", "a"}
+	sort.Slice(paths, func(i, j int) bool { return pathLess(less, paths[i], paths[j]) })
+	if got, want := strings.Join(paths, " "), "a d2 d2/a d2/b d2-x d10/a"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestUnknownSort(t *testing.T) {
+	root := midservetest.NewFS().
+		File("b", "b").
+		File("a", "a").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) { o.Sort = "bogus" })
+
+	res := midservetest.Get(t, h, "/").Status(http.StatusOK)
+	body := res.ResponseRecorder.Body.String()
+	if strings.Index(body, `href="a"`) > strings.Index(body, `href="b"`) {
+		t.Errorf("listing not in lexical order:\n%s", body)
+	}
+}
@@ -0,0 +1,206 @@
+// Server-side includes
+//
+// A minimal subset of Apache mod_include is supported:
+//
+//	<!--#include virtual="/header.html" -->
+//	<!--#include file="footer.html" -->
+//	<!--#echo var="DOCUMENT_NAME" -->
+//
+// Included files go through the same rules as requests for them by the
+// same client, and are expanded themselves if they have an SSI
+// extension.
+
+package midserve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ssiMaxDepth bounds nested includes, which also stops include loops.
+const ssiMaxDepth = 8
+
+// ssiMaxFile bounds the size of each file expanded or included, and
+// ssiMaxSize that of the whole expansion.
+const (
+	ssiMaxFile = 4 << 20
+	ssiMaxSize = 16 << 20
+)
+
+var errSSITooLarge = fmt.Errorf("expansion larger than %d bytes", ssiMaxSize)
+
+// ssiErrorMessage replaces directives that failed, as Apache does. The
+// cause is only logged.
+const ssiErrorMessage = "[an error occurred while processing this directive]"
+
+var (
+	ssiDirectiveRe = regexp.MustCompile(`<!--#([a-z]+)((?:\s+[a-z]+="[^"]*")*)\s*-->`)
+	ssiAttrRe      = regexp.MustCompile(`([a-z]+)="([^"]*)"`)
+)
+
+// isSSI reports whether name has one of the extensions in exts.
+func isSSI(name string, exts []string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// serveSSI expands the directives in f and serves the result as HTML.
+func (fh *fileHandler) serveSSI(w http.ResponseWriter, r *http.Request, name string, f io.Reader, modtime time.Time) {
+	var buf bytes.Buffer
+	if err := fh.expandSSI(&buf, r, name, f, modtime, 0); err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(buf.Bytes())
+	}
+}
+
+func (fh *fileHandler) expandSSI(w *bytes.Buffer, r *http.Request, name string, f io.Reader, modtime time.Time, depth int) error {
+	src, err := readSSIFile(f)
+	if err != nil {
+		return err
+	}
+	for len(src) > 0 {
+		loc := ssiDirectiveRe.FindSubmatchIndex(src)
+		if loc == nil {
+			w.Write(src)
+			break
+		}
+		w.Write(src[:loc[0]])
+		directive := string(src[loc[2]:loc[3]])
+		attrs := map[string]string{}
+		for _, m := range ssiAttrRe.FindAllStringSubmatch(string(src[loc[4]:loc[5]]), -1) {
+			attrs[m[1]] = m[2]
+		}
+		src = src[loc[1]:]
+
+		var derr error
+		switch directive {
+		case "include":
+			derr = fh.ssiInclude(w, r, name, attrs, depth)
+		case "echo":
+			derr = ssiEcho(w, r, name, modtime, attrs)
+		default:
+			derr = fmt.Errorf("unsupported directive %q", directive)
+		}
+		if w.Len() > ssiMaxSize {
+			return errSSITooLarge
+		}
+		if errors.Is(derr, errSSITooLarge) {
+			return derr
+		}
+		if derr != nil {
+			logf(r, "http: ssi: %s: %v", name, derr)
+			w.WriteString(ssiErrorMessage)
+		}
+	}
+	return nil
+}
+
+// readSSIFile reads f, which may be at most ssiMaxFile bytes.
+func readSSIFile(f io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(f, ssiMaxFile+1))
+	if err == nil && len(b) > ssiMaxFile {
+		err = fmt.Errorf("file larger than %d bytes", ssiMaxFile)
+	}
+	return b, err
+}
+
+func (fh *fileHandler) ssiInclude(w *bytes.Buffer, r *http.Request, name string, attrs map[string]string, depth int) error {
+	if depth >= ssiMaxDepth {
+		return errors.New("includes nested too deeply")
+	}
+	var target string
+	if v, ok := attrs["virtual"]; ok {
+		// Relative to the URL of the including document.
+		target = path.Join(path.Dir(name), v)
+		if strings.HasPrefix(v, "/") {
+			target = path.Clean(v)
+		}
+	} else if v, ok := attrs["file"]; ok {
+		// Relative to the directory of the including document, which
+		// it may not leave.
+		if path.IsAbs(v) || strings.HasPrefix(path.Clean(v), "..") {
+			return fmt.Errorf("include file %q leaves the directory", v)
+		}
+		target = path.Join(path.Dir(name), v)
+	} else {
+		return errors.New("include without virtual or file")
+	}
+	if !fh.permitted(r, target, RoleRead) {
+		fh.publish(r, EventDenied, target, http.StatusForbidden, -1, nil)
+		return fmt.Errorf("include %s: %w", target, fs.ErrPermission)
+	}
+	if fh.signed(target) {
+		// Signed URLs are only good for the file itself.
+		fh.publish(r, EventDenied, target, http.StatusNotFound, -1, nil)
+		return fmt.Errorf("include %s requires a signed URL", target)
+	}
+	// Refused if excluded or in a closed access window.
+	f, d, err := fh.openRegular(r, target)
+	if err != nil {
+		return fmt.Errorf("include %s: %w", target, err)
+	}
+	defer f.Close()
+	if isSSI(target, fh.ssiExts) {
+		return fh.expandSSI(w, r, target, f, d.ModTime(), depth+1)
+	}
+	b, err := readSSIFile(f)
+	if err != nil {
+		return fmt.Errorf("include %s: %w", target, err)
+	}
+	w.Write(b)
+	return nil
+}
+
+func ssiEcho(w *bytes.Buffer, r *http.Request, name string, modtime time.Time, attrs map[string]string) error {
+	var v string
+	switch attrs["var"] {
+	case "DOCUMENT_NAME":
+		v = path.Base(name)
+	case "DOCUMENT_URI":
+		v = r.URL.Path
+	case "QUERY_STRING":
+		v = r.URL.RawQuery
+	case "REMOTE_ADDR":
+		v = r.RemoteAddr
+	case "DATE_LOCAL":
+		v = time.Now().Format(time.RFC1123)
+	case "DATE_GMT":
+		v = time.Now().UTC().Format(http.TimeFormat)
+	case "LAST_MODIFIED":
+		v = modtime.Format(time.RFC1123)
+	default:
+		return fmt.Errorf("unknown variable %q", attrs["var"])
+	}
+	switch attrs["encoding"] {
+	case "", "entity":
+		v = template.HTMLEscapeString(v)
+	case "url":
+		v = template.URLQueryEscaper(v)
+	case "none":
+	default:
+		return fmt.Errorf("unknown encoding %q", attrs["encoding"])
+	}
+	w.WriteString(v)
+	return nil
+}
@@ -0,0 +1,53 @@
+package midserve
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestSSIIncludeRules(t *testing.T) {
+	root := midservetest.NewFS().
+		File("pub/page.shtml", `<!--#include virtual="/pub/ok.txt" -->|<!--#include virtual="/team/secret.txt" -->|<!--#include virtual="/private/signed.txt" -->|<!--#include virtual="/later/embargo.txt" -->`).
+		File("pub/ok.txt", "ok").
+		File("team/secret.txt", "secret").
+		File("private/signed.txt", "signed").
+		File("later/embargo.txt", "embargo").
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) {
+		o.SSIExts = []string{".shtml"}
+		o.Anonymous = nil
+		o.Principals = []Principal{{Name: "alice", Token: "a", Grants: []Grant{{"/pub", RoleRead}, {"/private", RoleRead}, {"/later", RoleRead}}}}
+		o.SignedURLs = "hmac"
+		o.SignKey = []byte("0123456789abcdef0123456789abcdef")
+		o.SignedPrefixes = []string{"/private"}
+		o.AccessWindows = []AccessWindow{
+			{Prefix: "/later", NotBefore: time.Now().Add(time.Hour), Status: http.StatusNotFound},
+		}
+	})
+
+	want := strings.Join([]string{"ok", ssiErrorMessage, ssiErrorMessage, ssiErrorMessage}, "|")
+	midservetest.Do(t, h, midservetest.NewRequest("GET", "/pub/page.shtml", "Authorization", "Bearer a")).
+		Status(http.StatusOK).
+		Body(want)
+}
+
+func TestSSISizeLimits(t *testing.T) {
+	big := strings.Repeat("x", ssiMaxFile+1)
+	part := strings.Repeat("y", ssiMaxFile)
+	root := midservetest.NewFS().
+		File("big.shtml", big).
+		File("big.txt", big).
+		File("part.txt", part).
+		File("one.shtml", `<!--#include virtual="/big.txt" -->`).
+		File("many.shtml", strings.Repeat(`<!--#include virtual="/part.txt" -->`, ssiMaxSize/ssiMaxFile+1)).
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) { o.SSIExts = []string{".shtml"} })
+
+	midservetest.Get(t, h, "/big.shtml").Status(http.StatusInternalServerError)
+	midservetest.Get(t, h, "/one.shtml").Status(http.StatusOK).Body(ssiErrorMessage)
+	midservetest.Get(t, h, "/many.shtml").Status(http.StatusInternalServerError)
+}
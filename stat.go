@@ -0,0 +1,93 @@
+// File metadata API
+
+package midserve
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+)
+
+// statMaxPaths bounds the number of files a single stat request may ask
+// about.
+const statMaxPaths = 1000
+
+// statEntry is what /_api/stat reports about one path.
+type statEntry struct {
+	Path        string     `json:"path"`
+	Error       string     `json:"error,omitempty"`
+	IsDir       bool       `json:"dir,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	ModTime     *time.Time `json:"mtime,omitempty"`
+	Mode        string     `json:"mode,omitempty"`
+	ETag        string     `json:"etag,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+}
+
+// serveStat implements /_api/stat?path=..., reporting what a HEAD request
+// for each path would, in the order given. A file that can't be opened
+// doesn't fail the request but gets the error a request for it would.
+func (fh *fileHandler) serveStat(w http.ResponseWriter, r *http.Request) {
+	names := r.URL.Query()["path"]
+	if len(names) == 0 {
+		apiError(w, errors.New("parameter path is required"), http.StatusBadRequest)
+		return
+	}
+	if len(names) > statMaxPaths {
+		apiError(w, fmt.Errorf("at most %d paths per request", statMaxPaths), http.StatusBadRequest)
+		return
+	}
+	entries := make([]statEntry, len(names))
+	for i, name := range names {
+		entries[i] = fh.stat(r, path.Clean("/"+name))
+	}
+	writeJSON(w, r, entries)
+}
+
+func (fh *fileHandler) stat(r *http.Request, name string) statEntry {
+	e := statEntry{Path: name}
+	fail := func(err error) statEntry {
+		e.Error, _ = toHTTPError(err)
+		return e
+	}
+	if fh.denied(name) {
+		fh.publish(r, EventDenied, name, http.StatusNotFound, -1, nil)
+		return fail(fs.ErrNotExist)
+	}
+	if err := fh.closedWindow(name); err != nil {
+		_, code := toHTTPError(err)
+		fh.publish(r, EventDenied, name, code, -1, nil)
+		return fail(err)
+	}
+	f, err := openContext(r.Context(), fh.root, name)
+	if err != nil {
+		return fail(err)
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	if d.IsDir() && fh.denied(name+"/") {
+		return fail(fs.ErrNotExist)
+	}
+
+	mtime := d.ModTime().UTC()
+	e.IsDir, e.ModTime, e.Mode = d.IsDir(), &mtime, d.Mode().String()
+	if !d.Mode().IsRegular() {
+		return e
+	}
+	e.Size, e.ETag = d.Size(), fh.etag(r.Context(), name, d)
+	if e.ContentType = mime.TypeByExtension(path.Ext(name)); e.ContentType == "" {
+		// Sniff like serveContent.
+		var buf [sniffLen]byte
+		n, _ := io.ReadFull(f, buf[:])
+		e.ContentType = http.DetectContentType(buf[:n])
+	}
+	return e
+}
@@ -0,0 +1,322 @@
+// Remote tail of text files
+
+package midserve
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tailPath streams the lines appended to a file.
+const tailPath = "/_tail"
+
+const (
+	// tailMaxLines bounds the trailing lines sent first.
+	tailMaxLines = 1000
+	// tailMaxLine is the longest line sent whole; longer ones are split.
+	tailMaxLine = 64 << 10
+	// tailMaxLag is how far a client may fall behind the end of the
+	// file before the lines in between are skipped.
+	tailMaxLag = 4 << 20
+	// tailWriteTimeout is how long a client may take to accept a batch
+	// of lines before it is dropped.
+	tailWriteTimeout = 30 * time.Second
+)
+
+// sameFile reports whether a and b are the same file, assuming they are
+// unless the file system tells.
+func sameFile(a, b fs.FileInfo) bool {
+	if a.Sys() == nil || b.Sys() == nil {
+		return true
+	}
+	return os.SameFile(a, b)
+}
+
+// serveTail implements /_tail?path=&lines=, streaming the last lines of
+// a text file and then those appended to it as server-sent events, one
+// line each, with the offset after it as the event ID, so that clients
+// reconnecting with Last-Event-ID or offset= miss nothing. Lines beyond
+// the -tail-rate a second are dropped, and so are those a client falls
+// too far behind on; a skipped event says how many. Truncated or
+// replaced files, as by log rotation, are followed from the start with
+// a reset event.
+func (fh *fileHandler) serveTail(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := path.Clean("/" + q.Get("path"))
+	if !fh.checkPermitted(w, r, name, RoleRead) {
+		return
+	}
+	if fh.denied(name) || fh.signed(name) {
+		// Signed URLs are only good for the file itself.
+		sw := &statusWriter{ResponseWriter: w}
+		fh.errorHandler.ServeError(sw, r, fs.ErrNotExist)
+		fh.publish(r, EventDenied, name, sw.status, -1, nil)
+		return
+	}
+	if err := fh.closedWindow(name); err != nil {
+		sw := &statusWriter{ResponseWriter: w}
+		fh.errorHandler.ServeError(sw, r, err)
+		fh.publish(r, EventDenied, name, sw.status, -1, nil)
+		return
+	}
+	f, err := openContext(r.Context(), fh.root, name)
+	if err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	defer func() { f.Close() }()
+	d, err := f.Stat()
+	if err != nil {
+		fh.error(w, r, name, err)
+		return
+	}
+	if !d.Mode().IsRegular() {
+		http.Error(w, "not a regular file", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if fh.usage.cap > 0 && !fh.checkTransferCap(w, r, name) {
+		return
+	}
+
+	lines := 10
+	if s := q.Get("lines"); s != "" {
+		if lines, err = strconv.Atoi(s); err != nil || lines < 0 || lines > tailMaxLines {
+			http.Error(w, fmt.Sprintf("lines must be between 0 and %d", tailMaxLines), http.StatusBadRequest)
+			return
+		}
+	}
+	size := d.Size()
+	offset := int64(-1)
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = q.Get("offset")
+	}
+	if n, err := strconv.ParseInt(resume, 10, 64); err == nil && n >= 0 && n <= size {
+		offset = n
+	}
+	if offset < 0 {
+		offset = tailStart(f, size, lines)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	fh.publish(r, EventServed, name, http.StatusOK, -1, nil)
+
+	// Sent bytes are accounted as they are flushed, as a tail may go
+	// on for days.
+	sw := &statusWriter{ResponseWriter: w}
+	var accounted int64
+	t := &tailer{w: sw, rate: fh.tailRate, window: time.Now()}
+	rc := http.NewResponseController(w)
+	buf := make([]byte, tailMaxLine)
+	tick := time.NewTicker(logPollInterval)
+	defer tick.Stop()
+	keepAlive := time.Now()
+	for {
+		if size-offset > tailMaxLag {
+			// The client can't keep up; skip to what is recent.
+			skipTo := size - tailMaxLag/2
+			t.skipped += countLines(f, offset, skipTo-offset, buf)
+			offset = skipTo
+			t.partial = t.partial[:0]
+			t.flushSkipped()
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return
+		}
+		for offset < size {
+			n, err := f.Read(buf[:min64(size-offset, int64(len(buf)))])
+			t.feed(buf[:n], offset)
+			offset += int64(n)
+			if err != nil && err != io.EOF {
+				return
+			}
+			if n == 0 {
+				break
+			}
+		}
+		t.flushSkipped()
+		if t.sent || time.Since(keepAlive) >= changesKeepAlive {
+			if !t.sent {
+				fmt.Fprint(sw, ": keep-alive\n\n")
+			}
+			rc.SetWriteDeadline(time.Now().Add(tailWriteTimeout))
+			err := rc.Flush()
+			fh.usage.add(usageClient(r), sw.written-accounted)
+			accounted = sw.written
+			if err != nil {
+				return
+			}
+			t.sent, keepAlive = false, time.Now()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+		}
+		cur, err := openContext(r.Context(), fh.root, name)
+		if err != nil {
+			continue
+		}
+		cd, err := cur.Stat()
+		if err != nil {
+			cur.Close()
+			continue
+		}
+		if fd, err := f.Stat(); err == nil && sameFile(fd, cd) && cd.Size() >= offset {
+			cur.Close()
+			size = cd.Size()
+			continue
+		}
+		// Truncated, or replaced by a new file.
+		f.Close()
+		f, size, offset = cur, cd.Size(), 0
+		t.partial = t.partial[:0]
+		fmt.Fprint(sw, "event: reset\ndata: {}\n\n")
+		t.sent = true
+	}
+}
+
+// tailStart returns the offset of the last lines lines of f, of size
+// bytes, looking at most at the last tailMaxLag bytes.
+func tailStart(f http.File, size int64, lines int) int64 {
+	if lines == 0 {
+		return size
+	}
+	start := size - tailMaxLag
+	if start < 0 {
+		start = 0
+	}
+	b := readAt(f, start, size-start)
+	end := len(b)
+	if end > 0 && b[end-1] == '\n' {
+		// The last line is complete.
+		end--
+	}
+	for i := 0; i < lines; i++ {
+		nl := bytes.LastIndexByte(b[:end], '\n')
+		if nl < 0 {
+			if start == 0 {
+				return 0
+			}
+			break
+		}
+		end = nl
+	}
+	if end == len(b) {
+		return size
+	}
+	return start + int64(end) + 1
+}
+
+// readAt returns up to n bytes of f at offset.
+func readAt(f http.File, offset, n int64) []byte {
+	if n <= 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil
+	}
+	m, _ := io.ReadFull(f, b)
+	return b[:m]
+}
+
+// countLines returns the newlines in the n bytes of f at offset, reading
+// them through buf, however many there are.
+func countLines(f http.File, offset, n int64, buf []byte) int {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0
+	}
+	lines := 0
+	for n > 0 {
+		m, err := f.Read(buf[:min64(n, int64(len(buf)))])
+		lines += bytes.Count(buf[:m], []byte("\n"))
+		n -= int64(m)
+		if err != nil || m == 0 {
+			break
+		}
+	}
+	return lines
+}
+
+// tailer splits what is read from a file into line events, dropping
+// those beyond rate a second.
+type tailer struct {
+	w       io.Writer
+	rate    int
+	partial []byte
+	sent    bool
+	skipped int
+
+	window time.Time
+	count  int
+}
+
+// feed splits b, read at offset, into lines and sends the complete ones.
+func (t *tailer) feed(b []byte, offset int64) {
+	for len(b) > 0 {
+		nl := bytes.IndexByte(b, '\n')
+		if nl < 0 {
+			t.partial = append(t.partial, b...)
+			if len(t.partial) >= tailMaxLine {
+				t.line(t.partial, offset+int64(len(b)))
+				t.partial = t.partial[:0]
+			}
+			return
+		}
+		offset += int64(nl + 1)
+		if len(t.partial) > 0 {
+			t.partial = append(t.partial, b[:nl]...)
+			t.line(t.partial, offset)
+			t.partial = t.partial[:0]
+		} else {
+			t.line(b[:nl], offset)
+		}
+		b = b[nl+1:]
+	}
+}
+
+// flushSkipped sends the number of lines skipped since it was last
+// sent, if any.
+func (t *tailer) flushSkipped() {
+	if t.skipped > 0 {
+		fmt.Fprintf(t.w, "event: skipped\ndata: %d\n\n", t.skipped)
+		t.skipped, t.sent = 0, true
+	}
+}
+
+// line sends the line ending at end, unless over the rate.
+func (t *tailer) line(line []byte, end int64) {
+	if t.rate > 0 {
+		if now := time.Now(); now.Sub(t.window) >= time.Second {
+			t.window, t.count = now, 0
+		}
+		if t.count >= t.rate {
+			t.skipped++
+			return
+		}
+		t.count++
+	}
+	s := strings.ToValidUTF8(strings.TrimSuffix(string(line), "\r"), "�")
+	// A line can't hold the line breaks that end SSE data lines.
+	s = strings.NewReplacer("\r", "�").Replace(s)
+	fmt.Fprintf(t.w, "id: %d\ndata: %s\n\n", end, s)
+	t.sent = true
+}
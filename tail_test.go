@@ -0,0 +1,32 @@
+package midserve
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestCountLines(t *testing.T) {
+	content := strings.Repeat("line\n", 1000)
+	f, err := midservetest.NewFS().File("log", content).HTTP().Open("/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 7)
+	for _, tc := range []struct {
+		offset, n int64
+		want      int
+	}{
+		{0, int64(len(content)), 1000},
+		{0, 4, 0},
+		{0, 5, 1},
+		{3, 100, 20},
+		{int64(len(content)) - 1, 10, 1},
+	} {
+		if got := countLines(f, tc.offset, tc.n, buf); got != tc.want {
+			t.Errorf("countLines(%d, %d) = %d, want %d", tc.offset, tc.n, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Temporary files
+
+package midserve
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// tempPrefix starts the names of temporary files, and tempDirName names
+// the directories only midserve writes them to. Entries named like this
+// are neither listed nor served, so partial files never show. They are
+// particular to midserve so as not to hide files of users or other
+// tools.
+const (
+	tempPrefix  = ".midserve-tmp-"
+	tempDirName = ".midserve-tmp"
+)
+
+// tempOrphanAge is the age of temporary files removed as left behind
+// by an interrupted run. Younger ones may still be in use by another
+// process sharing the directory, such as with -reuse-port.
+const tempOrphanAge = time.Hour
+
+// tempFiles creates the temporary files that are renamed into place
+// once complete, in dir or, if it is empty, next to their destination.
+// A dir must be on the file system of the destinations, so that the
+// rename is atomic; checkTempDir verifies that. It is created if
+// needed.
+type tempFiles struct {
+	dir string
+}
+
+// isTemp reports whether the '/'-separated name, which may end in a
+// slash, is a temporary file.
+func isTemp(name string) bool {
+	base := path.Base(strings.TrimSuffix(name, "/"))
+	return base == tempDirName || strings.HasPrefix(base, tempPrefix)
+}
+
+// create creates a temporary file to be renamed into the directory dst,
+// which is created if needed.
+func (t *tempFiles) create(dst string) (*os.File, error) {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return nil, err
+	}
+	dir := dst
+	if t.dir != "" {
+		if err := os.MkdirAll(t.dir, 0700); err != nil {
+			return nil, err
+		}
+		dir = t.dir
+	}
+	return os.CreateTemp(dir, tempPrefix+"*")
+}
+
+// write creates the file name with the content written by fill. The
+// file is written under a temporary name and renamed, so concurrent
+// readers never see a partial file.
+func (t *tempFiles) write(name string, fill func(w io.Writer) error) error {
+	return t.writeWith(name, fill, os.Rename)
+}
+
+// writeWith is write, with rename moving the complete temporary file
+// into place.
+func (t *tempFiles) writeWith(name string, fill func(w io.Writer) error, rename func(tmp, name string) error) error {
+	tmp, err := t.create(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = fill(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return rename(tmp.Name(), name)
+}
+
+// renameNoReplace renames src to dst like os.Rename, but fails with
+// errExists rather than replacing dst if it exists, however recently
+// it was created. Files are linked to dst and then removed; directories
+// claim dst by creating it empty, which renaming replaces, except on
+// Windows.
+func renameNoReplace(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		err := os.Link(src, dst)
+		if errors.Is(err, fs.ErrExist) {
+			return errExists
+		}
+		if err != nil {
+			// No hard links on this file system.
+			if _, err := os.Lstat(dst); err == nil {
+				return errExists
+			}
+			return os.Rename(src, dst)
+		}
+		return os.Remove(src)
+	}
+	err = os.Mkdir(dst, 0755)
+	if errors.Is(err, fs.ErrExist) {
+		return errExists
+	}
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// Renaming doesn't replace directories there.
+		os.Remove(dst)
+		return os.Rename(src, dst)
+	}
+	// os.Rename refuses to replace directories, rename(2) replaces
+	// empty ones.
+	if err := syscall.Rename(src, dst); err != nil {
+		// Only removes the claim if still empty.
+		os.Remove(dst)
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+	}
+	return nil
+}
+
+// checkTempDir creates dir and reports an error unless files in it can
+// be renamed into dst.
+func checkTempDir(dir, dst string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, tempPrefix+"probe-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	moved := filepath.Join(dst, filepath.Base(probe.Name()))
+	err = os.Rename(probe.Name(), moved)
+	os.Remove(probe.Name())
+	os.Remove(moved)
+	if err != nil {
+		return fmt.Errorf("tmp dir %s: must be on the file system of %s: %v", dir, dst, err)
+	}
+	return nil
+}
+
+// cleanTemps removes the temporary files left behind in dir, a
+// directory temporary files are created in, by an interrupted run. It
+// neither descends into nor removes directories.
+func cleanTemps(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-tempOrphanAge)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), tempPrefix) {
+			continue
+		}
+		if fi, err := e.Info(); err == nil && fi.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package midserve
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestRenameNoReplace(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a":       "a",
+		"b":       "b",
+		"d/x":     "x",
+		"taken/y": "y",
+	})
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	if err := renameNoReplace(p("a"), p("b")); err != errExists {
+		t.Fatalf("file over file: %v", err)
+	}
+	if err := renameNoReplace(p("d"), p("taken")); err != errExists {
+		t.Fatalf("directory over directory: %v", err)
+	}
+	if err := renameNoReplace(p("d"), p("b")); err != errExists {
+		t.Fatalf("directory over file: %v", err)
+	}
+	if b, err := os.ReadFile(p("b")); err != nil || string(b) != "b" {
+		t.Fatalf("b = %q, %v", b, err)
+	}
+
+	if err := renameNoReplace(p("a"), p("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameNoReplace(p("d"), p("e")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"c": "a", "e/x": "x"} {
+		if b, err := os.ReadFile(p(name)); err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v", name, b, err)
+		}
+	}
+	for _, name := range []string{"a", "d"} {
+		if _, err := os.Lstat(p(name)); !os.IsNotExist(err) {
+			t.Errorf("%s still there: %v", name, err)
+		}
+	}
+}
+
+func TestCleanTemps(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		tempPrefix + "old":          "partial",
+		tempPrefix + "new":          "in progress",
+		tempPrefix + "dir/a":        "a",
+		"sub/" + tempPrefix + "old": "not ours",
+		".tmp-old":                  "kept",
+	})
+	old := time.Now().Add(-2 * tempOrphanAge)
+	for _, name := range []string{tempPrefix + "old", tempPrefix + "dir", "sub/" + tempPrefix + "old", ".tmp-old"} {
+		os.Chtimes(filepath.Join(dir, filepath.FromSlash(name)), old, old)
+	}
+
+	cleanTemps(dir)
+	for name, gone := range map[string]bool{
+		tempPrefix + "old":          true,
+		tempPrefix + "new":          false,
+		tempPrefix + "dir/a":        false,
+		"sub/" + tempPrefix + "old": false,
+		".tmp-old":                  false,
+	} {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) != gone {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestWriteTemps(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"docs/a.txt": "a"})
+	h := newTestServer(t, Dir(dir), func(o *Options) {
+		o.API = true
+		o.Write = true
+	})
+	if d := h.(*fileHandler).writeTemps.dir; d != filepath.Join(dir, tempDirName) {
+		t.Fatalf("temporary files in %s", d)
+	}
+
+	midservetest.Do(t, h, withBody(midservetest.NewRequest("PUT", "/docs/b.txt"), "b")).
+		Status(http.StatusCreated)
+	for _, sub := range []string{"", "docs"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if e.Name() != tempDirName && isTemp(e.Name()) {
+				t.Errorf("temporary file %s left in %q", e.Name(), sub)
+			}
+		}
+	}
+	midservetest.Get(t, h, "/"+tempDirName+"/").Status(http.StatusNotFound)
+}
+
+func TestTempFilesHidden(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".tmp-notes":     "mine",
+		tempPrefix + "x": "partial",
+	})
+	h := newTestServer(t, Dir(dir), nil)
+
+	midservetest.Get(t, h, "/.tmp-notes").Status(http.StatusOK).Body("mine")
+	midservetest.Get(t, h, "/"+tempPrefix+"x").Status(http.StatusNotFound)
+}
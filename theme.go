@@ -0,0 +1,44 @@
+// Listing themes and custom CSS
+
+package midserve
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// themes maps the -theme values to the CSS they add to listings.
+var themes = map[string]string{
+	"light": `:root { color-scheme: light; }
+body { background: #fff; color: #222; }
+a { color: #0645ad; }
+`,
+	"dark": `:root { color-scheme: dark; }
+body { background: #1e1e1e; color: #ddd; }
+a { color: #9cf; }
+`,
+	"auto": `:root { color-scheme: light dark; }
+@media (prefers-color-scheme: dark) {
+body { background: #1e1e1e; color: #ddd; }
+a { color: #9cf; }
+}
+`,
+}
+
+// checkTheme reports an error if theme, a -theme value, is unknown.
+func checkTheme(theme string) error {
+	if _, ok := themes[theme]; theme != "" && !ok {
+		return fmt.Errorf("theme: %q is not light, dark or auto", theme)
+	}
+	return nil
+}
+
+// writeListingStyle writes the base style of listings followed by the
+// theme and custom CSS, if any, as a style element.
+func (fh *fileHandler) writeListingStyle(w io.Writer) {
+	css := listingBaseCSS + themes[fh.theme] + fh.customCSS
+	// The CSS can't end the element early; in CSS "\/" is just "/".
+	css = strings.Replace(css, "</", `<\/`, -1)
+	fmt.Fprintf(w, "<style>\n%s</style>\n", css)
+}
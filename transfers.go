@@ -0,0 +1,148 @@
+// Progress of transfers
+
+package midserve
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A transfer is a file being sent to a client.
+type transfer struct {
+	sent, total int64 // accessed atomically, total is -1 until known
+
+	id         string
+	path       string
+	remoteAddr string
+	started    time.Time
+}
+
+// transferTable holds the transfers in progress. Request IDs may come
+// from clients, so they are not used as keys.
+type transferTable struct {
+	mu sync.Mutex
+	m  map[*transfer]struct{}
+}
+
+func newTransferTable() *transferTable {
+	return &transferTable{m: make(map[*transfer]struct{})}
+}
+
+// track registers the transfer of name in response to r, returning the
+// ResponseWriter to send it through and the function to call once done.
+func (tt *transferTable) track(w http.ResponseWriter, r *http.Request, name string) (http.ResponseWriter, func()) {
+	t := &transfer{
+		total:      -1,
+		id:         requestID(r),
+		path:       name,
+		remoteAddr: r.RemoteAddr,
+		started:    time.Now(),
+	}
+	tt.mu.Lock()
+	tt.m[t] = struct{}{}
+	tt.mu.Unlock()
+	return &progressWriter{ResponseWriter: w, t: t}, func() {
+		tt.mu.Lock()
+		delete(tt.m, t)
+		tt.mu.Unlock()
+	}
+}
+
+// progressWriter counts the body bytes written through it into t.
+type progressWriter struct {
+	http.ResponseWriter
+	t           *transfer
+	wroteHeader bool
+}
+
+func (w *progressWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+			atomic.StoreInt64(&w.t.total, n)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&w.t.sent, int64(n))
+	return n, err
+}
+
+// progressChunk is how much ReadFrom sends between updates of progress.
+const progressChunk = 4 << 20
+
+// ReadFrom keeps the ResponseWriter's optimized copying, such as
+// sendfile for the io.LimitedReader of a file passed by io.CopyN, and
+// sends in chunks so that progress is still reported while it runs.
+func (w *progressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	r, limit := src, int64(math.MaxInt64)
+	if lr, ok := src.(*io.LimitedReader); ok {
+		r, limit = lr.R, lr.N
+		defer func() { lr.N = limit }()
+	}
+	var written int64
+	for limit > 0 {
+		chunk := &io.LimitedReader{R: r, N: min(limit, progressChunk)}
+		n, err := io.Copy(w.ResponseWriter, chunk)
+		written += n
+		limit -= n
+		atomic.AddInt64(&w.t.sent, n)
+		if err != nil || chunk.N > 0 {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (w *progressWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *progressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// serveTransfers implements /_admin/transfers, listing the files being
+// sent, oldest first, with the addresses of their clients.
+func (fh *fileHandler) serveTransfers(w http.ResponseWriter, r *http.Request) {
+	type transferInfo struct {
+		ID         string    `json:"id"`
+		Path       string    `json:"path"`
+		RemoteAddr string    `json:"remote_addr"`
+		Started    time.Time `json:"started"`
+		Sent       int64     `json:"sent"`
+		Total      int64     `json:"total"` // -1 if unknown
+	}
+	list := []transferInfo{}
+	fh.transfers.mu.Lock()
+	for t := range fh.transfers.m {
+		list = append(list, transferInfo{
+			t.id, t.path, t.remoteAddr, t.started,
+			atomic.LoadInt64(&t.sent), atomic.LoadInt64(&t.total),
+		})
+	}
+	fh.transfers.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	writeJSON(w, r, list)
+}
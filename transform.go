@@ -0,0 +1,130 @@
+// Content transforms
+
+package midserve
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A Transform converts the content of a file into a variant, for
+// example an audio file into a lower bitrate.
+type Transform interface {
+	Apply(ctx context.Context, dst io.Writer, src io.Reader) error
+}
+
+// The TransformFunc type is an adapter to allow the use of ordinary
+// functions as transforms.
+type TransformFunc func(ctx context.Context, dst io.Writer, src io.Reader) error
+
+// Apply calls f(ctx, dst, src).
+func (f TransformFunc) Apply(ctx context.Context, dst io.Writer, src io.Reader) error {
+	return f(ctx, dst, src)
+}
+
+// A TransformRule makes a Transform available as ?transform=Name for
+// files whose content type starts with Match, such as "audio/" or
+// "video/x-matroska".
+type TransformRule struct {
+	Name        string
+	Match       string
+	ContentType string // of the transformed content
+	Transform   Transform
+}
+
+// CommandTransform is a Transform running an external program, which
+// reads the source on its standard input. The output is taken from its
+// standard output, or from the file named by an "{out}" argument for
+// programs that need a seekable output.
+type CommandTransform []string
+
+// Apply implements Transform.
+func (c CommandTransform) Apply(ctx context.Context, dst io.Writer, src io.Reader) error {
+	if len(c) == 0 {
+		return errors.New("empty transform command")
+	}
+	args := append([]string(nil), c[1:]...)
+	toFile := false
+	for i, a := range args {
+		if a == "{out}" {
+			f, ok := dst.(*os.File)
+			if !ok {
+				return errors.New("transform output {out} needs a file")
+			}
+			args[i] = f.Name()
+			toFile = true
+		}
+	}
+	cmd := exec.CommandContext(ctx, c[0], args...)
+	cmd.Stdin = src
+	if !toFile {
+		cmd.Stdout = dst
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v: %s", c[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// transformFor returns the rule named by the transform query parameter
+// of r, if it applies to name. ok is false when no transform was asked
+// for.
+func (fh *fileHandler) transformFor(r *http.Request, name string) (rule *TransformRule, ok bool) {
+	want := r.URL.Query().Get("transform")
+	if want == "" {
+		return nil, false
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+	for i := range fh.transforms {
+		t := &fh.transforms[i]
+		if t.Name == want && ctype != "" && strings.HasPrefix(ctype, t.Match) {
+			return t, true
+		}
+	}
+	return nil, true
+}
+
+// serveTransformed serves the output of rule applied to the file name,
+// caching it so that it can be range-served like any file.
+func (fh *fileHandler) serveTransformed(w http.ResponseWriter, r *http.Request, name string, f io.Reader, d fs.FileInfo, rule *TransformRule) {
+	key := sha256.Sum256([]byte(fmt.Sprintf("transform\x00%s\x00%s\x00%d\x00%d", rule.Name, name, d.ModTime().UnixNano(), d.Size())))
+	cached := filepath.Join(fh.cacheDir, "transforms", hex.EncodeToString(key[:]))
+	fh.dropPurged(name, cached)
+
+	cf, err := os.Open(cached)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fh.produce(r.Context(), cached, func(w io.Writer) error {
+			return rule.Transform.Apply(r.Context(), w, f)
+		})
+		if err == nil {
+			cf, err = os.Open(cached)
+		}
+	}
+	if err != nil {
+		if r.Context().Err() == nil {
+			logf(r, "http: error transforming %s with %s: %v", name, rule.Name, err)
+		}
+		fh.error(w, r, name, err)
+		return
+	}
+	defer cf.Close()
+	if rule.ContentType != "" {
+		w.Header().Set("Content-Type", rule.ContentType)
+	}
+	fh.serveCached(w, r, name, d, cf)
+}
@@ -0,0 +1,131 @@
+//go:build !windows
+// +build !windows
+
+// Handing the listeners over to a new process
+
+package midserve
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeFDsEnv tells a new process the addresses of the listeners it
+// inherits, separated by commas, as file descriptors 3 and on.
+// upgradeReadyEnv is the descriptor it closes once it serves.
+const (
+	upgradeFDsEnv   = "MIDSERVE_UPGRADE_FDS"
+	upgradeReadyEnv = "MIDSERVE_UPGRADE_READY"
+)
+
+// upgradeReadyTimeout is how long the old process waits for the new
+// one to serve before giving up on the upgrade.
+const upgradeReadyTimeout = 30 * time.Second
+
+// notifyUpgrade relays SIGUSR2, the request to upgrade, to c.
+func notifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// inheritedListener returns the listener for addr passed down by the
+// process that started this one to upgrade, if any.
+func inheritedListener(addr string) (net.Listener, error) {
+	addrs := os.Getenv(upgradeFDsEnv)
+	if addrs == "" {
+		return nil, nil
+	}
+	for i, a := range strings.Split(addrs, ",") {
+		if a != addr {
+			continue
+		}
+		f := os.NewFile(uintptr(3+i), "listener "+a)
+		if f == nil {
+			return nil, fmt.Errorf("upgrade: no listener for %s", a)
+		}
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return nil, nil
+}
+
+// upgradeReady tells the process that started this one to upgrade that
+// it serves now, so that the old one stops accepting connections.
+func upgradeReady() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	if err != nil {
+		return
+	}
+	if f := os.NewFile(uintptr(fd), "upgrade ready"); f != nil {
+		f.Write([]byte{1})
+		f.Close()
+	}
+	os.Unsetenv(upgradeFDsEnv)
+	os.Unsetenv(upgradeReadyEnv)
+}
+
+// upgrade starts the executable again with the same arguments, passing
+// it the listeners for addrs, and returns once it serves.
+func upgrade(addrs []string, listeners []net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("upgrade: can't pass on a %T", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, upgradeFDsEnv+"=") && !strings.HasPrefix(kv, upgradeReadyEnv+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		upgradeFDsEnv+"="+strings.Join(addrs, ","),
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(listeners)))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Only the new process may hold the write end, so that reading
+	// ends when it exits without getting ready.
+	readyW.Close()
+	files = files[:len(files)-1]
+	go cmd.Wait()
+
+	ready.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		return errors.New("upgrade: the new process failed to start serving")
+	}
+	return nil
+}
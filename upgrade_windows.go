@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package midserve
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+func notifyUpgrade(c chan<- os.Signal) {}
+
+func inheritedListener(addr string) (net.Listener, error) { return nil, nil }
+
+func upgradeReady() {}
+
+func upgrade(addrs []string, listeners []net.Listener) error {
+	return errors.New("upgrade: not supported on Windows")
+}
@@ -0,0 +1,459 @@
+// Uploads and their progress
+
+package midserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// uploadKeep is how long the progress of a finished upload stays
+	// available, for clients polling it to see the end.
+	uploadKeep = time.Minute
+	// uploadProgressInterval is how often the progress stream sends an
+	// event.
+	uploadProgressInterval = 500 * time.Millisecond
+)
+
+// uploadIDPattern is what the upload IDs chosen by clients look like.
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+var (
+	errUploadID     = errors.New("X-Upload-ID must be 8 to 64 letters, digits, '-' or '_'")
+	errUploadActive = errors.New("upload id in use")
+	errBadFileName  = errors.New("invalid file name")
+)
+
+// An upload is the progress of an upload request, as seen by the
+// server, which is what proxies buffering the body hide from browsers.
+type upload struct {
+	received, total int64 // accessed atomically, total is -1 if unknown
+
+	started time.Time
+
+	mu      sync.Mutex
+	current string
+	files   []manageResult
+	done    time.Time
+	err     string
+}
+
+// uploadTable holds the uploads by the ID their clients gave them, so
+// that the progress can be asked for before the request completes.
+type uploadTable struct {
+	mu sync.Mutex
+	m  map[string]*upload
+}
+
+func newUploadTable() *uploadTable {
+	return &uploadTable{m: make(map[string]*upload)}
+}
+
+// start registers the upload id of total bytes, dropping those finished
+// for longer than uploadKeep.
+func (ut *uploadTable) start(id string, total int64) (*upload, error) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	for k, u := range ut.m {
+		u.mu.Lock()
+		if !u.done.IsZero() && time.Since(u.done) > uploadKeep {
+			delete(ut.m, k)
+		}
+		u.mu.Unlock()
+	}
+	if u, ok := ut.m[id]; ok {
+		u.mu.Lock()
+		active := u.done.IsZero()
+		u.mu.Unlock()
+		if active {
+			return nil, errUploadActive
+		}
+	}
+	u := &upload{total: total, started: time.Now()}
+	ut.m[id] = u
+	return u, nil
+}
+
+func (ut *uploadTable) get(id string) *upload {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	return ut.m[id]
+}
+
+// uploadReader counts the bytes read from r into u.
+type uploadReader struct {
+	r io.Reader
+	u *upload
+}
+
+func (ur *uploadReader) Read(p []byte) (int, error) {
+	n, err := ur.r.Read(p)
+	atomic.AddInt64(&ur.u.received, int64(n))
+	return n, err
+}
+
+// uploadStatus is what /_api/upload-progress reports.
+type uploadStatus struct {
+	Received int64          `json:"received"`
+	Total    int64          `json:"total"`
+	Rate     float64        `json:"rate"`
+	ETA      *float64       `json:"eta,omitempty"`
+	Current  string         `json:"current,omitempty"`
+	Files    []manageResult `json:"files"`
+	Done     bool           `json:"done"`
+	Error    string         `json:"error,omitempty"`
+}
+
+func (u *upload) status() uploadStatus {
+	st := uploadStatus{
+		Received: atomic.LoadInt64(&u.received),
+		Total:    atomic.LoadInt64(&u.total),
+	}
+	u.mu.Lock()
+	end := u.done
+	st.Current = u.current
+	st.Files = append([]manageResult{}, u.files...)
+	st.Done = !u.done.IsZero()
+	st.Error = u.err
+	u.mu.Unlock()
+	if end.IsZero() {
+		end = time.Now()
+	}
+	if elapsed := end.Sub(u.started).Seconds(); elapsed > 0 {
+		st.Rate = float64(st.Received) / elapsed
+	}
+	if !st.Done && st.Total >= 0 && st.Rate > 0 {
+		eta := float64(st.Total-st.Received) / st.Rate
+		st.ETA = &eta
+	}
+	return st
+}
+
+func (u *upload) finish(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.current = ""
+	u.done = time.Now()
+	if err != nil {
+		u.err = err.Error()
+	}
+}
+
+// limitUpload returns the body of r bounded by the maximum upload size
+// and, if set, the minimum rate.
+func (fh *fileHandler) limitUpload(w http.ResponseWriter, r *http.Request) io.Reader {
+	body := r.Body
+	if fh.maxUpload > 0 {
+		body = http.MaxBytesReader(w, r.Body, fh.maxUpload)
+	}
+	if fh.minBodyRate <= 0 {
+		return body
+	}
+	return &rateReader{r: body, rc: http.NewResponseController(w), min: fh.minBodyRate, start: time.Now()}
+}
+
+// serveUpload implements POST /_api/upload?path=<dir>, storing the files
+// of a multipart/form-data body in dir. Existing files are not
+// replaced. The X-Upload-ID header names the upload for
+// /_api/upload-progress; as no form can send it, it also keeps other
+// sites from uploading from a browser without a CORS preflight.
+func (fh *fileHandler) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if !fh.write {
+		http.NotFound(w, r)
+		return
+	}
+	mt, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != "multipart/form-data" || params["boundary"] == "" {
+		apiError(w, errors.New("content type must be multipart/form-data"), http.StatusUnsupportedMediaType)
+		return
+	}
+	id := r.Header.Get("X-Upload-ID")
+	if !uploadIDPattern.MatchString(id) {
+		apiError(w, errUploadID, http.StatusBadRequest)
+		return
+	}
+	dir := path.Clean("/" + r.URL.Query().Get("path"))
+	if dir != "/" {
+		if err := fh.writable(r, dir, RoleUpload); err != nil {
+			apiError(w, err, 0)
+			return
+		}
+	}
+	if fi, err := os.Stat(fh.writeRoot.osPath(dir)); err != nil || !fi.IsDir() {
+		if err == nil {
+			err = errors.New("not a directory")
+		}
+		apiError(w, err, 0)
+		return
+	}
+	u, err := fh.uploads.start(id, r.ContentLength)
+	if err != nil {
+		apiError(w, err, http.StatusConflict)
+		return
+	}
+	mr := multipart.NewReader(&uploadReader{fh.limitUpload(w, r), u}, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			u.finish(err)
+			if code := bodyError(err); code != http.StatusBadRequest {
+				// Don't wait for the rest of the body.
+				w.Header().Set("Connection", "close")
+			}
+			apiError(w, err, bodyError(err))
+			return
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		res, err := fh.uploadFile(r, u, dir, part)
+		part.Close()
+		u.mu.Lock()
+		u.files = append(u.files, res)
+		u.mu.Unlock()
+		if err != nil {
+			u.finish(err)
+			if code := bodyError(err); code != http.StatusBadRequest {
+				w.Header().Set("Connection", "close")
+				apiError(w, err, code)
+				return
+			}
+		}
+	}
+	u.finish(nil)
+	st := u.status()
+	writeJSON(w, r, st.Files)
+}
+
+// uploadFile stores the file of part in dir, under the name the upload
+// policy of dir gives it. Failures particular to the file are reported
+// in the result, those of the body also as an error.
+func (fh *fileHandler) uploadFile(r *http.Request, u *upload, dir string, part *multipart.Part) (manageResult, error) {
+	name, err := fh.storeFile(r, u, dir, part.FileName(), part)
+	res := manageResult{Path: name}
+	var be *uploadBodyError
+	if errors.As(err, &be) {
+		res.Error = be.err.Error()
+		return res, be.err
+	}
+	if err != nil {
+		res.Error = manageError(err)
+	}
+	return res, nil
+}
+
+// uploadBodyError is an error reading the body of an upload, which ends
+// the request rather than only failing the file being stored.
+type uploadBodyError struct {
+	err error
+}
+
+func (e *uploadBodyError) Error() string { return e.err.Error() }
+func (e *uploadBodyError) Unwrap() error { return e.err }
+
+// storeFile stores the content of src as the file fn in dir, under the
+// name the upload policy of dir gives it, which it returns. Progress is
+// recorded in u, if not nil. Errors reading src are *uploadBodyError.
+func (fh *fileHandler) storeFile(r *http.Request, u *upload, dir, fn string, src io.Reader) (string, error) {
+	name := path.Join(dir, fn)
+	if fn == "" || fn == "." || fn == ".." || strings.ContainsAny(fn, `/\`) || isTemp(fn) {
+		return name, errBadFileName
+	}
+	policy := fh.uploadPolicy(dir)
+	if policy != nil {
+		var err error
+		if fn, err = policy.name(fn); err != nil {
+			return name, err
+		}
+	}
+	name, err := fh.uploadName(dir, fn, policy)
+	if err != nil {
+		return path.Join(dir, fn), err
+	}
+	if err := fh.writable(r, name, RoleUpload); err != nil {
+		return name, err
+	}
+	dst := fh.writeRoot.osPath(name)
+	if u != nil {
+		u.mu.Lock()
+		u.current = name
+		u.mu.Unlock()
+	}
+
+	tmp, err := fh.writeTemps.create(filepath.Dir(dst))
+	if err != nil {
+		return name, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return name, &uploadBodyError{err}
+	}
+	os.Chmod(tmp.Name(), 0644)
+	// Another upload may have created it meanwhile.
+	if _, err := os.Lstat(dst); err == nil {
+		if policy == nil || !policy.Rename {
+			return name, errExists
+		}
+		if name, err = fh.uploadName(dir, fn, policy); err == nil {
+			err = fh.writable(r, name, RoleUpload)
+		}
+		if err != nil {
+			return name, err
+		}
+		dst = fh.writeRoot.osPath(name)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	je, err := fh.journalBegin(r, "upload", name, "", n, sum)
+	if err == nil {
+		// Not over one created since.
+		err = renameNoReplace(tmp.Name(), dst)
+		fh.journalEnd(je, err)
+	}
+	if err != nil {
+		return name, err
+	}
+	// Spare hashing it again for checksums, moves and deletions.
+	if fi, err := os.Stat(dst); err == nil {
+		fh.checksums.put(name, fi.Size(), fi.ModTime(), sum)
+	}
+	fh.events.Publish(Event{
+		Kind:       EventUploaded,
+		Method:     r.Method,
+		Path:       name,
+		RemoteAddr: r.RemoteAddr,
+		RequestID:  requestID(r),
+		Principal:  principalName(r),
+		Country:    geoOf(r).Country,
+		ASN:        geoOf(r).ASN,
+		Status:     http.StatusOK,
+		Size:       n,
+		Sent:       -1,
+	})
+	return name, nil
+}
+
+// uploadName returns the name in dir to store the uploaded file fn as:
+// fn itself, or if that is taken and policy renames, the first free
+// numbered name.
+func (fh *fileHandler) uploadName(dir, fn string, policy *UploadPolicy) (string, error) {
+	name := path.Join(dir, fn)
+	for i := 1; ; i++ {
+		_, err := os.Lstat(fh.writeRoot.osPath(name))
+		if errors.Is(err, fs.ErrNotExist) {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if policy == nil || !policy.Rename || i > uploadMaxRenames {
+			return "", errExists
+		}
+		name = path.Join(dir, numberedName(fn, i))
+	}
+}
+
+// serveUploadProgress implements GET /_api/upload-progress?id=, the
+// progress of the upload named id: the bytes received of the total,
+// the rate in bytes per second and the estimated seconds left. Asked
+// for text/event-stream, it sends progress events until a done event.
+func (fh *fileHandler) serveUploadProgress(w http.ResponseWriter, r *http.Request) {
+	var u *upload
+	if fh.write {
+		u = fh.uploads.get(r.URL.Query().Get("id"))
+	}
+	if u == nil {
+		apiError(w, errors.New("no such upload"), http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		writeJSON(w, r, u.status())
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	tick := time.NewTicker(uploadProgressInterval)
+	defer tick.Stop()
+	for {
+		st := u.status()
+		data, _ := json.Marshal(st)
+		event := "progress"
+		if st.Done {
+			event = "done"
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+		if st.Done {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// uploadScript adds an upload form to a listing. The bar follows the
+// progress reported by the server, as a proxy buffering the body makes
+// the browser's own upload events finish long before the upload does.
+const uploadScript = `<script>(function(){
+var dir="%s",api="` + apiPrefix + `",t={upload:"%s",remaining:"%s",failed:"%s"};
+var pre=document.querySelector("pre"),form=document.createElement("form"),input=document.createElement("input"),
+button=document.createElement("button"),bar=document.createElement("progress"),status=document.createElement("span");
+input.type="file";input.multiple=true;button.type="submit";button.textContent=t.upload;bar.hidden=true;
+form.appendChild(input);form.appendChild(button);form.appendChild(bar);form.appendChild(status);
+function show(p){if(p.total>0)bar.value=p.received/p.total;
+status.textContent=" "+(p.current?p.current.slice(p.current.lastIndexOf("/")+1)+" ":"")+
+(p.eta!=null?t.remaining.replace("%%d",Math.ceil(p.eta)):"")}
+form.onsubmit=function(e){e.preventDefault();if(!input.files.length)return;
+var id="",b=new Uint8Array(16),fd=new FormData();crypto.getRandomValues(b);
+for(var i=0;i<b.length;i++)id+=("0"+b[i].toString(16)).slice(-2);
+for(var i=0;i<input.files.length;i++)fd.append("file",input.files[i]);
+button.disabled=true;bar.hidden=false;bar.removeAttribute("value");
+var es=new EventSource(api+"upload-progress?id="+id);
+es.addEventListener("progress",function(e){show(JSON.parse(e.data))});
+es.addEventListener("done",function(){es.close()});
+var m=document.cookie.match(/(?:^|; )` + csrfCookie + `=([^;]*)/);
+fetch(api+"upload?path="+encodeURIComponent(dir),{method:"POST",headers:{"X-Upload-ID":id,"X-CSRF-Token":m?m[1]:""},body:fd})
+.then(function(r){return r.json()}).then(function(rs){es.close();var errs=(rs.error?[rs]:rs).filter(function(x){return x.error})
+.map(function(x){return (x.path||"")+": "+x.error});if(errs.length)alert(t.failed+"\n"+errs.join("\n"));location.reload()})};
+pre.parentNode.insertBefore(form,pre);
+})();</script>
+`
+
+// writeUpload writes the script adding an upload form to the listing of
+// dir.
+func writeUpload(w io.Writer, dir string, msgs messages) {
+	js := func(s string) string { return template.JSEscapeString(msgs.t(s)) }
+	fmt.Fprintf(w, uploadScript, template.JSEscapeString(dir),
+		js("upload"), js("%d s remaining"), js("Some operations failed:"))
+}
@@ -0,0 +1,82 @@
+// File name policies of uploads
+
+package midserve
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// uploadMaxRenames bounds the numbered names tried for an upload whose
+// name is taken.
+const uploadMaxRenames = 1000
+
+var (
+	errUploadExt  = errors.New("file type not allowed here")
+	errUploadName = errors.New("file name not allowed here")
+)
+
+// An UploadPolicy constrains the names of files uploaded into the
+// directory Prefix and below it. Of several covering a directory, the
+// one with the longest Prefix applies.
+type UploadPolicy struct {
+	Prefix string   // '/'-separated directory
+	Exts   []string // allowed extensions, such as ".pdf" or ".tar.gz"; any if none
+	// Pattern, if set, must match the name, such as `^[a-z0-9._-]+$`.
+	Pattern *regexp.Regexp
+	// Lowercase stores files under their name in lower case, which
+	// Exts and Pattern see.
+	Lowercase bool
+	// Rename stores files whose name is taken under the first free of
+	// name-1.ext, name-2.ext and so on, instead of refusing them.
+	Rename bool
+}
+
+// uploadPolicy returns the policy of uploads into dir, nil if none.
+func (fh *fileHandler) uploadPolicy(dir string) *UploadPolicy {
+	var best *UploadPolicy
+	for i := range fh.uploadPolicies {
+		p := &fh.uploadPolicies[i]
+		if underPrefix(dir, p.Prefix) && (best == nil || len(p.Prefix) > len(best.Prefix)) {
+			best = p
+		}
+	}
+	return best
+}
+
+// name returns the name to store the uploaded file fn as, or an error if
+// the policy doesn't allow it.
+func (p *UploadPolicy) name(fn string) (string, error) {
+	if p.Lowercase {
+		fn = strings.ToLower(fn)
+	}
+	if len(p.Exts) > 0 {
+		lower, ok := strings.ToLower(fn), false
+		for _, ext := range p.Exts {
+			if strings.HasSuffix(lower, ext) && len(lower) > len(ext) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return "", errUploadExt
+		}
+	}
+	if p.Pattern != nil && !p.Pattern.MatchString(fn) {
+		return "", errUploadName
+	}
+	return fn, nil
+}
+
+// numberedName returns fn with "-i" inserted before its extension.
+func numberedName(fn string, i int) string {
+	ext := path.Ext(fn)
+	if ext == fn {
+		// Dot files have no extension.
+		ext = ""
+	}
+	return strings.TrimSuffix(fn, ext) + "-" + strconv.Itoa(i) + ext
+}
@@ -0,0 +1,82 @@
+// Listing and serving visibility rules
+
+package midserve
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// A VisibilityRule decides whether the paths matching Pattern show up in
+// listings and whether they are served, which -exclude only allows to
+// turn off together. Pattern is matched like an exclusion: against the
+// path without its leading slash, with a trailing slash for directories.
+//
+// Unserved paths are listed without a link, and otherwise treated as if
+// they didn't exist. Unlisted directories can still be browsed.
+type VisibilityRule struct {
+	Pattern *regexp.Regexp
+	Listed  bool
+	Served  bool
+}
+
+// visibilityModes maps the modes of VisibilityConfig to whether paths
+// are listed and served.
+var visibilityModes = map[string][2]bool{
+	"unlisted": {false, true},
+	"unserved": {true, false},
+	"hidden":   {false, false},
+}
+
+// visibility returns whether name is listed and served, as decided by
+// the first rule matching it. Temporary files are hidden.
+func (fh *fileHandler) visibility(name string) (listed, served bool) {
+	if isTemp(name) {
+		return false, false
+	}
+	for _, vr := range fh.visibilityRules {
+		if exclude(name, []*regexp.Regexp{vr.Pattern}) {
+			return vr.Listed, vr.Served
+		}
+	}
+	return true, true
+}
+
+// denied reports whether requests for name are refused by an exclusion
+// or a visibility rule.
+func (fh *fileHandler) denied(name string) bool {
+	if exclude(name, fh.excludes) {
+		return true
+	}
+	_, served := fh.visibility(name)
+	return !served
+}
+
+// listed reports whether name shows up in listings. Like exclusions,
+// the rules only apply to names as they appear there.
+func (fh *fileHandler) listed(name string) bool {
+	listed, _ := fh.visibility(name)
+	return listed
+}
+
+// unlistedEntry reports whether the walked entry name is left out of
+// generated listings, the manifest, sitemap and change stream, because
+// it is either unlisted or unserved.
+func (fh *fileHandler) unlistedEntry(name string, isDir bool) bool {
+	if isDir {
+		name += "/"
+	}
+	return fh.denied(name) || !fh.listed(name)
+}
+
+func (vc VisibilityConfig) rule() (VisibilityRule, error) {
+	mode, ok := visibilityModes[vc.Mode]
+	if !ok {
+		return VisibilityRule{}, fmt.Errorf("visibility %s: mode %q is not unlisted, unserved or hidden", vc.Pattern, vc.Mode)
+	}
+	re, err := regexp.Compile(vc.Pattern)
+	if err != nil {
+		return VisibilityRule{}, fmt.Errorf("visibility: %v", err)
+	}
+	return VisibilityRule{Pattern: re, Listed: mode[0], Served: mode[1]}, nil
+}
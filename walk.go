@@ -0,0 +1,87 @@
+// Walking the served tree
+
+package midserve
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+)
+
+// walkFunc is called by walkFS for each file and directory below the
+// starting directory, with its '/'-separated name. Returning fs.SkipDir
+// from a directory skips its content.
+type walkFunc func(name string, fi fs.FileInfo) error
+
+// walkFS walks the tree below dir in root in lexical order, calling fn
+// for everything not hidden by excludes. Subdirectories that vanish or
+// can't be read while walking are skipped, without their content. It
+// stops with ctx.Err() as soon as ctx is done, such as when the client
+// went away.
+func walkFS(ctx context.Context, root http.FileSystem, dir string, excludes []*regexp.Regexp, fn walkFunc) error {
+	list, err := readDirSorted(ctx, root, dir)
+	if err != nil {
+		return err
+	}
+	return walkList(ctx, root, dir, list, excludes, fn)
+}
+
+// readDirSorted returns the entries of dir in root in lexical order.
+func readDirSorted(ctx context.Context, root http.FileSystem, dir string) ([]fs.FileInfo, error) {
+	f, err := openContext(ctx, root, dir)
+	if err != nil {
+		return nil, err
+	}
+	list, err := readdirBatched(ctx, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// walkList walks list, the entries of dir, for walkFS.
+func walkList(ctx context.Context, root http.FileSystem, dir string, list []fs.FileInfo, excludes []*regexp.Regexp, fn walkFunc) error {
+	for _, fi := range list {
+		// fn may not do any I/O bound to ctx itself.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := path.Join(dir, fi.Name())
+		if fi.IsDir() {
+			if exclude(name+"/", excludes) {
+				continue
+			}
+			err := fn(name, fi)
+			if err == fs.SkipDir {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			sub, err := readDirSorted(ctx, root, name)
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := walkList(ctx, root, name, sub, excludes, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if exclude(name, excludes) {
+			continue
+		}
+		if err := fn(name, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package midserve
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+// failingFS fails to open the names in fail with their errors.
+type failingFS struct {
+	http.FileSystem
+	fail map[string]error
+}
+
+func (f failingFS) Open(name string) (http.File, error) {
+	if err := f.fail[name]; err != nil {
+		return nil, err
+	}
+	return f.FileSystem.Open(name)
+}
+
+func TestWalkFSSkipsUnreadable(t *testing.T) {
+	root := failingFS{
+		FileSystem: midservetest.NewFS().
+			File("a/1.txt", "1").
+			File("b/2.txt", "2").
+			File("c/3.txt", "3").
+			File("d.txt", "d").
+			HTTP(),
+		fail: map[string]error{"/a": fs.ErrPermission, "/b": fs.ErrNotExist},
+	}
+
+	var names []string
+	err := walkFS(context.Background(), root, "/", nil, func(name string, fi fs.FileInfo) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/a", "/b", "/c", "/c/3.txt", "/d.txt"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("walked %q, want %q", names, want)
+	}
+
+	// The starting directory itself must be readable.
+	root.fail["/"] = fs.ErrPermission
+	if err := walkFS(context.Background(), root, "/", nil, func(string, fs.FileInfo) error { return nil }); err != fs.ErrPermission {
+		t.Fatalf("err = %v", err)
+	}
+}
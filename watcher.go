@@ -0,0 +1,256 @@
+// File change watching
+
+package midserve
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ChangeOp is the kind of a Change.
+type ChangeOp int
+
+const (
+	ChangeCreated ChangeOp = iota
+	ChangeModified
+	ChangeRemoved
+	// ChangeResync tells a subscriber that changes were lost, because
+	// it didn't keep up, so it must re-read whatever it shows.
+	ChangeResync
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeCreated:
+		return "created"
+	case ChangeModified:
+		return "modified"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeResync:
+		return "resync"
+	}
+	return "unknown"
+}
+
+// A Change is a file or directory created, modified or removed in the
+// served tree.
+type Change struct {
+	Op    ChangeOp
+	Path  string // '/'-separated, relative to the root
+	IsDir bool
+	Size  int64
+}
+
+// watcher detects changes in the tree by periodically scanning it. It
+// only runs while it has subscribers.
+type watcher struct {
+	root     http.FileSystem
+	excludes []*regexp.Regexp
+	interval time.Duration
+
+	mu     sync.Mutex
+	subs   map[chan []Change]bool // true if owed a resync
+	cancel context.CancelFunc
+	health watcherHealth
+}
+
+// watcherHealth is what /_admin/watcher reports about the watcher.
+type watcherHealth struct {
+	Running     bool       `json:"running"`
+	Subscribers int        `json:"subscribers"`
+	Interval    string     `json:"interval"`
+	Scans       int64      `json:"scans"`
+	LastScan    *time.Time `json:"last_scan,omitempty"`
+	ScanTime    string     `json:"last_scan_duration,omitempty"`
+	Entries     int        `json:"entries"`
+	ScanErrors  int64      `json:"scan_errors"`
+	LastError   string     `json:"last_error,omitempty"`
+	Dropped     int64      `json:"dropped_batches"`
+	Resyncs     int64      `json:"resyncs"`
+	// Stale is set while the last successful scan is older than
+	// watcherStaleScans intervals, so changes show late if at all.
+	Stale bool `json:"stale"`
+}
+
+// watcherStaleScans is the number of intervals without a successful
+// scan after which the watcher is reported stale.
+const watcherStaleScans = 3
+
+// fileState is what a scan records of a file to detect changes.
+type fileState struct {
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func newWatcher(root http.FileSystem, excludes []*regexp.Regexp, interval time.Duration) *watcher {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &watcher{
+		root:     root,
+		excludes: excludes,
+		interval: interval,
+		subs:     make(map[chan []Change]bool),
+	}
+}
+
+// subscribe returns a channel receiving batches of changes and a
+// function ending the subscription. Batches are dropped for subscribers
+// that don't keep up.
+func (w *watcher) subscribe() (<-chan []Change, func()) {
+	ch := make(chan []Change, 16)
+	w.mu.Lock()
+	w.subs[ch] = false
+	if w.cancel == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		w.cancel = cancel
+		go w.run(ctx)
+	}
+	w.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			w.mu.Lock()
+			delete(w.subs, ch)
+			if len(w.subs) == 0 && w.cancel != nil {
+				w.cancel()
+				w.cancel = nil
+			}
+			w.mu.Unlock()
+		})
+	}
+}
+
+// publish sends changes, if any, to the subscribers. A subscriber whose
+// buffer is full misses them and is sent a resync as soon as it has
+// room again, instead of the following changes.
+func (w *watcher) publish(changes []Change) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch, owed := range w.subs {
+		batch := changes
+		if owed {
+			batch = []Change{{Op: ChangeResync, Path: "/", IsDir: true}}
+		} else if len(changes) == 0 {
+			continue
+		}
+		select {
+		case ch <- batch:
+			if owed {
+				w.subs[ch] = false
+				w.health.Resyncs++
+			}
+		default:
+			if !owed && len(changes) > 0 {
+				w.subs[ch] = true
+				w.health.Dropped++
+			}
+		}
+	}
+}
+
+func (w *watcher) run(ctx context.Context) {
+	prev, _ := w.scan(ctx)
+	tick := time.NewTicker(w.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		cur, err := w.scan(ctx)
+		if err != nil {
+			// The next successful scan is compared with the last one,
+			// so no change is lost, only late.
+			continue
+		}
+		var changes []Change
+		if prev != nil {
+			changes = diffStates(prev, cur)
+		}
+		w.publish(changes)
+		prev = cur
+	}
+}
+
+// scan records the state of every file in the tree.
+func (w *watcher) scan(ctx context.Context) (map[string]fileState, error) {
+	start := time.Now()
+	states := make(map[string]fileState)
+	err := walkFS(ctx, w.root, "/", w.excludes, func(name string, fi fs.FileInfo) error {
+		states[name] = fileState{fi.Size(), fi.ModTime(), fi.IsDir()}
+		return nil
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.health.Scans++
+	if err != nil {
+		w.health.ScanErrors++
+		w.health.LastError = err.Error()
+		log.Printf("watcher: scan failed: %v", err)
+		return nil, err
+	}
+	w.health.LastScan = &start
+	w.health.ScanTime = time.Since(start).String()
+	w.health.Entries = len(states)
+	return states, nil
+}
+
+// status returns the health of the watcher.
+func (w *watcher) status() watcherHealth {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	h := w.health
+	h.Running = w.cancel != nil
+	h.Subscribers = len(w.subs)
+	h.Interval = w.interval.String()
+	h.Stale = h.Running && (h.LastScan == nil || time.Since(*h.LastScan) > watcherStaleScans*w.interval)
+	return h
+}
+
+// serveWatcher implements GET /_admin/watcher, the health of the
+// watcher behind -changes and -dev.
+func (fh *fileHandler) serveWatcher(w http.ResponseWriter, r *http.Request) {
+	if fh.watcher == nil {
+		apiError(w, errors.New("no watcher: requires -changes or -dev"), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, r, fh.watcher.status())
+}
+
+// diffStates returns the changes turning prev into cur.
+func diffStates(prev, cur map[string]fileState) []Change {
+	var changes []Change
+	for name, s := range cur {
+		p, ok := prev[name]
+		switch {
+		case !ok:
+			changes = append(changes, Change{ChangeCreated, name, s.isDir, s.size})
+		case p.isDir != s.isDir:
+			changes = append(changes, Change{ChangeRemoved, name, p.isDir, p.size})
+			changes = append(changes, Change{ChangeCreated, name, s.isDir, s.size})
+		case !s.isDir && (p.size != s.size || !p.modTime.Equal(s.modTime)):
+			changes = append(changes, Change{ChangeModified, name, false, s.size})
+		}
+	}
+	for name, p := range prev {
+		if _, ok := cur[name]; !ok {
+			changes = append(changes, Change{ChangeRemoved, name, p.isDir, p.size})
+		}
+	}
+	return changes
+}
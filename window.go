@@ -0,0 +1,112 @@
+// Time-restricted access to paths
+
+package midserve
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An AccessWindow makes the files below Prefix accessible only between
+// NotBefore and NotAfter and, if Daily, only during the daily window
+// from From to To after local midnight, which may span midnight.
+// Outside, requests get Status, 403 or 404, and listings hide them
+// unless Status is 403.
+type AccessWindow struct {
+	Prefix    string // '/'-separated, e.g. "/releases/v2"
+	NotBefore time.Time
+	NotAfter  time.Time
+	Daily     bool
+	From, To  time.Duration
+	Status    int
+}
+
+// open reports whether the window is open at t.
+func (aw *AccessWindow) open(t time.Time) bool {
+	if !aw.NotBefore.IsZero() && t.Before(aw.NotBefore) {
+		return false
+	}
+	if !aw.NotAfter.IsZero() && !t.Before(aw.NotAfter) {
+		return false
+	}
+	return !aw.Daily || inDaily(t, aw.From, aw.To)
+}
+
+// inDaily reports whether t is in the daily window from from to to
+// after local midnight, which may span midnight.
+func inDaily(t time.Time, from, to time.Duration) bool {
+	since := sinceMidnight(t)
+	if from <= to {
+		return since >= from && since < to
+	}
+	return since >= from || since < to
+}
+
+// sinceMidnight returns the time elapsed on the day of t.
+func sinceMidnight(t time.Time) time.Duration {
+	y, m, d := t.Date()
+	return t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+}
+
+// covers reports whether name is Prefix or below it.
+func (aw *AccessWindow) covers(name string) bool {
+	return underPrefix(name, aw.Prefix)
+}
+
+// underPrefix reports whether the path name is prefix or below it.
+func underPrefix(name, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// closedWindow returns the error to reply with if name is currently
+// outside one of its access windows, fs.ErrPermission or
+// fs.ErrNotExist, and nil otherwise.
+func (fh *fileHandler) closedWindow(name string) error {
+	now := time.Now()
+	for i := range fh.windows {
+		aw := &fh.windows[i]
+		if !aw.covers(name) || aw.open(now) {
+			continue
+		}
+		if aw.Status == http.StatusForbidden {
+			return fs.ErrPermission
+		}
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+// skipEntry is what a walkFunc returns to leave out fi: fs.SkipDir for
+// directories, nil for files.
+func skipEntry(fi fs.FileInfo) error {
+	if fi.IsDir() {
+		return fs.SkipDir
+	}
+	return nil
+}
+
+// parseDaily parses a daily window such as "09:00-17:00".
+func parseDaily(s string) (from, to time.Duration, err error) {
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("%q is not of the form HH:MM-HH:MM", s)
+	}
+	clock := func(s string) (time.Duration, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(s))
+		if err != nil {
+			return 0, fmt.Errorf("%q is not of the form HH:MM-HH:MM", s)
+		}
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+	}
+	if from, err = clock(s[:i]); err != nil {
+		return 0, 0, err
+	}
+	if to, err = clock(s[i+1:]); err != nil {
+		return 0, 0, err
+	}
+	return from, to, nil
+}
@@ -0,0 +1,168 @@
+// Background workers for derived data
+
+package midserve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// workerQueue is how many jobs can wait for a worker before new ones are
+// dropped.
+const workerQueue = 1024
+
+// A workerPool computes derived data such as checksums, gzip variants
+// and thumbnails in the background with bounded concurrency, so that requests needing it later
+// find it cached. Requests never wait for it: they compute what they
+// need themselves if it isn't ready.
+//
+// A nil *workerPool is valid and drops all jobs.
+type workerPool struct {
+	queued, done, failed, dropped uint64 // accessed atomically
+
+	jobs    chan workerJob
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+type workerJob struct {
+	key string
+	run func(ctx context.Context) error
+}
+
+// newWorkerPool starts n workers running for the life of the process.
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{
+		jobs:    make(chan workerJob, workerQueue),
+		pending: make(map[string]bool),
+	}
+	for i := 0; i < n; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for j := range p.jobs {
+		if err := j.run(context.Background()); err != nil {
+			atomic.AddUint64(&p.failed, 1)
+		} else {
+			atomic.AddUint64(&p.done, 1)
+		}
+		p.mu.Lock()
+		delete(p.pending, j.key)
+		p.mu.Unlock()
+	}
+}
+
+// submit queues run unless a job with the same key is already pending
+// or the queue is full. It returns whether a job with the key will run.
+func (p *workerPool) submit(key string, run func(ctx context.Context) error) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending[key] {
+		return true
+	}
+	select {
+	case p.jobs <- workerJob{key, run}:
+		p.pending[key] = true
+		atomic.AddUint64(&p.queued, 1)
+		return true
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+		return false
+	}
+}
+
+// serveWorkers implements /_api/workers, reporting the pool's counters.
+func (fh *fileHandler) serveWorkers(w http.ResponseWriter, r *http.Request) {
+	p := fh.workers
+	if p == nil {
+		p = &workerPool{}
+	}
+	writeJSON(w, r, struct {
+		Queued  uint64 `json:"queued"`
+		Pending int    `json:"pending"`
+		Done    uint64 `json:"done"`
+		Failed  uint64 `json:"failed"`
+		Dropped uint64 `json:"dropped"`
+	}{
+		atomic.LoadUint64(&p.queued),
+		len(p.jobs),
+		atomic.LoadUint64(&p.done),
+		atomic.LoadUint64(&p.failed),
+		atomic.LoadUint64(&p.dropped),
+	})
+}
+
+// prepare queues the derived data of the file name with info d to be
+// computed in the background.
+func (fh *fileHandler) prepare(name string, d fs.FileInfo) {
+	if fh.workers == nil {
+		return
+	}
+	if fh.metafiles {
+		// The digests include the SHA-256.
+		fh.workers.submit("digests\x00"+name, func(ctx context.Context) error {
+			f, err := openContext(ctx, fh.root, name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = fh.digests(name, f, d)
+			return err
+		})
+		return
+	}
+	if _, ok := fh.checksums.get(name, d.Size(), d.ModTime()); !ok {
+		fh.workers.submit("sha256\x00"+name, func(ctx context.Context) error {
+			_, err := fh.fileSHA256(ctx, name, d)
+			return err
+		})
+	}
+}
+
+// prepareThumbnails queues the variants of the image name in the sizes
+// requested last to be resized in the background, as a listing showing
+// it tends to be followed by requests for them. Requests arriving while
+// one is resized wait for it rather than resize it again.
+func (fh *fileHandler) prepareThumbnails(name string) {
+	format := resizableExts[strings.ToLower(path.Ext(name))]
+	if fh.workers == nil || !fh.resizeImages || format == "" {
+		return
+	}
+	for _, p := range fh.thumbSizes.get() {
+		p := p
+		key := fmt.Sprintf("thumb\x00%s\x00%dx%d@%d", name, p.width, p.height, p.quality)
+		fh.workers.submit(key, func(ctx context.Context) error {
+			f, err := openContext(ctx, fh.root, name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			d, err := f.Stat()
+			if err != nil || !d.Mode().IsRegular() {
+				return err
+			}
+			cached := fh.resizedPath(name, d, format, p)
+			fh.dropPurged(name, cached)
+			err = fh.produce(ctx, cached, func(w io.Writer) error { return resizeImage(ctx, w, f, format, p) })
+			if errors.Is(err, errImageTooLarge) {
+				// Served as it is.
+				return nil
+			}
+			return err
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package midserve
+
+import (
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hellodword/midserve/midservetest"
+)
+
+func TestPrepareThumbnails(t *testing.T) {
+	root := midservetest.NewFS().
+		File("a.png", encodePNG(t, 200, 100)).
+		File("b.png", encodePNG(t, 100, 200)).
+		HTTP()
+	h := newTestServer(t, root, func(o *Options) {
+		o.ResizeImages = true
+		o.Workers = 1
+	})
+	fh := h.(*fileHandler)
+
+	// Listings before any image was resized prepare nothing.
+	midservetest.Get(t, h, "/").Status(http.StatusOK)
+	if n := len(fh.workers.jobs); n != 0 {
+		t.Fatalf("%d jobs queued without known sizes", n)
+	}
+
+	midservetest.Get(t, h, "/a.png?w=50").Status(http.StatusOK)
+	midservetest.Get(t, h, "/").Status(http.StatusOK)
+
+	d, err := root.Open("/b.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := d.Stat()
+	d.Close()
+	cached := fh.resizedPath("/b.png", fi, "png", imageParams{width: 50, quality: jpeg.DefaultQuality})
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(cached); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("thumbnail of b.png not prepared")
+		}
+	}
+
+	res := midservetest.Get(t, h, "/b.png?w=50").Status(http.StatusOK)
+	cfg, err := png.DecodeConfig(res.ResponseRecorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 50 || cfg.Height != 100 {
+		t.Errorf("thumbnail is %dx%d, want 50x100", cfg.Width, cfg.Height)
+	}
+}